@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// Appointment is a time a customer is booked to bring a car in. CarId is
+// empty when the car isn't known yet.
+type Appointment struct {
+	gorm.Model
+
+	CustomerId uint  `gorm:"index"`
+	CarId      *uint `gorm:"index"`
+	StartsAt   time.Time
+	Note       string
+}
+
+//checks the customer exists and the car, if any, is theirs
+func validateAppointment(tx *gorm.DB, appointment Appointment) error {
+	if appointment.StartsAt.IsZero() {
+		return errors.New("StartsAt is required")
+	}
+	if tx.First(&Customer{}, appointment.CustomerId).RecordNotFound() {
+		return fmt.Errorf("customer %d not found", appointment.CustomerId)
+	}
+	if appointment.CarId != nil && tx.Where("id = ? AND customer_id = ?", *appointment.CarId, appointment.CustomerId).First(&Car{}).RecordNotFound() {
+		return fmt.Errorf("car %d is not this customer's", *appointment.CarId)
+	}
+	return nil
+}
+
+//sends the customer the appointment_confirmed message for an appointment
+func confirmAppointment(tx *gorm.DB, appointment Appointment) error {
+	var car *Car
+	if appointment.CarId != nil {
+		car = &Car{}
+		tx.First(car, *appointment.CarId)
+	}
+	when := appointment.StartsAt.In(shopLocation).Format("Monday January 2 at 15:04")
+	_, err := notifyCustomer(tx, appointment.CustomerId, EventAppointmentConfirmed, car, nil, map[string]string{"When": when})
+	return err
+}
+
+//get the appointments from ?from= to ?to= (YYYY-MM-DD, from today on when
+//there is no from), of one customer with ?customerId=
+func getAppointments(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	now := time.Now().In(shopLocation)
+	from := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, shopLocation)
+	if value := r.URL.Query().Get("from"); value != "" {
+		t, err := time.ParseInLocation("2006-01-02", value, shopLocation)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid from %q, use YYYY-MM-DD", value))
+			return
+		}
+		from = t
+	}
+	query := shopDB(r).Where("starts_at >= ?", from).Order("starts_at, id")
+	if value := r.URL.Query().Get("to"); value != "" {
+		t, err := time.ParseInLocation("2006-01-02", value, shopLocation)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid to %q, use YYYY-MM-DD", value))
+			return
+		}
+		query = query.Where("starts_at < ?", t.AddDate(0, 0, 1))
+	}
+	if customerId := r.URL.Query().Get("customerId"); customerId != "" {
+		query = query.Where("customer_id = ?", customerId)
+	}
+
+	appointments := []Appointment{}
+	query.Find(&appointments)
+	json.NewEncoder(w).Encode(&appointments)
+}
+
+//book an appointment, with "Notify": true the customer is sent a
+//confirmation
+func createAppointment(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	var body struct {
+		Appointment
+		Notify bool
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	appointment := body.Appointment
+	appointment.Model = gorm.Model{}
+	if err := validateAppointment(shopDB(r), appointment); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&appointment).Error; err != nil {
+			return err
+		}
+		if body.Notify {
+			return confirmAppointment(tx, appointment)
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&appointment)
+}
+
+//move an appointment or change its car or note, "Notify": true sends the
+//customer the new time
+func updateAppointment(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var appointment Appointment
+	if shopDB(r).First(&appointment, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("appointment %s not found", params["id"]))
+		return
+	}
+	body := struct {
+		Appointment
+		Notify bool
+	}{Appointment: appointment}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	//appointments don't move to another customer
+	id, customerId := appointment.ID, appointment.CustomerId
+	appointment = body.Appointment
+	appointment.ID, appointment.CustomerId = id, customerId
+	if err := validateAppointment(shopDB(r), appointment); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&appointment).Error; err != nil {
+			return err
+		}
+		if body.Notify {
+			return confirmAppointment(tx, appointment)
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&appointment)
+}
+
+//cancel an appointment
+func deleteAppointment(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var appointment Appointment
+	if shopDB(r).First(&appointment, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("appointment %s not found", params["id"]))
+		return
+	}
+	if err := shopDB(r).Delete(&appointment).Error; err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&appointment)
+}
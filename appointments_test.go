@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPortalShowsTheCustomersUpcomingAppointments(t *testing.T) {
+	tx := setupTestDB(t)
+	service := createTestService(t, tx)
+	var car Car
+	tx.First(&car, service.CarId)
+	other := createTestService(t, tx)
+	var otherCar Car
+	tx.First(&otherCar, other.CarId)
+
+	tomorrow := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	body := fmt.Sprintf(`{"CustomerId": %d, "CarId": %d, "StartsAt": %q, "Note": "front brakes squeal", "Notify": true}`,
+		car.CustomerId, car.ID, tomorrow.Format(time.RFC3339))
+	w := httptest.NewRecorder()
+	createAppointment(w, httptest.NewRequest("POST", "/create/appointment", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var booked Appointment
+	json.NewDecoder(w.Body).Decode(&booked)
+
+	var notifications []Notification
+	tx.Where("customer_id = ? AND event = ?", car.CustomerId, EventAppointmentConfirmed).Find(&notifications)
+	if len(notifications) == 0 {
+		t.Error("no confirmation was queued")
+	}
+
+	//someone else's car can't be booked for this customer
+	body = fmt.Sprintf(`{"CustomerId": %d, "CarId": %d, "StartsAt": %q}`, car.CustomerId, otherCar.ID, tomorrow.Format(time.RFC3339))
+	w = httptest.NewRecorder()
+	createAppointment(w, httptest.NewRequest("POST", "/create/appointment", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("booking another customer's car: status %d, want 400", w.Code)
+	}
+
+	past := Appointment{CustomerId: car.CustomerId, StartsAt: time.Now().Add(-24 * time.Hour)}
+	theirs := Appointment{CustomerId: otherCar.CustomerId, StartsAt: tomorrow}
+	tx.Create(&past)
+	tx.Create(&theirs)
+
+	secret, _, err := issuePortalToken(tx, car.CustomerId, PortalTokenSession, portalSessionTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/portal/appointments", nil)
+	req.Header.Set("Authorization", "Bearer "+secret)
+	w = httptest.NewRecorder()
+	portalAuth(portalAppointments)(w, req)
+
+	var upcoming []Appointment
+	if err := json.NewDecoder(w.Body).Decode(&upcoming); err != nil {
+		t.Fatalf("%d %v", w.Code, err)
+	}
+	if len(upcoming) != 1 || upcoming[0].ID != booked.ID || upcoming[0].CarId == nil || *upcoming[0].CarId != car.ID {
+		t.Fatalf("got appointments %+v, want only appointment %d", upcoming, booked.ID)
+	}
+}
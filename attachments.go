@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+//uploads bigger than this are refused unless MAX_UPLOAD_BYTES says otherwise
+const defaultMaxUploadBytes = 10 << 20
+
+//images with more pixels than this are refused: a small file can claim to
+//be huge, and decoding it for a thumbnail would take that much memory
+const maxImagePixels = 50 << 20
+
+//longest side of a generated thumbnail, in pixels
+const thumbnailSize = 256
+
+//how long a signed download URL stays valid
+const downloadURLTTL = 15 * time.Minute
+
+//content types accepted for upload, with the extension they are stored under
+var attachmentTypes = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"application/pdf": ".pdf",
+}
+
+var blobs BlobStore
+
+//key used to sign download URLs
+var attachmentSecret []byte
+
+// Attachment is an uploaded photo or document. Exactly one of CarId,
+// ServiceId and CustomerId is set.
+type Attachment struct {
+	gorm.Model
+
+	CarId        *uint
+	ServiceId    *uint
+	CustomerId   *uint
+	FileName     string
+	ContentType  string
+	Size         int64
+	Checksum     string
+	BlobKey      string `json:"-"`
+	ThumbnailKey string `json:"-"`
+
+	// signed URLs, filled in when the attachment is returned
+	URL          string `gorm:"-"`
+	ThumbnailURL string `gorm:"-"`
+}
+
+//sets up the blob store and the key used to sign download URLs
+func setupAttachments() error {
+	var err error
+	blobs, err = newBlobStoreFromEnv()
+	if err != nil {
+		return err
+	}
+
+	if secret := os.Getenv("ATTACHMENT_SECRET"); secret != "" {
+		attachmentSecret = []byte(secret)
+		return nil
+	}
+	log.Println("ATTACHMENT_SECRET not set, download URLs will stop working on restart")
+	attachmentSecret = make([]byte, 32)
+	_, err = rand.Read(attachmentSecret)
+	return err
+}
+
+func maxUploadBytes() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("MAX_UPLOAD_BYTES"), 10, 64); err == nil && n > 0 {
+		return n
+	}
+	return defaultMaxUploadBytes
+}
+
+//random key for a new blob
+func newBlobKey(ext string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return path.Join("attachments", time.Now().Format("2006/01"), hex.EncodeToString(b)+ext), nil
+}
+
+//signature of a download URL for an attachment variant (original or thumb)
+//of a shop's attachment
+func downloadSignature(id, shopId uint, variant string, expires int64) string {
+	mac := hmac.New(sha256.New, attachmentSecret)
+	fmt.Fprintf(mac, "%d:%d:%s:%d", id, shopId, variant, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//the URL names the shop: it is opened from <img> tags and exports, which
+//can't send the shop's API key
+func signedDownloadURL(id, shopId uint, variant string, expires time.Time) string {
+	exp := expires.Unix()
+	return fmt.Sprintf("/attachment/%d/download?shop=%d&variant=%s&expires=%d&signature=%s", id, shopId, variant, exp, downloadSignature(id, shopId, variant, exp))
+}
+
+//fills in fresh signed URLs for an attachment of a shop
+func signAttachment(a *Attachment, shopId uint) {
+	expires := time.Now().Add(downloadURLTTL)
+	a.URL = signedDownloadURL(a.ID, shopId, "original", expires)
+	if a.ThumbnailKey != "" {
+		a.ThumbnailURL = signedDownloadURL(a.ID, shopId, "thumbnail", expires)
+	}
+}
+
+//scales an image down so its longest side is at most size, averaging the
+//source pixels that fall in each thumbnail pixel
+func thumbnail(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		size = w
+		if h > w {
+			size = h
+		}
+	}
+	tw, th := size, h*size/w
+	if h > w {
+		tw, th = w*size/h, size
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := b.Min.Y+y*h/th, b.Min.Y+(y+1)*h/th
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < tw; x++ {
+			x0, x1 := b.Min.X+x*w/tw, b.Min.X+(x+1)*w/tw
+			if x1 == x0 {
+				x1++
+			}
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(bl / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
+
+//reads the uploaded "file" field, checking its size and type
+func readUpload(w http.ResponseWriter, r *http.Request) ([]byte, string, string, error) {
+	max := maxUploadBytes()
+	r.Body = http.MaxBytesReader(w, r.Body, max+1<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		return nil, "", "", fmt.Errorf("upload must be multipart/form-data of at most %d bytes: %v", max, err)
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return nil, "", "", errors.New("file is required")
+	}
+	defer file.Close()
+
+	content, err := ioutil.ReadAll(io.LimitReader(file, max+1))
+	if err != nil {
+		return nil, "", "", err
+	}
+	if int64(len(content)) > max {
+		return nil, "", "", fmt.Errorf("file is larger than %d bytes", max)
+	}
+
+	//trust the bytes, not the name or the header the client sent
+	contentType := http.DetectContentType(content)
+	if _, ok := attachmentTypes[contentType]; !ok {
+		return nil, "", "", fmt.Errorf("%s files are not allowed", contentType)
+	}
+	if contentType != "application/pdf" {
+		config, _, err := image.DecodeConfig(bytes.NewReader(content))
+		if err != nil {
+			return nil, "", "", fmt.Errorf("invalid image: %v", err)
+		}
+		if int64(config.Width)*int64(config.Height) > maxImagePixels {
+			return nil, "", "", fmt.Errorf("image is %dx%d, at most %d pixels are allowed", config.Width, config.Height, maxImagePixels)
+		}
+	}
+	return content, contentType, path.Base(header.Filename), nil
+}
+
+//stores an upload and its metadata, attachment already says what it belongs to
+func saveAttachment(w http.ResponseWriter, r *http.Request, attachment Attachment) {
+	content, contentType, fileName, err := readUpload(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	key, err := newBlobKey(attachmentTypes[contentType])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := blobs.Put(key, content, contentType); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	attachment.FileName = fileName
+	attachment.ContentType = contentType
+	attachment.Size = int64(len(content))
+	attachment.Checksum = sha256Hex(content)
+	attachment.BlobKey = key
+
+	if contentType != "application/pdf" {
+		if img, _, err := image.Decode(bytes.NewReader(content)); err == nil {
+			var buf bytes.Buffer
+			if err := jpeg.Encode(&buf, thumbnail(img, thumbnailSize), &jpeg.Options{Quality: 80}); err == nil {
+				thumbKey := key[:len(key)-len(path.Ext(key))] + "_thumb.jpg"
+				if err := blobs.Put(thumbKey, buf.Bytes(), "image/jpeg"); err == nil {
+					attachment.ThumbnailKey = thumbKey
+				} else {
+					log.Printf("attachments: storing thumbnail: %v", err)
+				}
+			}
+		}
+	}
+
+	if err := shopDB(r).Create(&attachment).Error; err != nil {
+		blobs.Delete(attachment.BlobKey)
+		if attachment.ThumbnailKey != "" {
+			blobs.Delete(attachment.ThumbnailKey)
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	signAttachment(&attachment, requestShopId(r))
+	json.NewEncoder(w).Encode(&attachment)
+}
+
+//upload a photo or document of a car
+func uploadCarAttachment(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var car Car
+	if shopDB(r).First(&car, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("car %s not found", params["id"]))
+		return
+	}
+	saveAttachment(w, r, Attachment{CarId: &car.ID})
+}
+
+//upload a photo or document of a service
+func uploadServiceAttachment(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var service Service
+	if shopDB(r).First(&service, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("service %s not found", params["id"]))
+		return
+	}
+	saveAttachment(w, r, Attachment{ServiceId: &service.ID})
+}
+
+//upload a document of a customer
+func uploadCustomerAttachment(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var customer Customer
+	if shopDB(r).First(&customer, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("customer %s not found", params["id"]))
+		return
+	}
+	saveAttachment(w, r, Attachment{CustomerId: &customer.ID})
+}
+
+//list attachments of a ?carId=, ?serviceId= or ?customerId=
+func getAttachments(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	query := r.URL.Query()
+	scoped := shopDB(r).Order("id desc")
+	switch {
+	case query.Get("carId") != "":
+		scoped = scoped.Where("car_id = ?", query.Get("carId"))
+	case query.Get("serviceId") != "":
+		scoped = scoped.Where("service_id = ?", query.Get("serviceId"))
+	case query.Get("customerId") != "":
+		scoped = scoped.Where("customer_id = ?", query.Get("customerId"))
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("carId, serviceId or customerId is required"))
+		return
+	}
+
+	var attachments []Attachment
+	scoped.Find(&attachments)
+	for i := range attachments {
+		signAttachment(&attachments[i], requestShopId(r))
+	}
+	json.NewEncoder(w).Encode(&attachments)
+}
+
+//get an attachment's metadata with fresh download URLs
+func getAttachment(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var attachment Attachment
+	if shopDB(r).First(&attachment, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("attachment %s not found", params["id"]))
+		return
+	}
+	signAttachment(&attachment, requestShopId(r))
+	json.NewEncoder(w).Encode(&attachment)
+}
+
+//serve the bytes of an attachment to whoever holds a valid signed URL
+func downloadAttachment(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	query := r.URL.Query()
+	variant := query.Get("variant")
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	shopId, shopErr := strconv.ParseUint(query.Get("shop"), 10, 64)
+	if err != nil || shopErr != nil || uint(shopId) != requestShopId(r) {
+		writeError(w, http.StatusForbidden, errors.New("invalid download URL"))
+		return
+	}
+
+	var attachment Attachment
+	if shopDB(r).First(&attachment, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("attachment %s not found", params["id"]))
+		return
+	}
+
+	expected := downloadSignature(attachment.ID, uint(shopId), variant, expires)
+	if !hmac.Equal([]byte(expected), []byte(query.Get("signature"))) {
+		writeError(w, http.StatusForbidden, errors.New("invalid download URL"))
+		return
+	}
+	if time.Now().Unix() > expires {
+		writeError(w, http.StatusForbidden, errors.New("download URL has expired"))
+		return
+	}
+
+	key, contentType := attachment.BlobKey, attachment.ContentType
+	if variant == "thumbnail" {
+		if attachment.ThumbnailKey == "" {
+			writeError(w, http.StatusNotFound, errors.New("attachment has no thumbnail"))
+			return
+		}
+		key, contentType = attachment.ThumbnailKey, "image/jpeg"
+	}
+
+	blob, err := blobs.Get(key)
+	if err == errBlobNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	defer blob.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", attachment.FileName))
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	io.Copy(w, blob)
+}
+
+//delete an attachment and its blobs
+func deleteAttachment(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var attachment Attachment
+	if shopDB(r).First(&attachment, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("attachment %s not found", params["id"]))
+		return
+	}
+	if err := shopDB(r).Unscoped().Delete(&attachment).Error; err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, key := range []string{attachment.BlobKey, attachment.ThumbnailKey} {
+		if key == "" {
+			continue
+		}
+		if err := blobs.Delete(key); err != nil {
+			log.Printf("attachments: deleting blob %s: %v", key, err)
+		}
+	}
+	json.NewEncoder(w).Encode(&attachment)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+//an S3 bucket kept in memory, refusing requests that aren't signed
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case "PUT":
+		s.objects[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+	case "GET":
+		content, ok := s.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(content)
+	case "DELETE":
+		delete(s.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+//points blobs at a fake S3 for as long as the test runs
+func useFakeS3(t *testing.T) *fakeS3 {
+	t.Helper()
+	bucket := &fakeS3{objects: map[string][]byte{}}
+	server := httptest.NewServer(bucket)
+	store, err := NewS3BlobStore(server.URL, "", "photos", "key", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := blobs
+	blobs = store
+	t.Cleanup(func() {
+		blobs = previous
+		server.Close()
+	})
+	return bucket
+}
+
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func uploadRequest(t *testing.T, path string, content []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "photo.png")
+	part.Write(content)
+	form.Close()
+	req := httptest.NewRequest("POST", path, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req
+}
+
+func TestUploadIsStoredInS3WithAThumbnail(t *testing.T) {
+	tx := setupTestDB(t)
+	bucket := useFakeS3(t)
+	service := createTestService(t, tx)
+	router := mux.NewRouter()
+	router.HandleFunc("/car/{id}/attachments", uploadCarAttachment).Methods("POST")
+	router.HandleFunc("/attachment/{id}/download", downloadAttachment).Methods("GET")
+
+	content := testPNG(t, 640, 480)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, uploadRequest(t, fmt.Sprintf("/car/%d/attachments", service.CarId), content))
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	var attachment Attachment
+	json.NewDecoder(w.Body).Decode(&attachment)
+	tx.First(&attachment, attachment.ID)
+	if !bytes.Equal(bucket.objects["/photos/"+attachment.BlobKey], content) {
+		t.Fatalf("%s isn't in the bucket", attachment.BlobKey)
+	}
+	if _, ok := bucket.objects["/photos/"+attachment.ThumbnailKey]; attachment.ThumbnailKey == "" || !ok {
+		t.Fatalf("thumbnail %q isn't in the bucket", attachment.ThumbnailKey)
+	}
+
+	signAttachment(&attachment, defaultShopId)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", attachment.URL, nil))
+	if !bytes.Equal(w.Body.Bytes(), content) {
+		t.Fatalf("download: %d, %d bytes", w.Code, w.Body.Len())
+	}
+}
+
+func TestUploadOfAHugeImageIsRefused(t *testing.T) {
+	tx := setupTestDB(t)
+	bucket := useFakeS3(t)
+	service := createTestService(t, tx)
+	router := mux.NewRouter()
+	router.HandleFunc("/car/{id}/attachments", uploadCarAttachment).Methods("POST")
+
+	//a tiny file whose header says it is 100000x100000
+	content := testPNG(t, 1, 1)
+	ihdr := content[12:29]
+	binary.BigEndian.PutUint32(ihdr[4:], 100000)
+	binary.BigEndian.PutUint32(ihdr[8:], 100000)
+	binary.BigEndian.PutUint32(content[29:], crc32.ChecksumIEEE(ihdr))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, uploadRequest(t, fmt.Sprintf("/car/%d/attachments", service.CarId), content))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "pixels") || len(bucket.objects) != 0 {
+		t.Fatalf("got %d with %d objects stored: %s", w.Code, len(bucket.objects), w.Body)
+	}
+}
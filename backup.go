@@ -0,0 +1,535 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+//what an export archive says it is, and the version of its layout. Rows of
+//version 1 archives are the models' JSON, from version 2 on they are the
+//table's columns.
+const (
+	archiveFormat        = "mecanica-export"
+	archiveFormatVersion = 2
+	archiveManifestName  = "manifest.json"
+)
+
+//the column an archive leaves out: its rows go in the shop that imports it
+const archiveSkippedColumn = "shop_id"
+
+//rows are read from the database this many at a time while exporting
+const exportBatchSize = 500
+
+//every table an archive holds, parents before the tables that reference
+//them so an import never trips a foreign key. Attachment rows are exported
+//but the files themselves stay in the blob store.
+var backupModels = []interface{}{
+	&Customer{},
+	&Supplier{},
+	&LaborOperation{},
+	&Employee{},
+	&Part{},
+	&Car{},
+	&Service{},
+	&StockMovement{},
+	&ServicePart{},
+	&PurchaseOrder{},
+	&PurchaseOrderLine{},
+	&CannedJob{},
+	&CannedJobLabor{},
+	&CannedJobPart{},
+	&TimePunch{},
+	&InspectionTemplate{},
+	&InspectionSection{},
+	&InspectionTemplateItem{},
+	&Inspection{},
+	&InspectionResult{},
+	&Attachment{},
+	&OdometerReading{},
+	&MaintenanceRule{},
+	&Notification{},
+	&NotificationTemplate{},
+	&PortalToken{},
+	&CarOwnership{},
+	&CustomerContact{},
+	&ContactPoint{},
+	&Address{},
+	&CustomerMerge{},
+	&PrivacyRequest{},
+	&Appointment{},
+}
+
+// ArchiveManifest describes an export archive. It is the last file of the
+// archive, written once every table is in.
+type ArchiveManifest struct {
+	Format        string
+	FormatVersion int
+	SchemaVersion int
+	Dialect       string
+	CreatedAt     time.Time
+	Tables        []ArchiveTable
+}
+
+// ArchiveTable is one table of an archive, stored as NDJSON in File with a
+// row per line
+type ArchiveTable struct {
+	Name   string
+	File   string
+	Rows   int
+	SHA256 string
+}
+
+//the newest migration the database has
+func schemaVersion(tx *gorm.DB) (int, error) {
+	applied, err := appliedMigrations(tx)
+	if err != nil {
+		return 0, err
+	}
+	version := 0
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+//runs fn in a read-only transaction that sees the whole database as it was
+//when it started, so an export taken while the shop works is consistent
+func withExportSnapshot(conn *gorm.DB, fn func(tx *gorm.DB) error) error {
+	return conn.Transaction(func(tx *gorm.DB) error {
+		//a SQLite transaction reads from one snapshot already
+		if !isSQLite(tx) {
+			if err := tx.Exec(`SET TRANSACTION ISOLATION LEVEL REPEATABLE READ, READ ONLY`).Error; err != nil {
+				return err
+			}
+		}
+		return fn(tx)
+	})
+}
+
+//writes every table, deleted rows included, as a zip of NDJSON files
+//followed by the manifest
+func exportArchive(tx *gorm.DB, w io.Writer) (ArchiveManifest, error) {
+	manifest := ArchiveManifest{
+		Format:        archiveFormat,
+		FormatVersion: archiveFormatVersion,
+		Dialect:       tx.Dialect().GetName(),
+		CreatedAt:     time.Now().UTC(),
+	}
+	var err error
+	if manifest.SchemaVersion, err = schemaVersion(tx); err != nil {
+		return manifest, err
+	}
+
+	archive := zip.NewWriter(w)
+	for _, model := range backupModels {
+		name := tx.NewScope(model).TableName()
+		entry, err := archive.CreateHeader(&zip.FileHeader{Name: name + ".ndjson", Method: zip.Deflate, Modified: manifest.CreatedAt})
+		if err != nil {
+			return manifest, err
+		}
+		sum := sha256.New()
+		rows, err := exportTable(tx, model, io.MultiWriter(entry, sum))
+		if err != nil {
+			return manifest, fmt.Errorf("exporting %s: %v", name, err)
+		}
+		manifest.Tables = append(manifest.Tables, ArchiveTable{
+			Name:   name,
+			File:   name + ".ndjson",
+			Rows:   rows,
+			SHA256: hex.EncodeToString(sum.Sum(nil)),
+		})
+	}
+
+	entry, err := archive.CreateHeader(&zip.FileHeader{Name: archiveManifestName, Method: zip.Deflate, Modified: manifest.CreatedAt})
+	if err != nil {
+		return manifest, err
+	}
+	encoder := json.NewEncoder(entry)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(&manifest); err != nil {
+		return manifest, err
+	}
+	return manifest, archive.Close()
+}
+
+//writes the rows of one table as JSON lines in id order, a batch at a time.
+//Rows are read column by column rather than through the model, whose JSON
+//leaves out what the API mustn't show, like the blob keys of attachments.
+func exportTable(tx *gorm.DB, model interface{}, w io.Writer) (int, error) {
+	name := tx.NewScope(model).TableName()
+	encoder := json.NewEncoder(w)
+	count := 0
+	var lastId int64
+	for {
+		batch, err := readArchiveRows(tx.Table(name).Where("id > ?", lastId).Order("id").Limit(exportBatchSize))
+		if err != nil {
+			return count, err
+		}
+		for _, row := range batch {
+			if err := encoder.Encode(row); err != nil {
+				return count, err
+			}
+			id, _ := row["id"].(int64)
+			lastId = id
+			count++
+		}
+		if len(batch) < exportBatchSize {
+			return count, nil
+		}
+	}
+}
+
+//the rows a query reads as maps of column to value, deleted rows included
+func readArchiveRows(query *gorm.DB) ([]map[string]interface{}, error) {
+	rows, err := query.Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var batch []map[string]interface{}
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		row := map[string]interface{}{}
+		for i, column := range columns {
+			if column == archiveSkippedColumn {
+				continue
+			}
+			//text and postgres numerics come back as bytes
+			if b, ok := values[i].([]byte); ok {
+				row[column] = string(b)
+			} else {
+				row[column] = values[i]
+			}
+		}
+		batch = append(batch, row)
+	}
+	return batch, rows.Err()
+}
+
+//reads the manifest of an archive and checks this build can import it
+func readManifest(archive *zip.Reader) (ArchiveManifest, error) {
+	var manifest ArchiveManifest
+	for _, f := range archive.File {
+		if f.Name != archiveManifestName {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return manifest, err
+		}
+		defer r.Close()
+		if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+			return manifest, fmt.Errorf("reading the manifest: %v", err)
+		}
+		if manifest.Format != archiveFormat {
+			return manifest, fmt.Errorf("not a %s archive", archiveFormat)
+		}
+		if manifest.FormatVersion > archiveFormatVersion {
+			return manifest, fmt.Errorf("archive format %d is newer than this build understands (%d)", manifest.FormatVersion, archiveFormatVersion)
+		}
+		return manifest, nil
+	}
+	return manifest, errors.New("the archive has no manifest, it may be truncated")
+}
+
+//loads an archive into an empty, fully migrated database in one
+//transaction. Nothing is kept when a checksum or row count doesn't match.
+func importArchive(archive *zip.Reader) (ArchiveManifest, error) {
+	manifest, err := readManifest(archive)
+	if err != nil {
+		return manifest, err
+	}
+	if err := requireMigratedSchema(); err != nil {
+		return manifest, err
+	}
+	current, err := schemaVersion(db)
+	if err != nil {
+		return manifest, err
+	}
+	if manifest.SchemaVersion > current {
+		return manifest, fmt.Errorf("the archive was taken at schema version %d, this database is at %d", manifest.SchemaVersion, current)
+	}
+
+	files := map[string]*zip.File{}
+	for _, f := range archive.File {
+		files[f.Name] = f
+	}
+	tables := map[string]ArchiveTable{}
+	for _, table := range manifest.Tables {
+		if files[table.File] == nil {
+			return manifest, fmt.Errorf("the archive is missing %s", table.File)
+		}
+		tables[table.Name] = table
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, model := range backupModels {
+			name := tx.NewScope(model).TableName()
+			var existing int
+			if err := tx.Unscoped().Model(model).Count(&existing).Error; err != nil {
+				return err
+			}
+			if existing > 0 {
+				return fmt.Errorf("%s already has rows, import needs an empty database", name)
+			}
+		}
+
+		for _, model := range backupModels {
+			name := tx.NewScope(model).TableName()
+			table, ok := tables[name]
+			if !ok {
+				//archives from older schemas don't have the newer tables
+				continue
+			}
+			if err := importTable(tx, model, files[table.File], table, manifest.FormatVersion); err != nil {
+				return fmt.Errorf("importing %s: %v", name, err)
+			}
+			//rows keep their ids, the next new row has to come after them.
+			//Other shops' rows aren't visible, so the sequence only moves on.
+			if !isSQLite(tx) {
+				err := tx.Exec(`SELECT setval(pg_get_serial_sequence(?, 'id'), GREATEST(COALESCE(MAX(id), 0), COALESCE(pg_sequence_last_value(pg_get_serial_sequence(?, 'id')::regclass), 0)) + 1, false) FROM `+name, name, name).Error
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return manifest, err
+}
+
+//inserts the rows of one archive file as they are, ids included
+func importTable(tx *gorm.DB, model interface{}, f *zip.File, table ArchiveTable, formatVersion int) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	sum := sha256.New()
+	decoder := json.NewDecoder(io.TeeReader(r, sum))
+	decoder.UseNumber()
+	columns := archiveColumns(tx, model)
+	rowType := reflect.TypeOf(model).Elem()
+	rows := 0
+	for {
+		var err error
+		if formatVersion < 2 {
+			row := reflect.New(rowType).Interface()
+			if err = decoder.Decode(row); err == nil {
+				err = tx.Set("gorm:save_associations", false).Create(row).Error
+			}
+		} else {
+			var row map[string]interface{}
+			if err = decoder.Decode(&row); err == nil {
+				err = insertArchiveRow(tx, table.Name, columns, row)
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("line %d: %v", rows+1, err)
+		}
+		rows++
+	}
+	//the decoder may stop short of a trailing newline
+	if _, err := io.Copy(sum, r); err != nil {
+		return err
+	}
+	if rows != table.Rows {
+		return fmt.Errorf("%d rows, the manifest says %d", rows, table.Rows)
+	}
+	if hex.EncodeToString(sum.Sum(nil)) != table.SHA256 {
+		return errors.New("checksum doesn't match the manifest")
+	}
+	return nil
+}
+
+//the columns of a model's table an archive row can have, true for the ones
+//holding times
+func archiveColumns(tx *gorm.DB, model interface{}) map[string]bool {
+	columns := map[string]bool{}
+	for _, field := range tx.NewScope(model).Fields() {
+		if !field.IsNormal || field.IsIgnored {
+			continue
+		}
+		fieldType := field.Struct.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		columns[field.DBName] = fieldType == reflect.TypeOf(time.Time{})
+	}
+	return columns
+}
+
+//inserts one row of a version 2 archive. Its columns are checked against the
+//model before they go in the statement.
+func insertArchiveRow(tx *gorm.DB, table string, columns map[string]bool, row map[string]interface{}) error {
+	names := make([]string, 0, len(row))
+	for name := range row {
+		if name == archiveSkippedColumn {
+			continue
+		}
+		if _, ok := columns[name]; !ok {
+			return fmt.Errorf("unknown column %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	values := make([]interface{}, len(names))
+	for i, name := range names {
+		switch v := row[name].(type) {
+		case json.Number:
+			if n, err := v.Int64(); err == nil {
+				values[i] = n
+			} else if f, err := v.Float64(); err == nil {
+				values[i] = f
+			} else {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		case string:
+			values[i] = v
+			if columns[name] {
+				t, err := time.Parse(time.RFC3339Nano, v)
+				if err != nil {
+					return fmt.Errorf("%s: %v", name, err)
+				}
+				values[i] = t
+			}
+		default:
+			values[i] = v
+		}
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", ")
+	return tx.Exec(`INSERT INTO `+table+` (`+strings.Join(names, ", ")+`) VALUES (`+placeholders+`)`, values...).Error
+}
+
+//mecanica-service export [file], the file defaults to one named after the
+//current time
+func runExportCommand(args []string) error {
+	path := fmt.Sprintf("mecanica-%s.zip", time.Now().Format("20060102-150405"))
+	if len(args) > 0 {
+		path = args[0]
+	}
+	//written next to the destination and moved there once complete, so a
+	//failed export never leaves something that looks like a backup
+	partial := path + ".partial"
+	f, err := os.Create(partial)
+	if err != nil {
+		return err
+	}
+	var manifest ArchiveManifest
+	err = withExportSnapshot(db, func(tx *gorm.DB) error {
+		var err error
+		manifest, err = exportArchive(tx, f)
+		return err
+	})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(partial)
+		return err
+	}
+	if err := os.Rename(partial, path); err != nil {
+		return err
+	}
+
+	rows := 0
+	for _, table := range manifest.Tables {
+		rows += table.Rows
+	}
+	fmt.Printf("exported %d rows from %d tables to %s\n", rows, len(manifest.Tables), path)
+	return nil
+}
+
+//mecanica-service import <file>
+func runImportCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: import <file>")
+	}
+	archive, err := zip.OpenReader(args[0])
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	manifest, err := importArchive(&archive.Reader)
+	if err != nil {
+		return err
+	}
+	for _, table := range manifest.Tables {
+		fmt.Printf("%-28s %d rows\n", table.Name, table.Rows)
+	}
+	fmt.Printf("imported the export of %s\n", manifest.CreatedAt.Format(time.RFC3339))
+	return nil
+}
+
+//wraps an admin handler so it only runs with the ADMIN_TOKEN bearer token.
+//Without ADMIN_TOKEN the admin endpoints are off.
+func adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		if (*r).Method == "OPTIONS" {
+			return
+		}
+
+		expected := os.Getenv("ADMIN_TOKEN")
+		if expected == "" {
+			writeError(w, http.StatusForbidden, errors.New("admin endpoints are disabled, set ADMIN_TOKEN to use them"))
+			return
+		}
+		given := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(given), []byte("Bearer "+expected)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("admin token required"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+//stream a backup of the whole database as an export archive
+func getExport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="mecanica-%s.zip"`, time.Now().Format("20060102-150405")))
+
+	//once the archive has started the status can't change anymore, a
+	//failure leaves it without a manifest and import refuses it
+	err := withExportSnapshot(shopDB(r), func(tx *gorm.DB) error {
+		_, err := exportArchive(tx, w)
+		return err
+	})
+	if err != nil {
+		log.Printf("export failed: %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestArchiveKeepsEveryColumn(t *testing.T) {
+	tx := setupTestDB(t)
+	service := createTestService(t, tx)
+	attachment := Attachment{ServiceId: &service.ID, FileName: "brakes.jpg", ContentType: "image/jpeg", BlobKey: "blobs/brakes.jpg", ThumbnailKey: "blobs/brakes-thumb.jpg"}
+	if err := tx.Create(&attachment).Error; err != nil {
+		t.Fatal(err)
+	}
+	deleted := Customer{FirstName: "Gone", Phone: "555-000-0000"}
+	tx.Create(&deleted)
+	tx.Delete(&deleted)
+
+	var archive bytes.Buffer
+	if _, err := exportArchive(tx, &archive); err != nil {
+		t.Fatal(err)
+	}
+
+	//restore into a database of its own
+	restored := setupTestDB(t)
+	reader, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := importArchive(reader); err != nil {
+		t.Fatal(err)
+	}
+
+	var got Attachment
+	if restored.First(&got, attachment.ID).RecordNotFound() {
+		t.Fatal("the attachment wasn't restored")
+	}
+	if got.BlobKey != attachment.BlobKey || got.ThumbnailKey != attachment.ThumbnailKey {
+		t.Fatalf("restored blob keys %q and %q, want %q and %q", got.BlobKey, got.ThumbnailKey, attachment.BlobKey, attachment.ThumbnailKey)
+	}
+	if got.ServiceId == nil || *got.ServiceId != service.ID {
+		t.Fatalf("restored attachment belongs to service %v, want %d", got.ServiceId, service.ID)
+	}
+	if d := got.CreatedAt.Sub(attachment.CreatedAt); d > time.Millisecond || d < -time.Millisecond {
+		t.Fatalf("restored CreatedAt %s, want %s", got.CreatedAt, attachment.CreatedAt)
+	}
+
+	var gone Customer
+	if restored.Unscoped().First(&gone, deleted.ID).RecordNotFound() || gone.DeletedAt == nil {
+		t.Fatal("the deleted customer wasn't restored as deleted")
+	}
+}
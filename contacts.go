@@ -0,0 +1,487 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+//kinds of contact points
+const (
+	ContactMobile = "mobile"
+	ContactHome   = "home"
+	ContactWork   = "work"
+	ContactEmail  = "email"
+)
+
+//languages customers are written to in
+const (
+	LanguageSpanish = "es"
+	LanguageEnglish = "en"
+)
+
+// ContactPoint is a phone number or email address of a customer. A customer
+// has at most one primary phone and one primary email, which are mirrored
+// into Customer.Phone and Customer.Email.
+type ContactPoint struct {
+	gorm.Model
+
+	CustomerId uint `gorm:"index"`
+	Kind       string
+	Value      string
+	Normalized string `gorm:"index"`
+	IsPrimary  bool
+	Verified   bool
+	VerifiedAt *time.Time
+}
+
+// Address is a postal address of a customer
+type Address struct {
+	gorm.Model
+
+	CustomerId uint `gorm:"index"`
+	Kind       string
+	Line1      string
+	Line2      string
+	City       string
+	State      string
+	PostalCode string
+	Country    string
+	IsPrimary  bool
+}
+
+func isPhoneKind(kind string) bool {
+	return kind == ContactMobile || kind == ContactHome || kind == ContactWork
+}
+
+//phones are compared by their digits only, without the country code of US
+//numbers, emails in lower case. Stored and looked up values both go through
+//here so they always match.
+func normalizeContactValue(kind, value string) string {
+	value = strings.TrimSpace(value)
+	if kind == ContactEmail {
+		return strings.ToLower(value)
+	}
+	var digits strings.Builder
+	for _, c := range value {
+		if c >= '0' && c <= '9' {
+			digits.WriteRune(c)
+		}
+	}
+	normalized := digits.String()
+	if len(normalized) == 11 && normalized[0] == '1' {
+		normalized = normalized[1:]
+	}
+	return normalized
+}
+
+//cleans up and checks a contact point before it is saved
+func normalizeContactPoint(point *ContactPoint) error {
+	point.Kind = strings.ToLower(strings.TrimSpace(point.Kind))
+	point.Value = strings.TrimSpace(point.Value)
+	if !isPhoneKind(point.Kind) && point.Kind != ContactEmail {
+		return fmt.Errorf("Kind must be %s, %s, %s or %s", ContactMobile, ContactHome, ContactWork, ContactEmail)
+	}
+	point.Normalized = normalizeContactValue(point.Kind, point.Value)
+	if point.Normalized == "" {
+		return errors.New("Value is required")
+	}
+	if point.Kind == ContactEmail && !strings.Contains(point.Normalized, "@") {
+		return fmt.Errorf("%q is not an email address", point.Value)
+	}
+	if !point.Verified {
+		point.VerifiedAt = nil
+	} else if point.VerifiedAt == nil {
+		now := time.Now()
+		point.VerifiedAt = &now
+	}
+	return nil
+}
+
+//narrows customers down to those with a phone number, whichever of their
+//phones it is
+func customersWithPhone(query *gorm.DB, phone string) *gorm.DB {
+	digits := normalizeContactValue(ContactMobile, phone)
+	return query.Where("customers.id IN (?)", query.New().Table("contact_points").Select("customer_id").
+		Where("normalized = ? AND kind IN (?) AND deleted_at IS NULL", digits, []string{ContactMobile, ContactHome, ContactWork}).QueryExpr())
+}
+
+//customers with a phone number, whichever of their phones it is
+func findCustomersByPhone(tx *gorm.DB, phone string) []Customer {
+	customers := []Customer{}
+	if normalizeContactValue(ContactMobile, phone) == "" {
+		return customers
+	}
+	customersWithPhone(tx, phone).Order("id").Find(&customers)
+	return customers
+}
+
+//the customer with an email address
+func findCustomerByEmail(tx *gorm.DB, email string) (Customer, bool) {
+	var customer Customer
+	notFound := tx.Where("id IN (?)", tx.Table("contact_points").Select("customer_id").
+		Where("normalized = ? AND kind = ? AND deleted_at IS NULL", normalizeContactValue(ContactEmail, email), ContactEmail).QueryExpr()).
+		Order("id").First(&customer).RecordNotFound()
+	return customer, !notFound
+}
+
+//the number to text a customer on: their primary phone if it is a mobile,
+//else their first mobile. Customers without contact points get their Phone.
+func textablePhone(tx *gorm.DB, customer Customer) string {
+	var points []ContactPoint
+	tx.Where("customer_id = ? AND kind IN (?)", customer.ID, []string{ContactMobile, ContactHome, ContactWork}).
+		Order("is_primary DESC, id").Find(&points)
+	if len(points) == 0 {
+		return customer.Phone
+	}
+	for _, point := range points {
+		if point.Kind == ContactMobile {
+			return point.Value
+		}
+	}
+	return ""
+}
+
+//saves a contact point. A new primary takes over from the customer's other
+//phones or emails, and the customer's Phone and Email follow the primaries.
+func saveContactPoint(tx *gorm.DB, point *ContactPoint) error {
+	if point.IsPrimary {
+		kinds := []string{ContactEmail}
+		if isPhoneKind(point.Kind) {
+			kinds = []string{ContactMobile, ContactHome, ContactWork}
+		}
+		err := tx.Model(&ContactPoint{}).Where("customer_id = ? AND kind IN (?) AND id <> ?", point.CustomerId, kinds, point.ID).
+			Update("is_primary", false).Error
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Save(point).Error; err != nil {
+		return err
+	}
+	return syncCustomerContacts(tx, point.CustomerId)
+}
+
+//sets Customer.Phone and Customer.Email from the primary contact points,
+//falling back to a mobile and then any phone when none is primary
+func syncCustomerContacts(tx *gorm.DB, customerId uint) error {
+	var points []ContactPoint
+	tx.Where("customer_id = ?", customerId).Order("is_primary DESC, id").Find(&points)
+
+	phone, email := "", ""
+	for _, point := range points {
+		if point.Kind == ContactEmail && email == "" {
+			email = point.Value
+		}
+	}
+	for _, preferMobile := range []bool{true, false} {
+		for _, point := range points {
+			if phone == "" && isPhoneKind(point.Kind) && (point.IsPrimary || !preferMobile || point.Kind == ContactMobile) {
+				phone = point.Value
+			}
+		}
+	}
+	return tx.Model(&Customer{}).Where("id = ?", customerId).Updates(map[string]interface{}{"phone": phone, "email": email}).Error
+}
+
+//turns the Phone and Email set directly on a customer into contact points,
+//so clients that only know those fields keep working. A value the customer
+//doesn't have yet becomes their primary.
+func adoptLegacyContacts(tx *gorm.DB, customer *Customer) error {
+	legacy := []ContactPoint{
+		{CustomerId: customer.ID, Kind: ContactMobile, Value: customer.Phone},
+		{CustomerId: customer.ID, Kind: ContactEmail, Value: customer.Email},
+	}
+	for _, point := range legacy {
+		if strings.TrimSpace(point.Value) == "" {
+			continue
+		}
+		kinds := []string{ContactEmail}
+		if isPhoneKind(point.Kind) {
+			kinds = []string{ContactMobile, ContactHome, ContactWork}
+		}
+		normalized := normalizeContactValue(point.Kind, point.Value)
+		var existing ContactPoint
+		if !tx.Where("customer_id = ? AND kind IN (?) AND normalized = ?", customer.ID, kinds, normalized).First(&existing).RecordNotFound() {
+			continue
+		}
+		point.IsPrimary = true
+		if err := normalizeContactPoint(&point); err != nil {
+			return err
+		}
+		if err := saveContactPoint(tx, &point); err != nil {
+			return err
+		}
+	}
+	return syncCustomerContacts(tx, customer.ID)
+}
+
+//checks the contact points and addresses sent along with a new customer
+func prepareCustomerContacts(customer *Customer) error {
+	primaryPhone, primaryEmail := false, false
+	for i := range customer.ContactPoints {
+		point := &customer.ContactPoints[i]
+		point.ID = 0
+		if err := normalizeContactPoint(point); err != nil {
+			return err
+		}
+		if point.IsPrimary && isPhoneKind(point.Kind) {
+			if primaryPhone {
+				return errors.New("only one phone can be primary")
+			}
+			primaryPhone = true
+		}
+		if point.IsPrimary && point.Kind == ContactEmail {
+			if primaryEmail {
+				return errors.New("only one email can be primary")
+			}
+			primaryEmail = true
+		}
+	}
+	for i := range customer.Addresses {
+		customer.Addresses[i].ID = 0
+		if strings.TrimSpace(customer.Addresses[i].Line1) == "" {
+			return errors.New("Line1 is required on addresses")
+		}
+	}
+	return nil
+}
+
+//moves the Phone and Email of customers saved before contact points existed
+//into contact points
+func backfillContactPoints(tx *gorm.DB) error {
+	var customers []Customer
+	tx.Where("id NOT IN (?)", tx.Table("contact_points").Select("customer_id").QueryExpr()).Find(&customers)
+	for _, customer := range customers {
+		if err := adoptLegacyContacts(tx, &customer); err != nil {
+			return fmt.Errorf("customer %d: %v", customer.ID, err)
+		}
+	}
+	return nil
+}
+
+//get the phones and emails of a customer
+func getContactPoints(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var points []ContactPoint
+	shopDB(r).Where("customer_id = ?", params["id"]).Order("kind, id").Find(&points)
+	json.NewEncoder(w).Encode(&points)
+}
+
+//add a phone or email to a customer
+func createContactPoint(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var customer Customer
+	if shopDB(r).First(&customer, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("customer %s not found", params["id"]))
+		return
+	}
+
+	var point ContactPoint
+	if err := json.NewDecoder(r.Body).Decode(&point); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	point.ID = 0
+	point.CustomerId = customer.ID
+	if err := normalizeContactPoint(&point); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		return saveContactPoint(tx, &point)
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&point)
+}
+
+//edit a phone or email, setting Verified stamps VerifiedAt
+func updateContactPoint(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var point ContactPoint
+	if shopDB(r).First(&point, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("contact point %s not found", params["id"]))
+		return
+	}
+	id, customerId, normalized, verifiedAt := point.ID, point.CustomerId, point.Normalized, point.VerifiedAt
+	if err := json.NewDecoder(r.Body).Decode(&point); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	point.ID, point.CustomerId = id, customerId
+	if err := normalizeContactPoint(&point); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	//a changed number or address has to be verified again
+	if point.Normalized != normalized {
+		point.Verified, point.VerifiedAt = false, nil
+	} else if point.Verified && verifiedAt != nil {
+		point.VerifiedAt = verifiedAt
+	}
+
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		return saveContactPoint(tx, &point)
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&point)
+}
+
+//delete a phone or email
+func deleteContactPoint(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var point ContactPoint
+	if shopDB(r).First(&point, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("contact point %s not found", params["id"]))
+		return
+	}
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&point).Error; err != nil {
+			return err
+		}
+		return syncCustomerContacts(tx, point.CustomerId)
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&point)
+}
+
+//get the addresses of a customer
+func getAddresses(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var addresses []Address
+	shopDB(r).Where("customer_id = ?", params["id"]).Order("id").Find(&addresses)
+	json.NewEncoder(w).Encode(&addresses)
+}
+
+//saves an address, a new primary address takes over from the old one
+func saveAddress(tx *gorm.DB, address *Address) error {
+	if strings.TrimSpace(address.Line1) == "" {
+		return errors.New("Line1 is required")
+	}
+	if address.IsPrimary {
+		err := tx.Model(&Address{}).Where("customer_id = ? AND id <> ?", address.CustomerId, address.ID).
+			Update("is_primary", false).Error
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Save(address).Error
+}
+
+//add an address to a customer
+func createAddress(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var customer Customer
+	if shopDB(r).First(&customer, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("customer %s not found", params["id"]))
+		return
+	}
+
+	var address Address
+	if err := json.NewDecoder(r.Body).Decode(&address); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	address.ID = 0
+	address.CustomerId = customer.ID
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		return saveAddress(tx, &address)
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&address)
+}
+
+//edit an address
+func updateAddress(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var address Address
+	if shopDB(r).First(&address, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("address %s not found", params["id"]))
+		return
+	}
+	id, customerId := address.ID, address.CustomerId
+	if err := json.NewDecoder(r.Body).Decode(&address); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	address.ID, address.CustomerId = id, customerId
+
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		return saveAddress(tx, &address)
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&address)
+}
+
+//delete an address
+func deleteAddress(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var address Address
+	if shopDB(r).First(&address, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("address %s not found", params["id"]))
+		return
+	}
+	shopDB(r).Delete(&address)
+	json.NewEncoder(w).Encode(&address)
+}
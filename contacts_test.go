@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestSpousesShareALandlineAndAreFoundByAnyPhone(t *testing.T) {
+	tx := setupTestDB(t)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/customers", getCustomers).Methods("GET")
+	router.HandleFunc("/create/customer", createCustomer).Methods("POST")
+	router.HandleFunc("/customer/{id}/contactpoints", createContactPoint).Methods("POST")
+	send := func(method, path, body string, into interface{}) int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		if into != nil && w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(into); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code
+	}
+	findByPhone := func(phone string) []Customer {
+		var customers []Customer
+		send("GET", "/customers?phone="+url.QueryEscape(phone), "", &customers)
+		return customers
+	}
+
+	var ana, luis Customer
+	send("POST", "/create/customer", `{"FirstName": "Ana", "Phone": "555-222-3333", "MarketingConsent": true, "PreferredLanguage": "ES"}`, &ana)
+	if code := send("POST", "/create/customer", `{"FirstName": "Luis", "Phone": "(555) 222 3333"}`, &luis); code != http.StatusOK {
+		t.Fatalf("a second customer on the same landline: status %d", code)
+	}
+	if ana.MarketingConsentAt == nil || ana.PreferredLanguage != LanguageSpanish {
+		t.Errorf("consent stamped at %v and language %q, want a time and %s", ana.MarketingConsentAt, ana.PreferredLanguage, LanguageSpanish)
+	}
+
+	var mobile ContactPoint
+	code := send("POST", fmt.Sprintf("/customer/%d/contactpoints", ana.ID), `{"Kind": "Mobile", "Value": "+1 555 444 5555", "IsPrimary": true}`, &mobile)
+	if code != http.StatusOK || mobile.Normalized != "5554445555" {
+		t.Fatalf("status %d, mobile normalized to %q", code, mobile.Normalized)
+	}
+	tx.First(&ana, ana.ID)
+	if ana.Phone != "+1 555 444 5555" {
+		t.Errorf("Phone is %q, want the new primary", ana.Phone)
+	}
+	var primaries int
+	tx.Model(&ContactPoint{}).Where("customer_id = ? AND is_primary", ana.ID).Count(&primaries)
+	if primaries != 1 {
+		t.Errorf("Ana has %d primary phones", primaries)
+	}
+
+	if found := findByPhone("5552223333"); len(found) != 2 {
+		t.Errorf("found %d customers on the landline, want both", len(found))
+	}
+	if found := findByPhone("555.444.5555"); len(found) != 1 || found[0].ID != ana.ID {
+		t.Errorf("found %+v by the mobile, want only Ana", found)
+	}
+
+	for _, body := range []string{
+		`{"FirstName": "Eva", "ContactPoints": [{"Kind": "mobile", "Value": "5550001111", "IsPrimary": true}, {"Kind": "home", "Value": "5550002222", "IsPrimary": true}]}`,
+		`{"FirstName": "Eva", "ContactPoints": [{"Kind": "email", "Value": "not an address"}]}`,
+		`{"FirstName": "Eva", "PreferredLanguage": "fr"}`,
+	} {
+		if code := send("POST", "/create/customer", body, nil); code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, code)
+		}
+	}
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+//the fields a spreadsheet column can be mapped to, each with the headers it
+//is found under when no mapping is given. Headers are compared lowercase
+//with anything but letters and digits left out.
+var csvImportFields = []struct {
+	Field   string
+	Headers []string
+}{
+	{"Name", []string{"name", "customer", "customername", "nombre", "cliente"}},
+	{"FirstName", []string{"firstname", "first"}},
+	{"LastName", []string{"lastname", "last", "surname", "apellido"}},
+	{"Phone", []string{"phone", "phonenumber", "telephone", "tel", "cell", "cellphone", "mobile", "mobilephone", "telefono", "celular"}},
+	{"Make", []string{"make", "marca"}},
+	{"Modelo", []string{"modelo", "model"}},
+	{"Color", []string{"color", "colour"}},
+	{"VinNumber", []string{"vin", "vinnumber"}},
+	{"Notes", []string{"notes", "servicenotes", "service", "comments", "comment", "notas"}},
+	{"ServiceDate", []string{"servicedate", "date", "fecha"}},
+}
+
+//dates legacy spreadsheets write service dates in
+var csvDateLayouts = []string{"2006-01-02", "01/02/2006", "1/2/2006", "01/02/06", "1/2/06"}
+
+//returned from the import transaction to throw away what it did
+var errCSVRollback = errors.New("rollback")
+
+// CSVImportOptions are how a spreadsheet is imported. Mapping maps a field
+// to the header of its column and overrides the headers found on their own.
+type CSVImportOptions struct {
+	DryRun      bool
+	SkipInvalid bool
+	Mapping     map[string]string
+}
+
+// CSVImportChange is something a line of the spreadsheet creates or updates.
+// Id is the updated row, or the created one once committed.
+type CSVImportChange struct {
+	Line   int
+	Action string
+	Entity string
+	Id     uint
+	Detail string
+}
+
+// CSVImportError is why a line of the spreadsheet can't be imported
+type CSVImportError struct {
+	Line  int
+	Error string
+}
+
+// CSVImportReport is what an import did, or would do on a dry run. Nothing
+// is committed on a dry run, or when a line has errors unless SkipInvalid is
+// set, in which case only the lines without errors are.
+type CSVImportReport struct {
+	DryRun           bool
+	Committed        bool
+	Columns          map[string]string
+	Lines            int
+	CustomersCreated int
+	CustomersUpdated int
+	CarsCreated      int
+	CarsUpdated      int
+	ServicesCreated  int
+	Changes          []CSVImportChange
+	Errors           []CSVImportError
+}
+
+//a header as it is compared against the known ones
+func csvHeaderKey(header string) string {
+	var key strings.Builder
+	for _, c := range strings.ToLower(header) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			key.WriteRune(c)
+		}
+	}
+	return key.String()
+}
+
+//reads a spreadsheet saved as CSV, separated by commas, semicolons or tabs
+//as Excel writes them depending on the locale
+func readCSV(r io.Reader) ([][]string, error) {
+	buffered := bufio.NewReader(r)
+	first, err := buffered.Peek(4096)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	if i := bytes.IndexByte(first, '\n'); i >= 0 {
+		first = first[:i]
+	}
+
+	reader := csv.NewReader(buffered)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+	for _, separator := range []rune{';', '\t'} {
+		if bytes.Count(first, []byte(string(separator))) > bytes.Count(first, []byte(",")) {
+			reader.Comma = separator
+		}
+	}
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) > 0 && len(records[0]) > 0 {
+		records[0][0] = strings.TrimPrefix(records[0][0], "\ufeff")
+	}
+	return records, nil
+}
+
+//which column each field comes from, by the mapping first and the header
+//names after that
+func mapCSVColumns(header []string, mapping map[string]string) (map[string]int, error) {
+	known := map[string]bool{}
+	for _, f := range csvImportFields {
+		known[f.Field] = true
+	}
+	byKey := map[string]int{}
+	for i, h := range header {
+		if _, ok := byKey[csvHeaderKey(h)]; !ok {
+			byKey[csvHeaderKey(h)] = i
+		}
+	}
+
+	columns := map[string]int{}
+	for field, h := range mapping {
+		if !known[field] {
+			return nil, fmt.Errorf("unknown field %q in the mapping", field)
+		}
+		i, ok := byKey[csvHeaderKey(h)]
+		if !ok {
+			return nil, fmt.Errorf("the spreadsheet has no %q column for %s", h, field)
+		}
+		columns[field] = i
+	}
+	for _, f := range csvImportFields {
+		if _, ok := columns[f.Field]; ok {
+			continue
+		}
+		for _, h := range f.Headers {
+			if i, ok := byKey[h]; ok {
+				columns[f.Field] = i
+				break
+			}
+		}
+	}
+	if _, ok := columns["Phone"]; !ok {
+		if _, ok := columns["VinNumber"]; !ok {
+			return nil, errors.New("the spreadsheet needs a Phone or a VinNumber column to match customers")
+		}
+	}
+	return columns, nil
+}
+
+//the digits of a phone number as contact points store them
+func normalizeImportPhone(phone string) (string, error) {
+	digits := normalizeContactValue(ContactMobile, phone)
+	if digits != "" && len(digits) < 7 {
+		return "", fmt.Errorf("%q is not a phone number", phone)
+	}
+	return digits, nil
+}
+
+//the first and last name of a line, split from a single Name column when
+//the spreadsheet doesn't have them apart
+func csvRowName(row map[string]string) (string, string) {
+	first, last := row["FirstName"], row["LastName"]
+	if first == "" && last == "" {
+		name := strings.Fields(row["Name"])
+		if len(name) > 0 {
+			first = strings.Join(name[:len(name)-1], " ")
+			last = name[len(name)-1]
+			if first == "" {
+				first, last = last, ""
+			}
+		}
+	}
+	return first, last
+}
+
+//fills in the fields of an existing row that are empty, the spreadsheet
+//never overwrites what the shop already has
+func fillBlanks(current map[string]string, from map[string]string) map[string]interface{} {
+	updates := map[string]interface{}{}
+	for column, value := range from {
+		if strings.TrimSpace(current[column]) == "" && value != "" {
+			updates[column] = value
+		}
+	}
+	return updates
+}
+
+//describes the columns an update fills in
+func describeUpdates(updates map[string]interface{}) string {
+	var parts []string
+	for _, f := range []string{"first_name", "last_name", "make", "modelo", "color"} {
+		if value, ok := updates[f]; ok {
+			parts = append(parts, fmt.Sprintf("%s=%v", f, value))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+//imports one line: finds or creates its customer, then its car, then adds
+//its service notes to the car's history
+func importCSVRow(tx *gorm.DB, line int, row map[string]string, dryRun bool) ([]CSVImportChange, error) {
+	var changes []CSVImportChange
+	created := func(entity string, id uint, detail string) {
+		if dryRun {
+			id = 0
+		}
+		changes = append(changes, CSVImportChange{Line: line, Action: "create", Entity: entity, Id: id, Detail: detail})
+	}
+
+	phone, err := normalizeImportPhone(row["Phone"])
+	if err != nil {
+		return nil, err
+	}
+	first, last := csvRowName(row)
+	car := Car{Make: row["Make"], Modelo: row["Modelo"], Color: row["Color"], VinNumber: row["VinNumber"]}
+	if err := normalizeCar(&car); err != nil {
+		return nil, err
+	}
+	hasCar := car.Make != "" || car.Modelo != "" || car.Color != "" || car.VinNumber != ""
+	if row["Notes"] != "" && !hasCar {
+		return nil, errors.New("service notes need a car on the same line")
+	}
+
+	var existingCar Car
+	carFound := car.VinNumber != "" && !tx.Where("vin_number = ?", car.VinNumber).First(&existingCar).RecordNotFound()
+
+	//the customer is the one with the phone, or the owner of the VIN
+	var customer Customer
+	customerFound := false
+	if phone != "" {
+		matches := findCustomersByPhone(tx, phone)
+		if len(matches) > 1 {
+			return nil, fmt.Errorf("phone %s belongs to %d customers", phone, len(matches))
+		}
+		if len(matches) == 1 {
+			customer, customerFound = matches[0], true
+		}
+	}
+	if !customerFound && carFound {
+		customerFound = !tx.First(&customer, existingCar.CustomerId).RecordNotFound()
+	}
+	if customerFound && carFound && existingCar.CustomerId != customer.ID {
+		return nil, fmt.Errorf("VIN %s belongs to customer %d, not to the customer with phone %s", car.VinNumber, existingCar.CustomerId, phone)
+	}
+
+	if !customerFound {
+		if phone == "" {
+			return nil, errors.New("a Phone is needed to create a customer")
+		}
+		if first == "" && last == "" {
+			return nil, errors.New("a name is needed to create a customer")
+		}
+		customer = Customer{FirstName: first, LastName: last, Phone: phone}
+		if err := normalizeCustomer(&customer); err != nil {
+			return nil, err
+		}
+		if err := tx.Create(&customer).Error; err != nil {
+			return nil, err
+		}
+		if err := adoptLegacyContacts(tx, &customer); err != nil {
+			return nil, err
+		}
+		created("customer", customer.ID, strings.TrimSpace(first+" "+last))
+	} else {
+		updates := fillBlanks(map[string]string{"first_name": customer.FirstName, "last_name": customer.LastName},
+			map[string]string{"first_name": first, "last_name": last})
+		if len(updates) > 0 {
+			if err := tx.Model(&customer).Updates(updates).Error; err != nil {
+				return nil, err
+			}
+			changes = append(changes, CSVImportChange{Line: line, Action: "update", Entity: "customer", Id: customer.ID, Detail: describeUpdates(updates)})
+		}
+	}
+	if !hasCar {
+		return changes, nil
+	}
+
+	//without a VIN the customer's car of the same model, and make when the
+	//line has one, is the one
+	if !carFound && car.VinNumber == "" && car.Modelo != "" {
+		query := tx.Where("customer_id = ? AND LOWER(modelo) = ?", customer.ID, strings.ToLower(car.Modelo))
+		if car.Make != "" {
+			query = query.Where("LOWER(make) = ?", strings.ToLower(car.Make))
+		}
+		carFound = !query.Order("id").First(&existingCar).RecordNotFound()
+	}
+	if carFound {
+		updates := fillBlanks(map[string]string{"make": existingCar.Make, "modelo": existingCar.Modelo, "color": existingCar.Color},
+			map[string]string{"make": car.Make, "modelo": car.Modelo, "color": car.Color})
+		if len(updates) > 0 {
+			if err := tx.Model(&existingCar).Updates(updates).Error; err != nil {
+				return nil, err
+			}
+			changes = append(changes, CSVImportChange{Line: line, Action: "update", Entity: "car", Id: existingCar.ID, Detail: describeUpdates(updates)})
+		}
+		car = existingCar
+	} else {
+		car.CustomerId = customer.ID
+		if err := tx.Create(&car).Error; err != nil {
+			return nil, err
+		}
+		if err := startOwnership(tx, car); err != nil {
+			return nil, err
+		}
+		created("car", car.ID, strings.TrimSpace(car.Make+" "+car.Modelo+" "+car.VinNumber))
+	}
+
+	//notes already in the car's history aren't added again
+	if row["Notes"] != "" {
+		var count int
+		tx.Model(&Service{}).Where("car_id = ? AND comment = ?", car.ID, row["Notes"]).Count(&count)
+		if count == 0 {
+			service := Service{CarId: car.ID, Comment: row["Notes"], Status: ServiceCompleted}
+			if row["ServiceDate"] != "" {
+				date, err := parseCSVDate(row["ServiceDate"])
+				if err != nil {
+					return nil, err
+				}
+				service.CreatedAt = date
+			}
+			if err := tx.Create(&service).Error; err != nil {
+				return nil, err
+			}
+			//a car that never changed hands was owned since its oldest service
+			var ownerships []CarOwnership
+			tx.Where("car_id = ?", car.ID).Find(&ownerships)
+			if len(ownerships) == 1 && service.CreatedAt.Before(ownerships[0].StartedAt) {
+				if err := tx.Model(&ownerships[0]).Update("started_at", service.CreatedAt).Error; err != nil {
+					return nil, err
+				}
+			}
+			created("service", service.ID, row["Notes"])
+		}
+	}
+	return changes, nil
+}
+
+//a service date in any of the layouts spreadsheets use
+func parseCSVDate(value string) (time.Time, error) {
+	for _, layout := range csvDateLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a date", value)
+}
+
+//imports a spreadsheet in one transaction. Each line runs in a savepoint so
+//a line that fails leaves nothing behind and the rest can still go in.
+func importCSV(conn *gorm.DB, r io.Reader, options CSVImportOptions) (CSVImportReport, error) {
+	report := CSVImportReport{DryRun: options.DryRun, Columns: map[string]string{}, Changes: []CSVImportChange{}, Errors: []CSVImportError{}}
+	records, err := readCSV(r)
+	if err != nil {
+		return report, err
+	}
+	if len(records) == 0 {
+		return report, errors.New("the spreadsheet is empty")
+	}
+	columns, err := mapCSVColumns(records[0], options.Mapping)
+	if err != nil {
+		return report, err
+	}
+	for field, i := range columns {
+		report.Columns[field] = records[0][i]
+	}
+
+	err = conn.Transaction(func(tx *gorm.DB) error {
+		for i, record := range records[1:] {
+			line := i + 2
+			row := map[string]string{}
+			blank := true
+			for field, column := range columns {
+				if column < len(record) {
+					row[field] = strings.TrimSpace(record[column])
+					blank = blank && row[field] == ""
+				}
+			}
+			if blank {
+				continue
+			}
+			report.Lines++
+
+			if err := tx.Exec(`SAVEPOINT csv_line`).Error; err != nil {
+				return err
+			}
+			changes, err := importCSVRow(tx, line, row, options.DryRun)
+			if err != nil {
+				if err := tx.Exec(`ROLLBACK TO SAVEPOINT csv_line`).Error; err != nil {
+					return err
+				}
+				report.Errors = append(report.Errors, CSVImportError{Line: line, Error: err.Error()})
+				continue
+			}
+			if err := tx.Exec(`RELEASE SAVEPOINT csv_line`).Error; err != nil {
+				return err
+			}
+			report.Changes = append(report.Changes, changes...)
+		}
+		if options.DryRun || (len(report.Errors) > 0 && !options.SkipInvalid) {
+			return errCSVRollback
+		}
+		return nil
+	})
+	if err != nil && err != errCSVRollback {
+		return report, err
+	}
+	report.Committed = err == nil
+
+	for _, change := range report.Changes {
+		switch change.Action + " " + change.Entity {
+		case "create customer":
+			report.CustomersCreated++
+		case "update customer":
+			report.CustomersUpdated++
+		case "create car":
+			report.CarsCreated++
+		case "update car":
+			report.CarsUpdated++
+		case "create service":
+			report.ServicesCreated++
+		}
+	}
+	return report, nil
+}
+
+//repeatable -map Field=Header flags
+type csvMappingFlag map[string]string
+
+func (m csvMappingFlag) String() string { return fmt.Sprint(map[string]string(m)) }
+
+func (m csvMappingFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("%q should be Field=Header", value)
+	}
+	m[parts[0]] = parts[1]
+	return nil
+}
+
+//mecanica-service import-csv [-dry-run] [-skip-invalid] [-map Field=Header]... <file>
+func runImportCSVCommand(args []string) error {
+	mapping := csvMappingFlag{}
+	flags := flag.NewFlagSet("import-csv", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "report what would change without saving anything")
+	skipInvalid := flags.Bool("skip-invalid", false, "save the lines without errors even when others have them")
+	flags.Var(mapping, "map", "map a field to a column header, e.g. -map Phone=\"Cell Phone\"")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: import-csv [-dry-run] [-skip-invalid] [-map Field=Header]... <file>")
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	report, err := importCSV(db, f, CSVImportOptions{DryRun: *dryRun, SkipInvalid: *skipInvalid, Mapping: mapping})
+	if err != nil {
+		return err
+	}
+
+	for _, change := range report.Changes {
+		fmt.Printf("line %d: %s %s %s\n", change.Line, change.Action, change.Entity, change.Detail)
+	}
+	for _, e := range report.Errors {
+		fmt.Printf("line %d: error: %s\n", e.Line, e.Error)
+	}
+	fmt.Printf("%d lines: %d customers created, %d updated, %d cars created, %d updated, %d services created, %d errors\n",
+		report.Lines, report.CustomersCreated, report.CustomersUpdated, report.CarsCreated, report.CarsUpdated, report.ServicesCreated, len(report.Errors))
+	switch {
+	case report.Committed:
+		fmt.Println("committed")
+	case report.DryRun:
+		fmt.Println("dry run, nothing was saved")
+	default:
+		return errors.New("nothing was saved because of the errors, fix them or use -skip-invalid")
+	}
+	return nil
+}
+
+//import a CSV spreadsheet uploaded as "file". Form values: dry_run,
+//skip_invalid and mapping, a JSON object of fields to column headers.
+func importCSVHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 32<<20)
+	f, _, err := r.FormFile("file")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("upload the spreadsheet as file: %v", err))
+		return
+	}
+	defer f.Close()
+
+	options := CSVImportOptions{
+		DryRun:      r.FormValue("dry_run") == "true" || r.FormValue("dry_run") == "1",
+		SkipInvalid: r.FormValue("skip_invalid") == "true" || r.FormValue("skip_invalid") == "1",
+	}
+	if mapping := r.FormValue("mapping"); mapping != "" {
+		if err := json.Unmarshal([]byte(mapping), &options.Mapping); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("mapping: %v", err))
+			return
+		}
+	}
+
+	report, err := importCSV(shopDB(r), f, options)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !report.Committed && !report.DryRun {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(&report)
+}
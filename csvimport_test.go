@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestImportMatchesPhonesWrittenWithTheCountryCode(t *testing.T) {
+	tx := setupTestDB(t)
+	customer := Customer{FirstName: "Ana", LastName: "Ruiz", Phone: "+1 555 123 4567"}
+	if err := tx.Create(&customer).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := adoptLegacyContacts(tx, &customer); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, phone := range []string{"1-555-123-4567", "(555) 123-4567", "555.123.4567"} {
+		report, err := importCSV(tx, strings.NewReader("Name,Phone\nAna Ruiz,"+phone+"\n"), CSVImportOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.CustomersCreated != 0 {
+			t.Fatalf("%s: created %d customers, want the existing one matched", phone, report.CustomersCreated)
+		}
+	}
+	var count int
+	tx.Model(&Customer{}).Count(&count)
+	if count != 1 {
+		t.Fatalf("%d customers, want 1", count)
+	}
+	if found := findCustomersByPhone(tx, "15551234567"); len(found) != 1 || found[0].ID != customer.ID {
+		t.Fatalf("looking the phone up found %d customers", len(found))
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+//the read replica from READ_DATABASE_URL, nil when there isn't one
+var replica *gorm.DB
+
+//clients that wrote recently read from the primary until their window ends
+var recentWriters = &writeTracker{until: map[string]time.Time{}}
+
+//a duration from the environment, fallback when it isn't set or valid
+func envDuration(name string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(name)); err == nil && d >= 0 {
+		return d
+	}
+	return fallback
+}
+
+//a number from the environment, fallback when it isn't set or valid
+func envInt(name string, fallback int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n >= 0 {
+		return n
+	}
+	return fallback
+}
+
+//opens the database, retrying with exponential backoff while it is still
+//starting up, for at most DB_CONNECT_TIMEOUT (1m by default)
+func connectDatabase(dialect, url string) (*gorm.DB, error) {
+	deadline := time.Now().Add(envDuration("DB_CONNECT_TIMEOUT", time.Minute))
+	wait := 250 * time.Millisecond
+	for {
+		conn, err := openDatabase(dialect, url)
+		if err == nil {
+			configurePool(conn)
+			return conn, nil
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return nil, err
+		}
+		log.Printf("database isn't ready (%v), retrying in %s", err, wait)
+		time.Sleep(wait)
+		if wait *= 2; wait > 8*time.Second {
+			wait = 8 * time.Second
+		}
+	}
+}
+
+//applies DB_MAX_OPEN_CONNS, DB_MAX_IDLE_CONNS, DB_CONN_MAX_LIFETIME and
+//DB_CONN_MAX_IDLE_TIME. SQLite keeps its single connection.
+func configurePool(conn *gorm.DB) {
+	if isSQLite(conn) {
+		return
+	}
+	pool := conn.DB()
+	pool.SetMaxOpenConns(envInt("DB_MAX_OPEN_CONNS", 20))
+	pool.SetMaxIdleConns(envInt("DB_MAX_IDLE_CONNS", 5))
+	pool.SetConnMaxLifetime(envDuration("DB_CONN_MAX_LIFETIME", 30*time.Minute))
+	pool.SetConnMaxIdleTime(envDuration("DB_CONN_MAX_IDLE_TIME", 5*time.Minute))
+}
+
+//connects to READ_DATABASE_URL when it is set. Without a replica, or when it
+//can't be reached, everything reads from the primary.
+func connectReplica(dialect string) *gorm.DB {
+	url := os.Getenv("READ_DATABASE_URL")
+	if url == "" {
+		return nil
+	}
+	if isSQLite(db) {
+		log.Println("READ_DATABASE_URL is ignored with SQLite")
+		return nil
+	}
+	conn, err := connectDatabase(dialect, withShopSetting(dialect, url, mainShopSetting()))
+	if err != nil {
+		log.Printf("read replica unavailable, reading from the primary: %v", err)
+		return nil
+	}
+	recentWriters.window = envDuration("DB_READ_STICKY_WINDOW", 5*time.Second)
+	return conn
+}
+
+//who made a request, the first X-Forwarded-For address behind a proxy
+func clientKey(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+//remembers which clients wrote within the last window
+type writeTracker struct {
+	mu     sync.Mutex
+	window time.Duration
+	until  map[string]time.Time
+}
+
+func (t *writeTracker) mark(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	//forget clients whose window is over now and then
+	if len(t.until) > 1024 {
+		for k, until := range t.until {
+			if now.After(until) {
+				delete(t.until, k)
+			}
+		}
+	}
+	t.until[key] = now.Add(t.window)
+}
+
+func (t *writeTracker) recent(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Now().Before(t.until[key])
+}
+
+//marks the client of every write so its next reads see what it wrote. The
+//mark is made before the write starts and renewed once it has committed.
+func trackWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := clientKey(r)
+		recentWriters.mark(key)
+		next.ServeHTTP(w, r)
+		recentWriters.mark(key)
+	})
+}
+
+//the database read-only handlers query: the shop's replica, unless the
+//client wrote something within the sticky window and the replica may lag
+//behind
+func readDB(r *http.Request) *gorm.DB {
+	replica := shopReplica(r)
+	if replica == nil || recentWriters.recent(clientKey(r)) {
+		return shopDB(r)
+	}
+	return replica
+}
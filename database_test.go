@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestReadsGoToTheReplicaUnlessTheClientJustWrote(t *testing.T) {
+	lagging := setupTestDB(t)
+	lagging.Create(&Customer{FirstName: "Replica"})
+	setupTestDB(t)
+	previousReplica, previousWriters := replica, recentWriters
+	replica, recentWriters = lagging, &writeTracker{window: time.Minute, until: map[string]time.Time{}}
+	defer func() { replica, recentWriters = previousReplica, previousWriters }()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/customers", getCustomers).Methods("GET")
+	router.HandleFunc("/create/customer", createCustomer).Methods("POST")
+	handler := trackWrites(router)
+	customers := func(client string) []string {
+		req := httptest.NewRequest("GET", "/customers", nil)
+		req.Header.Set("X-Forwarded-For", client+", 10.0.0.1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		var found []Customer
+		json.NewDecoder(w.Body).Decode(&found)
+		names := []string{}
+		for _, customer := range found {
+			names = append(names, customer.FirstName)
+		}
+		return names
+	}
+
+	if names := customers("203.0.113.7"); strings.Join(names, ",") != "Replica" {
+		t.Errorf("read %v before writing, want the replica", names)
+	}
+	req := httptest.NewRequest("POST", "/create/customer", strings.NewReader(`{"FirstName": "Ana"}`))
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if names := customers("203.0.113.7"); strings.Join(names, ",") != "Ana" {
+		t.Errorf("read %v right after writing, want the primary", names)
+	}
+	if names := customers("198.51.100.2"); strings.Join(names, ",") != "Replica" {
+		t.Errorf("another client read %v, want the replica", names)
+	}
+
+	recentWriters.window = 0
+	recentWriters.mark("203.0.113.7")
+	if names := customers("203.0.113.7"); strings.Join(names, ",") != "Replica" {
+		t.Errorf("read %v once the window was over, want the replica", names)
+	}
+}
+
+func TestConnectingGivesUpAtTheTimeout(t *testing.T) {
+	setenv(t, "DB_CONNECT_TIMEOUT", "300ms")
+	start := time.Now()
+	if _, err := connectDatabase("sqlite", "/nonexistent/dir/mecanica.db"); err == nil {
+		t.Fatal("connected to a database that can't exist")
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("gave up after %s, want one retry within the timeout", elapsed)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+//the databases the service runs on, DIALECT=sqlite works as well
+const (
+	DialectPostgres = "postgres"
+	DialectSQLite   = "sqlite3"
+)
+
+//where a SQLite database is kept when DATABASE_URL is empty
+const defaultSQLiteFile = "mecanica.db"
+
+//opens the database DIALECT names. For SQLite the url is a file path or
+//:memory: for a database that lasts as long as the process. Updates and
+//deletes without a WHERE clause are refused: a model whose id was never
+//loaded would otherwise hit every row.
+func openDatabase(dialect, url string) (*gorm.DB, error) {
+	switch strings.ToLower(strings.TrimSpace(dialect)) {
+	case DialectPostgres:
+		conn, err := gorm.Open(DialectPostgres, url)
+		if err != nil {
+			return nil, err
+		}
+		return conn.BlockGlobalUpdate(true), nil
+	case "sqlite", DialectSQLite:
+		if url == "" {
+			url = defaultSQLiteFile
+		}
+		conn, err := gorm.Open(DialectSQLite, withForeignKeys(url))
+		if err != nil {
+			return nil, err
+		}
+		//SQLite writes one transaction at a time, and every connection to
+		//:memory: would be a database of its own
+		conn.DB().SetMaxOpenConns(1)
+		conn.DB().SetConnMaxLifetime(0)
+		return conn.BlockGlobalUpdate(true), nil
+	}
+	return nil, fmt.Errorf("DIALECT %q isn't supported, use %s or sqlite", dialect, DialectPostgres)
+}
+
+//SQLite leaves foreign keys unchecked unless every connection asks for them
+func withForeignKeys(url string) string {
+	if strings.Contains(url, "_foreign_keys=") || strings.Contains(url, "_fk=") {
+		return url
+	}
+	if strings.Contains(url, "?") {
+		return url + "&_foreign_keys=1"
+	}
+	return url + "?_foreign_keys=1"
+}
+
+//whether tx talks to SQLite rather than postgres
+func isSQLite(tx *gorm.DB) bool {
+	return tx.Dialect().GetName() == DialectSQLite
+}
+
+//whether a SQLite url is a database in memory, which starts empty every time
+func sqliteInMemory(url string) bool {
+	return url == ":memory:" || strings.HasPrefix(url, "file::memory:") || strings.Contains(url, "mode=memory")
+}
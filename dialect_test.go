@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestSQLiteEnforcesForeignKeys(t *testing.T) {
+	tx := setupTestDB(t)
+	service := createTestService(t, tx)
+
+	if err := tx.Create(&Car{Make: "Kia", CustomerId: service.CarId + 100}).Error; err == nil {
+		t.Fatal("a car of a customer that doesn't exist was saved")
+	}
+
+	var car Car
+	if err := tx.First(&car, service.CarId).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Unscoped().Delete(&Customer{}, car.CustomerId).Error; err != nil {
+		t.Fatal(err)
+	}
+	var cars, services int
+	tx.Unscoped().Model(&Car{}).Where("id = ?", car.ID).Count(&cars)
+	tx.Unscoped().Model(&Service{}).Where("id = ?", service.ID).Count(&services)
+	if cars != 0 || services != 0 {
+		t.Fatalf("deleting the customer left %d cars and %d services", cars, services)
+	}
+}
+
+func TestWithForeignKeys(t *testing.T) {
+	cases := map[string]string{
+		"mecanica.db":              "mecanica.db?_foreign_keys=1",
+		":memory:":                 ":memory:?_foreign_keys=1",
+		"file:x.db?cache=shared":   "file:x.db?cache=shared&_foreign_keys=1",
+		"mecanica.db?_fk=0":        "mecanica.db?_fk=0",
+		"t.db?_foreign_keys=false": "t.db?_foreign_keys=false",
+	}
+	for url, want := range cases {
+		if got := withForeignKeys(url); got != want {
+			t.Errorf("withForeignKeys(%q) = %q, want %q", url, got, want)
+		}
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+//employee roles
+const (
+	RoleTechnician = "technician"
+	RoleAdvisor    = "advisor"
+)
+
+//shift end used for employees that don't have their own
+const defaultShiftEnd = "18:00"
+
+//no shift is longer than this. A punch whose next shift end is further
+//away was clocked on after the previous shift had ended.
+const maxShiftLength = 12 * time.Hour
+
+var errAlreadyClockedOn = errors.New("employee is already clocked on to a job")
+
+type Employee struct {
+	gorm.Model
+
+	FirstName string
+	LastName  string
+	Phone     string
+	Role      string
+	Active    bool
+	// ShiftEnd is the local time of day, as HH:MM, at which open punches
+	// are closed automatically
+	ShiftEnd string
+}
+
+// TimePunch is the time an employee spent on a service. An open punch has
+// no ClockOff, and the database only allows one open punch per employee.
+type TimePunch struct {
+	gorm.Model
+
+	EmployeeId uint
+	ServiceId  uint
+	ClockOn    time.Time
+	ClockOff   *time.Time
+	AutoClosed bool
+}
+
+// Hours is the length of a closed punch
+func (p TimePunch) Hours() float64 {
+	if p.ClockOff == nil {
+		return 0
+	}
+	return p.ClockOff.Sub(p.ClockOn).Hours()
+}
+
+//first shift end after t, for a shift ending at HH:MM in the shop's time zone
+func shiftEndAfter(t time.Time, shiftEnd string) (time.Time, error) {
+	if shiftEnd == "" {
+		shiftEnd = os.Getenv("SHIFT_END")
+	}
+	if shiftEnd == "" {
+		shiftEnd = defaultShiftEnd
+	}
+	clock, err := time.Parse("15:04", shiftEnd)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid shift end %q", shiftEnd)
+	}
+
+	t = t.In(shopLocation)
+	end := time.Date(t.Year(), t.Month(), t.Day(), clock.Hour(), clock.Minute(), 0, 0, shopLocation)
+	if !end.After(t) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end, nil
+}
+
+//closes punches left open past the end of the employee's shift
+func closeForgottenPunches(tx *gorm.DB, now time.Time) {
+	var punches []TimePunch
+	tx.Where("clock_off IS NULL").Find(&punches)
+
+	for _, punch := range punches {
+		var employee Employee
+		tx.First(&employee, punch.EmployeeId)
+
+		end, err := shiftEndAfter(punch.ClockOn, employee.ShiftEnd)
+		if err != nil {
+			log.Printf("time clock: employee %d: %v", employee.ID, err)
+			continue
+		}
+		if end.After(now) {
+			continue
+		}
+		//clocked on after the shift had ended, the shift end that follows is
+		//the next one. No hours are made up, the flag tells someone to put
+		//in the real ones.
+		closeAt := end
+		if end.Sub(punch.ClockOn) > maxShiftLength {
+			closeAt = punch.ClockOn
+		}
+
+		err = tx.Model(&punch).Where("clock_off IS NULL").Updates(map[string]interface{}{
+			"clock_off":   closeAt,
+			"auto_closed": true,
+		}).Error
+		if err != nil {
+			log.Printf("time clock: closing punch %d: %v", punch.ID, err)
+			continue
+		}
+		log.Printf("time clock: auto-closed punch %d for employee %d at %s", punch.ID, punch.EmployeeId, closeAt.Format(time.RFC3339))
+	}
+}
+
+//runs closeForgottenPunches every interval
+func watchForgottenPunches(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		closeForgottenPunches(jobsDB(), now)
+	}
+}
+
+//get all employees
+func getEmployees(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	query := shopDB(r).Order("last_name, first_name")
+	if role := r.URL.Query().Get("role"); role != "" {
+		query = query.Where("role = ?", role)
+	}
+
+	var employees []Employee
+	query.Find(&employees)
+	json.NewEncoder(w).Encode(&employees)
+}
+
+//get an employee
+func getEmployee(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var employee Employee
+	if shopDB(r).First(&employee, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("employee %s not found", params["id"]))
+		return
+	}
+	json.NewEncoder(w).Encode(&employee)
+}
+
+//create an employee
+func createEmployee(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	employee := Employee{Role: RoleTechnician, Active: true}
+	if err := json.NewDecoder(r.Body).Decode(&employee); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if employee.ShiftEnd != "" {
+		if _, err := shiftEndAfter(time.Now(), employee.ShiftEnd); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if err := shopDB(r).Create(&employee).Error; err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&employee)
+}
+
+//edit an employee
+func updateEmployee(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var employee Employee
+	if shopDB(r).First(&employee, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("employee %s not found", params["id"]))
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&employee); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if employee.ShiftEnd != "" {
+		if _, err := shiftEndAfter(time.Now(), employee.ShiftEnd); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if err := shopDB(r).Save(&employee).Error; err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&employee)
+}
+
+//get an employee's punches, optionally between ?from= and ?to= (YYYY-MM-DD)
+func getEmployeePunches(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	query, err := punchesBetween(shopDB(r).Where("employee_id = ?", params["id"]), r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var punches []TimePunch
+	query.Order("clock_on").Find(&punches)
+	json.NewEncoder(w).Encode(&punches)
+}
+
+//filters punches by the ?from= and ?to= dates of the request
+func punchesBetween(query *gorm.DB, r *http.Request) (*gorm.DB, error) {
+	if from := r.URL.Query().Get("from"); from != "" {
+		t, err := time.ParseInLocation("2006-01-02", from, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid from date %q", from)
+		}
+		query = query.Where("clock_on >= ?", t)
+	}
+	if to := r.URL.Query().Get("to"); to != "" {
+		t, err := time.ParseInLocation("2006-01-02", to, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid to date %q", to)
+		}
+		query = query.Where("clock_on < ?", t.AddDate(0, 0, 1))
+	}
+	return query, nil
+}
+
+//assign a service to a technician
+func assignService(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var service Service
+	if shopDB(r).First(&service, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("service %s not found", params["id"]))
+		return
+	}
+
+	var assignment struct {
+		TechnicianId *uint
+	}
+	if err := json.NewDecoder(r.Body).Decode(&assignment); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if assignment.TechnicianId != nil {
+		var employee Employee
+		if shopDB(r).First(&employee, *assignment.TechnicianId).RecordNotFound() {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("employee %d not found", *assignment.TechnicianId))
+			return
+		}
+	}
+
+	service.TechnicianId = assignment.TechnicianId
+	if err := shopDB(r).Model(&service).Update("technician_id", assignment.TechnicianId).Error; err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&service)
+}
+
+//clock an employee on to a service
+func clockOn(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var service Service
+	if shopDB(r).First(&service, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("service %s not found", params["id"]))
+		return
+	}
+	if service.Status == ServiceCompleted {
+		writeError(w, http.StatusConflict, errors.New("service is already completed"))
+		return
+	}
+
+	var body struct {
+		EmployeeId uint
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var employee Employee
+	if shopDB(r).First(&employee, body.EmployeeId).RecordNotFound() {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("employee %d not found", body.EmployeeId))
+		return
+	}
+	if !employee.Active {
+		writeError(w, http.StatusConflict, errors.New("employee is not active"))
+		return
+	}
+
+	var open TimePunch
+	if !shopDB(r).Where("employee_id = ? AND clock_off IS NULL", employee.ID).First(&open).RecordNotFound() {
+		writeError(w, http.StatusConflict, fmt.Errorf("%v: service %d", errAlreadyClockedOn, open.ServiceId))
+		return
+	}
+
+	punch := TimePunch{EmployeeId: employee.ID, ServiceId: service.ID, ClockOn: time.Now()}
+	if err := shopDB(r).Create(&punch).Error; err != nil {
+		//lost a race with another clock on, the open punch index caught it
+		writeError(w, http.StatusConflict, errAlreadyClockedOn)
+		return
+	}
+	json.NewEncoder(w).Encode(&punch)
+}
+
+//clock an employee off a service
+func clockOff(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var body struct {
+		EmployeeId uint
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var punch TimePunch
+	if shopDB(r).Where("employee_id = ? AND service_id = ? AND clock_off IS NULL", body.EmployeeId, params["id"]).First(&punch).RecordNotFound() {
+		writeError(w, http.StatusConflict, errors.New("employee is not clocked on to this service"))
+		return
+	}
+
+	now := time.Now()
+	res := shopDB(r).Model(&punch).Where("clock_off IS NULL").Update("clock_off", now)
+	if res.Error != nil {
+		writeError(w, http.StatusInternalServerError, res.Error)
+		return
+	}
+	if res.RowsAffected == 0 {
+		writeError(w, http.StatusConflict, errors.New("punch was already closed"))
+		return
+	}
+	punch.ClockOff = &now
+	json.NewEncoder(w).Encode(&punch)
+}
+
+type jobTime struct {
+	ServiceId   uint
+	Comment     string
+	Status      string
+	FlatRate    float64
+	Actual      float64
+	Efficiency  float64
+	Punches     []TimePunch
+	OpenPunches int
+}
+
+//compares the clocked hours of a service to its flat-rate hours
+func serviceJobTime(tx *gorm.DB, service Service) jobTime {
+	job := jobTime{ServiceId: service.ID, Comment: service.Comment, Status: service.Status, FlatRate: service.Hours}
+	tx.Where("service_id = ?", service.ID).Order("clock_on").Find(&job.Punches)
+	for _, punch := range job.Punches {
+		if punch.ClockOff == nil {
+			job.OpenPunches++
+		}
+		job.Actual += punch.Hours()
+	}
+	if job.Actual > 0 {
+		job.Efficiency = job.FlatRate / job.Actual
+	}
+	return job
+}
+
+//get actual versus flat-rate hours for a service
+func getServiceTime(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var service Service
+	if shopDB(r).First(&service, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("service %s not found", params["id"]))
+		return
+	}
+	job := serviceJobTime(shopDB(r), service)
+	json.NewEncoder(w).Encode(&job)
+}
+
+//productivity per employee between ?from= and ?to=: clocked hours against
+//the flat-rate hours of the jobs they worked on, split by the time each
+//employee spent on the job
+func getProductivityReport(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	rdb := readDB(r)
+	query, err := punchesBetween(rdb.Where("clock_off IS NOT NULL"), r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var punches []TimePunch
+	query.Find(&punches)
+
+	type row struct {
+		EmployeeId  uint
+		Name        string
+		ActualHours float64
+		FlatRate    float64
+		Efficiency  float64
+		Jobs        int
+	}
+
+	//hours clocked per service, by everyone and by each employee
+	serviceTotals := map[uint]float64{}
+	byEmployee := map[uint]map[uint]float64{}
+	for _, punch := range punches {
+		serviceTotals[punch.ServiceId] += punch.Hours()
+		if byEmployee[punch.EmployeeId] == nil {
+			byEmployee[punch.EmployeeId] = map[uint]float64{}
+		}
+		byEmployee[punch.EmployeeId][punch.ServiceId] += punch.Hours()
+	}
+
+	report := []row{}
+	for employeeId, services := range byEmployee {
+		var employee Employee
+		rdb.Unscoped().First(&employee, employeeId)
+		line := row{EmployeeId: employeeId, Name: employee.FirstName + " " + employee.LastName, Jobs: len(services)}
+		for serviceId, hours := range services {
+			var service Service
+			rdb.Unscoped().First(&service, serviceId)
+			line.ActualHours += hours
+			if serviceTotals[serviceId] > 0 {
+				line.FlatRate += service.Hours * hours / serviceTotals[serviceId]
+			}
+		}
+		if line.ActualHours > 0 {
+			line.Efficiency = line.FlatRate / line.ActualHours
+		}
+		report = append(report, line)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Name != report[j].Name {
+			return report[i].Name < report[j].Name
+		}
+		return report[i].EmployeeId < report[j].EmployeeId
+	})
+	json.NewEncoder(w).Encode(&report)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestForgottenPunchesCloseWithinTheirShift(t *testing.T) {
+	tx := setupTestDB(t)
+	service := createTestService(t, tx)
+	day := time.Date(2026, 3, 10, 0, 0, 0, 0, time.Local)
+
+	dayShift := Employee{FirstName: "Ana", ShiftEnd: "17:00"}
+	lateStart := Employee{FirstName: "Luis", ShiftEnd: "17:00"}
+	nightShift := Employee{FirstName: "Bea", ShiftEnd: "02:00"}
+	tx.Create(&dayShift)
+	tx.Create(&lateStart)
+	tx.Create(&nightShift)
+	morning := TimePunch{EmployeeId: dayShift.ID, ServiceId: service.ID, ClockOn: day.Add(9 * time.Hour)}
+	evening := TimePunch{EmployeeId: lateStart.ID, ServiceId: service.ID, ClockOn: day.Add(19 * time.Hour)}
+	overnight := TimePunch{EmployeeId: nightShift.ID, ServiceId: service.ID, ClockOn: day.Add(18 * time.Hour)}
+	tx.Create(&morning)
+	tx.Create(&evening)
+	tx.Create(&overnight)
+
+	closeForgottenPunches(tx, day.AddDate(0, 0, 1).Add(18*time.Hour))
+
+	tx.First(&morning, morning.ID)
+	tx.First(&evening, evening.ID)
+	tx.First(&overnight, overnight.ID)
+	if overnight.ClockOff == nil || !overnight.ClockOff.Equal(day.AddDate(0, 0, 1).Add(2*time.Hour)) || overnight.Hours() != 8 {
+		t.Errorf("overnight punch closed at %v, want the 02:00 shift end", overnight.ClockOff)
+	}
+	if morning.ClockOff == nil || !morning.ClockOff.Equal(day.Add(17*time.Hour)) || !morning.AutoClosed {
+		t.Errorf("morning punch closed at %v, want the shift end", morning.ClockOff)
+	}
+	if evening.ClockOff == nil || evening.Hours() != 0 || !evening.AutoClosed {
+		t.Errorf("punch clocked on after the shift closed at %v, want its clock-on time", evening.ClockOff)
+	}
+}
+
+func TestProductivityReportIsInEmployeeOrder(t *testing.T) {
+	tx := setupTestDB(t)
+	service := createTestService(t, tx)
+	on := time.Date(2026, 3, 10, 9, 0, 0, 0, time.Local)
+	off := on.Add(2 * time.Hour)
+	for _, name := range []string{"Zoe", "Ana", "Mia", "Luis", "Bea"} {
+		employee := Employee{FirstName: name, LastName: "Diaz"}
+		tx.Create(&employee)
+		tx.Create(&TimePunch{EmployeeId: employee.ID, ServiceId: service.ID, ClockOn: on, ClockOff: &off})
+	}
+
+	w := httptest.NewRecorder()
+	getProductivityReport(w, httptest.NewRequest("GET", "/reports/productivity", nil))
+	var report []struct{ Name string }
+	json.NewDecoder(w.Body).Decode(&report)
+	want := []string{"Ana Diaz", "Bea Diaz", "Luis Diaz", "Mia Diaz", "Zoe Diaz"}
+	if len(report) != len(want) {
+		t.Fatalf("got %d rows, want %d", len(report), len(want))
+	}
+	for i := range want {
+		if report[i].Name != want[i] {
+			t.Fatalf("got %+v, want them in the order %v", report, want)
+		}
+	}
+}
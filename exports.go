@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+//the export writes out what it has every this many rows
+const csvFlushRows = 200
+
+// CSVColumn is a column a spreadsheet export can have, Expr is the SQL it is
+// read with
+type CSVColumn struct {
+	Name string
+	Expr string
+}
+
+//a kind of spreadsheet export: the rows it reads, the tables joined in to
+//flatten them and the filters the matching list endpoints take
+type csvExport struct {
+	Model   interface{}
+	Joins   []string
+	Columns []CSVColumn
+	Filter  func(query *gorm.DB, r *http.Request) (*gorm.DB, error)
+}
+
+//an owner's name as one column
+const ownerNameExpr = "TRIM(COALESCE(customers.first_name, '') || ' ' || COALESCE(customers.last_name, ''))"
+
+var csvExports = map[string]csvExport{
+	"customers": {
+		Model: &Customer{},
+		Columns: []CSVColumn{
+			{"id", "customers.id"},
+			{"created_at", "customers.created_at"},
+			{"first_name", "customers.first_name"},
+			{"last_name", "customers.last_name"},
+			{"kind", "customers.kind"},
+			{"company_name", "customers.company_name"},
+			{"tax_id", "customers.tax_id"},
+			{"billing_terms", "customers.billing_terms"},
+			{"phone", "customers.phone"},
+			{"email", "customers.email"},
+			{"preferred_language", "customers.preferred_language"},
+			{"preferred_channel", "customers.preferred_channel"},
+			{"marketing_consent", "customers.marketing_consent"},
+			{"marketing_consent_at", "customers.marketing_consent_at"},
+			{"email_opt_out", "customers.email_opt_out"},
+			{"sms_opt_out", "customers.sms_opt_out"},
+		},
+		//?phone= as on /customers
+		Filter: func(query *gorm.DB, r *http.Request) (*gorm.DB, error) {
+			if phone := r.URL.Query().Get("phone"); phone != "" {
+				query = customersWithPhone(query, phone)
+			}
+			return query, nil
+		},
+	},
+	"cars": {
+		Model: &Car{},
+		Joins: []string{"LEFT JOIN customers ON customers.id = cars.customer_id"},
+		Columns: []CSVColumn{
+			{"id", "cars.id"},
+			{"created_at", "cars.created_at"},
+			{"make", "cars.make"},
+			{"modelo", "cars.modelo"},
+			{"year", "cars.year"},
+			{"trim", "cars.trim"},
+			{"color", "cars.color"},
+			{"vin_number", "cars.vin_number"},
+			{"license_plate", "cars.license_plate"},
+			{"plate_state", "cars.plate_state"},
+			{"plate_country", "cars.plate_country"},
+			{"engine", "cars.engine"},
+			{"transmission", "cars.transmission"},
+			{"fuel_type", "cars.fuel_type"},
+			{"mileage_unit", "cars.mileage_unit"},
+			{"customer_id", "cars.customer_id"},
+			{"owner_name", ownerNameExpr},
+			{"owner_company", "customers.company_name"},
+			{"owner_phone", "customers.phone"},
+			{"owner_email", "customers.email"},
+		},
+		//?plate=, ?state= and ?country= as on /cars, ?customerId= and ?q= as
+		//on /customer/{id}/cars
+		Filter: func(query *gorm.DB, r *http.Request) (*gorm.DB, error) {
+			if plate := r.URL.Query().Get("plate"); plate != "" {
+				query = carsWithPlate(query, plate, r.URL.Query().Get("state"), r.URL.Query().Get("country"))
+			}
+			if customerId := r.URL.Query().Get("customerId"); customerId != "" {
+				query = query.Where("cars.customer_id = ?", customerId)
+			}
+			return searchCars(query, r.URL.Query().Get("q")), nil
+		},
+	},
+	"services": {
+		Model: &Service{},
+		Joins: []string{
+			"LEFT JOIN cars ON cars.id = services.car_id",
+			"LEFT JOIN customers ON customers.id = cars.customer_id",
+		},
+		Columns: []CSVColumn{
+			{"id", "services.id"},
+			{"created_at", "services.created_at"},
+			{"status", "services.status"},
+			{"comment", "services.comment"},
+			{"miles", "services.miles"},
+			{"hours", "services.hours"},
+			{"price", "services.price"},
+			{"po_number", "services.po_number"},
+			{"car_id", "services.car_id"},
+			{"car_make", "cars.make"},
+			{"car_modelo", "cars.modelo"},
+			{"car_year", "cars.year"},
+			{"car_vin", "cars.vin_number"},
+			{"car_plate", "cars.license_plate"},
+			{"customer_id", "cars.customer_id"},
+			{"owner_name", ownerNameExpr},
+			{"owner_company", "customers.company_name"},
+			{"owner_phone", "customers.phone"},
+		},
+		//?from= and ?to= as on the fleet views, ?carId=, ?customerId= and
+		//?status= (several separated by commas)
+		Filter: func(query *gorm.DB, r *http.Request) (*gorm.DB, error) {
+			query, err := servicesBetween(query, r)
+			if err != nil {
+				return nil, err
+			}
+			if carId := r.URL.Query().Get("carId"); carId != "" {
+				query = query.Where("services.car_id = ?", carId)
+			}
+			if customerId := r.URL.Query().Get("customerId"); customerId != "" {
+				query = query.Where("cars.customer_id = ?", customerId)
+			}
+			if status := r.URL.Query().Get("status"); status != "" {
+				query = query.Where("services.status IN (?)", strings.Split(status, ","))
+			}
+			return query, nil
+		},
+	},
+}
+
+//the columns picked with ?columns=, in the order asked for, or all of them
+func selectCSVColumns(export csvExport, r *http.Request) ([]CSVColumn, error) {
+	wanted := strings.TrimSpace(r.URL.Query().Get("columns"))
+	if wanted == "" {
+		return export.Columns, nil
+	}
+	byName := map[string]CSVColumn{}
+	for _, column := range export.Columns {
+		byName[column.Name] = column
+	}
+	var columns []CSVColumn
+	for _, name := range strings.Split(wanted, ",") {
+		column, ok := byName[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown column %q", strings.TrimSpace(name))
+		}
+		columns = append(columns, column)
+	}
+	return columns, nil
+}
+
+//a value read from the database as it goes in a spreadsheet cell. Text that
+//a spreadsheet would take for a formula is quoted so it stays text.
+func csvCell(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case bool:
+		return strconv.FormatBool(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []byte:
+		return csvText(string(v))
+	case string:
+		return csvText(v)
+	}
+	return csvText(fmt.Sprint(value))
+}
+
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+//download customers, cars or services as a CSV spreadsheet. Rows are written
+//as they are read from the database, ?columns= picks the columns.
+func getCSVExport(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	export, ok := csvExports[params["kind"]]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("there is no %s export", params["kind"]))
+		return
+	}
+	columns, err := selectCSVColumns(export, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	query := readDB(r).Model(export.Model)
+	for _, join := range export.Joins {
+		query = query.Joins(join)
+	}
+	if query, err = export.Filter(query, r); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	exprs := make([]string, len(columns))
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		exprs[i], header[i] = column.Expr, column.Name
+	}
+	table := query.NewScope(export.Model).TableName()
+	rows, err := query.Select(strings.Join(exprs, ", ")).Order(table + ".id").Rows()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.csv"`, params["kind"], time.Now().Format("2006-01-02")))
+	out := csv.NewWriter(w)
+	out.Write(header)
+
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	record := make([]string, len(columns))
+	written := 0
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			log.Printf("%s export: %v", params["kind"], err)
+			break
+		}
+		for i, value := range values {
+			record[i] = csvCell(value)
+		}
+		out.Write(record)
+		if written++; written%csvFlushRows == 0 {
+			out.Flush()
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("%s export: %v", params["kind"], err)
+	}
+	out.Flush()
+}
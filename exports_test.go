@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestServicesExportFlattensTheCarAndOwner(t *testing.T) {
+	tx := setupTestDB(t)
+	service := createTestService(t, tx)
+	var car Car
+	tx.First(&car, service.CarId)
+	tx.Model(&car).Update("vin_number", "1HGCM82633A004352")
+	var customer Customer
+	tx.First(&customer, car.CustomerId)
+	tx.Model(&customer).Update("last_name", "=HYPERLINK(\"x\")")
+	if err := adoptLegacyContacts(tx, &customer); err != nil {
+		t.Fatal(err)
+	}
+	tx.Create(&Service{Comment: "tires", Status: ServiceEstimate, CarId: car.ID})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/v1/exports/{kind:customers|cars|services}.csv", getCSVExport).Methods("GET")
+	export := func(path string) (int, [][]string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		records, _ := csv.NewReader(w.Body).ReadAll()
+		return w.Code, records
+	}
+
+	code, records := export("/v1/exports/services.csv?columns=id,car_vin,owner_name,status&status=open")
+	if code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	want := [][]string{
+		{"id", "car_vin", "owner_name", "status"},
+		{fmt.Sprint(service.ID), "1HGCM82633A004352", "Ana =HYPERLINK(\"x\")", ServiceOpen},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("got %q, want %q", records, want)
+	}
+
+	_, records = export("/v1/exports/customers.csv?columns=last_name&phone=(555)%20123-4567")
+	if len(records) != 2 || records[1][0] != "'=HYPERLINK(\"x\")" {
+		t.Errorf("got %q, want the customer with the formula quoted", records)
+	}
+	if code, _ := export("/v1/exports/cars.csv?columns=id,secret"); code != http.StatusBadRequest {
+		t.Errorf("an unknown column: status %d, want 400", code)
+	}
+	if code, _ := export("/v1/exports/services.csv?from=yesterday"); code != http.StatusBadRequest {
+		t.Errorf("a bad date: status %d, want 400", code)
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+//kinds of customer accounts
+const (
+	CustomerIndividual = "individual"
+	CustomerBusiness   = "business"
+)
+
+var errPONumberRequired = errors.New("this account requires a PONumber on every job")
+
+// CustomerContact is a person to talk to at a business account
+type CustomerContact struct {
+	gorm.Model
+
+	CustomerId uint `gorm:"index"`
+	Name       string
+	Role       string
+	Phone      string
+	Email      string
+	IsPrimary  bool
+}
+
+// FleetCarSpend is what was spent on one car of a fleet
+type FleetCarSpend struct {
+	CarId        uint
+	Make         string
+	Modelo       string
+	LicensePlate string
+	VinNumber    string
+	Services     int
+	Labor        float64
+	Parts        float64
+	Total        float64
+}
+
+// FleetSpend is what a business account spent across its cars
+type FleetSpend struct {
+	CustomerId  uint
+	CompanyName string
+	Cars        []FleetCarSpend
+	Labor       float64
+	Parts       float64
+	Total       float64
+}
+
+//checks the account fields of a customer before it is saved
+func normalizeCustomer(customer *Customer) error {
+	customer.Kind = strings.ToLower(strings.TrimSpace(customer.Kind))
+	if customer.Kind == "" {
+		customer.Kind = CustomerIndividual
+	}
+	switch customer.Kind {
+	case CustomerIndividual:
+		if customer.RequirePONumber {
+			return errors.New("only business accounts can require PO numbers")
+		}
+	case CustomerBusiness:
+		if strings.TrimSpace(customer.CompanyName) == "" {
+			return errors.New("CompanyName is required for business accounts")
+		}
+	default:
+		return fmt.Errorf("Kind must be %s or %s", CustomerIndividual, CustomerBusiness)
+	}
+
+	customer.PreferredLanguage = strings.ToLower(strings.TrimSpace(customer.PreferredLanguage))
+	if customer.PreferredLanguage == "" {
+		customer.PreferredLanguage = LanguageEnglish
+	}
+	if customer.PreferredLanguage != LanguageEnglish && customer.PreferredLanguage != LanguageSpanish {
+		return fmt.Errorf("PreferredLanguage must be %s or %s", LanguageEnglish, LanguageSpanish)
+	}
+	customer.PreferredChannel = strings.ToLower(strings.TrimSpace(customer.PreferredChannel))
+	if customer.PreferredChannel != "" && customer.PreferredChannel != ChannelEmail && customer.PreferredChannel != ChannelSMS {
+		return fmt.Errorf("PreferredChannel must be %s or %s", ChannelEmail, ChannelSMS)
+	}
+	return nil
+}
+
+//makes sure work on a car carries a PO number when its owner asks for one
+func checkPONumber(tx *gorm.DB, carId uint, poNumber string) error {
+	var customer Customer
+	if tx.Joins("JOIN cars ON cars.customer_id = customers.id").Where("cars.id = ?", carId).First(&customer).RecordNotFound() {
+		return nil
+	}
+	if customer.RequirePONumber && strings.TrimSpace(poNumber) == "" {
+		return errPONumberRequired
+	}
+	return nil
+}
+
+//narrows services down to the ?from= and ?to= dates of the request
+func servicesBetween(query *gorm.DB, r *http.Request) (*gorm.DB, error) {
+	if from := r.URL.Query().Get("from"); from != "" {
+		t, err := time.ParseInLocation("2006-01-02", from, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid from date %q", from)
+		}
+		query = query.Where("services.created_at >= ?", t)
+	}
+	if to := r.URL.Query().Get("to"); to != "" {
+		t, err := time.ParseInLocation("2006-01-02", to, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid to date %q", to)
+		}
+		query = query.Where("services.created_at < ?", t.AddDate(0, 0, 1))
+	}
+	return query, nil
+}
+
+//loads a business account or writes the error
+func findFleetAccount(tx *gorm.DB, w http.ResponseWriter, id string) (Customer, bool) {
+	var customer Customer
+	if tx.First(&customer, id).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("customer %s not found", id))
+		return customer, false
+	}
+	if customer.Kind != CustomerBusiness {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("customer %s isn't a business account", id))
+		return customer, false
+	}
+	return customer, true
+}
+
+//narrows services joined with their cars down to those done while the
+//customer owned the car. A car that never changed hands has no ownerships
+//and all of its services are its owner's.
+func servicesOwnedBy(query *gorm.DB, customerId uint) *gorm.DB {
+	return query.Where(`(cars.customer_id = ? AND NOT EXISTS (
+			SELECT 1 FROM car_ownerships WHERE car_ownerships.car_id = services.car_id AND car_ownerships.deleted_at IS NULL))
+		OR EXISTS (
+			SELECT 1 FROM car_ownerships WHERE car_ownerships.car_id = services.car_id AND car_ownerships.deleted_at IS NULL
+			AND car_ownerships.customer_id = ? AND services.created_at >= car_ownerships.started_at
+			AND (car_ownerships.ended_at IS NULL OR services.created_at < car_ownerships.ended_at))`,
+		customerId, customerId)
+}
+
+//get the contacts of an account
+func getCustomerContacts(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var contacts []CustomerContact
+	shopDB(r).Where("customer_id = ?", params["id"]).Order("id").Find(&contacts)
+	json.NewEncoder(w).Encode(&contacts)
+}
+
+//add a contact to an account
+func createCustomerContact(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	customer, ok := findFleetAccount(shopDB(r), w, params["id"])
+	if !ok {
+		return
+	}
+
+	var contact CustomerContact
+	if err := json.NewDecoder(r.Body).Decode(&contact); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if strings.TrimSpace(contact.Name) == "" {
+		writeError(w, http.StatusBadRequest, errors.New("Name is required"))
+		return
+	}
+	contact.ID = 0
+	contact.CustomerId = customer.ID
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		return saveContact(tx, &contact)
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&contact)
+}
+
+//saves a contact, a new primary contact takes over from the old one
+func saveContact(tx *gorm.DB, contact *CustomerContact) error {
+	if contact.IsPrimary {
+		err := tx.Model(&CustomerContact{}).Where("customer_id = ? AND id <> ?", contact.CustomerId, contact.ID).
+			Update("is_primary", false).Error
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Save(contact).Error
+}
+
+//edit a contact
+func updateCustomerContact(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var contact CustomerContact
+	if shopDB(r).First(&contact, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("contact %s not found", params["id"]))
+		return
+	}
+	id, customerId := contact.ID, contact.CustomerId
+	if err := json.NewDecoder(r.Body).Decode(&contact); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	contact.ID, contact.CustomerId = id, customerId
+
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		return saveContact(tx, &contact)
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&contact)
+}
+
+//delete a contact
+func deleteCustomerContact(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var contact CustomerContact
+	if shopDB(r).First(&contact, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("contact %s not found", params["id"]))
+		return
+	}
+	shopDB(r).Delete(&contact)
+	json.NewEncoder(w).Encode(&contact)
+}
+
+//narrows cars down to those with q in their make, model, plate or VIN
+func searchCars(query *gorm.DB, q string) *gorm.DB {
+	q = strings.TrimSpace(q)
+	if q == "" {
+		return query
+	}
+	like := "%" + strings.ToLower(q) + "%"
+	return query.Where("LOWER(cars.make) LIKE ? OR LOWER(cars.modelo) LIKE ? OR cars.license_plate LIKE ? OR cars.vin_number LIKE ?",
+		like, like, "%"+normalizePlate(q)+"%", "%"+strings.ToUpper(q)+"%")
+}
+
+//a page of an account's cars: ?limit= (default 50, at most 500), ?offset=
+//and ?q= to search make, model, plate or VIN
+func getCustomerCarRoster(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	limit, offset := 50, 0
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	if limit > 500 {
+		limit = 500
+	}
+	if n, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && n > 0 {
+		offset = n
+	}
+
+	query := searchCars(shopDB(r).Model(&Car{}).Where("customer_id = ?", params["id"]), r.URL.Query().Get("q"))
+
+	var page struct {
+		Total  int
+		Limit  int
+		Offset int
+		Cars   []Car
+	}
+	page.Limit, page.Offset = limit, offset
+	query.Count(&page.Total)
+	query.Order("id").Limit(limit).Offset(offset).Find(&page.Cars)
+	json.NewEncoder(w).Encode(&page)
+}
+
+//service history across all of an account's cars, newest first, between
+//?from= and ?to=. Services done before a car came to the account, or after
+//it left, belong to its other owners.
+func getFleetServices(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	customer, ok := findFleetAccount(shopDB(r), w, params["id"])
+	if !ok {
+		return
+	}
+	query, err := servicesBetween(servicesOwnedBy(shopDB(r).Joins("JOIN cars ON cars.id = services.car_id").
+		Where("cars.deleted_at IS NULL"), customer.ID), r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	services := []Service{}
+	query.Order("services.created_at DESC, services.id DESC").Find(&services)
+	json.NewEncoder(w).Encode(&services)
+}
+
+//labor and parts spent per car of an account between ?from= and ?to=, on
+//the cars it has and the ones it had for the time it had them. Estimates
+//that were never approved don't count.
+func getFleetSpend(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	customer, ok := findFleetAccount(shopDB(r), w, params["id"])
+	if !ok {
+		return
+	}
+	query, err := servicesBetween(servicesOwnedBy(shopDB(r).Joins("JOIN cars ON cars.id = services.car_id").
+		Where("cars.deleted_at IS NULL AND COALESCE(services.status, '') <> ?", ServiceEstimate), customer.ID), r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var services []Service
+	query.Find(&services)
+	serviceIds := []uint{}
+	for _, service := range services {
+		serviceIds = append(serviceIds, service.ID)
+	}
+	var lines []ServicePart
+	if len(serviceIds) > 0 {
+		shopDB(r).Where("service_id IN (?) AND status <> ?", serviceIds, PartLineReleased).Find(&lines)
+	}
+	partsByService := map[uint]float64{}
+	for _, line := range lines {
+		partsByService[line.ServiceId] += float64(line.Quantity) * line.Price
+	}
+
+	var cars []Car
+	carIds := []uint{}
+	for _, service := range services {
+		carIds = append(carIds, service.CarId)
+	}
+	shopDB(r).Where("customer_id = ? OR id IN (?)", customer.ID, append(carIds, 0)).Order("id").Find(&cars)
+	byCar := map[uint]*FleetCarSpend{}
+	spend := FleetSpend{CustomerId: customer.ID, CompanyName: customer.CompanyName, Cars: []FleetCarSpend{}}
+	for _, car := range cars {
+		byCar[car.ID] = &FleetCarSpend{CarId: car.ID, Make: car.Make, Modelo: car.Modelo, LicensePlate: car.LicensePlate, VinNumber: car.VinNumber}
+	}
+	for _, service := range services {
+		car, ok := byCar[service.CarId]
+		if !ok {
+			continue
+		}
+		car.Services++
+		car.Labor += service.Price
+		car.Parts += partsByService[service.ID]
+	}
+	for _, car := range cars {
+		item := byCar[car.ID]
+		item.Total = item.Labor + item.Parts
+		spend.Labor += item.Labor
+		spend.Parts += item.Parts
+		spend.Cars = append(spend.Cars, *item)
+	}
+	spend.Total = spend.Labor + spend.Parts
+	json.NewEncoder(w).Encode(&spend)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestFleetSpendCountsServicesWithoutAStatus(t *testing.T) {
+	tx := setupTestDB(t)
+	fleet := Customer{Kind: CustomerBusiness, CompanyName: "Acme Delivery"}
+	tx.Create(&fleet)
+	car := Car{Make: "Ford", Modelo: "Transit", CustomerId: fleet.ID}
+	tx.Create(&car)
+	legacy := Service{CarId: car.ID, Comment: "brakes", Price: 100}
+	tx.Create(&legacy)
+	//services from before there were statuses
+	tx.Exec("UPDATE services SET status = NULL WHERE id = ?", legacy.ID)
+	tx.Create(&Service{CarId: car.ID, Comment: "oil", Status: ServiceCompleted, Price: 50})
+	tx.Create(&Service{CarId: car.ID, Comment: "engine", Status: ServiceEstimate, Price: 999})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/fleet/{id}/spend", getFleetSpend).Methods("GET")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", fmt.Sprintf("/fleet/%d/spend", fleet.ID), nil))
+	var spend FleetSpend
+	json.NewDecoder(w.Body).Decode(&spend)
+	if w.Code != http.StatusOK || spend.Labor != 150 || len(spend.Cars) != 1 || spend.Cars[0].Services != 2 {
+		t.Fatalf("got %d %+v, want 150 of labor over 2 services", w.Code, spend)
+	}
+
+	individual := Customer{Kind: CustomerIndividual, FirstName: "Ana"}
+	tx.Create(&individual)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", fmt.Sprintf("/fleet/%d/spend", individual.ID), nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("individual customer: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
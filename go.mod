@@ -1,6 +1,6 @@
 module github.com/castillojuan1000/mecanica-service
 
-go 1.15
+go 1.16
 
 require (
 	github.com/gorilla/mux v1.8.1-0.20200912192056-d07530f46e1e
@@ -8,4 +8,5 @@ require (
 	github.com/jinzhu/inflection v1.0.1-0.20210111022912-b5281034e75e // indirect
 	github.com/joho/godotenv v1.4.1-0.20210924113850-c40e9c6392b0
 	github.com/lib/pq v1.10.0 // indirect
+	github.com/mattn/go-sqlite3 v1.14.17 // indirect
 )
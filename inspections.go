@@ -0,0 +1,485 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+//traffic-light ratings of an inspection item
+const (
+	RatingGreen  = "green"
+	RatingYellow = "yellow"
+	RatingRed    = "red"
+)
+
+//status of an inspection
+const (
+	InspectionOpen      = "open"
+	InspectionCompleted = "completed"
+)
+
+// InspectionTemplate is a configurable multi-point checklist
+type InspectionTemplate struct {
+	gorm.Model
+
+	Name     string
+	Sections []InspectionSection
+}
+
+type InspectionSection struct {
+	gorm.Model
+
+	InspectionTemplateId uint
+	Name                 string
+	Position             int
+	Items                []InspectionTemplateItem
+}
+
+type InspectionTemplateItem struct {
+	gorm.Model
+
+	InspectionSectionId uint
+	Name                string
+	Position            int
+	// Unit of the measurement taken for this item, like mm or 32nds,
+	// empty when the item is only rated
+	Unit string
+}
+
+// Inspection is a template filled in for a car on a visit
+type Inspection struct {
+	gorm.Model
+
+	CarId                uint
+	InspectionTemplateId uint
+	TechnicianId         *uint
+	Miles                string
+	Status               string
+	Results              []InspectionResult
+}
+
+// InspectionResult copies the section and item names from the template so
+// later template edits don't rewrite past inspections
+type InspectionResult struct {
+	gorm.Model
+
+	InspectionId             uint
+	InspectionTemplateItemId uint
+	Section                  string
+	Item                     string
+	Position                 int
+	Rating                   string
+	Notes                    string
+	Measurement              *float64
+	Unit                     string
+	// ServiceId is the estimate line created from this result
+	ServiceId *uint
+}
+
+//loads a template with its sections and items in order
+func findInspectionTemplate(tx *gorm.DB, id interface{}) (InspectionTemplate, bool) {
+	var template InspectionTemplate
+	if tx.First(&template, id).RecordNotFound() {
+		return template, false
+	}
+	tx.Where("inspection_template_id = ?", template.ID).Order("position, id").Find(&template.Sections)
+	for i := range template.Sections {
+		tx.Where("inspection_section_id = ?", template.Sections[i].ID).Order("position, id").Find(&template.Sections[i].Items)
+	}
+	return template, true
+}
+
+//loads an inspection with its results in order
+func findInspection(tx *gorm.DB, id interface{}) (Inspection, bool) {
+	var inspection Inspection
+	if tx.First(&inspection, id).RecordNotFound() {
+		return inspection, false
+	}
+	tx.Where("inspection_id = ?", inspection.ID).Order("position, id").Find(&inspection.Results)
+	return inspection, true
+}
+
+//inspections of a car, newest first
+func carInspections(tx *gorm.DB, carId uint) []Inspection {
+	var inspections []Inspection
+	tx.Where("car_id = ?", carId).Order("id desc").Find(&inspections)
+	for i := range inspections {
+		inspections[i], _ = findInspection(tx, inspections[i].ID)
+	}
+	return inspections
+}
+
+func validRating(rating string) bool {
+	switch rating {
+	case "", RatingGreen, RatingYellow, RatingRed:
+		return true
+	}
+	return false
+}
+
+//numbers sections and items in the order they were sent
+func positionTemplate(template *InspectionTemplate) error {
+	if template.Name == "" {
+		return errors.New("Name is required")
+	}
+	for i := range template.Sections {
+		section := &template.Sections[i]
+		if section.Name == "" {
+			return fmt.Errorf("section %d: Name is required", i)
+		}
+		section.ID = 0
+		section.Position = i
+		for j := range section.Items {
+			if section.Items[j].Name == "" {
+				return fmt.Errorf("section %q item %d: Name is required", section.Name, j)
+			}
+			section.Items[j].ID = 0
+			section.Items[j].Position = j
+		}
+	}
+	return nil
+}
+
+//get all inspection templates
+func getInspectionTemplates(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	var templates []InspectionTemplate
+	shopDB(r).Order("name").Find(&templates)
+	for i := range templates {
+		templates[i], _ = findInspectionTemplate(shopDB(r), templates[i].ID)
+	}
+	json.NewEncoder(w).Encode(&templates)
+}
+
+//get an inspection template
+func getInspectionTemplate(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	template, ok := findInspectionTemplate(shopDB(r), params["id"])
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("inspection template %s not found", params["id"]))
+		return
+	}
+	json.NewEncoder(w).Encode(&template)
+}
+
+//create an inspection template with its sections and items
+func createInspectionTemplate(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	var template InspectionTemplate
+	if err := json.NewDecoder(r.Body).Decode(&template); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := positionTemplate(&template); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := shopDB(r).Create(&template).Error; err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&template)
+}
+
+//edit an inspection template, the sections sent replace the existing ones.
+//Inspections already made keep their own copy of the items.
+func updateInspectionTemplate(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	template, ok := findInspectionTemplate(shopDB(r), params["id"])
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("inspection template %s not found", params["id"]))
+		return
+	}
+
+	var changes InspectionTemplate
+	if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := positionTemplate(&changes); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		for _, section := range template.Sections {
+			if err := tx.Where("inspection_section_id = ?", section.ID).Delete(&InspectionTemplateItem{}).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("inspection_template_id = ?", template.ID).Delete(&InspectionSection{}).Error; err != nil {
+			return err
+		}
+		template.Name = changes.Name
+		template.Sections = changes.Sections
+		return tx.Save(&template).Error
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&template)
+}
+
+//start an inspection of a car from a template
+func createInspection(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var car Car
+	if shopDB(r).First(&car, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("car %s not found", params["id"]))
+		return
+	}
+
+	var inspection Inspection
+	if err := json.NewDecoder(r.Body).Decode(&inspection); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	template, ok := findInspectionTemplate(shopDB(r), inspection.InspectionTemplateId)
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("inspection template %d not found", inspection.InspectionTemplateId))
+		return
+	}
+
+	inspection.CarId = car.ID
+	inspection.Status = InspectionOpen
+	inspection.Results = nil
+	position := 0
+	for _, section := range template.Sections {
+		for _, item := range section.Items {
+			inspection.Results = append(inspection.Results, InspectionResult{
+				InspectionTemplateItemId: item.ID,
+				Section:                  section.Name,
+				Item:                     item.Name,
+				Position:                 position,
+				Unit:                     item.Unit,
+			})
+			position++
+		}
+	}
+
+	if err := shopDB(r).Create(&inspection).Error; err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&inspection)
+}
+
+//get an inspection
+func getInspection(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	inspection, ok := findInspection(shopDB(r), params["id"])
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("inspection %s not found", params["id"]))
+		return
+	}
+	json.NewEncoder(w).Encode(&inspection)
+}
+
+//rate an item of an inspection
+func updateInspectionResult(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var inspection Inspection
+	if shopDB(r).First(&inspection, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("inspection %s not found", params["id"]))
+		return
+	}
+	if inspection.Status == InspectionCompleted {
+		writeError(w, http.StatusConflict, errors.New("inspection is already completed"))
+		return
+	}
+
+	var result InspectionResult
+	if shopDB(r).Where("id = ? AND inspection_id = ?", params["resultId"], inspection.ID).First(&result).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("inspection result %s not found", params["resultId"]))
+		return
+	}
+
+	var rating struct {
+		Rating      string
+		Notes       string
+		Measurement *float64
+	}
+	if err := json.NewDecoder(r.Body).Decode(&rating); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	rating.Rating = strings.ToLower(rating.Rating)
+	if !validRating(rating.Rating) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Rating must be %s, %s or %s", RatingGreen, RatingYellow, RatingRed))
+		return
+	}
+
+	result.Rating = rating.Rating
+	result.Notes = rating.Notes
+	result.Measurement = rating.Measurement
+	if err := shopDB(r).Save(&result).Error; err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&result)
+}
+
+//complete an inspection, every item has to be rated
+func completeInspection(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	inspection, ok := findInspection(shopDB(r), params["id"])
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("inspection %s not found", params["id"]))
+		return
+	}
+	for _, result := range inspection.Results {
+		if result.Rating == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("%s - %s is not rated", result.Section, result.Item))
+			return
+		}
+	}
+
+	inspection.Status = InspectionCompleted
+	if err := shopDB(r).Model(&inspection).Update("status", inspection.Status).Error; err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&inspection)
+}
+
+//turn the red and yellow items of an inspection into estimate lines on the
+//car. Items already on an estimate are skipped, so this can be called again
+//after more items are rated. The body may narrow it down to some ratings,
+//e.g. {"Ratings": ["red"]}.
+func createInspectionEstimate(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	inspection, ok := findInspection(shopDB(r), params["id"])
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("inspection %s not found", params["id"]))
+		return
+	}
+
+	body := struct {
+		Ratings []string
+	}{Ratings: []string{RatingRed, RatingYellow}}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	wanted := map[string]bool{}
+	for _, rating := range body.Ratings {
+		wanted[strings.ToLower(rating)] = true
+	}
+
+	var services []Service
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		for i := range inspection.Results {
+			result := &inspection.Results[i]
+			if result.ServiceId != nil || result.Rating == "" || !wanted[result.Rating] {
+				continue
+			}
+
+			comment := fmt.Sprintf("%s - %s (%s)", result.Section, result.Item, result.Rating)
+			if result.Notes != "" {
+				comment += ": " + result.Notes
+			}
+			service := Service{
+				CarId:        inspection.CarId,
+				Comment:      comment,
+				Miles:        inspection.Miles,
+				Status:       ServiceEstimate,
+				TechnicianId: inspection.TechnicianId,
+			}
+			if err := tx.Create(&service).Error; err != nil {
+				return err
+			}
+			result.ServiceId = &service.ID
+			if err := tx.Model(result).Update("service_id", service.ID).Error; err != nil {
+				return err
+			}
+			services = append(services, service)
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if len(services) > 0 {
+		var car Car
+		if !shopDB(r).First(&car, inspection.CarId).RecordNotFound() {
+			notifyCarOwner(shopDB(r), EventEstimateApproval, car, services)
+		}
+	}
+	json.NewEncoder(w).Encode(&services)
+}
+
+//approve an estimate line so work can start on it
+func approveService(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var service Service
+	if shopDB(r).First(&service, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("service %s not found", params["id"]))
+		return
+	}
+	if service.Status != ServiceEstimate {
+		writeError(w, http.StatusConflict, fmt.Errorf("service is %s, not an estimate", service.Status))
+		return
+	}
+
+	service.Status = ServiceOpen
+	if err := shopDB(r).Model(&service).Update("status", service.Status).Error; err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&service)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRedAndYellowItemsBecomeEstimateLinesOnce(t *testing.T) {
+	tx := setupTestDB(t)
+	service := createTestService(t, tx)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/create/inspection/template", createInspectionTemplate).Methods("POST")
+	router.HandleFunc("/car/{id}/inspections", createInspection).Methods("POST")
+	router.HandleFunc("/inspection/{id}/result/{resultId}", updateInspectionResult).Methods("PUT")
+	router.HandleFunc("/inspection/{id}/estimate", createInspectionEstimate).Methods("POST")
+	router.HandleFunc("/complete/inspection/{id}", completeInspection).Methods("PUT")
+	send := func(method, path, body string, into interface{}) int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		if into != nil && w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(into); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code
+	}
+
+	var template InspectionTemplate
+	code := send("POST", "/create/inspection/template", `{"Name": "Multi-point", "Sections": [
+		{"Name": "Brakes", "Items": [{"Name": "Front pads", "Unit": "mm"}, {"Name": "Rear pads", "Unit": "mm"}]},
+		{"Name": "Tires", "Items": [{"Name": "Tread", "Unit": "32nds"}]}]}`, &template)
+	if code != http.StatusOK {
+		t.Fatalf("creating the template: status %d", code)
+	}
+	var inspection Inspection
+	code = send("POST", fmt.Sprintf("/car/%d/inspections", service.CarId), fmt.Sprintf(`{"InspectionTemplateId": %d, "Miles": "42000"}`, template.ID), &inspection)
+	if code != http.StatusOK || len(inspection.Results) != 3 {
+		t.Fatalf("status %d and %d results, want 3 results", code, len(inspection.Results))
+	}
+	if inspection.Results[0].Section != "Brakes" || inspection.Results[0].Item != "Front pads" || inspection.Results[0].Unit != "mm" {
+		t.Errorf("first result %+v, want the front pads in mm", inspection.Results[0])
+	}
+
+	rate := func(result InspectionResult, body string) int {
+		return send("PUT", fmt.Sprintf("/inspection/%d/result/%d", inspection.ID, result.ID), body, nil)
+	}
+	if code := rate(inspection.Results[0], `{"Rating": "purple"}`); code != http.StatusBadRequest {
+		t.Errorf("an unknown rating: status %d, want 400", code)
+	}
+	rate(inspection.Results[0], `{"Rating": "Red", "Notes": "metal on metal", "Measurement": 1.5}`)
+	rate(inspection.Results[1], `{"Rating": "green", "Measurement": 7}`)
+	if code := send("PUT", fmt.Sprintf("/complete/inspection/%d", inspection.ID), "", nil); code != http.StatusBadRequest {
+		t.Errorf("completing with an item not rated: status %d, want 400", code)
+	}
+	rate(inspection.Results[2], `{"Rating": "yellow", "Measurement": 4}`)
+
+	var estimate []Service
+	send("POST", fmt.Sprintf("/inspection/%d/estimate", inspection.ID), "", &estimate)
+	if len(estimate) != 2 {
+		t.Fatalf("got %d estimate lines, want the red and the yellow item", len(estimate))
+	}
+	if estimate[0].Status != ServiceEstimate || estimate[0].Comment != "Brakes - Front pads (red): metal on metal" || estimate[0].Miles != "42000" {
+		t.Errorf("first estimate line %+v", estimate[0])
+	}
+	estimate = nil
+	send("POST", fmt.Sprintf("/inspection/%d/estimate", inspection.ID), "", &estimate)
+	if len(estimate) != 0 {
+		t.Errorf("calling again added %d estimate lines", len(estimate))
+	}
+	if code := send("PUT", fmt.Sprintf("/complete/inspection/%d", inspection.ID), "", nil); code != http.StatusOK {
+		t.Errorf("completing: status %d", code)
+	}
+	if code := rate(inspection.Results[0], `{"Rating": "green"}`); code != http.StatusConflict {
+		t.Errorf("rating a completed inspection: status %d, want 409", code)
+	}
+
+	car, _ := findCarWithHistory(tx, service.CarId)
+	if len(car.Inspections) != 1 || car.Inspections[0].Status != InspectionCompleted || *car.Inspections[0].Results[0].Measurement != 1.5 {
+		t.Errorf("the car's history has inspections %+v", car.Inspections)
+	}
+}
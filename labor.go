@@ -0,0 +1,413 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// LaborOperation is a catalog entry for a piece of work, priced flat rate
+type LaborOperation struct {
+	gorm.Model
+
+	Code        string `gorm:"type:varchar(50);unique_index"`
+	Description string
+	Hours       float64
+	Price       float64
+}
+
+// CannedJob bundles labor operations and parts that are usually sold
+// together, like an oil change or a front brake job
+type CannedJob struct {
+	gorm.Model
+
+	Name        string
+	Description string
+	Labor       []CannedJobLabor
+	Parts       []CannedJobPart
+}
+
+type CannedJobLabor struct {
+	gorm.Model
+
+	CannedJobId      uint
+	LaborOperationId uint
+}
+
+type CannedJobPart struct {
+	gorm.Model
+
+	CannedJobId uint
+	PartId      uint
+	Quantity    int
+}
+
+//loads a canned job with its labor and parts
+func findCannedJob(tx *gorm.DB, id interface{}) (CannedJob, bool) {
+	var job CannedJob
+	if tx.First(&job, id).RecordNotFound() {
+		return job, false
+	}
+	tx.Where("canned_job_id = ?", job.ID).Order("id").Find(&job.Labor)
+	tx.Where("canned_job_id = ?", job.ID).Order("id").Find(&job.Parts)
+	return job, true
+}
+
+//checks that everything a canned job points to exists
+func validateCannedJob(tx *gorm.DB, job CannedJob) error {
+	if job.Name == "" {
+		return errors.New("Name is required")
+	}
+	for _, labor := range job.Labor {
+		var op LaborOperation
+		if tx.First(&op, labor.LaborOperationId).RecordNotFound() {
+			return fmt.Errorf("labor operation %d not found", labor.LaborOperationId)
+		}
+	}
+	for _, item := range job.Parts {
+		if item.Quantity <= 0 {
+			return fmt.Errorf("part %d: Quantity must be positive", item.PartId)
+		}
+		var part Part
+		if tx.First(&part, item.PartId).RecordNotFound() {
+			return fmt.Errorf("part %d not found", item.PartId)
+		}
+	}
+	return nil
+}
+
+//get the labor operations catalog
+func getLaborOperations(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	var ops []LaborOperation
+	shopDB(r).Order("code").Find(&ops)
+	json.NewEncoder(w).Encode(&ops)
+}
+
+//get a labor operation
+func getLaborOperation(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var op LaborOperation
+	if shopDB(r).First(&op, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("labor operation %s not found", params["id"]))
+		return
+	}
+	json.NewEncoder(w).Encode(&op)
+}
+
+//create a labor operation
+func createLaborOperation(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	var op LaborOperation
+	if err := json.NewDecoder(r.Body).Decode(&op); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if op.Code == "" {
+		writeError(w, http.StatusBadRequest, errors.New("Code is required"))
+		return
+	}
+	if err := shopDB(r).Create(&op).Error; err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&op)
+}
+
+//edit a labor operation
+func updateLaborOperation(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var op LaborOperation
+	if shopDB(r).First(&op, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("labor operation %s not found", params["id"]))
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&op); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := shopDB(r).Save(&op).Error; err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&op)
+}
+
+//delete a labor operation, services already priced with it are kept
+func deleteLaborOperation(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var op LaborOperation
+	if shopDB(r).First(&op, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("labor operation %s not found", params["id"]))
+		return
+	}
+
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("labor_operation_id = ?", op.ID).Delete(&CannedJobLabor{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&op).Error
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&op)
+}
+
+//get all canned jobs
+func getCannedJobs(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	var jobs []CannedJob
+	shopDB(r).Order("name").Find(&jobs)
+	for i := range jobs {
+		jobs[i], _ = findCannedJob(shopDB(r), jobs[i].ID)
+	}
+	json.NewEncoder(w).Encode(&jobs)
+}
+
+//get a canned job
+func getCannedJob(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	job, ok := findCannedJob(shopDB(r), params["id"])
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("canned job %s not found", params["id"]))
+		return
+	}
+	json.NewEncoder(w).Encode(&job)
+}
+
+//create a canned job with its labor and parts
+func createCannedJob(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	var job CannedJob
+	if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := validateCannedJob(shopDB(r), job); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := shopDB(r).Create(&job).Error; err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&job)
+}
+
+//edit a canned job, the labor and parts sent replace the existing ones
+func updateCannedJob(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	job, ok := findCannedJob(shopDB(r), params["id"])
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("canned job %s not found", params["id"]))
+		return
+	}
+
+	var changes CannedJob
+	if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := validateCannedJob(shopDB(r), changes); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("canned_job_id = ?", job.ID).Delete(&CannedJobLabor{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("canned_job_id = ?", job.ID).Delete(&CannedJobPart{}).Error; err != nil {
+			return err
+		}
+
+		job.Name = changes.Name
+		job.Description = changes.Description
+		job.Labor = nil
+		job.Parts = nil
+		for _, labor := range changes.Labor {
+			job.Labor = append(job.Labor, CannedJobLabor{LaborOperationId: labor.LaborOperationId})
+		}
+		for _, item := range changes.Parts {
+			job.Parts = append(job.Parts, CannedJobPart{PartId: item.PartId, Quantity: item.Quantity})
+		}
+		return tx.Save(&job).Error
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&job)
+}
+
+//delete a canned job
+func deleteCannedJob(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	job, ok := findCannedJob(shopDB(r), params["id"])
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("canned job %s not found", params["id"]))
+		return
+	}
+
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("canned_job_id = ?", job.ID).Delete(&CannedJobLabor{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("canned_job_id = ?", job.ID).Delete(&CannedJobPart{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&job).Error
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&job)
+}
+
+//apply a canned job to a car: every labor operation becomes a priced
+//service line and the job's parts are reserved on the first of them
+func applyCannedJob(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var car Car
+	if shopDB(r).First(&car, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("car %s not found", params["id"]))
+		return
+	}
+	job, ok := findCannedJob(shopDB(r), params["jobId"])
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("canned job %s not found", params["jobId"]))
+		return
+	}
+
+	//the body is optional and only carries the visit's mileage and PO number
+	var visit struct {
+		Miles    string
+		PONumber string
+	}
+	json.NewDecoder(r.Body).Decode(&visit)
+
+	var services []*Service
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		if err := checkPONumber(tx, car.ID, visit.PONumber); err != nil {
+			return err
+		}
+		for _, labor := range job.Labor {
+			var op LaborOperation
+			if err := tx.First(&op, labor.LaborOperationId).Error; err != nil {
+				return err
+			}
+			opId := op.ID
+			services = append(services, &Service{
+				CarId:            car.ID,
+				Comment:          op.Description,
+				Miles:            visit.Miles,
+				Status:           ServiceOpen,
+				LaborOperationId: &opId,
+				Hours:            op.Hours,
+				Price:            op.Price,
+				PONumber:         visit.PONumber,
+			})
+		}
+		//a job made only of parts still needs a line to hang them on
+		if len(services) == 0 {
+			services = append(services, &Service{CarId: car.ID, Comment: job.Name, Miles: visit.Miles, Status: ServiceOpen, PONumber: visit.PONumber})
+		}
+
+		for _, service := range services {
+			if err := tx.Create(service).Error; err != nil {
+				return err
+			}
+		}
+
+		first := services[0]
+		if err := recordServiceMiles(tx, first); err != nil {
+			return err
+		}
+		for _, item := range job.Parts {
+			var part Part
+			if err := tx.First(&part, item.PartId).Error; err != nil {
+				return err
+			}
+			if err := reservePart(tx, part.ID, first.ID, item.Quantity); err != nil {
+				return fmt.Errorf("%s: %w", part.SKU, err)
+			}
+			line := ServicePart{ServiceId: first.ID, PartId: part.ID, Quantity: item.Quantity, Price: part.Price, Status: PartLineReserved}
+			if err := tx.Create(&line).Error; err != nil {
+				return err
+			}
+			first.Parts = append(first.Parts, line)
+		}
+		return nil
+	})
+	if errors.Is(err, errInsufficientStock) || errors.Is(err, errOdometerWentBack) {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	for _, item := range job.Parts {
+		checkLowStock(shopDB(r), item.PartId)
+	}
+
+	json.NewEncoder(w).Encode(&services)
+}
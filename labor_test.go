@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCannedJobShortOfStockIsAConflict(t *testing.T) {
+	tx := setupTestDB(t)
+	car := createTestService(t, tx).CarId
+	part := Part{SKU: "PAD-9", OnHand: 1}
+	tx.Create(&part)
+	job := CannedJob{Name: "Front brakes", Parts: []CannedJobPart{{PartId: part.ID, Quantity: 2}}}
+	tx.Create(&job)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/car/{id}/cannedjob/{jobId}", applyCannedJob).Methods("POST")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", fmt.Sprintf("/car/%d/cannedjob/%d", car, job.ID), strings.NewReader(`{}`)))
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "PAD-9") {
+		t.Fatalf("got %d %s, want %d naming the part", w.Code, w.Body, http.StatusConflict)
+	}
+	assertStock(t, tx, part.ID, 1, 0)
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
@@ -18,27 +20,80 @@ type Customer struct {
 
 	FirstName string
 	LastName  string
-	Phone     string `gorm:"typevarchar(100);unique_index"`
-	Cars      []Car  `gorm:"constraint:OnDelete:CASCADE;"`
+	Phone     string
+	Cars      []Car
+
+	// notification preferences, quiet hours are HH:MM local time
+	Email           string
+	EmailOptOut     bool
+	SmsOptOut       bool
+	QuietHoursStart string
+	QuietHoursEnd   string
+
+	// business accounts have a company, contacts and usually many cars
+	Kind            string
+	CompanyName     string
+	TaxId           string
+	BillingTerms    string
+	RequirePONumber bool
+	Contacts        []CustomerContact
+
+	// Phone and Email above are the primary ones of these
+	ContactPoints      []ContactPoint
+	Addresses          []Address
+	PreferredLanguage  string
+	PreferredChannel   string
+	MarketingConsent   bool
+	MarketingConsentAt *time.Time
+
+	// set once the customer's personal data has been scrubbed
+	AnonymizedAt *time.Time
 }
 
 type Car struct {
 	gorm.Model
 
-	Make       string
-	Modelo     string
-	Color      string
-	VinNumber  string     `gorm:"typevarchar(100);unique_index"`
-	Services   []*Service `gorm:"constraint:OnDelete:CASCADE;"`
-	CustomerId uint
+	Make        string
+	Modelo      string
+	Color       string
+	VinNumber   string
+	Services    []*Service
+	CustomerId  uint
+	Inspections []Inspection
+
+	// a plate is unique within the state and country that issued it
+	LicensePlate string
+	PlateState   string
+	PlateCountry string
+	Year         int
+	Trim         string
+	Engine       string
+	Transmission string
+	FuelType     string
+	MileageUnit  string
+
+	//where the VIN disagrees with what was entered, empty when it doesn't
+	VinIssues string
 }
 
 type Service struct {
 	gorm.Model
 
-	Comment string
-	Miles   string
-	CarId   uint
+	Comment          string
+	Miles            string
+	Status           string
+	CarId            uint
+	LaborOperationId *uint
+	TechnicianId     *uint
+	Hours            float64
+	Price            float64
+	MilesUnparsed    bool
+	PONumber         string
+	Parts            []ServicePart
+
+	// OdometerReplaced lets a new service record a reading lower than the
+	// car's last one
+	OdometerReplaced bool `gorm:"-"`
 }
 
 var db *gorm.DB
@@ -46,6 +101,14 @@ var err error
 
 func main() {
 
+	//writing a new migration doesn't need a database
+	if len(os.Args) > 2 && os.Args[1] == "migrate" && os.Args[2] == "new" {
+		if err := runMigrateCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	err := godotenv.Load()
 	if err != nil {
 		log.Fatal("Error loading .env file")
@@ -53,6 +116,7 @@ func main() {
 
 	//Loading env variables
 	dialect := os.Getenv("DIALECT")
+	multiTenant = envFlag("MULTI_TENANT")
 	// host := os.Getenv("HOST")
 	// dbPort := os.Getenv("DBPORT")
 	// user := os.Getenv("USER")
@@ -67,14 +131,19 @@ func main() {
 	//connect to db postgres
 	// dbURI := fmt.Sprintf("host=%s user=%s dbname=%s sslmode=disable password=%s port=%s", host, user, dbName, password, dbPort)
 
-	// openning connection to DB
-	db, err = gorm.Open(dialect, url)
+	// openning connection to DB, waiting for it while it boots
+	db, err = connectDatabase(dialect, withShopSetting(dialect, url, mainShopSetting()))
 	if err != nil {
 		log.Fatal(err)
 	} else {
 		fmt.Println("Succesfully connected to DB")
 	}
 
+	//with MULTI_TENANT, commands work on the shop SHOP names
+	if err := setupShops(dialect, url); err != nil {
+		log.Fatal(err)
+	}
+
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -82,29 +151,262 @@ func main() {
 	//close connection do db when main function finishes
 	defer db.Close()
 
-	//Make migration to the db
-	db.Debug().AutoMigrate(&Customer{})
-	db.Debug().AutoMigrate(&Car{})
-	db.Debug().AutoMigrate(&Service{})
+	//mecanica-service migrate up|down|status changes the schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	//with MULTI_TENANT, backups and spreadsheet imports are of one shop
+	if len(os.Args) > 1 && multiTenant && os.Getenv("SHOP") == "" {
+		switch os.Args[1] {
+		case "export", "import", "import-csv":
+			log.Fatalf("set SHOP to the id or subdomain of the shop to %s", os.Args[1])
+		}
+	}
+
+	//mecanica-service export [file] and import <file> back up and restore
+	//the whole database
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		if err := runExportCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		if err := runImportCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	//mecanica-service import-csv loads a legacy customer spreadsheet
+	if len(os.Args) > 1 && os.Args[1] == "import-csv" {
+		if err := runImportCSVCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	//mecanica-service shop list|add|key manages the shops
+	if len(os.Args) > 1 && os.Args[1] == "shop" {
+		if err := runShopCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	//mecanica-service schema check compares the database with the migrations
+	if len(os.Args) > 1 && os.Args[1] == "schema" {
+		if err := runSchemaCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	//a database in memory is new every time the server starts
+	if isSQLite(db) && sqliteInMemory(url) {
+		if _, err := migrateUp(0); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	//the schema is changed by migrate, never by the server
+	if err := requireMigratedSchema(); err != nil {
+		log.Fatal(err)
+	}
+	if multiTenant {
+		if err := checkTenantIsolation(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := setupShopLocation(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupNotifications(); err != nil {
+		log.Fatal(err)
+	}
+	go watchNotifications(30 * time.Second)
+
+	if err := setupAttachments(); err != nil {
+		log.Fatal(err)
+	}
+
+	//close punches technicians forgot to clock off
+	go watchForgottenPunches(5 * time.Minute)
+
+	//reports and lookups read from the replica when there is one
+	replica = connectReplica(dialect)
+	if replica != nil {
+		defer replica.Close()
+	}
+
 	//api routes
 	router := mux.NewRouter()
+	if multiTenant {
+		router.Use(resolveShop)
+	}
+	if replica != nil {
+		router.Use(trackWrites)
+	}
 
 	//customers
 	router.HandleFunc("/customers", getCustomers).Methods("GET", "OPTIONS")
+	router.HandleFunc("/customers/duplicates", getDuplicateCustomers).Methods("GET", "OPTIONS")
 	router.HandleFunc("/customer/{id}", getCustomerById).Methods("GET", "OPTIONS") //and get their cars as well
 	router.HandleFunc("/create/customer", createCustomer).Methods("POST", "OPTIONS")
 	router.HandleFunc("/delete/customer/{id}", deleteCustomer).Methods("DELETE", "OPTIONS")
 	router.HandleFunc("/update/customer/{id}", updateCustomer).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/customer/{id}/attachments", uploadCustomerAttachment).Methods("POST", "OPTIONS")
+	router.HandleFunc("/customer/{id}/notify", notifyCustomerHandler).Methods("POST", "OPTIONS")
+	router.HandleFunc("/customer/{id}/contactpoints", getContactPoints).Methods("GET", "OPTIONS")
+	router.HandleFunc("/customer/{id}/contactpoints", createContactPoint).Methods("POST", "OPTIONS")
+	router.HandleFunc("/update/contactpoint/{id}", updateContactPoint).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/delete/contactpoint/{id}", deleteContactPoint).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/customer/{id}/addresses", getAddresses).Methods("GET", "OPTIONS")
+	router.HandleFunc("/customer/{id}/addresses", createAddress).Methods("POST", "OPTIONS")
+	router.HandleFunc("/update/address/{id}", updateAddress).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/delete/address/{id}", deleteAddress).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/customer/{id}/merge", mergeCustomerHandler).Methods("POST", "OPTIONS")
+	router.HandleFunc("/customer/{id}/merges", getCustomerMerges).Methods("GET", "OPTIONS")
+
+	//fleet and business accounts
+	router.HandleFunc("/customer/{id}/contacts", getCustomerContacts).Methods("GET", "OPTIONS")
+	router.HandleFunc("/customer/{id}/contacts", createCustomerContact).Methods("POST", "OPTIONS")
+	router.HandleFunc("/update/contact/{id}", updateCustomerContact).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/delete/contact/{id}", deleteCustomerContact).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/customer/{id}/cars", getCustomerCarRoster).Methods("GET", "OPTIONS")
+	router.HandleFunc("/fleet/{id}/services", getFleetServices).Methods("GET", "OPTIONS")
+	router.HandleFunc("/fleet/{id}/spend", getFleetSpend).Methods("GET", "OPTIONS")
 
 	//cars
 	router.HandleFunc("/cars", getCars).Methods("GET", "OPTIONS")
 	router.HandleFunc("/car/{id}", getCar).Methods("GET", "OPTIONS")
+	router.HandleFunc("/car/plate/{plate}", getCarByPlate).Methods("GET", "OPTIONS")
+	router.HandleFunc("/v1/vin/{vin}/decode", getVinDecode).Methods("GET", "OPTIONS")
+	router.HandleFunc("/v1/exports/{kind:customers|cars|services}.csv", getCSVExport).Methods("GET", "OPTIONS")
 	router.HandleFunc("/create/car", createCar).Methods("POST", "OPTIONS")
+	router.HandleFunc("/update/car/{id}", updateCar).Methods("PUT", "OPTIONS")
 	router.HandleFunc("/delete/car/{id}", deleteCar).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/car/{id}/transfer", transferCarHandler).Methods("POST", "OPTIONS")
+	router.HandleFunc("/car/{id}/owners", getCarOwners).Methods("GET", "OPTIONS")
+	router.HandleFunc("/update/ownership/{id}", updateOwnership).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/car/{id}/cannedjob/{jobId}", applyCannedJob).Methods("POST", "OPTIONS")
+	router.HandleFunc("/car/{id}/inspections", createInspection).Methods("POST", "OPTIONS")
+	router.HandleFunc("/car/{id}/attachments", uploadCarAttachment).Methods("POST", "OPTIONS")
+	router.HandleFunc("/v1/cars/{id}/odometer", getOdometerSeries).Methods("GET", "OPTIONS")
+	router.HandleFunc("/v1/cars/{id}/odometer", createOdometerReading).Methods("POST")
+	router.HandleFunc("/reports/unparsed-miles", getUnparsedMiles).Methods("GET", "OPTIONS")
+	router.HandleFunc("/car/{id}/maintenance", getCarMaintenance).Methods("GET", "OPTIONS")
+
+	//maintenance schedule
+	router.HandleFunc("/maintenance/rules", getMaintenanceRules).Methods("GET", "OPTIONS")
+	router.HandleFunc("/create/maintenance/rule", createMaintenanceRule).Methods("POST", "OPTIONS")
+	router.HandleFunc("/update/maintenance/rule/{id}", updateMaintenanceRule).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/delete/maintenance/rule/{id}", deleteMaintenanceRule).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/reports/due", getDueList).Methods("GET", "OPTIONS")
+
+	//notifications
+	router.HandleFunc("/notifications", getNotifications).Methods("GET", "OPTIONS")
+	router.HandleFunc("/notification/templates", getNotificationTemplates).Methods("GET", "OPTIONS")
+	router.HandleFunc("/update/notification/template", updateNotificationTemplate).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/notification/{id}", getNotification).Methods("GET", "OPTIONS")
+
+	//customer portal, read-only and scoped to the signed-in customer
+	router.HandleFunc("/portal/login", portalLogin).Methods("POST", "OPTIONS")
+	router.HandleFunc("/portal/session", portalCreateSession).Methods("POST", "OPTIONS")
+	router.HandleFunc("/portal/logout", portalAuth(portalLogout)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/portal/me", portalAuth(portalMe)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/portal/car/{id}", portalAuth(portalCar)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/portal/estimates", portalAuth(portalEstimates)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/portal/invoices", portalAuth(portalInvoices)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/portal/appointments", portalAuth(portalAppointments)).Methods("GET", "OPTIONS")
+
+	//appointments
+	router.HandleFunc("/appointments", getAppointments).Methods("GET", "OPTIONS")
+	router.HandleFunc("/create/appointment", createAppointment).Methods("POST", "OPTIONS")
+	router.HandleFunc("/update/appointment/{id}", updateAppointment).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/delete/appointment/{id}", deleteAppointment).Methods("DELETE", "OPTIONS")
 
 	//Maintanences
 	router.HandleFunc("/create/service", createService).Methods("POST", "OPTIONS")
 	router.HandleFunc("/delete/service", deleteService).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/service/{id}/parts", reserveServicePart).Methods("POST", "OPTIONS")
+	router.HandleFunc("/service/{id}/part/{lineId}", releaseServicePart).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/complete/service/{id}", completeService).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/assign/service/{id}", assignService).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/service/{id}/clockon", clockOn).Methods("POST", "OPTIONS")
+	router.HandleFunc("/service/{id}/clockoff", clockOff).Methods("POST", "OPTIONS")
+	router.HandleFunc("/service/{id}/time", getServiceTime).Methods("GET", "OPTIONS")
+	router.HandleFunc("/approve/service/{id}", approveService).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/service/{id}/attachments", uploadServiceAttachment).Methods("POST", "OPTIONS")
+
+	//attachments
+	router.HandleFunc("/attachments", getAttachments).Methods("GET", "OPTIONS")
+	router.HandleFunc("/attachment/{id}", getAttachment).Methods("GET", "OPTIONS")
+	router.HandleFunc("/attachment/{id}/download", downloadAttachment).Methods("GET", "OPTIONS")
+	router.HandleFunc("/delete/attachment/{id}", deleteAttachment).Methods("DELETE", "OPTIONS")
+
+	//inspections
+	router.HandleFunc("/inspection/templates", getInspectionTemplates).Methods("GET", "OPTIONS")
+	router.HandleFunc("/inspection/template/{id}", getInspectionTemplate).Methods("GET", "OPTIONS")
+	router.HandleFunc("/create/inspection/template", createInspectionTemplate).Methods("POST", "OPTIONS")
+	router.HandleFunc("/update/inspection/template/{id}", updateInspectionTemplate).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/inspection/{id}", getInspection).Methods("GET", "OPTIONS")
+	router.HandleFunc("/inspection/{id}/result/{resultId}", updateInspectionResult).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/inspection/{id}/estimate", createInspectionEstimate).Methods("POST", "OPTIONS")
+	router.HandleFunc("/complete/inspection/{id}", completeInspection).Methods("PUT", "OPTIONS")
+
+	//parts inventory
+	router.HandleFunc("/parts", getParts).Methods("GET", "OPTIONS")
+	router.HandleFunc("/part/{id}", getPart).Methods("GET", "OPTIONS")
+	router.HandleFunc("/part/{id}/movements", getPartMovements).Methods("GET", "OPTIONS")
+	router.HandleFunc("/create/part", createPart).Methods("POST", "OPTIONS")
+	router.HandleFunc("/update/part/{id}", updatePart).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/adjust/part/{id}", adjustPart).Methods("POST", "OPTIONS")
+	router.HandleFunc("/reports/reorder", getReorderReport).Methods("GET", "OPTIONS")
+
+	//suppliers and purchase orders
+	router.HandleFunc("/suppliers", getSuppliers).Methods("GET", "OPTIONS")
+	router.HandleFunc("/supplier/{id}", getSupplier).Methods("GET", "OPTIONS")
+	router.HandleFunc("/create/supplier", createSupplier).Methods("POST", "OPTIONS")
+	router.HandleFunc("/update/supplier/{id}", updateSupplier).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/purchaseorders", getPurchaseOrders).Methods("GET", "OPTIONS")
+	router.HandleFunc("/purchaseorder/{id}", getPurchaseOrder).Methods("GET", "OPTIONS")
+	router.HandleFunc("/create/purchaseorder", createPurchaseOrder).Methods("POST", "OPTIONS")
+	router.HandleFunc("/generate/purchaseorders", generatePurchaseOrders).Methods("POST", "OPTIONS")
+	router.HandleFunc("/send/purchaseorder/{id}", sendPurchaseOrder).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/receive/purchaseorder/{id}", receivePurchaseOrder).Methods("POST", "OPTIONS")
+
+	//employees and time clock
+	router.HandleFunc("/employees", getEmployees).Methods("GET", "OPTIONS")
+	router.HandleFunc("/employee/{id}", getEmployee).Methods("GET", "OPTIONS")
+	router.HandleFunc("/employee/{id}/punches", getEmployeePunches).Methods("GET", "OPTIONS")
+	router.HandleFunc("/create/employee", createEmployee).Methods("POST", "OPTIONS")
+	router.HandleFunc("/update/employee/{id}", updateEmployee).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/reports/productivity", getProductivityReport).Methods("GET", "OPTIONS")
+
+	//labor operations and canned jobs
+	router.HandleFunc("/labor", getLaborOperations).Methods("GET", "OPTIONS")
+	router.HandleFunc("/labor/{id}", getLaborOperation).Methods("GET", "OPTIONS")
+	router.HandleFunc("/create/labor", createLaborOperation).Methods("POST", "OPTIONS")
+	router.HandleFunc("/update/labor/{id}", updateLaborOperation).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/delete/labor/{id}", deleteLaborOperation).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/cannedjobs", getCannedJobs).Methods("GET", "OPTIONS")
+	router.HandleFunc("/cannedjob/{id}", getCannedJob).Methods("GET", "OPTIONS")
+	router.HandleFunc("/create/cannedjob", createCannedJob).Methods("POST", "OPTIONS")
+	router.HandleFunc("/update/cannedjob/{id}", updateCannedJob).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/delete/cannedjob/{id}", deleteCannedJob).Methods("DELETE", "OPTIONS")
+
+	//admin
+	router.HandleFunc("/admin/export", adminAuth(getExport)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/admin/import/csv", adminAuth(importCSVHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/admin/customer/{id}/export", adminAuth(getCustomerDataExport)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/admin/customer/{id}/anonymize", adminAuth(anonymizeCustomerHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/admin/privacy/requests", adminAuth(getPrivacyRequests)).Methods("GET", "OPTIONS")
 
 	// get the port
 	port, err := getPort()
@@ -127,7 +429,14 @@ func getPort() (string, error) {
 func setupResponse(w *http.ResponseWriter, req *http.Request) {
 	(*w).Header().Set("Access-Control-Allow-Origin", "*")
 	(*w).Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-	(*w).Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	(*w).Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-Api-Key")
+}
+
+//write an error as json with the given status code
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 }
 
 //api controllers
@@ -139,8 +448,15 @@ func getCustomers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//?phone= finds customers by any of their phones
+	if phone := r.URL.Query().Get("phone"); phone != "" {
+		customers := findCustomersByPhone(readDB(r), phone)
+		json.NewEncoder(w).Encode(&customers)
+		return
+	}
+
 	var customers []Customer
-	db.Find(&customers)
+	readDB(r).Find(&customers)
 	json.NewEncoder(w).Encode(&customers)
 }
 
@@ -155,14 +471,25 @@ func getCustomerById(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	id := params["id"]
 
+	customer, _ := findCustomerWithCars(shopDB(r), id)
+	json.NewEncoder(w).Encode(&customer)
+}
+
+//loads a customer and their cars
+func findCustomerWithCars(tx *gorm.DB, id interface{}) (Customer, bool) {
 	var customer Customer
 	var cars []Car
 
-	db.Where("id = ?", id).Find(&customer)
-	db.Model(&customer).Related(&cars)
+	if tx.Where("id = ?", id).Find(&customer).RecordNotFound() {
+		return customer, false
+	}
+	tx.Model(&customer).Related(&cars)
+	tx.Where("customer_id = ?", customer.ID).Order("id").Find(&customer.Contacts)
+	tx.Where("customer_id = ?", customer.ID).Order("kind, id").Find(&customer.ContactPoints)
+	tx.Where("customer_id = ?", customer.ID).Order("id").Find(&customer.Addresses)
 
 	customer.Cars = cars
-	json.NewEncoder(w).Encode(&customer)
+	return customer, true
 }
 
 //create new customer
@@ -175,9 +502,35 @@ func createCustomer(w http.ResponseWriter, r *http.Request) {
 	}
 
 	json.NewDecoder(r.Body).Decode(&customer)
+	if err := normalizeCustomer(&customer); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := prepareCustomerContacts(&customer); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	customer.MarketingConsentAt = nil
+	if customer.MarketingConsent {
+		now := time.Now()
+		customer.MarketingConsentAt = &now
+	}
 
-	createdPerson := db.Create(&customer)
-	err = createdPerson.Error
+	err = shopDB(r).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&customer).Error; err != nil {
+			return err
+		}
+		//cars sent along with the customer are created with it
+		for _, car := range customer.Cars {
+			if err := startOwnership(tx, car); err != nil {
+				return err
+			}
+		}
+		if err := adoptLegacyContacts(tx, &customer); err != nil {
+			return err
+		}
+		return tx.First(&customer, customer.ID).Error
+	})
 
 	if err != nil {
 		json.NewEncoder(w).Encode(err)
@@ -197,36 +550,51 @@ func deleteCustomer(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var customer Customer
-	var cars []Car
-
-	db.First(&customer, params["id"])
-	db.Model(&customer).Related(&cars)
-
-	deleteServicesSqlStatement := `
-		DELETE FROM services
-		WHERE car_id = $1;`
-
-	for i, car := range cars {
-		fmt.Println(i, car.ID)
-		err := db.Exec(deleteServicesSqlStatement, car.ID).Error
-		if err != nil {
-			fmt.Println(err)
-		}
-
+	if shopDB(r).First(&customer, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("customer %s not found", params["id"]))
+		return
 	}
 
-	DeleteCarsSqlStatement := `
-		DELETE FROM cars
-		WHERE customer_id = $1;`
-
-	err := db.Exec(DeleteCarsSqlStatement, params["id"]).Error
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		carIds := []uint{}
+		if err := tx.Unscoped().Model(&Car{}).Where("customer_id = ?", customer.ID).Pluck("id", &carIds).Error; err != nil {
+			return err
+		}
+		serviceIds := []uint{}
+		if err := tx.Unscoped().Model(&Service{}).Where("car_id IN (?)", append(carIds, 0)).Pluck("id", &serviceIds).Error; err != nil {
+			return err
+		}
+		if err := releaseServiceParts(tx, serviceIds); err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("car_id IN (?)", append(carIds, 0)).Delete(&Service{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("customer_id = ?", customer.ID).Delete(&Car{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("customer_id = ?", customer.ID).Delete(&CustomerContact{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("customer_id = ?", customer.ID).Delete(&ContactPoint{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("customer_id = ?", customer.ID).Delete(&Address{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("customer_id = ?", customer.ID).Delete(&Appointment{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("survivor_id = ?", customer.ID).Delete(&CustomerMerge{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&customer).Error
+	})
 	if err != nil {
-		fmt.Println(err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
-
-	db.Debug().Unscoped().Delete(&customer)
 	json.NewEncoder(w).Encode(&customer)
-
 }
 
 //edit customer
@@ -242,7 +610,12 @@ func updateCustomer(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	params := mux.Vars(r)
 	var customer Customer
-	db.First(&customer, params["id"])
+	shopDB(r).First(&customer, params["id"])
+	if customer.AnonymizedAt != nil {
+		writeError(w, http.StatusConflict, errCustomerAnonymized)
+		return
+	}
+	consent, consentAt := customer.MarketingConsent, customer.MarketingConsentAt
 
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&customer); err != nil {
@@ -250,8 +623,25 @@ func updateCustomer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer r.Body.Close()
+	customer.Contacts, customer.ContactPoints, customer.Addresses = nil, nil, nil
+	if err := normalizeCustomer(&customer); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	//consent is stamped when it changes, not when the client says so
+	customer.MarketingConsentAt = consentAt
+	if customer.MarketingConsent != consent {
+		now := time.Now()
+		customer.MarketingConsentAt = &now
+	}
 
-	if err := db.Save(&customer).Error; err != nil {
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&customer).Error; err != nil {
+			return err
+		}
+		return adoptLegacyContacts(tx, &customer)
+	})
+	if err != nil {
 		fmt.Println(err)
 		return
 	}
@@ -267,13 +657,20 @@ func getCars(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//?plate= looks cars up by license plate instead
+	if plate := r.URL.Query().Get("plate"); plate != "" {
+		cars := findCarsByPlate(shopDB(r), plate, r.URL.Query().Get("state"), r.URL.Query().Get("country"))
+		json.NewEncoder(w).Encode(&cars)
+		return
+	}
+
 	params := mux.Vars(r)
 
 	var customer Customer
 	var cars []Car
 
-	db.First(&customer, params["id"])
-	db.Model(&customer).Related(&cars)
+	shopDB(r).First(&customer, params["id"])
+	shopDB(r).Model(&customer).Related(&cars)
 
 	customer.Cars = cars
 	json.NewEncoder(w).Encode(&customer)
@@ -286,14 +683,23 @@ func getCar(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	params := mux.Vars(r)
+	car, _ := findCarWithHistory(readDB(r), params["id"])
+	json.NewEncoder(w).Encode(&car)
+}
+
+//loads a car with its services and inspections
+func findCarWithHistory(tx *gorm.DB, id interface{}) (Car, bool) {
 	var car Car
 	var services []*Service
 
-	db.First(&car, params["id"])
-	db.Model(&car).Related(&services)
+	if tx.First(&car, id).RecordNotFound() {
+		return car, false
+	}
+	tx.Model(&car).Related(&services)
 
 	car.Services = services
-	json.NewEncoder(w).Encode(&car)
+	car.Inspections = carInspections(tx, car.ID)
+	return car, true
 }
 
 //create  a car
@@ -306,8 +712,24 @@ func createCar(w http.ResponseWriter, r *http.Request) {
 	}
 
 	json.NewDecoder(r.Body).Decode(&car)
-	createdCar := db.Create(&car)
-	err = createdCar.Error
+	if err := normalizeCar(&car); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if plateTaken(shopDB(r), car) {
+		writeError(w, http.StatusConflict, fmt.Errorf("plate %s %s %s belongs to another car", car.LicensePlate, car.PlateState, car.PlateCountry))
+		return
+	}
+	if vinTaken(shopDB(r), car) {
+		writeError(w, http.StatusConflict, fmt.Errorf("VIN %s belongs to another car", car.VinNumber))
+		return
+	}
+	err = shopDB(r).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&car).Error; err != nil {
+			return err
+		}
+		return startOwnership(tx, car)
+	})
 
 	if err != nil {
 		json.NewEncoder(w).Encode(err)
@@ -328,19 +750,31 @@ func deleteCar(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 
 	var car Car
-	db.First(&car, params["id"])
-
-	sqlStatement := `
-		DELETE FROM services
-		WHERE car_id = $1;`
-
-	err := db.Exec(sqlStatement, params["id"]).Error
+	if shopDB(r).First(&car, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("car %s not found", params["id"]))
+		return
+	}
 
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		serviceIds := []uint{}
+		if err := tx.Unscoped().Model(&Service{}).Where("car_id = ?", car.ID).Pluck("id", &serviceIds).Error; err != nil {
+			return err
+		}
+		if err := releaseServiceParts(tx, serviceIds); err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("car_id = ?", car.ID).Delete(&Service{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("car_id = ?", car.ID).Delete(&CarOwnership{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&car).Error
+	})
 	if err != nil {
-		fmt.Println(err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
-
-	db.Debug().Unscoped().Delete(&car)
 	json.NewEncoder(w).Encode(&car)
 }
 
@@ -348,11 +782,26 @@ func deleteCar(w http.ResponseWriter, r *http.Request) {
 func deleteService(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	id := params["id"]
+	if id == "" {
+		id = r.URL.Query().Get("id")
+	}
 
 	var service Service
 
-	db.First(&service, id)
-	db.Delete(&service)
+	if id == "" || shopDB(r).First(&service, id).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("service %s not found", id))
+		return
+	}
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		if err := releaseServiceParts(tx, []uint{service.ID}); err != nil {
+			return err
+		}
+		return tx.Delete(&service).Error
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 
 	json.NewEncoder(w).Encode(&service)
 }
@@ -367,11 +816,25 @@ func createService(w http.ResponseWriter, r *http.Request) {
 	var maintenance Service
 
 	json.NewDecoder(r.Body).Decode(&maintenance)
-	createdMaintanence := db.Create(&maintenance)
-	err = createdMaintanence.Error
+	if maintenance.Status == "" {
+		maintenance.Status = ServiceOpen
+	}
 
-	if err != nil {
-		json.NewEncoder(w).Encode(err)
+	//the service and its odometer reading go in together
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		if err := checkPONumber(tx, maintenance.CarId, maintenance.PONumber); err != nil {
+			return err
+		}
+		if err := tx.Create(&maintenance).Error; err != nil {
+			return err
+		}
+		return recordServiceMiles(tx, &maintenance)
+	})
+
+	if errors.Is(err, errOdometerWentBack) {
+		writeError(w, http.StatusConflict, err)
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, err)
 	} else {
 		json.NewEncoder(w).Encode(&maintenance)
 	}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+//points db at a new SQLite database in memory with every migration applied,
+//for as long as the test runs
+func setupTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	conn, err := openDatabase("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := db
+	db = conn
+	t.Cleanup(func() {
+		db = previous
+		conn.Close()
+	})
+	if _, err := migrateUp(0); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+//a customer with a car and an open service on it
+func createTestService(t *testing.T, tx *gorm.DB) Service {
+	t.Helper()
+	customer := Customer{FirstName: "Ana", LastName: "Ruiz", Phone: "555-123-4567"}
+	if err := tx.Create(&customer).Error; err != nil {
+		t.Fatal(err)
+	}
+	car := Car{Make: "Ford", Modelo: "F150", CustomerId: customer.ID}
+	if err := tx.Create(&car).Error; err != nil {
+		t.Fatal(err)
+	}
+	service := Service{Comment: "brakes", Status: ServiceOpen, CarId: car.ID}
+	if err := tx.Create(&service).Error; err != nil {
+		t.Fatal(err)
+	}
+	return service
+}
+
+func TestDeletingAnUnknownIdDeletesNothing(t *testing.T) {
+	tx := setupTestDB(t)
+	createTestService(t, tx)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/delete/customer/{id}", deleteCustomer).Methods("DELETE")
+	router.HandleFunc("/delete/car/{id}", deleteCar).Methods("DELETE")
+	router.HandleFunc("/delete/service", deleteService).Methods("DELETE")
+	for _, path := range []string{"/delete/customer/99999", "/delete/car/99999", "/delete/service?id=99999", "/delete/service"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("DELETE", path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s answered %d, want %d", path, w.Code, http.StatusNotFound)
+		}
+	}
+
+	var customers, cars, services int
+	tx.Model(&Customer{}).Count(&customers)
+	tx.Model(&Car{}).Count(&cars)
+	tx.Model(&Service{}).Count(&services)
+	if customers != 1 || cars != 1 || services != 1 {
+		t.Fatalf("%d customers, %d cars and %d services left, want one of each", customers, cars, services)
+	}
+
+	//a delete with no WHERE clause is refused outright
+	if err := tx.Unscoped().Delete(&Car{}).Error; err == nil {
+		t.Fatal("deleting every car went through")
+	}
+}
+
+func TestDeletingACarDeletesItsServices(t *testing.T) {
+	tx := setupTestDB(t)
+	service := createTestService(t, tx)
+	other := createTestService(t, tx)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/delete/car/{id}", deleteCar).Methods("DELETE")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/delete/car/"+fmt.Sprint(service.CarId), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete car: %d %s", w.Code, w.Body)
+	}
+	var services []Service
+	tx.Unscoped().Find(&services)
+	if len(services) != 1 || services[0].ID != other.ID {
+		t.Fatalf("services left: %+v", services)
+	}
+}
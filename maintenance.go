@@ -0,0 +1,471 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+//where a car stands with a maintenance rule. Upcoming is inside the warning
+//window before the due point, due is past it but inside the same window
+//after it, overdue is further past it.
+const (
+	MaintenanceOk       = "ok"
+	MaintenanceUpcoming = "upcoming"
+	MaintenanceDue      = "due"
+	MaintenanceOverdue  = "overdue"
+)
+
+//warning window used when a rule doesn't set its own
+const (
+	defaultWarnMiles = 500
+	defaultWarnDays  = 30
+)
+
+// MaintenanceRule is a service to repeat every IntervalMiles or
+// IntervalMonths, whichever comes first. Make, Modelo and the year range
+// narrow it down to some cars, a rule with none of them applies to all.
+// Past services count as this rule when they used LaborOperationId or their
+// Comment contains one of the comma separated Keywords.
+type MaintenanceRule struct {
+	gorm.Model
+
+	Name             string
+	Make             string
+	Modelo           string
+	YearFrom         int
+	YearTo           int
+	IntervalMiles    int
+	IntervalMonths   int
+	WarnMiles        int
+	WarnDays         int
+	LaborOperationId *uint
+	Keywords         string
+}
+
+// MaintenanceItem is a rule worked out for one car
+type MaintenanceItem struct {
+	CarId          uint
+	RuleId         uint
+	Rule           string
+	Status         string
+	NeverPerformed bool
+	LastServiceId  *uint
+	LastDate       *time.Time
+	LastMiles      *int
+	DueMiles       *int
+	DueDate        *time.Time
+	CurrentMiles   *int
+}
+
+//tells whether a rule is meant for a car
+func ruleApplies(rule MaintenanceRule, car Car) bool {
+	if rule.Make != "" && !strings.EqualFold(rule.Make, car.Make) {
+		return false
+	}
+	if rule.Modelo != "" && !strings.EqualFold(rule.Modelo, car.Modelo) {
+		return false
+	}
+	if rule.YearFrom > 0 || rule.YearTo > 0 {
+		year := car.Year
+		if year == 0 {
+			return false
+		}
+		if rule.YearFrom > 0 && year < rule.YearFrom {
+			return false
+		}
+		if rule.YearTo > 0 && year > rule.YearTo {
+			return false
+		}
+	}
+	return true
+}
+
+//tells whether a past service was the work a rule asks for. Estimates are
+//work that may never happen, every other service counts: most are logged
+//after the fact and never completed through the API.
+func ruleMatchesService(rule MaintenanceRule, service Service) bool {
+	if service.Status == ServiceEstimate {
+		return false
+	}
+	if rule.LaborOperationId != nil && service.LaborOperationId != nil && *rule.LaborOperationId == *service.LaborOperationId {
+		return true
+	}
+	comment := strings.ToLower(service.Comment)
+	for _, keyword := range strings.Split(rule.Keywords, ",") {
+		keyword = strings.ToLower(strings.TrimSpace(keyword))
+		if keyword != "" && strings.Contains(comment, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+//mileage of a car at a service, from its odometer reading
+func serviceMiles(service Service, readings []OdometerReading) *int {
+	for _, reading := range readings {
+		if reading.ServiceId != nil && *reading.ServiceId == service.ID {
+			miles := int(math.Round(reading.Miles()))
+			return &miles
+		}
+	}
+	return nil
+}
+
+//estimates today's mileage from the readings so far, projecting the car's
+//average daily use since the last reading
+func estimateMiles(readings []OdometerReading, now time.Time) *int {
+	if len(readings) == 0 {
+		return nil
+	}
+	first, last := readings[0], readings[len(readings)-1]
+	//only look at readings since the odometer was last replaced
+	for _, reading := range readings {
+		if reading.Replacement {
+			first = reading
+		}
+	}
+
+	current := last.Miles()
+	days := last.ReadAt.Sub(first.ReadAt).Hours() / 24
+	if days >= 30 && last.Miles() > first.Miles() {
+		perDay := (last.Miles() - first.Miles()) / days
+		current += perDay * now.Sub(last.ReadAt).Hours() / 24
+	}
+	miles := int(math.Round(current))
+	return &miles
+}
+
+//works out where a car stands with a rule. Services and readings are the
+//car's, oldest first.
+func computeMaintenance(rule MaintenanceRule, car Car, services []Service, readings []OdometerReading, now time.Time) MaintenanceItem {
+	item := MaintenanceItem{CarId: car.ID, RuleId: rule.ID, Rule: rule.Name, Status: MaintenanceOk}
+	item.CurrentMiles = estimateMiles(readings, now)
+
+	warnMiles, warnDays := rule.WarnMiles, rule.WarnDays
+	if warnMiles <= 0 {
+		warnMiles = defaultWarnMiles
+	}
+	if warnDays <= 0 {
+		warnDays = defaultWarnDays
+	}
+
+	var last *Service
+	for i := range services {
+		if ruleMatchesService(rule, services[i]) {
+			last = &services[i]
+		}
+	}
+
+	if last == nil {
+		//with no record the car is measured from new, and in time from
+		//when we first saw it
+		item.NeverPerformed = true
+		if rule.IntervalMiles > 0 {
+			due := rule.IntervalMiles
+			item.DueMiles = &due
+		}
+		if rule.IntervalMonths > 0 {
+			due := firstSeen(car, readings).AddDate(0, rule.IntervalMonths, 0)
+			item.DueDate = &due
+		}
+	} else {
+		id, date := last.ID, last.CreatedAt
+		item.LastServiceId = &id
+		item.LastDate = &date
+		item.LastMiles = serviceMiles(*last, readings)
+		if rule.IntervalMiles > 0 && item.LastMiles != nil {
+			due := *item.LastMiles + rule.IntervalMiles
+			item.DueMiles = &due
+		}
+		if rule.IntervalMonths > 0 {
+			due := date.AddDate(0, rule.IntervalMonths, 0)
+			item.DueDate = &due
+		}
+	}
+
+	status := func(s string) {
+		rank := map[string]int{MaintenanceOk: 0, MaintenanceUpcoming: 1, MaintenanceDue: 2, MaintenanceOverdue: 3}
+		if rank[s] > rank[item.Status] {
+			item.Status = s
+		}
+	}
+	if item.DueMiles != nil && item.CurrentMiles != nil {
+		left := *item.DueMiles - *item.CurrentMiles
+		switch {
+		case left < -warnMiles:
+			status(MaintenanceOverdue)
+		case left <= 0:
+			status(MaintenanceDue)
+		case left <= warnMiles:
+			status(MaintenanceUpcoming)
+		}
+	}
+	if item.DueDate != nil {
+		left := item.DueDate.Sub(now).Hours() / 24
+		switch {
+		case left < -float64(warnDays):
+			status(MaintenanceOverdue)
+		case left <= 0:
+			status(MaintenanceDue)
+		case left <= float64(warnDays):
+			status(MaintenanceUpcoming)
+		}
+	}
+	return item
+}
+
+//when the shop first knew of a car: when it was added, or its first odometer
+//reading if that is older
+func firstSeen(car Car, readings []OdometerReading) time.Time {
+	seen := car.CreatedAt
+	for _, reading := range readings {
+		if seen.IsZero() || reading.ReadAt.Before(seen) {
+			seen = reading.ReadAt
+		}
+	}
+	return seen
+}
+
+//works out every rule that applies to a car
+func carMaintenance(tx *gorm.DB, car Car, rules []MaintenanceRule, now time.Time) []MaintenanceItem {
+	var services []Service
+	tx.Where("car_id = ?", car.ID).Order("created_at, id").Find(&services)
+	var readings []OdometerReading
+	tx.Where("car_id = ?", car.ID).Order("read_at, id").Find(&readings)
+
+	items := []MaintenanceItem{}
+	for _, rule := range rules {
+		if ruleApplies(rule, car) {
+			items = append(items, computeMaintenance(rule, car, services, readings, now))
+		}
+	}
+	return items
+}
+
+func validateMaintenanceRule(rule MaintenanceRule) error {
+	if rule.Name == "" {
+		return errors.New("Name is required")
+	}
+	if rule.IntervalMiles <= 0 && rule.IntervalMonths <= 0 {
+		return errors.New("IntervalMiles or IntervalMonths is required")
+	}
+	if rule.LaborOperationId == nil && strings.TrimSpace(rule.Keywords) == "" {
+		return errors.New("LaborOperationId or Keywords is required to find past services")
+	}
+	return nil
+}
+
+//get all maintenance rules
+func getMaintenanceRules(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	var rules []MaintenanceRule
+	shopDB(r).Order("name").Find(&rules)
+	json.NewEncoder(w).Encode(&rules)
+}
+
+//create a maintenance rule
+func createMaintenanceRule(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	var rule MaintenanceRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := validateMaintenanceRule(rule); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := shopDB(r).Create(&rule).Error; err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&rule)
+}
+
+//edit a maintenance rule
+func updateMaintenanceRule(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var rule MaintenanceRule
+	if shopDB(r).First(&rule, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("maintenance rule %s not found", params["id"]))
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := validateMaintenanceRule(rule); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := shopDB(r).Save(&rule).Error; err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&rule)
+}
+
+//delete a maintenance rule
+func deleteMaintenanceRule(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var rule MaintenanceRule
+	if shopDB(r).First(&rule, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("maintenance rule %s not found", params["id"]))
+		return
+	}
+	shopDB(r).Delete(&rule)
+	json.NewEncoder(w).Encode(&rule)
+}
+
+//get the maintenance schedule of a car
+func getCarMaintenance(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var car Car
+	if shopDB(r).First(&car, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("car %s not found", params["id"]))
+		return
+	}
+
+	var rules []MaintenanceRule
+	shopDB(r).Order("name").Find(&rules)
+	items := carMaintenance(shopDB(r), car, rules, time.Now())
+	json.NewEncoder(w).Encode(&items)
+}
+
+//shop-wide list of cars with services upcoming, due or overdue, with the
+//owner's phone so they can be called. ?status=overdue,due narrows it down.
+func getDueList(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	rdb := readDB(r)
+	wanted := map[string]bool{MaintenanceUpcoming: true, MaintenanceDue: true, MaintenanceOverdue: true}
+	if statuses := r.URL.Query().Get("status"); statuses != "" {
+		wanted = map[string]bool{}
+		for _, s := range strings.Split(statuses, ",") {
+			wanted[strings.TrimSpace(s)] = true
+		}
+	}
+
+	var rules []MaintenanceRule
+	rdb.Order("name").Find(&rules)
+	var cars []Car
+	rdb.Order("id").Find(&cars)
+
+	//load the history of every car in two queries instead of two per car
+	var services []Service
+	rdb.Order("created_at, id").Find(&services)
+	var readings []OdometerReading
+	rdb.Order("read_at, id").Find(&readings)
+	servicesByCar := map[uint][]Service{}
+	for _, service := range services {
+		servicesByCar[service.CarId] = append(servicesByCar[service.CarId], service)
+	}
+	readingsByCar := map[uint][]OdometerReading{}
+	for _, reading := range readings {
+		readingsByCar[reading.CarId] = append(readingsByCar[reading.CarId], reading)
+	}
+
+	type dueCar struct {
+		CarId      uint
+		Make       string
+		Modelo     string
+		VinNumber  string
+		CustomerId uint
+		Customer   string
+		Phone      string
+		Items      []MaintenanceItem
+	}
+
+	customers := map[uint]Customer{}
+	now := time.Now()
+	list := []dueCar{}
+	for _, car := range cars {
+		var items []MaintenanceItem
+		for _, rule := range rules {
+			if !ruleApplies(rule, car) {
+				continue
+			}
+			item := computeMaintenance(rule, car, servicesByCar[car.ID], readingsByCar[car.ID], now)
+			if wanted[item.Status] {
+				items = append(items, item)
+			}
+		}
+		if len(items) == 0 {
+			continue
+		}
+
+		customer, ok := customers[car.CustomerId]
+		if !ok {
+			rdb.First(&customer, car.CustomerId)
+			customers[car.CustomerId] = customer
+		}
+		list = append(list, dueCar{
+			CarId:      car.ID,
+			Make:       car.Make,
+			Modelo:     car.Modelo,
+			VinNumber:  car.VinNumber,
+			CustomerId: car.CustomerId,
+			Customer:   strings.TrimSpace(customer.FirstName + " " + customer.LastName),
+			Phone:      customer.Phone,
+			Items:      items,
+		})
+	}
+
+	//the most urgent cars first
+	urgency := func(c dueCar) int {
+		worst := 0
+		for _, item := range c.Items {
+			switch item.Status {
+			case MaintenanceOverdue:
+				worst = 3
+			case MaintenanceDue:
+				if worst < 2 {
+					worst = 2
+				}
+			case MaintenanceUpcoming:
+				if worst < 1 {
+					worst = 1
+				}
+			}
+		}
+		return worst
+	}
+	sort.SliceStable(list, func(i, j int) bool { return urgency(list[i]) > urgency(list[j]) })
+
+	json.NewEncoder(w).Encode(&list)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestDateRuleIsDueOnACarWithNoHistory(t *testing.T) {
+	now := time.Now()
+	rule := MaintenanceRule{Name: "Brake fluid", IntervalMonths: 24, Keywords: "brake fluid"}
+	car := Car{Model: gorm.Model{ID: 1, CreatedAt: now.AddDate(-3, 0, 0)}}
+
+	item := computeMaintenance(rule, car, nil, nil, now)
+	if !item.NeverPerformed || item.DueDate == nil || item.Status != MaintenanceOverdue {
+		t.Fatalf("got %s due %v, want %s", item.Status, item.DueDate, MaintenanceOverdue)
+	}
+
+	//a reading older than the car's record moves the baseline back
+	car.CreatedAt = now.AddDate(0, -23, -20)
+	readings := []OdometerReading{{Value: 30000, ReadAt: now.AddDate(-2, -1, 0)}}
+	if item := computeMaintenance(rule, car, nil, readings, now); item.Status != MaintenanceDue && item.Status != MaintenanceOverdue {
+		t.Fatalf("measured from the first reading: got %s", item.Status)
+	}
+}
+
+func TestServiceLoggedTheUsualWayResetsARule(t *testing.T) {
+	tx := setupTestDB(t)
+	car := createTestService(t, tx).CarId
+	rule := MaintenanceRule{Name: "Oil change", IntervalMonths: 6, Keywords: "oil"}
+	tx.Create(&rule)
+	tx.Model(&Car{}).Where("id = ?", car).UpdateColumn("created_at", time.Now().AddDate(-2, 0, 0))
+
+	estimate := fmt.Sprintf(`{"CarId": %d, "Comment": "oil change", "Status": "estimate"}`, car)
+	logged := fmt.Sprintf(`{"CarId": %d, "Comment": "oil change"}`, car)
+	for i, body := range []string{estimate, logged} {
+		w := httptest.NewRecorder()
+		createService(w, httptest.NewRequest("POST", "/create/service", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("create service: %d %s", w.Code, w.Body)
+		}
+
+		var c Car
+		tx.First(&c, car)
+		item := carMaintenance(tx, c, []MaintenanceRule{rule}, time.Now())[0]
+		if i == 0 && item.Status != MaintenanceOverdue {
+			t.Fatalf("an estimate reset the rule: %s", item.Status)
+		}
+		if i == 1 && item.Status != MaintenanceOk {
+			t.Fatalf("a logged service didn't reset the rule: %s", item.Status)
+		}
+	}
+}
@@ -0,0 +1,590 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+//how much each kind of evidence adds to the score of a pair of customers,
+//a score is capped at 1
+const (
+	duplicatePhoneWeight = 0.45
+	duplicateVinWeight   = 0.4
+	duplicateNameWeight  = 0.35
+)
+
+//pairs scoring below this aren't listed unless ?min= says otherwise
+const defaultDuplicateScore = 0.5
+
+var errMergeSelf = errors.New("a customer can't be merged into itself")
+
+// DuplicateCandidate is a pair of customers that look like the same person.
+// Score is between 0 and 1, Reasons say what it is made of.
+type DuplicateCandidate struct {
+	Score          float64
+	Reasons        []string
+	SharedPhones   []string
+	SharedVins     []string
+	NameSimilarity float64
+	Customer       Customer
+	Other          Customer
+}
+
+// CustomerMerge records a customer merged into another. Merged is the
+// merged-away customer as it was before the merge, with its cars, contacts,
+// contact points and addresses, as JSON. Moved has the ids of the rows that
+// went over to the survivor by table, and of the duplicate contact points
+// and portal links deleted, also as JSON.
+type CustomerMerge struct {
+	gorm.Model
+
+	SurvivorId uint `gorm:"index"`
+	MergedId   uint `gorm:"index"`
+	Score      float64
+	Note       string
+	Merged     string
+	Moved      string
+}
+
+//what a customer is compared on
+type duplicateEvidence struct {
+	customer Customer
+	name     string
+	phones   map[string]bool
+	vins     map[string]bool
+}
+
+//accents people type or leave out, "Martínez" is "Martinez"
+var nameFolds = strings.NewReplacer(
+	"á", "a", "à", "a", "ä", "a", "â", "a", "é", "e", "è", "e", "ë", "e", "ê", "e",
+	"í", "i", "ì", "i", "ï", "i", "î", "i", "ó", "o", "ò", "o", "ö", "o", "ô", "o",
+	"ú", "u", "ù", "u", "ü", "u", "û", "u", "ñ", "n", "ç", "c",
+)
+
+//a name with case, accents and punctuation left out and its words sorted,
+//so "Castillo, Juan" and "juan castillo" are the same
+func duplicateNameKey(customer Customer) string {
+	name := customer.FirstName + " " + customer.LastName
+	if customer.Kind == CustomerBusiness && strings.TrimSpace(customer.CompanyName) != "" {
+		name = customer.CompanyName
+	}
+	words := strings.FieldsFunc(nameFolds.Replace(strings.ToLower(name)), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+	sort.Strings(words)
+	return strings.Join(words, " ")
+}
+
+//a phone as the digits that identify it, a leading US country code is left
+//out. Numbers too short to be a phone have no key.
+func duplicatePhoneKey(phone string) string {
+	digits, err := normalizeImportPhone(phone)
+	if err != nil {
+		return ""
+	}
+	return digits
+}
+
+//how alike two names are, 1 when they are the same and 0 when nothing is
+func nameSimilarity(a, b string) float64 {
+	if a == "" || b == "" {
+		return 0
+	}
+	if a == b {
+		return 1
+	}
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(minInt(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	return 1 - float64(previous[len(rb)])/float64(longest)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+//loads what customers are compared on: their names, the phones of their
+//contact points and the VINs of the cars they have or had. With no ids it
+//loads every customer that hasn't been anonymized.
+func loadDuplicateEvidence(tx *gorm.DB, ids ...uint) (map[uint]*duplicateEvidence, error) {
+	var customers []Customer
+	query := tx.Where("anonymized_at IS NULL").Order("id")
+	if len(ids) > 0 {
+		query = query.Where("id IN (?)", ids)
+	}
+	if err := query.Find(&customers).Error; err != nil {
+		return nil, err
+	}
+	evidence := map[uint]*duplicateEvidence{}
+	for _, customer := range customers {
+		e := &duplicateEvidence{customer: customer, name: duplicateNameKey(customer), phones: map[string]bool{}, vins: map[string]bool{}}
+		if key := duplicatePhoneKey(customer.Phone); key != "" {
+			e.phones[key] = true
+		}
+		evidence[customer.ID] = e
+	}
+
+	var points []ContactPoint
+	query = tx.Select("customer_id, value").Where("kind IN (?)", []string{ContactMobile, ContactHome, ContactWork})
+	if len(ids) > 0 {
+		query = query.Where("customer_id IN (?)", ids)
+	}
+	if err := query.Find(&points).Error; err != nil {
+		return nil, err
+	}
+	for _, point := range points {
+		if e, ok := evidence[point.CustomerId]; ok {
+			if key := duplicatePhoneKey(point.Value); key != "" {
+				e.phones[key] = true
+			}
+		}
+	}
+
+	//cars count whoever has them now or had them before, deleted cars too
+	//since a duplicate car is often how a duplicate customer shows
+	var cars []Car
+	if err := tx.Unscoped().Select("id, customer_id, vin_number").Where("vin_number <> ''").Find(&cars).Error; err != nil {
+		return nil, err
+	}
+	vins := map[uint]string{}
+	for _, car := range cars {
+		vins[car.ID] = strings.ToUpper(car.VinNumber)
+		if e, ok := evidence[car.CustomerId]; ok {
+			e.vins[vins[car.ID]] = true
+		}
+	}
+	var ownerships []CarOwnership
+	if err := tx.Select("car_id, customer_id").Find(&ownerships).Error; err != nil {
+		return nil, err
+	}
+	for _, ownership := range ownerships {
+		if e, ok := evidence[ownership.CustomerId]; ok && vins[ownership.CarId] != "" {
+			e.vins[vins[ownership.CarId]] = true
+		}
+	}
+	return evidence, nil
+}
+
+//keys of a set both sides have, sorted
+func sharedKeys(a, b map[string]bool) []string {
+	shared := []string{}
+	for key := range a {
+		if b[key] {
+			shared = append(shared, key)
+		}
+	}
+	sort.Strings(shared)
+	return shared
+}
+
+//how likely two customers are the same person and why
+func scoreDuplicate(a, b *duplicateEvidence) DuplicateCandidate {
+	candidate := DuplicateCandidate{
+		Reasons:        []string{},
+		SharedPhones:   sharedKeys(a.phones, b.phones),
+		SharedVins:     sharedKeys(a.vins, b.vins),
+		NameSimilarity: math.Round(nameSimilarity(a.name, b.name)*100) / 100,
+		Customer:       a.customer,
+		Other:          b.customer,
+	}
+	if len(candidate.SharedPhones) > 0 {
+		candidate.Score += duplicatePhoneWeight
+		candidate.Reasons = append(candidate.Reasons, "same phone "+strings.Join(candidate.SharedPhones, ", "))
+	}
+	if len(candidate.SharedVins) > 0 {
+		candidate.Score += duplicateVinWeight
+		candidate.Reasons = append(candidate.Reasons, "same car "+strings.Join(candidate.SharedVins, ", "))
+	}
+	if candidate.NameSimilarity == 1 {
+		candidate.Reasons = append(candidate.Reasons, "same name")
+	} else if candidate.NameSimilarity > 0 {
+		candidate.Reasons = append(candidate.Reasons, fmt.Sprintf("names %.0f%% alike", candidate.NameSimilarity*100))
+	}
+	candidate.Score += duplicateNameWeight * candidate.NameSimilarity
+	candidate.Score = math.Round(math.Min(candidate.Score, 1)*100) / 100
+	return candidate
+}
+
+//pairs of customers that may be the same person, best first. Only customers
+//sharing a phone, a car or a name are compared; with a customerId only the
+//pairs that customer is in are returned.
+func findDuplicateCandidates(tx *gorm.DB, customerId uint, min float64) ([]DuplicateCandidate, error) {
+	evidence, err := loadDuplicateEvidence(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := map[string][]uint{}
+	for id, e := range evidence {
+		for phone := range e.phones {
+			groups["phone "+phone] = append(groups["phone "+phone], id)
+		}
+		for vin := range e.vins {
+			groups["vin "+vin] = append(groups["vin "+vin], id)
+		}
+		if e.name != "" {
+			groups["name "+e.name] = append(groups["name "+e.name], id)
+		}
+	}
+	pairs := map[[2]uint]bool{}
+	for _, ids := range groups {
+		for i := range ids {
+			for j := range ids {
+				if ids[i] < ids[j] {
+					pairs[[2]uint{ids[i], ids[j]}] = true
+				}
+			}
+		}
+	}
+
+	candidates := []DuplicateCandidate{}
+	for pair := range pairs {
+		if customerId != 0 && pair[0] != customerId && pair[1] != customerId {
+			continue
+		}
+		candidate := scoreDuplicate(evidence[pair[0]], evidence[pair[1]])
+		if candidate.Score >= min {
+			candidates = append(candidates, candidate)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Score != candidates[j].Score {
+			return candidates[i].Score > candidates[j].Score
+		}
+		if candidates[i].Customer.ID != candidates[j].Customer.ID {
+			return candidates[i].Customer.ID < candidates[j].Customer.ID
+		}
+		return candidates[i].Other.ID < candidates[j].Other.ID
+	})
+	return candidates, nil
+}
+
+//the tables pointing at a customer and the column they do it with, the rows
+//of a merged customer move over to the survivor. Contact points are moved on
+//their own since they can be duplicates, and portal links are deleted: one
+//sent to the merged customer's address shouldn't open the survivor's records.
+var customerReferences = []struct {
+	Model  interface{}
+	Column string
+}{
+	{&Car{}, "customer_id"},
+	{&CarOwnership{}, "customer_id"},
+	{&CustomerContact{}, "customer_id"},
+	{&Address{}, "customer_id"},
+	{&Attachment{}, "customer_id"},
+	{&Notification{}, "customer_id"},
+	{&PrivacyRequest{}, "customer_id"},
+	{&Appointment{}, "customer_id"},
+	{&CustomerMerge{}, "survivor_id"},
+}
+
+//moves the contact points of a merged customer to the survivor. A phone or
+//email the survivor already has is deleted, and the survivor's primaries stay
+//primary.
+func mergeContactPoints(tx *gorm.DB, survivorId, mergedId uint, moved map[string][]uint) error {
+	class := func(kind string) string {
+		if isPhoneKind(kind) {
+			return "phone"
+		}
+		return kind
+	}
+	//phones are the same when duplicates would take them for the same
+	key := func(point ContactPoint) string {
+		if phone := duplicatePhoneKey(point.Value); isPhoneKind(point.Kind) && phone != "" {
+			return "phone " + phone
+		}
+		return class(point.Kind) + " " + point.Normalized
+	}
+	var existing []ContactPoint
+	if err := tx.Where("customer_id = ?", survivorId).Find(&existing).Error; err != nil {
+		return err
+	}
+	has := map[string]ContactPoint{}
+	primary := map[string]bool{}
+	for _, point := range existing {
+		has[key(point)] = point
+		primary[class(point.Kind)] = primary[class(point.Kind)] || point.IsPrimary
+	}
+
+	var points []ContactPoint
+	if err := tx.Unscoped().Where("customer_id = ?", mergedId).Order("is_primary DESC, id").Find(&points).Error; err != nil {
+		return err
+	}
+	for _, point := range points {
+		if same, ok := has[key(point)]; ok && point.DeletedAt == nil {
+			//the survivor's copy stays, verified if either was
+			if point.Verified && !same.Verified {
+				err := tx.Model(&same).Updates(map[string]interface{}{"verified": true, "verified_at": point.VerifiedAt}).Error
+				if err != nil {
+					return err
+				}
+			}
+			if err := tx.Delete(&point).Error; err != nil {
+				return err
+			}
+			point.IsPrimary = false
+			moved["duplicate_contact_points"] = append(moved["duplicate_contact_points"], point.ID)
+		} else if point.DeletedAt == nil {
+			if point.IsPrimary && primary[class(point.Kind)] {
+				point.IsPrimary = false
+			}
+			primary[class(point.Kind)] = primary[class(point.Kind)] || point.IsPrimary
+			has[key(point)] = point
+		}
+		err := tx.Unscoped().Model(&ContactPoint{}).Where("id = ?", point.ID).
+			Updates(map[string]interface{}{"customer_id": survivorId, "is_primary": point.IsPrimary}).Error
+		if err != nil {
+			return err
+		}
+		moved["contact_points"] = append(moved["contact_points"], point.ID)
+	}
+	return syncCustomerContacts(tx, survivorId)
+}
+
+//merges a customer into a survivor: everything pointing at the merged
+//customer moves over, blank fields of the survivor are filled in from it and
+//it is deleted. What it was is kept in the CustomerMerge returned.
+func mergeCustomers(tx *gorm.DB, survivor, merged Customer, note string) (CustomerMerge, error) {
+	if survivor.ID == merged.ID {
+		return CustomerMerge{}, errMergeSelf
+	}
+	snapshot, _ := findCustomerWithCars(tx, merged.ID)
+	mergedData, err := json.Marshal(&snapshot)
+	if err != nil {
+		return CustomerMerge{}, err
+	}
+	evidence, err := loadDuplicateEvidence(tx, survivor.ID, merged.ID)
+	if err != nil {
+		return CustomerMerge{}, err
+	}
+	score := scoreDuplicate(evidence[survivor.ID], evidence[merged.ID]).Score
+
+	moved := map[string][]uint{}
+	var hasPrimaryAddress int
+	tx.Model(&Address{}).Where("customer_id = ? AND is_primary", survivor.ID).Count(&hasPrimaryAddress)
+	for _, reference := range customerReferences {
+		var ids []uint
+		err := tx.Unscoped().Model(reference.Model).Where(reference.Column+" = ?", merged.ID).Order("id").Pluck("id", &ids).Error
+		if err != nil {
+			return CustomerMerge{}, err
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		err = tx.Unscoped().Model(reference.Model).Where("id IN (?)", ids).Update(reference.Column, survivor.ID).Error
+		if err != nil {
+			return CustomerMerge{}, err
+		}
+		moved[tx.NewScope(reference.Model).TableName()] = ids
+	}
+	var tokens []uint
+	if err := tx.Unscoped().Model(&PortalToken{}).Where("customer_id = ?", merged.ID).Pluck("id", &tokens).Error; err != nil {
+		return CustomerMerge{}, err
+	}
+	if len(tokens) > 0 {
+		if err := tx.Unscoped().Where("id IN (?)", tokens).Delete(&PortalToken{}).Error; err != nil {
+			return CustomerMerge{}, err
+		}
+		moved["deleted_portal_tokens"] = tokens
+	}
+	if hasPrimaryAddress > 0 && len(moved["addresses"]) > 0 {
+		err := tx.Model(&Address{}).Where("id IN (?)", moved["addresses"]).Update("is_primary", false).Error
+		if err != nil {
+			return CustomerMerge{}, err
+		}
+	}
+	if err := mergeContactPoints(tx, survivor.ID, merged.ID, moved); err != nil {
+		return CustomerMerge{}, err
+	}
+
+	//the survivor keeps what it has, opting out on either record sticks
+	updates := fillBlanks(map[string]string{
+		"first_name":        survivor.FirstName,
+		"last_name":         survivor.LastName,
+		"company_name":      survivor.CompanyName,
+		"tax_id":            survivor.TaxId,
+		"billing_terms":     survivor.BillingTerms,
+		"preferred_channel": survivor.PreferredChannel,
+		"quiet_hours_start": survivor.QuietHoursStart,
+		"quiet_hours_end":   survivor.QuietHoursEnd,
+	}, map[string]string{
+		"first_name":        merged.FirstName,
+		"last_name":         merged.LastName,
+		"company_name":      merged.CompanyName,
+		"tax_id":            merged.TaxId,
+		"billing_terms":     merged.BillingTerms,
+		"preferred_channel": merged.PreferredChannel,
+		"quiet_hours_start": merged.QuietHoursStart,
+		"quiet_hours_end":   merged.QuietHoursEnd,
+	})
+	if merged.Kind == CustomerBusiness && survivor.Kind != CustomerBusiness {
+		updates["kind"] = CustomerBusiness
+	}
+	if merged.EmailOptOut && !survivor.EmailOptOut {
+		updates["email_opt_out"] = true
+	}
+	if merged.SmsOptOut && !survivor.SmsOptOut {
+		updates["sms_opt_out"] = true
+	}
+	if merged.RequirePONumber && !survivor.RequirePONumber {
+		updates["require_po_number"] = true
+	}
+	if len(updates) > 0 {
+		if err := tx.Model(&survivor).Updates(updates).Error; err != nil {
+			return CustomerMerge{}, err
+		}
+	}
+
+	if err := tx.Unscoped().Delete(&merged).Error; err != nil {
+		return CustomerMerge{}, err
+	}
+	movedData, err := json.Marshal(moved)
+	if err != nil {
+		return CustomerMerge{}, err
+	}
+	merge := CustomerMerge{
+		SurvivorId: survivor.ID,
+		MergedId:   merged.ID,
+		Score:      score,
+		Note:       note,
+		Merged:     string(mergedData),
+		Moved:      string(movedData),
+	}
+	return merge, tx.Create(&merge).Error
+}
+
+//get the pairs of customers that look like the same person. ?min= is the
+//lowest score listed, ?customerId= the pairs of one customer and ?limit= how
+//many pairs at most.
+func getDuplicateCustomers(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	min := defaultDuplicateScore
+	if s := r.URL.Query().Get("min"); s != "" {
+		var err error
+		if min, err = strconv.ParseFloat(s, 64); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid min %q", s))
+			return
+		}
+	}
+	var customerId uint64
+	if s := r.URL.Query().Get("customerId"); s != "" {
+		var err error
+		if customerId, err = strconv.ParseUint(s, 10, 32); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid customerId %q", s))
+			return
+		}
+	}
+	limit := 100
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", s))
+			return
+		}
+	}
+
+	candidates, err := findDuplicateCandidates(readDB(r), uint(customerId), min)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+	json.NewEncoder(w).Encode(&candidates)
+}
+
+//merge another customer into this one, which keeps its id
+func mergeCustomerHandler(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var body struct {
+		MergedId uint
+		Note     string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var merge CustomerMerge
+	status := http.StatusInternalServerError
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		var survivor, merged Customer
+		if tx.First(&survivor, params["id"]).RecordNotFound() {
+			status = http.StatusNotFound
+			return fmt.Errorf("customer %s not found", params["id"])
+		}
+		if tx.First(&merged, body.MergedId).RecordNotFound() {
+			status = http.StatusNotFound
+			return fmt.Errorf("customer %d not found", body.MergedId)
+		}
+		if survivor.AnonymizedAt != nil || merged.AnonymizedAt != nil {
+			status = http.StatusConflict
+			return errCustomerAnonymized
+		}
+		var err error
+		merge, err = mergeCustomers(tx, survivor, merged, body.Note)
+		if err == errMergeSelf {
+			status = http.StatusBadRequest
+		}
+		return err
+	})
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&merge)
+}
+
+//the customers merged into a customer, newest first
+func getCustomerMerges(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	merges := []CustomerMerge{}
+	shopDB(r).Where("survivor_id = ?", params["id"]).Order("id DESC").Find(&merges)
+	json.NewEncoder(w).Encode(&merges)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+func addTestContactPoint(t *testing.T, tx *gorm.DB, customerId uint, kind, value string, primary bool) ContactPoint {
+	t.Helper()
+	point := ContactPoint{CustomerId: customerId, Kind: kind, Value: value, IsPrimary: primary}
+	if err := normalizeContactPoint(&point); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveContactPoint(tx, &point); err != nil {
+		t.Fatal(err)
+	}
+	return point
+}
+
+func TestMergingMovesCarsAndDropsDuplicateContacts(t *testing.T) {
+	tx := setupTestDB(t)
+	survivor := Customer{FirstName: "Ana", LastName: "Ruiz"}
+	merged := Customer{FirstName: "Ana", LastName: "Ruiz", QuietHoursStart: "21:00", QuietHoursEnd: "08:00"}
+	for _, customer := range []*Customer{&survivor, &merged} {
+		if err := tx.Create(customer).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	addTestContactPoint(t, tx, survivor.ID, ContactMobile, "555-123-4567", true)
+	duplicate := addTestContactPoint(t, tx, merged.ID, ContactMobile, "(555) 123 4567", true)
+	email := addTestContactPoint(t, tx, merged.ID, ContactEmail, "ana@example.com", true)
+
+	car := Car{Make: "Ford", Modelo: "F150", CustomerId: merged.ID}
+	if err := tx.Create(&car).Error; err != nil {
+		t.Fatal(err)
+	}
+	ownership := CarOwnership{CarId: car.ID, CustomerId: merged.ID, StartedAt: time.Now()}
+	if err := tx.Create(&ownership).Error; err != nil {
+		t.Fatal(err)
+	}
+	request := PrivacyRequest{CustomerId: merged.ID, Kind: PrivacyExport}
+	if err := tx.Create(&request).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := issuePortalToken(tx, merged.ID, PortalTokenLink, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := mergeCustomers(tx, survivor, merged, "same person"); err != nil {
+		t.Fatal(err)
+	}
+
+	tx.First(&car, car.ID)
+	tx.First(&ownership, ownership.ID)
+	tx.First(&request, request.ID)
+	if car.CustomerId != survivor.ID || ownership.CustomerId != survivor.ID {
+		t.Errorf("car belongs to %d and its ownership to %d, want %d", car.CustomerId, ownership.CustomerId, survivor.ID)
+	}
+	if request.CustomerId != survivor.ID {
+		t.Errorf("privacy request belongs to %d, want %d", request.CustomerId, survivor.ID)
+	}
+
+	var points []ContactPoint
+	tx.Where("customer_id = ?", survivor.ID).Order("id").Find(&points)
+	if len(points) != 2 || points[1].ID != email.ID {
+		t.Fatalf("survivor has contact points %+v, want its phone and the merged email", points)
+	}
+	if !tx.First(&ContactPoint{}, duplicate.ID).RecordNotFound() {
+		t.Error("the duplicate phone is still there")
+	}
+	var reloaded Customer
+	tx.First(&reloaded, survivor.ID)
+	if reloaded.Email != "ana@example.com" || reloaded.QuietHoursStart != "21:00" {
+		t.Errorf("survivor email %q and quiet hours %q, want the merged customer's", reloaded.Email, reloaded.QuietHoursStart)
+	}
+
+	var tokens int
+	tx.Unscoped().Model(&PortalToken{}).Where("customer_id IN (?)", []uint{survivor.ID, merged.ID}).Count(&tokens)
+	if tokens != 0 {
+		t.Errorf("%d portal links survived the merge", tokens)
+	}
+	if !tx.Unscoped().First(&Customer{}, merged.ID).RecordNotFound() {
+		t.Error("the merged customer is still there")
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+//go:embed migrations/*.sql migrations/sqlite/*.sql
+var migrationFiles embed.FS
+
+//the key of the advisory lock held while migrating, so two instances
+//starting at once don't both run the same migration
+const migrationLockKey = 7316240551
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// Migration is a numbered pair of SQL scripts, Up applies it and Down
+// reverts it
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// SchemaMigration is a migration applied to the database
+type SchemaMigration struct {
+	Version   int `gorm:"primary_key;auto_increment:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+//Go backfills that run right after the SQL of a migration, in the same
+//transaction, for data SQL can't convert on its own
+var migrationHooks = map[int]func(tx *gorm.DB) error{
+	5: backfillOdometerReadings,
+	9: backfillContactPoints,
+}
+
+//where the scripts of a dialect are. SQLite has scripts of its own with the
+//same versions, written for databases that start out empty.
+func migrationDir(dialect string) string {
+	if dialect == DialectSQLite {
+		return "migrations/sqlite"
+	}
+	return "migrations"
+}
+
+//the migrations embedded in the binary for a dialect, oldest first
+func loadMigrations(dialect string) ([]Migration, error) {
+	dir := migrationDir(dialect)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration %s isn't named NNNN_name.up.sql or NNNN_name.down.sql", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		body, err := migrationFiles.ReadFile(dir + "/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := []Migration{}
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down script", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+//the migrations applied to the database by version, none when the
+//schema_migrations table doesn't exist yet
+func appliedMigrations(tx *gorm.DB) (map[int]SchemaMigration, error) {
+	applied := map[int]SchemaMigration{}
+	if !tx.HasTable(&SchemaMigration{}) {
+		return applied, nil
+	}
+	var rows []SchemaMigration
+	if err := tx.Order("version").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+//migrations in the binary the database doesn't have yet
+func pendingMigrations(tx *gorm.DB) ([]Migration, error) {
+	migrations, err := loadMigrations(tx.Dialect().GetName())
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(tx)
+	if err != nil {
+		return nil, err
+	}
+	pending := []Migration{}
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; !ok {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+//runs fn holding the migration lock. The lock belongs to a connection of
+//its own, which is kept until fn returns. SQLite has no advisory locks, its
+//single connection already keeps migrations from overlapping.
+func withMigrationLock(fn func() error) error {
+	appliedAt := "timestamp with time zone"
+	if isSQLite(db) {
+		appliedAt = "datetime"
+	} else {
+		ctx := context.Background()
+		conn, err := db.DB().Conn(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+			return fmt.Errorf("taking the migration lock: %v", err)
+		}
+		defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+	}
+
+	if err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer PRIMARY KEY,
+		name text NOT NULL,
+		applied_at ` + appliedAt + ` NOT NULL
+	);`).Error; err != nil {
+		return err
+	}
+	return fn()
+}
+
+//applies up to limit pending migrations, all of them when limit is 0
+func migrateUp(limit int) ([]Migration, error) {
+	var done []Migration
+	err := withMigrationLock(func() error {
+		//another instance may have migrated while we waited for the lock
+		pending, err := pendingMigrations(db)
+		if err != nil {
+			return err
+		}
+		for i, m := range pending {
+			if limit > 0 && i >= limit {
+				break
+			}
+			err := db.Transaction(func(tx *gorm.DB) error {
+				if err := seeEveryShop(tx); err != nil {
+					return err
+				}
+				if err := tx.Exec(m.Up).Error; err != nil {
+					return err
+				}
+				if hook, ok := migrationHooks[m.Version]; ok {
+					if err := hook(tx); err != nil {
+						return err
+					}
+				}
+				return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+			})
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s: %v", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+//reverts the last steps applied migrations
+func migrateDown(steps int) ([]Migration, error) {
+	var done []Migration
+	err := withMigrationLock(func() error {
+		migrations, err := loadMigrations(db.Dialect().GetName())
+		if err != nil {
+			return err
+		}
+		byVersion := map[int]Migration{}
+		for _, m := range migrations {
+			byVersion[m.Version] = m
+		}
+
+		var applied []SchemaMigration
+		if err := db.Order("version DESC").Limit(steps).Find(&applied).Error; err != nil {
+			return err
+		}
+		for _, row := range applied {
+			m, ok := byVersion[row.Version]
+			if !ok {
+				return fmt.Errorf("migration %04d_%s isn't in this build, it can't be reverted", row.Version, row.Name)
+			}
+			err := db.Transaction(func(tx *gorm.DB) error {
+				if err := seeEveryShop(tx); err != nil {
+					return err
+				}
+				if err := tx.Exec(m.Down).Error; err != nil {
+					return err
+				}
+				return tx.Where("version = ?", m.Version).Delete(&SchemaMigration{}).Error
+			})
+			if err != nil {
+				return fmt.Errorf("reverting %04d_%s: %v", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+//prints every migration and whether the database has it
+func printMigrationStatus() error {
+	migrations, err := loadMigrations(db.Dialect().GetName())
+	if err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	known := map[int]bool{}
+	for _, m := range migrations {
+		known[m.Version] = true
+		if row, ok := applied[m.Version]; ok {
+			fmt.Printf("%04d_%-40s applied %s\n", m.Version, m.Name, row.AppliedAt.Format(time.RFC3339))
+		} else {
+			fmt.Printf("%04d_%-40s pending\n", m.Version, m.Name)
+		}
+	}
+	for version, row := range applied {
+		if !known[version] {
+			fmt.Printf("%04d_%-40s applied %s, not in this build\n", version, row.Name, row.AppliedAt.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+//writes empty pairs of scripts for the next migration to dir, one for
+//postgres and one for SQLite in dir/sqlite
+func newMigration(dir, name string) ([]string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	name = regexp.MustCompile(`[^a-z0-9]+`).ReplaceAllString(name, "_")
+	name = strings.Trim(name, "_")
+	if name == "" {
+		return nil, errors.New("usage: migrate new <name>")
+	}
+
+	migrations, err := loadMigrations(DialectPostgres)
+	if err != nil {
+		return nil, err
+	}
+	next := 1
+	if len(migrations) > 0 {
+		next = migrations[len(migrations)-1].Version + 1
+	}
+	//the source directory may have scripts this binary wasn't built with
+	existing, _ := filepath.Glob(filepath.Join(dir, "*.sql"))
+	for _, path := range existing {
+		if match := migrationFileName.FindStringSubmatch(filepath.Base(path)); match != nil {
+			if version, _ := strconv.Atoi(match[1]); version >= next {
+				next = version + 1
+			}
+		}
+	}
+
+	var created []string
+	for _, target := range []string{dir, filepath.Join(dir, "sqlite")} {
+		for _, direction := range []string{"up", "down"} {
+			path := filepath.Join(target, fmt.Sprintf("%04d_%s.%s.sql", next, name, direction))
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+			if err != nil {
+				return created, err
+			}
+			fmt.Fprintf(f, "-- %04d_%s %s\n", next, name, direction)
+			if err := f.Close(); err != nil {
+				return created, err
+			}
+			created = append(created, path)
+		}
+	}
+	return created, nil
+}
+
+//mecanica-service migrate up [n] | down [n] | status | new <name>
+func runMigrateCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: migrate up [n] | down [n] | status | new <name>")
+	}
+	count := func(fallback int) (int, error) {
+		if len(args) < 2 {
+			return fallback, nil
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("%q is not a number of migrations", args[1])
+		}
+		return n, nil
+	}
+
+	switch args[0] {
+	case "up":
+		n, err := count(0)
+		if err != nil {
+			return err
+		}
+		done, err := migrateUp(n)
+		for _, m := range done {
+			fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Println("database is up to date")
+		}
+		return err
+	case "down":
+		n, err := count(1)
+		if err != nil {
+			return err
+		}
+		done, err := migrateDown(n)
+		for _, m := range done {
+			fmt.Printf("reverted %04d_%s\n", m.Version, m.Name)
+		}
+		return err
+	case "status":
+		return printMigrationStatus()
+	case "new":
+		if len(args) < 2 {
+			return errors.New("usage: migrate new <name>")
+		}
+		dir := os.Getenv("MIGRATIONS_DIR")
+		if dir == "" {
+			dir = "migrations"
+		}
+		created, err := newMigration(dir, strings.Join(args[1:], "_"))
+		for _, path := range created {
+			fmt.Println("created", path)
+		}
+		return err
+	}
+	return fmt.Errorf("unknown migrate command %q", args[0])
+}
+
+//stops the server from running against a database that is missing
+//migrations this build relies on
+func requireMigratedSchema() error {
+	pending, err := pendingMigrations(db)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		first := pending[0]
+		return fmt.Errorf("database is missing %d migration(s) starting with %04d_%s, run `mecanica-service migrate up`",
+			len(pending), first.Version, first.Name)
+	}
+	return nil
+}
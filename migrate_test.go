@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMigrationsTakeOverTablesWithSharedPhonesAndVINs(t *testing.T) {
+	conn, err := openDatabase("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := db
+	db = conn
+	defer func() {
+		db = previous
+		conn.Close()
+	}()
+
+	//tables made before there were migrations, without the unique indexes
+	err = conn.Exec(`
+		CREATE TABLE customers (id integer PRIMARY KEY AUTOINCREMENT, created_at datetime, updated_at datetime, deleted_at datetime, first_name text, last_name text, phone text);
+		CREATE TABLE cars (id integer PRIMARY KEY AUTOINCREMENT, created_at datetime, updated_at datetime, deleted_at datetime, make text, modelo text, color text, vin_number text, customer_id integer);
+		INSERT INTO customers (first_name, phone) VALUES ('Ana', '5551234567'), ('Luis', '5551234567');
+		INSERT INTO cars (make, vin_number, customer_id) VALUES ('Ford', '', 1), ('Honda', '', 2);
+	`).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrations, err := loadMigrations(DialectSQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrateUp(0); err != nil {
+		t.Fatal(err)
+	}
+	var customers, cars int
+	conn.Table("customers").Count(&customers)
+	conn.Table("cars").Count(&cars)
+	if customers != 2 || cars != 2 {
+		t.Errorf("%d customers and %d cars after migrating, want 2 of each", customers, cars)
+	}
+
+	//and every migration can be reverted and applied again
+	if done, err := migrateDown(len(migrations)); err != nil || len(done) != len(migrations) {
+		t.Fatalf("reverted %d of %d migrations: %v", len(done), len(migrations), err)
+	}
+	if _, err := migrateUp(0); err != nil {
+		t.Fatal(err)
+	}
+}
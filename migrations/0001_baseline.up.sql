@@ -0,0 +1,41 @@
+-- customers, cars and services as AutoMigrate created them, so databases
+-- that already have them can be brought under migrations. The unique phone
+-- and VIN indexes AutoMigrate made are left out: existing rows may break
+-- them, and 0009 and 0010 drop them anyway.
+CREATE TABLE IF NOT EXISTS customers (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	first_name text,
+	last_name text,
+	phone text,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_customers_deleted_at ON customers (deleted_at);
+
+CREATE TABLE IF NOT EXISTS cars (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	make text,
+	modelo text,
+	color text,
+	vin_number text,
+	customer_id integer,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_cars_deleted_at ON cars (deleted_at);
+
+CREATE TABLE IF NOT EXISTS services (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	comment text,
+	miles text,
+	car_id integer,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_services_deleted_at ON services (deleted_at);
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS purchase_order_lines;
+DROP TABLE IF EXISTS purchase_orders;
+DROP TABLE IF EXISTS suppliers;
+DROP TABLE IF EXISTS service_parts;
+DROP TABLE IF EXISTS stock_movements;
+DROP TABLE IF EXISTS parts;
+ALTER TABLE services DROP COLUMN IF EXISTS status;
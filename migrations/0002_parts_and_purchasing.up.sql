@@ -0,0 +1,95 @@
+ALTER TABLE services ADD COLUMN IF NOT EXISTS status text;
+
+CREATE TABLE IF NOT EXISTS parts (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	sku varchar(100),
+	description text,
+	brand text,
+	cost numeric,
+	price numeric,
+	bin_location text,
+	on_hand integer,
+	reserved integer,
+	min_quantity integer,
+	reorder_quantity integer,
+	preferred_supplier_id integer,
+	PRIMARY KEY (id)
+);
+ALTER TABLE parts ADD COLUMN IF NOT EXISTS reorder_quantity integer;
+ALTER TABLE parts ADD COLUMN IF NOT EXISTS preferred_supplier_id integer;
+CREATE INDEX IF NOT EXISTS idx_parts_deleted_at ON parts (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_parts_sku ON parts (sku);
+
+CREATE TABLE IF NOT EXISTS stock_movements (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	part_id integer,
+	service_id integer,
+	kind text,
+	quantity integer,
+	unit_cost numeric,
+	note text,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_stock_movements_deleted_at ON stock_movements (deleted_at);
+
+CREATE TABLE IF NOT EXISTS service_parts (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	service_id integer,
+	part_id integer,
+	quantity integer,
+	price numeric,
+	status text,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_service_parts_deleted_at ON service_parts (deleted_at);
+
+CREATE TABLE IF NOT EXISTS suppliers (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	name text,
+	contact_name text,
+	phone text,
+	email text,
+	notes text,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_suppliers_deleted_at ON suppliers (deleted_at);
+
+CREATE TABLE IF NOT EXISTS purchase_orders (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	supplier_id integer,
+	status text,
+	notes text,
+	sent_at timestamp with time zone,
+	received_at timestamp with time zone,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_purchase_orders_deleted_at ON purchase_orders (deleted_at);
+
+CREATE TABLE IF NOT EXISTS purchase_order_lines (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	purchase_order_id integer,
+	part_id integer,
+	quantity integer,
+	quantity_received integer,
+	unit_cost numeric,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_purchase_order_lines_deleted_at ON purchase_order_lines (deleted_at);
@@ -0,0 +1,85 @@
+ALTER TABLE services ADD COLUMN IF NOT EXISTS labor_operation_id integer;
+ALTER TABLE services ADD COLUMN IF NOT EXISTS technician_id integer;
+ALTER TABLE services ADD COLUMN IF NOT EXISTS hours numeric;
+ALTER TABLE services ADD COLUMN IF NOT EXISTS price numeric;
+
+CREATE TABLE IF NOT EXISTS labor_operations (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	code varchar(50),
+	description text,
+	hours numeric,
+	price numeric,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_labor_operations_deleted_at ON labor_operations (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_labor_operations_code ON labor_operations (code);
+
+CREATE TABLE IF NOT EXISTS canned_jobs (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	name text,
+	description text,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_canned_jobs_deleted_at ON canned_jobs (deleted_at);
+
+CREATE TABLE IF NOT EXISTS canned_job_labors (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	canned_job_id integer,
+	labor_operation_id integer,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_canned_job_labors_deleted_at ON canned_job_labors (deleted_at);
+
+CREATE TABLE IF NOT EXISTS canned_job_parts (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	canned_job_id integer,
+	part_id integer,
+	quantity integer,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_canned_job_parts_deleted_at ON canned_job_parts (deleted_at);
+
+CREATE TABLE IF NOT EXISTS employees (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	first_name text,
+	last_name text,
+	phone text,
+	role text,
+	active boolean,
+	shift_end text,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_employees_deleted_at ON employees (deleted_at);
+
+CREATE TABLE IF NOT EXISTS time_punches (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	employee_id integer,
+	service_id integer,
+	clock_on timestamp with time zone,
+	clock_off timestamp with time zone,
+	auto_closed boolean,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_time_punches_deleted_at ON time_punches (deleted_at);
+-- an employee can only be clocked on to one job at a time
+CREATE UNIQUE INDEX IF NOT EXISTS idx_time_punches_open
+	ON time_punches (employee_id)
+	WHERE clock_off IS NULL AND deleted_at IS NULL;
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS attachments;
+DROP TABLE IF EXISTS inspection_results;
+DROP TABLE IF EXISTS inspections;
+DROP TABLE IF EXISTS inspection_template_items;
+DROP TABLE IF EXISTS inspection_sections;
+DROP TABLE IF EXISTS inspection_templates;
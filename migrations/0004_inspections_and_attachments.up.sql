@@ -0,0 +1,85 @@
+CREATE TABLE IF NOT EXISTS inspection_templates (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	name text,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_inspection_templates_deleted_at ON inspection_templates (deleted_at);
+
+CREATE TABLE IF NOT EXISTS inspection_sections (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	inspection_template_id integer,
+	name text,
+	"position" integer,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_inspection_sections_deleted_at ON inspection_sections (deleted_at);
+
+CREATE TABLE IF NOT EXISTS inspection_template_items (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	inspection_section_id integer,
+	name text,
+	"position" integer,
+	unit text,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_inspection_template_items_deleted_at ON inspection_template_items (deleted_at);
+
+CREATE TABLE IF NOT EXISTS inspections (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	car_id integer,
+	inspection_template_id integer,
+	technician_id integer,
+	miles text,
+	status text,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_inspections_deleted_at ON inspections (deleted_at);
+
+CREATE TABLE IF NOT EXISTS inspection_results (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	inspection_id integer,
+	inspection_template_item_id integer,
+	section text,
+	item text,
+	"position" integer,
+	rating text,
+	notes text,
+	measurement numeric,
+	unit text,
+	service_id integer,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_inspection_results_deleted_at ON inspection_results (deleted_at);
+
+CREATE TABLE IF NOT EXISTS attachments (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	car_id integer,
+	service_id integer,
+	customer_id integer,
+	file_name text,
+	content_type text,
+	size bigint,
+	checksum text,
+	blob_key text,
+	thumbnail_key text,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_attachments_deleted_at ON attachments (deleted_at);
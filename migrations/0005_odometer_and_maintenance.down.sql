@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS maintenance_rules;
+DROP TABLE IF EXISTS odometer_readings;
+ALTER TABLE services DROP COLUMN IF EXISTS miles_unparsed;
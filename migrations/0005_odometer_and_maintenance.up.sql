@@ -0,0 +1,40 @@
+ALTER TABLE services ADD COLUMN IF NOT EXISTS miles_unparsed boolean;
+-- the odometer backfill only looks at services not already flagged
+UPDATE services SET miles_unparsed = false WHERE miles_unparsed IS NULL;
+
+CREATE TABLE IF NOT EXISTS odometer_readings (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	car_id integer,
+	service_id integer,
+	value integer,
+	unit text,
+	read_at timestamp with time zone,
+	replacement boolean,
+	source text,
+	note text,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_odometer_readings_deleted_at ON odometer_readings (deleted_at);
+
+CREATE TABLE IF NOT EXISTS maintenance_rules (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	name text,
+	make text,
+	modelo text,
+	year_from integer,
+	year_to integer,
+	interval_miles integer,
+	interval_months integer,
+	warn_miles integer,
+	warn_days integer,
+	labor_operation_id integer,
+	keywords text,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_maintenance_rules_deleted_at ON maintenance_rules (deleted_at);
@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS portal_tokens;
+DROP TABLE IF EXISTS notification_templates;
+DROP TABLE IF EXISTS notifications;
+ALTER TABLE customers DROP COLUMN IF EXISTS quiet_hours_end;
+ALTER TABLE customers DROP COLUMN IF EXISTS quiet_hours_start;
+ALTER TABLE customers DROP COLUMN IF EXISTS sms_opt_out;
+ALTER TABLE customers DROP COLUMN IF EXISTS email_opt_out;
+ALTER TABLE customers DROP COLUMN IF EXISTS email;
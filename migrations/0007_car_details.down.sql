@@ -0,0 +1,11 @@
+DROP INDEX IF EXISTS idx_cars_plate;
+ALTER TABLE cars DROP COLUMN IF EXISTS vin_issues;
+ALTER TABLE cars DROP COLUMN IF EXISTS mileage_unit;
+ALTER TABLE cars DROP COLUMN IF EXISTS fuel_type;
+ALTER TABLE cars DROP COLUMN IF EXISTS transmission;
+ALTER TABLE cars DROP COLUMN IF EXISTS engine;
+ALTER TABLE cars DROP COLUMN IF EXISTS "trim";
+ALTER TABLE cars DROP COLUMN IF EXISTS year;
+ALTER TABLE cars DROP COLUMN IF EXISTS plate_country;
+ALTER TABLE cars DROP COLUMN IF EXISTS plate_state;
+ALTER TABLE cars DROP COLUMN IF EXISTS license_plate;
@@ -0,0 +1,23 @@
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS license_plate text;
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS plate_state text;
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS plate_country text;
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS year integer;
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS "trim" text;
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS engine text;
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS transmission text;
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS fuel_type text;
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS mileage_unit text;
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS vin_issues text;
+
+-- empty rather than NULL plates so the unique index sees them, and miles
+-- for cars saved before the unit existed
+UPDATE cars SET license_plate = '' WHERE license_plate IS NULL;
+UPDATE cars SET plate_state = '' WHERE plate_state IS NULL;
+UPDATE cars SET plate_country = '' WHERE plate_country IS NULL;
+UPDATE cars SET year = 0 WHERE year IS NULL;
+UPDATE cars SET mileage_unit = 'mi' WHERE mileage_unit IS NULL OR mileage_unit = '';
+
+-- a plate is unique within the state and country that issued it
+CREATE UNIQUE INDEX IF NOT EXISTS idx_cars_plate
+	ON cars (license_plate, plate_state, plate_country)
+	WHERE license_plate <> '' AND deleted_at IS NULL;
@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS customer_contacts;
+ALTER TABLE services DROP COLUMN IF EXISTS po_number;
+ALTER TABLE customers DROP COLUMN IF EXISTS require_po_number;
+ALTER TABLE customers DROP COLUMN IF EXISTS billing_terms;
+ALTER TABLE customers DROP COLUMN IF EXISTS tax_id;
+ALTER TABLE customers DROP COLUMN IF EXISTS company_name;
+ALTER TABLE customers DROP COLUMN IF EXISTS kind;
+DROP TABLE IF EXISTS car_ownerships;
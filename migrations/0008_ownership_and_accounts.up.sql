@@ -0,0 +1,42 @@
+CREATE TABLE IF NOT EXISTS car_ownerships (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	car_id integer,
+	customer_id integer,
+	started_at timestamp with time zone,
+	ended_at timestamp with time zone,
+	private boolean,
+	note text,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_car_ownerships_deleted_at ON car_ownerships (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_car_ownerships_car_id ON car_ownerships (car_id);
+CREATE INDEX IF NOT EXISTS idx_car_ownerships_customer_id ON car_ownerships (customer_id);
+
+ALTER TABLE customers ADD COLUMN IF NOT EXISTS kind text;
+ALTER TABLE customers ADD COLUMN IF NOT EXISTS company_name text;
+ALTER TABLE customers ADD COLUMN IF NOT EXISTS tax_id text;
+ALTER TABLE customers ADD COLUMN IF NOT EXISTS billing_terms text;
+ALTER TABLE customers ADD COLUMN IF NOT EXISTS require_po_number boolean;
+-- customers saved before accounts had a kind are individuals
+UPDATE customers SET kind = 'individual' WHERE kind IS NULL OR kind = '';
+
+ALTER TABLE services ADD COLUMN IF NOT EXISTS po_number text;
+
+CREATE TABLE IF NOT EXISTS customer_contacts (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	customer_id integer,
+	name text,
+	role text,
+	phone text,
+	email text,
+	is_primary boolean,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_customer_contacts_deleted_at ON customer_contacts (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_customer_contacts_customer_id ON customer_contacts (customer_id);
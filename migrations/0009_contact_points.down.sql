@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS addresses;
+DROP TABLE IF EXISTS contact_points;
+-- customers may share a phone by now, so the index can't be unique again
+CREATE INDEX IF NOT EXISTS idx_customers_phone ON customers (phone);
+ALTER TABLE customers DROP COLUMN IF EXISTS marketing_consent_at;
+ALTER TABLE customers DROP COLUMN IF EXISTS marketing_consent;
+ALTER TABLE customers DROP COLUMN IF EXISTS preferred_channel;
+ALTER TABLE customers DROP COLUMN IF EXISTS preferred_language;
@@ -0,0 +1,55 @@
+DROP INDEX IF EXISTS idx_portal_tokens_customer_id;
+DROP INDEX IF EXISTS idx_time_punches_employee_id;
+DROP INDEX IF EXISTS idx_notifications_customer_id;
+DROP INDEX IF EXISTS idx_attachments_car_id;
+DROP INDEX IF EXISTS idx_inspection_results_inspection_id;
+DROP INDEX IF EXISTS idx_inspections_car_id;
+DROP INDEX IF EXISTS idx_odometer_readings_car_id;
+DROP INDEX IF EXISTS idx_stock_movements_part_id;
+DROP INDEX IF EXISTS idx_service_parts_service_id;
+DROP INDEX IF EXISTS idx_services_car_id;
+DROP INDEX IF EXISTS idx_cars_customer_id;
+
+ALTER TABLE addresses DROP CONSTRAINT IF EXISTS fk_addresses_customer_id;
+ALTER TABLE contact_points DROP CONSTRAINT IF EXISTS fk_contact_points_customer_id;
+ALTER TABLE customer_contacts DROP CONSTRAINT IF EXISTS fk_customer_contacts_customer_id;
+ALTER TABLE car_ownerships DROP CONSTRAINT IF EXISTS fk_car_ownerships_customer_id;
+ALTER TABLE car_ownerships DROP CONSTRAINT IF EXISTS fk_car_ownerships_car_id;
+ALTER TABLE portal_tokens DROP CONSTRAINT IF EXISTS fk_portal_tokens_customer_id;
+ALTER TABLE notifications DROP CONSTRAINT IF EXISTS fk_notifications_car_id;
+ALTER TABLE notifications DROP CONSTRAINT IF EXISTS fk_notifications_customer_id;
+ALTER TABLE maintenance_rules DROP CONSTRAINT IF EXISTS fk_maintenance_rules_labor_operation_id;
+ALTER TABLE odometer_readings DROP CONSTRAINT IF EXISTS fk_odometer_readings_service_id;
+ALTER TABLE odometer_readings DROP CONSTRAINT IF EXISTS fk_odometer_readings_car_id;
+ALTER TABLE attachments DROP CONSTRAINT IF EXISTS fk_attachments_customer_id;
+ALTER TABLE attachments DROP CONSTRAINT IF EXISTS fk_attachments_service_id;
+ALTER TABLE attachments DROP CONSTRAINT IF EXISTS fk_attachments_car_id;
+ALTER TABLE inspection_results DROP CONSTRAINT IF EXISTS fk_inspection_results_service_id;
+ALTER TABLE inspection_results DROP CONSTRAINT IF EXISTS fk_inspection_results_inspection_id;
+ALTER TABLE inspections DROP CONSTRAINT IF EXISTS fk_inspections_technician_id;
+ALTER TABLE inspections DROP CONSTRAINT IF EXISTS fk_inspections_inspection_template_id;
+ALTER TABLE inspections DROP CONSTRAINT IF EXISTS fk_inspections_car_id;
+ALTER TABLE inspection_template_items DROP CONSTRAINT IF EXISTS fk_inspection_template_items_inspection_section_id;
+ALTER TABLE inspection_sections DROP CONSTRAINT IF EXISTS fk_inspection_sections_inspection_template_id;
+ALTER TABLE time_punches DROP CONSTRAINT IF EXISTS fk_time_punches_service_id;
+ALTER TABLE time_punches DROP CONSTRAINT IF EXISTS fk_time_punches_employee_id;
+ALTER TABLE canned_job_parts DROP CONSTRAINT IF EXISTS fk_canned_job_parts_part_id;
+ALTER TABLE canned_job_parts DROP CONSTRAINT IF EXISTS fk_canned_job_parts_canned_job_id;
+ALTER TABLE canned_job_labors DROP CONSTRAINT IF EXISTS fk_canned_job_labors_labor_operation_id;
+ALTER TABLE canned_job_labors DROP CONSTRAINT IF EXISTS fk_canned_job_labors_canned_job_id;
+ALTER TABLE purchase_order_lines DROP CONSTRAINT IF EXISTS fk_purchase_order_lines_part_id;
+ALTER TABLE purchase_order_lines DROP CONSTRAINT IF EXISTS fk_purchase_order_lines_purchase_order_id;
+ALTER TABLE purchase_orders DROP CONSTRAINT IF EXISTS fk_purchase_orders_supplier_id;
+ALTER TABLE service_parts DROP CONSTRAINT IF EXISTS fk_service_parts_part_id;
+ALTER TABLE service_parts DROP CONSTRAINT IF EXISTS fk_service_parts_service_id;
+ALTER TABLE stock_movements DROP CONSTRAINT IF EXISTS fk_stock_movements_service_id;
+ALTER TABLE stock_movements DROP CONSTRAINT IF EXISTS fk_stock_movements_part_id;
+ALTER TABLE parts DROP CONSTRAINT IF EXISTS fk_parts_preferred_supplier_id;
+ALTER TABLE services DROP CONSTRAINT IF EXISTS fk_services_technician_id;
+ALTER TABLE services DROP CONSTRAINT IF EXISTS fk_services_labor_operation_id;
+ALTER TABLE services DROP CONSTRAINT IF EXISTS fk_services_car_id;
+ALTER TABLE cars DROP CONSTRAINT IF EXISTS fk_cars_customer_id;
+
+-- cars may share an empty VIN by now, so the index can't be unique again
+DROP INDEX IF EXISTS idx_cars_vin;
+CREATE INDEX IF NOT EXISTS idx_cars_vin_number ON cars (vin_number);
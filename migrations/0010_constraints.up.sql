@@ -0,0 +1,103 @@
+-- VINs are unique among cars that have one, the old index also counted
+-- empty and deleted ones
+DROP INDEX IF EXISTS uix_cars_vin_number;
+DROP INDEX IF EXISTS idx_cars_vin_number;
+UPDATE cars SET vin_number = '' WHERE vin_number IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_cars_vin
+	ON cars (vin_number)
+	WHERE vin_number <> '' AND deleted_at IS NULL;
+
+-- deletes made before there were foreign keys left references to rows that
+-- are gone, those are cleared rather than deleted so nothing is lost
+UPDATE cars SET customer_id = NULL WHERE customer_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM customers WHERE customers.id = cars.customer_id);
+UPDATE services SET car_id = NULL WHERE car_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM cars WHERE cars.id = services.car_id);
+UPDATE services SET labor_operation_id = NULL WHERE labor_operation_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM labor_operations WHERE labor_operations.id = services.labor_operation_id);
+UPDATE services SET technician_id = NULL WHERE technician_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM employees WHERE employees.id = services.technician_id);
+UPDATE parts SET preferred_supplier_id = NULL WHERE preferred_supplier_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM suppliers WHERE suppliers.id = parts.preferred_supplier_id);
+UPDATE stock_movements SET part_id = NULL WHERE part_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM parts WHERE parts.id = stock_movements.part_id);
+UPDATE stock_movements SET service_id = NULL WHERE service_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM services WHERE services.id = stock_movements.service_id);
+UPDATE service_parts SET service_id = NULL WHERE service_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM services WHERE services.id = service_parts.service_id);
+UPDATE service_parts SET part_id = NULL WHERE part_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM parts WHERE parts.id = service_parts.part_id);
+UPDATE purchase_orders SET supplier_id = NULL WHERE supplier_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM suppliers WHERE suppliers.id = purchase_orders.supplier_id);
+UPDATE purchase_order_lines SET purchase_order_id = NULL WHERE purchase_order_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM purchase_orders WHERE purchase_orders.id = purchase_order_lines.purchase_order_id);
+UPDATE purchase_order_lines SET part_id = NULL WHERE part_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM parts WHERE parts.id = purchase_order_lines.part_id);
+UPDATE canned_job_labors SET canned_job_id = NULL WHERE canned_job_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM canned_jobs WHERE canned_jobs.id = canned_job_labors.canned_job_id);
+UPDATE canned_job_labors SET labor_operation_id = NULL WHERE labor_operation_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM labor_operations WHERE labor_operations.id = canned_job_labors.labor_operation_id);
+UPDATE canned_job_parts SET canned_job_id = NULL WHERE canned_job_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM canned_jobs WHERE canned_jobs.id = canned_job_parts.canned_job_id);
+UPDATE canned_job_parts SET part_id = NULL WHERE part_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM parts WHERE parts.id = canned_job_parts.part_id);
+UPDATE time_punches SET employee_id = NULL WHERE employee_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM employees WHERE employees.id = time_punches.employee_id);
+UPDATE time_punches SET service_id = NULL WHERE service_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM services WHERE services.id = time_punches.service_id);
+UPDATE inspection_sections SET inspection_template_id = NULL WHERE inspection_template_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM inspection_templates WHERE inspection_templates.id = inspection_sections.inspection_template_id);
+UPDATE inspection_template_items SET inspection_section_id = NULL WHERE inspection_section_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM inspection_sections WHERE inspection_sections.id = inspection_template_items.inspection_section_id);
+UPDATE inspections SET car_id = NULL WHERE car_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM cars WHERE cars.id = inspections.car_id);
+UPDATE inspections SET inspection_template_id = NULL WHERE inspection_template_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM inspection_templates WHERE inspection_templates.id = inspections.inspection_template_id);
+UPDATE inspections SET technician_id = NULL WHERE technician_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM employees WHERE employees.id = inspections.technician_id);
+UPDATE inspection_results SET inspection_id = NULL WHERE inspection_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM inspections WHERE inspections.id = inspection_results.inspection_id);
+UPDATE inspection_results SET service_id = NULL WHERE service_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM services WHERE services.id = inspection_results.service_id);
+UPDATE attachments SET car_id = NULL WHERE car_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM cars WHERE cars.id = attachments.car_id);
+UPDATE attachments SET service_id = NULL WHERE service_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM services WHERE services.id = attachments.service_id);
+UPDATE attachments SET customer_id = NULL WHERE customer_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM customers WHERE customers.id = attachments.customer_id);
+UPDATE odometer_readings SET car_id = NULL WHERE car_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM cars WHERE cars.id = odometer_readings.car_id);
+UPDATE odometer_readings SET service_id = NULL WHERE service_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM services WHERE services.id = odometer_readings.service_id);
+UPDATE maintenance_rules SET labor_operation_id = NULL WHERE labor_operation_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM labor_operations WHERE labor_operations.id = maintenance_rules.labor_operation_id);
+UPDATE notifications SET customer_id = NULL WHERE customer_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM customers WHERE customers.id = notifications.customer_id);
+UPDATE notifications SET car_id = NULL WHERE car_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM cars WHERE cars.id = notifications.car_id);
+UPDATE portal_tokens SET customer_id = NULL WHERE customer_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM customers WHERE customers.id = portal_tokens.customer_id);
+UPDATE car_ownerships SET car_id = NULL WHERE car_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM cars WHERE cars.id = car_ownerships.car_id);
+UPDATE car_ownerships SET customer_id = NULL WHERE customer_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM customers WHERE customers.id = car_ownerships.customer_id);
+UPDATE customer_contacts SET customer_id = NULL WHERE customer_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM customers WHERE customers.id = customer_contacts.customer_id);
+UPDATE contact_points SET customer_id = NULL WHERE customer_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM customers WHERE customers.id = contact_points.customer_id);
+UPDATE addresses SET customer_id = NULL WHERE customer_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM customers WHERE customers.id = addresses.customer_id);
+
+ALTER TABLE cars ADD CONSTRAINT fk_cars_customer_id FOREIGN KEY (customer_id) REFERENCES customers (id) ON DELETE CASCADE;
+ALTER TABLE services ADD CONSTRAINT fk_services_car_id FOREIGN KEY (car_id) REFERENCES cars (id) ON DELETE CASCADE;
+ALTER TABLE services ADD CONSTRAINT fk_services_labor_operation_id FOREIGN KEY (labor_operation_id) REFERENCES labor_operations (id) ON DELETE SET NULL;
+ALTER TABLE services ADD CONSTRAINT fk_services_technician_id FOREIGN KEY (technician_id) REFERENCES employees (id) ON DELETE SET NULL;
+ALTER TABLE parts ADD CONSTRAINT fk_parts_preferred_supplier_id FOREIGN KEY (preferred_supplier_id) REFERENCES suppliers (id) ON DELETE SET NULL;
+ALTER TABLE stock_movements ADD CONSTRAINT fk_stock_movements_part_id FOREIGN KEY (part_id) REFERENCES parts (id) ON DELETE RESTRICT;
+ALTER TABLE stock_movements ADD CONSTRAINT fk_stock_movements_service_id FOREIGN KEY (service_id) REFERENCES services (id) ON DELETE SET NULL;
+ALTER TABLE service_parts ADD CONSTRAINT fk_service_parts_service_id FOREIGN KEY (service_id) REFERENCES services (id) ON DELETE CASCADE;
+ALTER TABLE service_parts ADD CONSTRAINT fk_service_parts_part_id FOREIGN KEY (part_id) REFERENCES parts (id) ON DELETE RESTRICT;
+ALTER TABLE purchase_orders ADD CONSTRAINT fk_purchase_orders_supplier_id FOREIGN KEY (supplier_id) REFERENCES suppliers (id) ON DELETE RESTRICT;
+ALTER TABLE purchase_order_lines ADD CONSTRAINT fk_purchase_order_lines_purchase_order_id FOREIGN KEY (purchase_order_id) REFERENCES purchase_orders (id) ON DELETE CASCADE;
+ALTER TABLE purchase_order_lines ADD CONSTRAINT fk_purchase_order_lines_part_id FOREIGN KEY (part_id) REFERENCES parts (id) ON DELETE RESTRICT;
+ALTER TABLE canned_job_labors ADD CONSTRAINT fk_canned_job_labors_canned_job_id FOREIGN KEY (canned_job_id) REFERENCES canned_jobs (id) ON DELETE CASCADE;
+ALTER TABLE canned_job_labors ADD CONSTRAINT fk_canned_job_labors_labor_operation_id FOREIGN KEY (labor_operation_id) REFERENCES labor_operations (id) ON DELETE CASCADE;
+ALTER TABLE canned_job_parts ADD CONSTRAINT fk_canned_job_parts_canned_job_id FOREIGN KEY (canned_job_id) REFERENCES canned_jobs (id) ON DELETE CASCADE;
+ALTER TABLE canned_job_parts ADD CONSTRAINT fk_canned_job_parts_part_id FOREIGN KEY (part_id) REFERENCES parts (id) ON DELETE CASCADE;
+ALTER TABLE time_punches ADD CONSTRAINT fk_time_punches_employee_id FOREIGN KEY (employee_id) REFERENCES employees (id) ON DELETE CASCADE;
+ALTER TABLE time_punches ADD CONSTRAINT fk_time_punches_service_id FOREIGN KEY (service_id) REFERENCES services (id) ON DELETE SET NULL;
+ALTER TABLE inspection_sections ADD CONSTRAINT fk_inspection_sections_inspection_template_id FOREIGN KEY (inspection_template_id) REFERENCES inspection_templates (id) ON DELETE CASCADE;
+ALTER TABLE inspection_template_items ADD CONSTRAINT fk_inspection_template_items_inspection_section_id FOREIGN KEY (inspection_section_id) REFERENCES inspection_sections (id) ON DELETE CASCADE;
+ALTER TABLE inspections ADD CONSTRAINT fk_inspections_car_id FOREIGN KEY (car_id) REFERENCES cars (id) ON DELETE CASCADE;
+ALTER TABLE inspections ADD CONSTRAINT fk_inspections_inspection_template_id FOREIGN KEY (inspection_template_id) REFERENCES inspection_templates (id) ON DELETE SET NULL;
+ALTER TABLE inspections ADD CONSTRAINT fk_inspections_technician_id FOREIGN KEY (technician_id) REFERENCES employees (id) ON DELETE SET NULL;
+ALTER TABLE inspection_results ADD CONSTRAINT fk_inspection_results_inspection_id FOREIGN KEY (inspection_id) REFERENCES inspections (id) ON DELETE CASCADE;
+ALTER TABLE inspection_results ADD CONSTRAINT fk_inspection_results_service_id FOREIGN KEY (service_id) REFERENCES services (id) ON DELETE SET NULL;
+ALTER TABLE attachments ADD CONSTRAINT fk_attachments_car_id FOREIGN KEY (car_id) REFERENCES cars (id) ON DELETE CASCADE;
+ALTER TABLE attachments ADD CONSTRAINT fk_attachments_service_id FOREIGN KEY (service_id) REFERENCES services (id) ON DELETE CASCADE;
+ALTER TABLE attachments ADD CONSTRAINT fk_attachments_customer_id FOREIGN KEY (customer_id) REFERENCES customers (id) ON DELETE CASCADE;
+ALTER TABLE odometer_readings ADD CONSTRAINT fk_odometer_readings_car_id FOREIGN KEY (car_id) REFERENCES cars (id) ON DELETE CASCADE;
+ALTER TABLE odometer_readings ADD CONSTRAINT fk_odometer_readings_service_id FOREIGN KEY (service_id) REFERENCES services (id) ON DELETE SET NULL;
+ALTER TABLE maintenance_rules ADD CONSTRAINT fk_maintenance_rules_labor_operation_id FOREIGN KEY (labor_operation_id) REFERENCES labor_operations (id) ON DELETE SET NULL;
+ALTER TABLE notifications ADD CONSTRAINT fk_notifications_customer_id FOREIGN KEY (customer_id) REFERENCES customers (id) ON DELETE CASCADE;
+ALTER TABLE notifications ADD CONSTRAINT fk_notifications_car_id FOREIGN KEY (car_id) REFERENCES cars (id) ON DELETE SET NULL;
+ALTER TABLE portal_tokens ADD CONSTRAINT fk_portal_tokens_customer_id FOREIGN KEY (customer_id) REFERENCES customers (id) ON DELETE CASCADE;
+ALTER TABLE car_ownerships ADD CONSTRAINT fk_car_ownerships_car_id FOREIGN KEY (car_id) REFERENCES cars (id) ON DELETE CASCADE;
+ALTER TABLE car_ownerships ADD CONSTRAINT fk_car_ownerships_customer_id FOREIGN KEY (customer_id) REFERENCES customers (id) ON DELETE SET NULL;
+ALTER TABLE customer_contacts ADD CONSTRAINT fk_customer_contacts_customer_id FOREIGN KEY (customer_id) REFERENCES customers (id) ON DELETE CASCADE;
+ALTER TABLE contact_points ADD CONSTRAINT fk_contact_points_customer_id FOREIGN KEY (customer_id) REFERENCES customers (id) ON DELETE CASCADE;
+ALTER TABLE addresses ADD CONSTRAINT fk_addresses_customer_id FOREIGN KEY (customer_id) REFERENCES customers (id) ON DELETE CASCADE;
+
+-- the columns cascades and lookups go through
+CREATE INDEX IF NOT EXISTS idx_cars_customer_id ON cars (customer_id);
+CREATE INDEX IF NOT EXISTS idx_services_car_id ON services (car_id);
+CREATE INDEX IF NOT EXISTS idx_service_parts_service_id ON service_parts (service_id);
+CREATE INDEX IF NOT EXISTS idx_stock_movements_part_id ON stock_movements (part_id);
+CREATE INDEX IF NOT EXISTS idx_odometer_readings_car_id ON odometer_readings (car_id);
+CREATE INDEX IF NOT EXISTS idx_inspections_car_id ON inspections (car_id);
+CREATE INDEX IF NOT EXISTS idx_inspection_results_inspection_id ON inspection_results (inspection_id);
+CREATE INDEX IF NOT EXISTS idx_attachments_car_id ON attachments (car_id);
+CREATE INDEX IF NOT EXISTS idx_notifications_customer_id ON notifications (customer_id);
+CREATE INDEX IF NOT EXISTS idx_time_punches_employee_id ON time_punches (employee_id);
+CREATE INDEX IF NOT EXISTS idx_portal_tokens_customer_id ON portal_tokens (customer_id);
@@ -0,0 +1,19 @@
+-- the audit trail of merged duplicate customers, merged_id is the customer
+-- that is gone so it has no foreign key
+CREATE TABLE IF NOT EXISTS customer_merges (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	survivor_id integer,
+	merged_id integer,
+	score numeric,
+	note text,
+	merged text,
+	moved text,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_customer_merges_deleted_at ON customer_merges (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_customer_merges_survivor_id ON customer_merges (survivor_id);
+CREATE INDEX IF NOT EXISTS idx_customer_merges_merged_id ON customer_merges (merged_id);
+ALTER TABLE customer_merges ADD CONSTRAINT fk_customer_merges_survivor_id FOREIGN KEY (survivor_id) REFERENCES customers (id) ON DELETE CASCADE;
@@ -0,0 +1,19 @@
+ALTER TABLE customers ADD COLUMN IF NOT EXISTS anonymized_at timestamp with time zone;
+
+-- the log of data exports and anonymizations asked for by customers, kept
+-- when the customer is deleted
+CREATE TABLE IF NOT EXISTS privacy_requests (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	customer_id integer,
+	kind text,
+	requested_by text,
+	note text,
+	summary text,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_privacy_requests_deleted_at ON privacy_requests (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_privacy_requests_customer_id ON privacy_requests (customer_id);
+ALTER TABLE privacy_requests ADD CONSTRAINT fk_privacy_requests_customer_id FOREIGN KEY (customer_id) REFERENCES customers (id) ON DELETE SET NULL;
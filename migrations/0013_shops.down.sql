@@ -0,0 +1,210 @@
+DROP INDEX IF EXISTS idx_notification_template_language;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_notification_template_language ON notification_templates (event, channel, language);
+DROP INDEX IF EXISTS uix_labor_operations_code;
+CREATE UNIQUE INDEX IF NOT EXISTS uix_labor_operations_code ON labor_operations (code);
+DROP INDEX IF EXISTS uix_parts_sku;
+CREATE UNIQUE INDEX IF NOT EXISTS uix_parts_sku ON parts (sku);
+DROP INDEX IF EXISTS idx_cars_plate;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_cars_plate
+	ON cars (license_plate, plate_state, plate_country)
+	WHERE license_plate <> '' AND deleted_at IS NULL;
+DROP INDEX IF EXISTS idx_cars_vin;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_cars_vin
+	ON cars (vin_number)
+	WHERE vin_number <> '' AND deleted_at IS NULL;
+
+DROP POLICY IF EXISTS shop_isolation ON privacy_requests;
+ALTER TABLE privacy_requests NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE privacy_requests DISABLE ROW LEVEL SECURITY;
+ALTER TABLE privacy_requests DROP CONSTRAINT IF EXISTS fk_privacy_requests_shop_id;
+ALTER TABLE privacy_requests DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON customer_merges;
+ALTER TABLE customer_merges NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE customer_merges DISABLE ROW LEVEL SECURITY;
+ALTER TABLE customer_merges DROP CONSTRAINT IF EXISTS fk_customer_merges_shop_id;
+ALTER TABLE customer_merges DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON addresses;
+ALTER TABLE addresses NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE addresses DISABLE ROW LEVEL SECURITY;
+ALTER TABLE addresses DROP CONSTRAINT IF EXISTS fk_addresses_shop_id;
+ALTER TABLE addresses DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON contact_points;
+ALTER TABLE contact_points NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE contact_points DISABLE ROW LEVEL SECURITY;
+ALTER TABLE contact_points DROP CONSTRAINT IF EXISTS fk_contact_points_shop_id;
+ALTER TABLE contact_points DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON customer_contacts;
+ALTER TABLE customer_contacts NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE customer_contacts DISABLE ROW LEVEL SECURITY;
+ALTER TABLE customer_contacts DROP CONSTRAINT IF EXISTS fk_customer_contacts_shop_id;
+ALTER TABLE customer_contacts DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON car_ownerships;
+ALTER TABLE car_ownerships NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE car_ownerships DISABLE ROW LEVEL SECURITY;
+ALTER TABLE car_ownerships DROP CONSTRAINT IF EXISTS fk_car_ownerships_shop_id;
+ALTER TABLE car_ownerships DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON portal_tokens;
+ALTER TABLE portal_tokens NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE portal_tokens DISABLE ROW LEVEL SECURITY;
+ALTER TABLE portal_tokens DROP CONSTRAINT IF EXISTS fk_portal_tokens_shop_id;
+ALTER TABLE portal_tokens DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON notification_templates;
+ALTER TABLE notification_templates NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE notification_templates DISABLE ROW LEVEL SECURITY;
+ALTER TABLE notification_templates DROP CONSTRAINT IF EXISTS fk_notification_templates_shop_id;
+ALTER TABLE notification_templates DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON notifications;
+ALTER TABLE notifications NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE notifications DISABLE ROW LEVEL SECURITY;
+ALTER TABLE notifications DROP CONSTRAINT IF EXISTS fk_notifications_shop_id;
+ALTER TABLE notifications DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON maintenance_rules;
+ALTER TABLE maintenance_rules NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE maintenance_rules DISABLE ROW LEVEL SECURITY;
+ALTER TABLE maintenance_rules DROP CONSTRAINT IF EXISTS fk_maintenance_rules_shop_id;
+ALTER TABLE maintenance_rules DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON odometer_readings;
+ALTER TABLE odometer_readings NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE odometer_readings DISABLE ROW LEVEL SECURITY;
+ALTER TABLE odometer_readings DROP CONSTRAINT IF EXISTS fk_odometer_readings_shop_id;
+ALTER TABLE odometer_readings DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON attachments;
+ALTER TABLE attachments NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE attachments DISABLE ROW LEVEL SECURITY;
+ALTER TABLE attachments DROP CONSTRAINT IF EXISTS fk_attachments_shop_id;
+ALTER TABLE attachments DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON inspection_results;
+ALTER TABLE inspection_results NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE inspection_results DISABLE ROW LEVEL SECURITY;
+ALTER TABLE inspection_results DROP CONSTRAINT IF EXISTS fk_inspection_results_shop_id;
+ALTER TABLE inspection_results DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON inspections;
+ALTER TABLE inspections NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE inspections DISABLE ROW LEVEL SECURITY;
+ALTER TABLE inspections DROP CONSTRAINT IF EXISTS fk_inspections_shop_id;
+ALTER TABLE inspections DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON inspection_template_items;
+ALTER TABLE inspection_template_items NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE inspection_template_items DISABLE ROW LEVEL SECURITY;
+ALTER TABLE inspection_template_items DROP CONSTRAINT IF EXISTS fk_inspection_template_items_shop_id;
+ALTER TABLE inspection_template_items DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON inspection_sections;
+ALTER TABLE inspection_sections NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE inspection_sections DISABLE ROW LEVEL SECURITY;
+ALTER TABLE inspection_sections DROP CONSTRAINT IF EXISTS fk_inspection_sections_shop_id;
+ALTER TABLE inspection_sections DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON inspection_templates;
+ALTER TABLE inspection_templates NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE inspection_templates DISABLE ROW LEVEL SECURITY;
+ALTER TABLE inspection_templates DROP CONSTRAINT IF EXISTS fk_inspection_templates_shop_id;
+ALTER TABLE inspection_templates DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON time_punches;
+ALTER TABLE time_punches NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE time_punches DISABLE ROW LEVEL SECURITY;
+ALTER TABLE time_punches DROP CONSTRAINT IF EXISTS fk_time_punches_shop_id;
+ALTER TABLE time_punches DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON employees;
+ALTER TABLE employees NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE employees DISABLE ROW LEVEL SECURITY;
+ALTER TABLE employees DROP CONSTRAINT IF EXISTS fk_employees_shop_id;
+ALTER TABLE employees DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON canned_job_parts;
+ALTER TABLE canned_job_parts NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE canned_job_parts DISABLE ROW LEVEL SECURITY;
+ALTER TABLE canned_job_parts DROP CONSTRAINT IF EXISTS fk_canned_job_parts_shop_id;
+ALTER TABLE canned_job_parts DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON canned_job_labors;
+ALTER TABLE canned_job_labors NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE canned_job_labors DISABLE ROW LEVEL SECURITY;
+ALTER TABLE canned_job_labors DROP CONSTRAINT IF EXISTS fk_canned_job_labors_shop_id;
+ALTER TABLE canned_job_labors DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON canned_jobs;
+ALTER TABLE canned_jobs NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE canned_jobs DISABLE ROW LEVEL SECURITY;
+ALTER TABLE canned_jobs DROP CONSTRAINT IF EXISTS fk_canned_jobs_shop_id;
+ALTER TABLE canned_jobs DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON labor_operations;
+ALTER TABLE labor_operations NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE labor_operations DISABLE ROW LEVEL SECURITY;
+ALTER TABLE labor_operations DROP CONSTRAINT IF EXISTS fk_labor_operations_shop_id;
+ALTER TABLE labor_operations DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON purchase_order_lines;
+ALTER TABLE purchase_order_lines NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE purchase_order_lines DISABLE ROW LEVEL SECURITY;
+ALTER TABLE purchase_order_lines DROP CONSTRAINT IF EXISTS fk_purchase_order_lines_shop_id;
+ALTER TABLE purchase_order_lines DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON purchase_orders;
+ALTER TABLE purchase_orders NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE purchase_orders DISABLE ROW LEVEL SECURITY;
+ALTER TABLE purchase_orders DROP CONSTRAINT IF EXISTS fk_purchase_orders_shop_id;
+ALTER TABLE purchase_orders DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON suppliers;
+ALTER TABLE suppliers NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE suppliers DISABLE ROW LEVEL SECURITY;
+ALTER TABLE suppliers DROP CONSTRAINT IF EXISTS fk_suppliers_shop_id;
+ALTER TABLE suppliers DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON service_parts;
+ALTER TABLE service_parts NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE service_parts DISABLE ROW LEVEL SECURITY;
+ALTER TABLE service_parts DROP CONSTRAINT IF EXISTS fk_service_parts_shop_id;
+ALTER TABLE service_parts DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON stock_movements;
+ALTER TABLE stock_movements NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE stock_movements DISABLE ROW LEVEL SECURITY;
+ALTER TABLE stock_movements DROP CONSTRAINT IF EXISTS fk_stock_movements_shop_id;
+ALTER TABLE stock_movements DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON parts;
+ALTER TABLE parts NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE parts DISABLE ROW LEVEL SECURITY;
+ALTER TABLE parts DROP CONSTRAINT IF EXISTS fk_parts_shop_id;
+ALTER TABLE parts DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON services;
+ALTER TABLE services NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE services DISABLE ROW LEVEL SECURITY;
+ALTER TABLE services DROP CONSTRAINT IF EXISTS fk_services_shop_id;
+ALTER TABLE services DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON cars;
+ALTER TABLE cars NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE cars DISABLE ROW LEVEL SECURITY;
+ALTER TABLE cars DROP CONSTRAINT IF EXISTS fk_cars_shop_id;
+ALTER TABLE cars DROP COLUMN IF EXISTS shop_id;
+
+DROP POLICY IF EXISTS shop_isolation ON customers;
+ALTER TABLE customers NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE customers DISABLE ROW LEVEL SECURITY;
+ALTER TABLE customers DROP CONSTRAINT IF EXISTS fk_customers_shop_id;
+ALTER TABLE customers DROP COLUMN IF EXISTS shop_id;
+
+DROP FUNCTION IF EXISTS shop_visible(integer);
+DROP FUNCTION IF EXISTS current_shop_id();
+DROP TABLE IF EXISTS shops;
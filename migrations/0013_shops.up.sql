@@ -0,0 +1,402 @@
+-- shops served by one deployment. Every other table gets a shop_id that the
+-- database fills in from the app.shop_id setting of the connection, and
+-- row-level security only lets a connection see and write its own shop's
+-- rows. Migrations and the jobs that go through every shop use
+-- app.shop_id = 'all', a connection without the setting sees nothing.
+CREATE TABLE IF NOT EXISTS shops (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	name text,
+	subdomain text,
+	api_key_hash text,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_shops_deleted_at ON shops (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_shops_subdomain ON shops (subdomain) WHERE subdomain <> '';
+CREATE UNIQUE INDEX IF NOT EXISTS idx_shops_api_key_hash ON shops (api_key_hash) WHERE api_key_hash <> '';
+
+-- everything there is so far belongs to the first shop
+INSERT INTO shops (id, created_at, updated_at, name, subdomain, api_key_hash)
+	VALUES (1, now(), now(), 'Main shop', '', '')
+	ON CONFLICT (id) DO NOTHING;
+SELECT setval(pg_get_serial_sequence('shops', 'id'), GREATEST((SELECT MAX(id) FROM shops), 1));
+
+-- the shop of the connection, NULL when it has none or sees every shop
+CREATE OR REPLACE FUNCTION current_shop_id() RETURNS integer AS $$
+	SELECT CASE WHEN current_setting('app.shop_id', true) ~ '^[0-9]+$'
+		THEN current_setting('app.shop_id', true)::integer END
+$$ LANGUAGE sql STABLE;
+
+CREATE OR REPLACE FUNCTION shop_visible(shop integer) RETURNS boolean AS $$
+	SELECT COALESCE(current_setting('app.shop_id', true) = 'all' OR shop = current_shop_id(), false)
+$$ LANGUAGE sql STABLE;
+
+ALTER TABLE customers ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE customers SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE customers ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE customers ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE customers ADD CONSTRAINT fk_customers_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_customers_shop_id ON customers (shop_id);
+ALTER TABLE customers ENABLE ROW LEVEL SECURITY;
+ALTER TABLE customers FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON customers;
+CREATE POLICY shop_isolation ON customers USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE cars SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE cars ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE cars ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE cars ADD CONSTRAINT fk_cars_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_cars_shop_id ON cars (shop_id);
+ALTER TABLE cars ENABLE ROW LEVEL SECURITY;
+ALTER TABLE cars FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON cars;
+CREATE POLICY shop_isolation ON cars USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE services ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE services SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE services ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE services ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE services ADD CONSTRAINT fk_services_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_services_shop_id ON services (shop_id);
+ALTER TABLE services ENABLE ROW LEVEL SECURITY;
+ALTER TABLE services FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON services;
+CREATE POLICY shop_isolation ON services USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE parts ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE parts SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE parts ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE parts ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE parts ADD CONSTRAINT fk_parts_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_parts_shop_id ON parts (shop_id);
+ALTER TABLE parts ENABLE ROW LEVEL SECURITY;
+ALTER TABLE parts FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON parts;
+CREATE POLICY shop_isolation ON parts USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE stock_movements ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE stock_movements SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE stock_movements ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE stock_movements ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE stock_movements ADD CONSTRAINT fk_stock_movements_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_stock_movements_shop_id ON stock_movements (shop_id);
+ALTER TABLE stock_movements ENABLE ROW LEVEL SECURITY;
+ALTER TABLE stock_movements FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON stock_movements;
+CREATE POLICY shop_isolation ON stock_movements USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE service_parts ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE service_parts SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE service_parts ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE service_parts ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE service_parts ADD CONSTRAINT fk_service_parts_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_service_parts_shop_id ON service_parts (shop_id);
+ALTER TABLE service_parts ENABLE ROW LEVEL SECURITY;
+ALTER TABLE service_parts FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON service_parts;
+CREATE POLICY shop_isolation ON service_parts USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE suppliers ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE suppliers SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE suppliers ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE suppliers ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE suppliers ADD CONSTRAINT fk_suppliers_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_suppliers_shop_id ON suppliers (shop_id);
+ALTER TABLE suppliers ENABLE ROW LEVEL SECURITY;
+ALTER TABLE suppliers FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON suppliers;
+CREATE POLICY shop_isolation ON suppliers USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE purchase_orders ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE purchase_orders SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE purchase_orders ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE purchase_orders ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE purchase_orders ADD CONSTRAINT fk_purchase_orders_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_purchase_orders_shop_id ON purchase_orders (shop_id);
+ALTER TABLE purchase_orders ENABLE ROW LEVEL SECURITY;
+ALTER TABLE purchase_orders FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON purchase_orders;
+CREATE POLICY shop_isolation ON purchase_orders USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE purchase_order_lines ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE purchase_order_lines SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE purchase_order_lines ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE purchase_order_lines ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE purchase_order_lines ADD CONSTRAINT fk_purchase_order_lines_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_purchase_order_lines_shop_id ON purchase_order_lines (shop_id);
+ALTER TABLE purchase_order_lines ENABLE ROW LEVEL SECURITY;
+ALTER TABLE purchase_order_lines FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON purchase_order_lines;
+CREATE POLICY shop_isolation ON purchase_order_lines USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE labor_operations ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE labor_operations SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE labor_operations ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE labor_operations ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE labor_operations ADD CONSTRAINT fk_labor_operations_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_labor_operations_shop_id ON labor_operations (shop_id);
+ALTER TABLE labor_operations ENABLE ROW LEVEL SECURITY;
+ALTER TABLE labor_operations FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON labor_operations;
+CREATE POLICY shop_isolation ON labor_operations USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE canned_jobs ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE canned_jobs SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE canned_jobs ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE canned_jobs ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE canned_jobs ADD CONSTRAINT fk_canned_jobs_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_canned_jobs_shop_id ON canned_jobs (shop_id);
+ALTER TABLE canned_jobs ENABLE ROW LEVEL SECURITY;
+ALTER TABLE canned_jobs FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON canned_jobs;
+CREATE POLICY shop_isolation ON canned_jobs USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE canned_job_labors ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE canned_job_labors SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE canned_job_labors ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE canned_job_labors ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE canned_job_labors ADD CONSTRAINT fk_canned_job_labors_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_canned_job_labors_shop_id ON canned_job_labors (shop_id);
+ALTER TABLE canned_job_labors ENABLE ROW LEVEL SECURITY;
+ALTER TABLE canned_job_labors FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON canned_job_labors;
+CREATE POLICY shop_isolation ON canned_job_labors USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE canned_job_parts ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE canned_job_parts SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE canned_job_parts ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE canned_job_parts ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE canned_job_parts ADD CONSTRAINT fk_canned_job_parts_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_canned_job_parts_shop_id ON canned_job_parts (shop_id);
+ALTER TABLE canned_job_parts ENABLE ROW LEVEL SECURITY;
+ALTER TABLE canned_job_parts FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON canned_job_parts;
+CREATE POLICY shop_isolation ON canned_job_parts USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE employees ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE employees SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE employees ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE employees ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE employees ADD CONSTRAINT fk_employees_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_employees_shop_id ON employees (shop_id);
+ALTER TABLE employees ENABLE ROW LEVEL SECURITY;
+ALTER TABLE employees FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON employees;
+CREATE POLICY shop_isolation ON employees USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE time_punches ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE time_punches SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE time_punches ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE time_punches ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE time_punches ADD CONSTRAINT fk_time_punches_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_time_punches_shop_id ON time_punches (shop_id);
+ALTER TABLE time_punches ENABLE ROW LEVEL SECURITY;
+ALTER TABLE time_punches FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON time_punches;
+CREATE POLICY shop_isolation ON time_punches USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE inspection_templates ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE inspection_templates SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE inspection_templates ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE inspection_templates ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE inspection_templates ADD CONSTRAINT fk_inspection_templates_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_inspection_templates_shop_id ON inspection_templates (shop_id);
+ALTER TABLE inspection_templates ENABLE ROW LEVEL SECURITY;
+ALTER TABLE inspection_templates FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON inspection_templates;
+CREATE POLICY shop_isolation ON inspection_templates USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE inspection_sections ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE inspection_sections SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE inspection_sections ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE inspection_sections ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE inspection_sections ADD CONSTRAINT fk_inspection_sections_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_inspection_sections_shop_id ON inspection_sections (shop_id);
+ALTER TABLE inspection_sections ENABLE ROW LEVEL SECURITY;
+ALTER TABLE inspection_sections FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON inspection_sections;
+CREATE POLICY shop_isolation ON inspection_sections USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE inspection_template_items ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE inspection_template_items SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE inspection_template_items ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE inspection_template_items ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE inspection_template_items ADD CONSTRAINT fk_inspection_template_items_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_inspection_template_items_shop_id ON inspection_template_items (shop_id);
+ALTER TABLE inspection_template_items ENABLE ROW LEVEL SECURITY;
+ALTER TABLE inspection_template_items FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON inspection_template_items;
+CREATE POLICY shop_isolation ON inspection_template_items USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE inspections ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE inspections SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE inspections ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE inspections ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE inspections ADD CONSTRAINT fk_inspections_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_inspections_shop_id ON inspections (shop_id);
+ALTER TABLE inspections ENABLE ROW LEVEL SECURITY;
+ALTER TABLE inspections FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON inspections;
+CREATE POLICY shop_isolation ON inspections USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE inspection_results ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE inspection_results SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE inspection_results ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE inspection_results ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE inspection_results ADD CONSTRAINT fk_inspection_results_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_inspection_results_shop_id ON inspection_results (shop_id);
+ALTER TABLE inspection_results ENABLE ROW LEVEL SECURITY;
+ALTER TABLE inspection_results FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON inspection_results;
+CREATE POLICY shop_isolation ON inspection_results USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE attachments ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE attachments SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE attachments ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE attachments ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE attachments ADD CONSTRAINT fk_attachments_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_attachments_shop_id ON attachments (shop_id);
+ALTER TABLE attachments ENABLE ROW LEVEL SECURITY;
+ALTER TABLE attachments FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON attachments;
+CREATE POLICY shop_isolation ON attachments USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE odometer_readings ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE odometer_readings SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE odometer_readings ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE odometer_readings ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE odometer_readings ADD CONSTRAINT fk_odometer_readings_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_odometer_readings_shop_id ON odometer_readings (shop_id);
+ALTER TABLE odometer_readings ENABLE ROW LEVEL SECURITY;
+ALTER TABLE odometer_readings FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON odometer_readings;
+CREATE POLICY shop_isolation ON odometer_readings USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE maintenance_rules ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE maintenance_rules SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE maintenance_rules ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE maintenance_rules ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE maintenance_rules ADD CONSTRAINT fk_maintenance_rules_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_maintenance_rules_shop_id ON maintenance_rules (shop_id);
+ALTER TABLE maintenance_rules ENABLE ROW LEVEL SECURITY;
+ALTER TABLE maintenance_rules FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON maintenance_rules;
+CREATE POLICY shop_isolation ON maintenance_rules USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE notifications ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE notifications SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE notifications ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE notifications ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE notifications ADD CONSTRAINT fk_notifications_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_notifications_shop_id ON notifications (shop_id);
+ALTER TABLE notifications ENABLE ROW LEVEL SECURITY;
+ALTER TABLE notifications FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON notifications;
+CREATE POLICY shop_isolation ON notifications USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE notification_templates ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE notification_templates SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE notification_templates ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE notification_templates ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE notification_templates ADD CONSTRAINT fk_notification_templates_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_notification_templates_shop_id ON notification_templates (shop_id);
+ALTER TABLE notification_templates ENABLE ROW LEVEL SECURITY;
+ALTER TABLE notification_templates FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON notification_templates;
+CREATE POLICY shop_isolation ON notification_templates USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE portal_tokens ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE portal_tokens SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE portal_tokens ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE portal_tokens ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE portal_tokens ADD CONSTRAINT fk_portal_tokens_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_portal_tokens_shop_id ON portal_tokens (shop_id);
+ALTER TABLE portal_tokens ENABLE ROW LEVEL SECURITY;
+ALTER TABLE portal_tokens FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON portal_tokens;
+CREATE POLICY shop_isolation ON portal_tokens USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE car_ownerships ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE car_ownerships SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE car_ownerships ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE car_ownerships ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE car_ownerships ADD CONSTRAINT fk_car_ownerships_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_car_ownerships_shop_id ON car_ownerships (shop_id);
+ALTER TABLE car_ownerships ENABLE ROW LEVEL SECURITY;
+ALTER TABLE car_ownerships FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON car_ownerships;
+CREATE POLICY shop_isolation ON car_ownerships USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE customer_contacts ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE customer_contacts SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE customer_contacts ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE customer_contacts ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE customer_contacts ADD CONSTRAINT fk_customer_contacts_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_customer_contacts_shop_id ON customer_contacts (shop_id);
+ALTER TABLE customer_contacts ENABLE ROW LEVEL SECURITY;
+ALTER TABLE customer_contacts FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON customer_contacts;
+CREATE POLICY shop_isolation ON customer_contacts USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE contact_points ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE contact_points SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE contact_points ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE contact_points ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE contact_points ADD CONSTRAINT fk_contact_points_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_contact_points_shop_id ON contact_points (shop_id);
+ALTER TABLE contact_points ENABLE ROW LEVEL SECURITY;
+ALTER TABLE contact_points FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON contact_points;
+CREATE POLICY shop_isolation ON contact_points USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE addresses ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE addresses SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE addresses ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE addresses ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE addresses ADD CONSTRAINT fk_addresses_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_addresses_shop_id ON addresses (shop_id);
+ALTER TABLE addresses ENABLE ROW LEVEL SECURITY;
+ALTER TABLE addresses FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON addresses;
+CREATE POLICY shop_isolation ON addresses USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE customer_merges ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE customer_merges SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE customer_merges ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE customer_merges ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE customer_merges ADD CONSTRAINT fk_customer_merges_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_customer_merges_shop_id ON customer_merges (shop_id);
+ALTER TABLE customer_merges ENABLE ROW LEVEL SECURITY;
+ALTER TABLE customer_merges FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON customer_merges;
+CREATE POLICY shop_isolation ON customer_merges USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+ALTER TABLE privacy_requests ADD COLUMN IF NOT EXISTS shop_id integer;
+UPDATE privacy_requests SET shop_id = 1 WHERE shop_id IS NULL;
+ALTER TABLE privacy_requests ALTER COLUMN shop_id SET DEFAULT current_shop_id();
+ALTER TABLE privacy_requests ALTER COLUMN shop_id SET NOT NULL;
+ALTER TABLE privacy_requests ADD CONSTRAINT fk_privacy_requests_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+CREATE INDEX IF NOT EXISTS idx_privacy_requests_shop_id ON privacy_requests (shop_id);
+ALTER TABLE privacy_requests ENABLE ROW LEVEL SECURITY;
+ALTER TABLE privacy_requests FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON privacy_requests;
+CREATE POLICY shop_isolation ON privacy_requests USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
+
+-- what has to be unique only has to be unique within a shop
+DROP INDEX IF EXISTS idx_cars_vin;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_cars_vin
+	ON cars (shop_id, vin_number)
+	WHERE vin_number <> '' AND deleted_at IS NULL;
+DROP INDEX IF EXISTS idx_cars_plate;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_cars_plate
+	ON cars (shop_id, license_plate, plate_state, plate_country)
+	WHERE license_plate <> '' AND deleted_at IS NULL;
+DROP INDEX IF EXISTS uix_parts_sku;
+CREATE UNIQUE INDEX IF NOT EXISTS uix_parts_sku ON parts (shop_id, sku);
+DROP INDEX IF EXISTS uix_labor_operations_code;
+CREATE UNIQUE INDEX IF NOT EXISTS uix_labor_operations_code ON labor_operations (shop_id, code);
+DROP INDEX IF EXISTS idx_notification_template_language;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_notification_template_language ON notification_templates (shop_id, event, channel, language);
@@ -0,0 +1,54 @@
+ALTER TABLE privacy_requests DROP CONSTRAINT IF EXISTS fk_privacy_requests_customer_id_shop;
+ALTER TABLE customer_merges DROP CONSTRAINT IF EXISTS fk_customer_merges_survivor_id_shop;
+ALTER TABLE addresses DROP CONSTRAINT IF EXISTS fk_addresses_customer_id_shop;
+ALTER TABLE contact_points DROP CONSTRAINT IF EXISTS fk_contact_points_customer_id_shop;
+ALTER TABLE customer_contacts DROP CONSTRAINT IF EXISTS fk_customer_contacts_customer_id_shop;
+ALTER TABLE car_ownerships DROP CONSTRAINT IF EXISTS fk_car_ownerships_customer_id_shop;
+ALTER TABLE car_ownerships DROP CONSTRAINT IF EXISTS fk_car_ownerships_car_id_shop;
+ALTER TABLE portal_tokens DROP CONSTRAINT IF EXISTS fk_portal_tokens_customer_id_shop;
+ALTER TABLE notifications DROP CONSTRAINT IF EXISTS fk_notifications_car_id_shop;
+ALTER TABLE notifications DROP CONSTRAINT IF EXISTS fk_notifications_customer_id_shop;
+ALTER TABLE maintenance_rules DROP CONSTRAINT IF EXISTS fk_maintenance_rules_labor_operation_id_shop;
+ALTER TABLE odometer_readings DROP CONSTRAINT IF EXISTS fk_odometer_readings_service_id_shop;
+ALTER TABLE odometer_readings DROP CONSTRAINT IF EXISTS fk_odometer_readings_car_id_shop;
+ALTER TABLE attachments DROP CONSTRAINT IF EXISTS fk_attachments_customer_id_shop;
+ALTER TABLE attachments DROP CONSTRAINT IF EXISTS fk_attachments_service_id_shop;
+ALTER TABLE attachments DROP CONSTRAINT IF EXISTS fk_attachments_car_id_shop;
+ALTER TABLE inspection_results DROP CONSTRAINT IF EXISTS fk_inspection_results_service_id_shop;
+ALTER TABLE inspection_results DROP CONSTRAINT IF EXISTS fk_inspection_results_inspection_id_shop;
+ALTER TABLE inspections DROP CONSTRAINT IF EXISTS fk_inspections_technician_id_shop;
+ALTER TABLE inspections DROP CONSTRAINT IF EXISTS fk_inspections_inspection_template_id_shop;
+ALTER TABLE inspections DROP CONSTRAINT IF EXISTS fk_inspections_car_id_shop;
+ALTER TABLE inspection_template_items DROP CONSTRAINT IF EXISTS fk_inspection_template_items_inspection_section_id_shop;
+ALTER TABLE inspection_sections DROP CONSTRAINT IF EXISTS fk_inspection_sections_inspection_template_id_shop;
+ALTER TABLE time_punches DROP CONSTRAINT IF EXISTS fk_time_punches_service_id_shop;
+ALTER TABLE time_punches DROP CONSTRAINT IF EXISTS fk_time_punches_employee_id_shop;
+ALTER TABLE canned_job_parts DROP CONSTRAINT IF EXISTS fk_canned_job_parts_part_id_shop;
+ALTER TABLE canned_job_parts DROP CONSTRAINT IF EXISTS fk_canned_job_parts_canned_job_id_shop;
+ALTER TABLE canned_job_labors DROP CONSTRAINT IF EXISTS fk_canned_job_labors_labor_operation_id_shop;
+ALTER TABLE canned_job_labors DROP CONSTRAINT IF EXISTS fk_canned_job_labors_canned_job_id_shop;
+ALTER TABLE purchase_order_lines DROP CONSTRAINT IF EXISTS fk_purchase_order_lines_part_id_shop;
+ALTER TABLE purchase_order_lines DROP CONSTRAINT IF EXISTS fk_purchase_order_lines_purchase_order_id_shop;
+ALTER TABLE purchase_orders DROP CONSTRAINT IF EXISTS fk_purchase_orders_supplier_id_shop;
+ALTER TABLE service_parts DROP CONSTRAINT IF EXISTS fk_service_parts_part_id_shop;
+ALTER TABLE service_parts DROP CONSTRAINT IF EXISTS fk_service_parts_service_id_shop;
+ALTER TABLE stock_movements DROP CONSTRAINT IF EXISTS fk_stock_movements_service_id_shop;
+ALTER TABLE stock_movements DROP CONSTRAINT IF EXISTS fk_stock_movements_part_id_shop;
+ALTER TABLE parts DROP CONSTRAINT IF EXISTS fk_parts_preferred_supplier_id_shop;
+ALTER TABLE services DROP CONSTRAINT IF EXISTS fk_services_technician_id_shop;
+ALTER TABLE services DROP CONSTRAINT IF EXISTS fk_services_labor_operation_id_shop;
+ALTER TABLE services DROP CONSTRAINT IF EXISTS fk_services_car_id_shop;
+ALTER TABLE cars DROP CONSTRAINT IF EXISTS fk_cars_customer_id_shop;
+
+ALTER TABLE inspections DROP CONSTRAINT IF EXISTS uix_inspections_shop_id_id;
+ALTER TABLE inspection_sections DROP CONSTRAINT IF EXISTS uix_inspection_sections_shop_id_id;
+ALTER TABLE inspection_templates DROP CONSTRAINT IF EXISTS uix_inspection_templates_shop_id_id;
+ALTER TABLE canned_jobs DROP CONSTRAINT IF EXISTS uix_canned_jobs_shop_id_id;
+ALTER TABLE purchase_orders DROP CONSTRAINT IF EXISTS uix_purchase_orders_shop_id_id;
+ALTER TABLE services DROP CONSTRAINT IF EXISTS uix_services_shop_id_id;
+ALTER TABLE parts DROP CONSTRAINT IF EXISTS uix_parts_shop_id_id;
+ALTER TABLE suppliers DROP CONSTRAINT IF EXISTS uix_suppliers_shop_id_id;
+ALTER TABLE employees DROP CONSTRAINT IF EXISTS uix_employees_shop_id_id;
+ALTER TABLE labor_operations DROP CONSTRAINT IF EXISTS uix_labor_operations_shop_id_id;
+ALTER TABLE cars DROP CONSTRAINT IF EXISTS uix_cars_shop_id_id;
+ALTER TABLE customers DROP CONSTRAINT IF EXISTS uix_customers_shop_id_id;
@@ -0,0 +1,60 @@
+-- foreign key checks don't go through row-level security, so a key on the
+-- id alone would let one shop point at another shop's rows, and then a
+-- delete in that shop would cascade into this one. Each reference is checked
+-- with its shop as well. The keys on the id alone keep their delete actions,
+-- they can only reach rows of the same shop now.
+
+ALTER TABLE customers ADD CONSTRAINT uix_customers_shop_id_id UNIQUE (shop_id, id);
+ALTER TABLE cars ADD CONSTRAINT uix_cars_shop_id_id UNIQUE (shop_id, id);
+ALTER TABLE labor_operations ADD CONSTRAINT uix_labor_operations_shop_id_id UNIQUE (shop_id, id);
+ALTER TABLE employees ADD CONSTRAINT uix_employees_shop_id_id UNIQUE (shop_id, id);
+ALTER TABLE suppliers ADD CONSTRAINT uix_suppliers_shop_id_id UNIQUE (shop_id, id);
+ALTER TABLE parts ADD CONSTRAINT uix_parts_shop_id_id UNIQUE (shop_id, id);
+ALTER TABLE services ADD CONSTRAINT uix_services_shop_id_id UNIQUE (shop_id, id);
+ALTER TABLE purchase_orders ADD CONSTRAINT uix_purchase_orders_shop_id_id UNIQUE (shop_id, id);
+ALTER TABLE canned_jobs ADD CONSTRAINT uix_canned_jobs_shop_id_id UNIQUE (shop_id, id);
+ALTER TABLE inspection_templates ADD CONSTRAINT uix_inspection_templates_shop_id_id UNIQUE (shop_id, id);
+ALTER TABLE inspection_sections ADD CONSTRAINT uix_inspection_sections_shop_id_id UNIQUE (shop_id, id);
+ALTER TABLE inspections ADD CONSTRAINT uix_inspections_shop_id_id UNIQUE (shop_id, id);
+
+ALTER TABLE cars ADD CONSTRAINT fk_cars_customer_id_shop FOREIGN KEY (shop_id, customer_id) REFERENCES customers (shop_id, id);
+ALTER TABLE services ADD CONSTRAINT fk_services_car_id_shop FOREIGN KEY (shop_id, car_id) REFERENCES cars (shop_id, id);
+ALTER TABLE services ADD CONSTRAINT fk_services_labor_operation_id_shop FOREIGN KEY (shop_id, labor_operation_id) REFERENCES labor_operations (shop_id, id);
+ALTER TABLE services ADD CONSTRAINT fk_services_technician_id_shop FOREIGN KEY (shop_id, technician_id) REFERENCES employees (shop_id, id);
+ALTER TABLE parts ADD CONSTRAINT fk_parts_preferred_supplier_id_shop FOREIGN KEY (shop_id, preferred_supplier_id) REFERENCES suppliers (shop_id, id);
+ALTER TABLE stock_movements ADD CONSTRAINT fk_stock_movements_part_id_shop FOREIGN KEY (shop_id, part_id) REFERENCES parts (shop_id, id);
+ALTER TABLE stock_movements ADD CONSTRAINT fk_stock_movements_service_id_shop FOREIGN KEY (shop_id, service_id) REFERENCES services (shop_id, id);
+ALTER TABLE service_parts ADD CONSTRAINT fk_service_parts_service_id_shop FOREIGN KEY (shop_id, service_id) REFERENCES services (shop_id, id);
+ALTER TABLE service_parts ADD CONSTRAINT fk_service_parts_part_id_shop FOREIGN KEY (shop_id, part_id) REFERENCES parts (shop_id, id);
+ALTER TABLE purchase_orders ADD CONSTRAINT fk_purchase_orders_supplier_id_shop FOREIGN KEY (shop_id, supplier_id) REFERENCES suppliers (shop_id, id);
+ALTER TABLE purchase_order_lines ADD CONSTRAINT fk_purchase_order_lines_purchase_order_id_shop FOREIGN KEY (shop_id, purchase_order_id) REFERENCES purchase_orders (shop_id, id);
+ALTER TABLE purchase_order_lines ADD CONSTRAINT fk_purchase_order_lines_part_id_shop FOREIGN KEY (shop_id, part_id) REFERENCES parts (shop_id, id);
+ALTER TABLE canned_job_labors ADD CONSTRAINT fk_canned_job_labors_canned_job_id_shop FOREIGN KEY (shop_id, canned_job_id) REFERENCES canned_jobs (shop_id, id);
+ALTER TABLE canned_job_labors ADD CONSTRAINT fk_canned_job_labors_labor_operation_id_shop FOREIGN KEY (shop_id, labor_operation_id) REFERENCES labor_operations (shop_id, id);
+ALTER TABLE canned_job_parts ADD CONSTRAINT fk_canned_job_parts_canned_job_id_shop FOREIGN KEY (shop_id, canned_job_id) REFERENCES canned_jobs (shop_id, id);
+ALTER TABLE canned_job_parts ADD CONSTRAINT fk_canned_job_parts_part_id_shop FOREIGN KEY (shop_id, part_id) REFERENCES parts (shop_id, id);
+ALTER TABLE time_punches ADD CONSTRAINT fk_time_punches_employee_id_shop FOREIGN KEY (shop_id, employee_id) REFERENCES employees (shop_id, id);
+ALTER TABLE time_punches ADD CONSTRAINT fk_time_punches_service_id_shop FOREIGN KEY (shop_id, service_id) REFERENCES services (shop_id, id);
+ALTER TABLE inspection_sections ADD CONSTRAINT fk_inspection_sections_inspection_template_id_shop FOREIGN KEY (shop_id, inspection_template_id) REFERENCES inspection_templates (shop_id, id);
+ALTER TABLE inspection_template_items ADD CONSTRAINT fk_inspection_template_items_inspection_section_id_shop FOREIGN KEY (shop_id, inspection_section_id) REFERENCES inspection_sections (shop_id, id);
+ALTER TABLE inspections ADD CONSTRAINT fk_inspections_car_id_shop FOREIGN KEY (shop_id, car_id) REFERENCES cars (shop_id, id);
+ALTER TABLE inspections ADD CONSTRAINT fk_inspections_inspection_template_id_shop FOREIGN KEY (shop_id, inspection_template_id) REFERENCES inspection_templates (shop_id, id);
+ALTER TABLE inspections ADD CONSTRAINT fk_inspections_technician_id_shop FOREIGN KEY (shop_id, technician_id) REFERENCES employees (shop_id, id);
+ALTER TABLE inspection_results ADD CONSTRAINT fk_inspection_results_inspection_id_shop FOREIGN KEY (shop_id, inspection_id) REFERENCES inspections (shop_id, id);
+ALTER TABLE inspection_results ADD CONSTRAINT fk_inspection_results_service_id_shop FOREIGN KEY (shop_id, service_id) REFERENCES services (shop_id, id);
+ALTER TABLE attachments ADD CONSTRAINT fk_attachments_car_id_shop FOREIGN KEY (shop_id, car_id) REFERENCES cars (shop_id, id);
+ALTER TABLE attachments ADD CONSTRAINT fk_attachments_service_id_shop FOREIGN KEY (shop_id, service_id) REFERENCES services (shop_id, id);
+ALTER TABLE attachments ADD CONSTRAINT fk_attachments_customer_id_shop FOREIGN KEY (shop_id, customer_id) REFERENCES customers (shop_id, id);
+ALTER TABLE odometer_readings ADD CONSTRAINT fk_odometer_readings_car_id_shop FOREIGN KEY (shop_id, car_id) REFERENCES cars (shop_id, id);
+ALTER TABLE odometer_readings ADD CONSTRAINT fk_odometer_readings_service_id_shop FOREIGN KEY (shop_id, service_id) REFERENCES services (shop_id, id);
+ALTER TABLE maintenance_rules ADD CONSTRAINT fk_maintenance_rules_labor_operation_id_shop FOREIGN KEY (shop_id, labor_operation_id) REFERENCES labor_operations (shop_id, id);
+ALTER TABLE notifications ADD CONSTRAINT fk_notifications_customer_id_shop FOREIGN KEY (shop_id, customer_id) REFERENCES customers (shop_id, id);
+ALTER TABLE notifications ADD CONSTRAINT fk_notifications_car_id_shop FOREIGN KEY (shop_id, car_id) REFERENCES cars (shop_id, id);
+ALTER TABLE portal_tokens ADD CONSTRAINT fk_portal_tokens_customer_id_shop FOREIGN KEY (shop_id, customer_id) REFERENCES customers (shop_id, id);
+ALTER TABLE car_ownerships ADD CONSTRAINT fk_car_ownerships_car_id_shop FOREIGN KEY (shop_id, car_id) REFERENCES cars (shop_id, id);
+ALTER TABLE car_ownerships ADD CONSTRAINT fk_car_ownerships_customer_id_shop FOREIGN KEY (shop_id, customer_id) REFERENCES customers (shop_id, id);
+ALTER TABLE customer_contacts ADD CONSTRAINT fk_customer_contacts_customer_id_shop FOREIGN KEY (shop_id, customer_id) REFERENCES customers (shop_id, id);
+ALTER TABLE contact_points ADD CONSTRAINT fk_contact_points_customer_id_shop FOREIGN KEY (shop_id, customer_id) REFERENCES customers (shop_id, id);
+ALTER TABLE addresses ADD CONSTRAINT fk_addresses_customer_id_shop FOREIGN KEY (shop_id, customer_id) REFERENCES customers (shop_id, id);
+ALTER TABLE customer_merges ADD CONSTRAINT fk_customer_merges_survivor_id_shop FOREIGN KEY (shop_id, survivor_id) REFERENCES customers (shop_id, id);
+ALTER TABLE privacy_requests ADD CONSTRAINT fk_privacy_requests_customer_id_shop FOREIGN KEY (shop_id, customer_id) REFERENCES customers (shop_id, id);
@@ -0,0 +1,2 @@
+-- can't be undone: which numbers had the US country code isn't known anymore
+SELECT 1;
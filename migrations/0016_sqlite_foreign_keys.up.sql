@@ -0,0 +1,2 @@
+-- postgres has had its foreign keys since 0010
+SELECT 1;
@@ -0,0 +1,2 @@
+-- can't be undone: which services had no status isn't known anymore
+SELECT 1;
@@ -0,0 +1,2 @@
+-- services from before 0002 have no status, they were all finished work
+UPDATE services SET status = 'completed' WHERE status IS NULL OR status = '';
@@ -0,0 +1,2 @@
+-- the ownerships added stay, they are right either way
+DROP INDEX IF EXISTS idx_car_ownerships_open;
@@ -0,0 +1,27 @@
+-- times customers are booked to bring a car in, shown in the portal
+CREATE TABLE IF NOT EXISTS appointments (
+	id serial,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	customer_id integer,
+	car_id integer,
+	starts_at timestamp with time zone,
+	note text,
+	shop_id integer NOT NULL DEFAULT current_shop_id(),
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_appointments_deleted_at ON appointments (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_appointments_customer_id ON appointments (customer_id);
+CREATE INDEX IF NOT EXISTS idx_appointments_car_id ON appointments (car_id);
+CREATE INDEX IF NOT EXISTS idx_appointments_starts_at ON appointments (starts_at);
+CREATE INDEX IF NOT EXISTS idx_appointments_shop_id ON appointments (shop_id);
+ALTER TABLE appointments ADD CONSTRAINT fk_appointments_customer_id FOREIGN KEY (customer_id) REFERENCES customers (id) ON DELETE CASCADE;
+ALTER TABLE appointments ADD CONSTRAINT fk_appointments_car_id FOREIGN KEY (car_id) REFERENCES cars (id) ON DELETE SET NULL;
+ALTER TABLE appointments ADD CONSTRAINT fk_appointments_shop_id FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE RESTRICT;
+ALTER TABLE appointments ADD CONSTRAINT fk_appointments_customer_id_shop FOREIGN KEY (shop_id, customer_id) REFERENCES customers (shop_id, id);
+ALTER TABLE appointments ADD CONSTRAINT fk_appointments_car_id_shop FOREIGN KEY (shop_id, car_id) REFERENCES cars (shop_id, id);
+ALTER TABLE appointments ENABLE ROW LEVEL SECURITY;
+ALTER TABLE appointments FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS shop_isolation ON appointments;
+CREATE POLICY shop_isolation ON appointments USING (shop_visible(shop_id)) WITH CHECK (shop_visible(shop_id));
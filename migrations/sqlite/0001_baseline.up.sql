@@ -0,0 +1,36 @@
+-- customers, cars and services. The unique phone and VIN indexes
+-- AutoMigrate made are left out, 0009 and 0010 drop them anyway.
+CREATE TABLE IF NOT EXISTS customers (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	first_name text,
+	last_name text,
+	phone text
+);
+CREATE INDEX IF NOT EXISTS idx_customers_deleted_at ON customers (deleted_at);
+
+CREATE TABLE IF NOT EXISTS cars (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	make text,
+	modelo text,
+	color text,
+	vin_number text,
+	customer_id integer
+);
+CREATE INDEX IF NOT EXISTS idx_cars_deleted_at ON cars (deleted_at);
+
+CREATE TABLE IF NOT EXISTS services (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	comment text,
+	miles text,
+	car_id integer
+);
+CREATE INDEX IF NOT EXISTS idx_services_deleted_at ON services (deleted_at);
@@ -0,0 +1,87 @@
+ALTER TABLE services ADD COLUMN status text;
+
+CREATE TABLE IF NOT EXISTS parts (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	sku varchar(100),
+	description text,
+	brand text,
+	cost real,
+	price real,
+	bin_location text,
+	on_hand integer,
+	reserved integer,
+	min_quantity integer,
+	reorder_quantity integer,
+	preferred_supplier_id integer
+);
+CREATE INDEX IF NOT EXISTS idx_parts_deleted_at ON parts (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_parts_sku ON parts (sku);
+
+CREATE TABLE IF NOT EXISTS stock_movements (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	part_id integer,
+	service_id integer,
+	kind text,
+	quantity integer,
+	unit_cost real,
+	note text
+);
+CREATE INDEX IF NOT EXISTS idx_stock_movements_deleted_at ON stock_movements (deleted_at);
+
+CREATE TABLE IF NOT EXISTS service_parts (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	service_id integer,
+	part_id integer,
+	quantity integer,
+	price real,
+	status text
+);
+CREATE INDEX IF NOT EXISTS idx_service_parts_deleted_at ON service_parts (deleted_at);
+
+CREATE TABLE IF NOT EXISTS suppliers (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	name text,
+	contact_name text,
+	phone text,
+	email text,
+	notes text
+);
+CREATE INDEX IF NOT EXISTS idx_suppliers_deleted_at ON suppliers (deleted_at);
+
+CREATE TABLE IF NOT EXISTS purchase_orders (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	supplier_id integer,
+	status text,
+	notes text,
+	sent_at datetime,
+	received_at datetime
+);
+CREATE INDEX IF NOT EXISTS idx_purchase_orders_deleted_at ON purchase_orders (deleted_at);
+
+CREATE TABLE IF NOT EXISTS purchase_order_lines (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	purchase_order_id integer,
+	part_id integer,
+	quantity integer,
+	quantity_received integer,
+	unit_cost real
+);
+CREATE INDEX IF NOT EXISTS idx_purchase_order_lines_deleted_at ON purchase_order_lines (deleted_at);
@@ -0,0 +1,10 @@
+DROP TABLE IF EXISTS time_punches;
+DROP TABLE IF EXISTS employees;
+DROP TABLE IF EXISTS canned_job_parts;
+DROP TABLE IF EXISTS canned_job_labors;
+DROP TABLE IF EXISTS canned_jobs;
+DROP TABLE IF EXISTS labor_operations;
+ALTER TABLE services DROP COLUMN price;
+ALTER TABLE services DROP COLUMN hours;
+ALTER TABLE services DROP COLUMN technician_id;
+ALTER TABLE services DROP COLUMN labor_operation_id;
@@ -0,0 +1,79 @@
+ALTER TABLE services ADD COLUMN labor_operation_id integer;
+ALTER TABLE services ADD COLUMN technician_id integer;
+ALTER TABLE services ADD COLUMN hours real;
+ALTER TABLE services ADD COLUMN price real;
+
+CREATE TABLE IF NOT EXISTS labor_operations (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	code varchar(50),
+	description text,
+	hours real,
+	price real
+);
+CREATE INDEX IF NOT EXISTS idx_labor_operations_deleted_at ON labor_operations (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_labor_operations_code ON labor_operations (code);
+
+CREATE TABLE IF NOT EXISTS canned_jobs (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	name text,
+	description text
+);
+CREATE INDEX IF NOT EXISTS idx_canned_jobs_deleted_at ON canned_jobs (deleted_at);
+
+CREATE TABLE IF NOT EXISTS canned_job_labors (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	canned_job_id integer,
+	labor_operation_id integer
+);
+CREATE INDEX IF NOT EXISTS idx_canned_job_labors_deleted_at ON canned_job_labors (deleted_at);
+
+CREATE TABLE IF NOT EXISTS canned_job_parts (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	canned_job_id integer,
+	part_id integer,
+	quantity integer
+);
+CREATE INDEX IF NOT EXISTS idx_canned_job_parts_deleted_at ON canned_job_parts (deleted_at);
+
+CREATE TABLE IF NOT EXISTS employees (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	first_name text,
+	last_name text,
+	phone text,
+	role text,
+	active boolean,
+	shift_end text
+);
+CREATE INDEX IF NOT EXISTS idx_employees_deleted_at ON employees (deleted_at);
+
+CREATE TABLE IF NOT EXISTS time_punches (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	employee_id integer,
+	service_id integer,
+	clock_on datetime,
+	clock_off datetime,
+	auto_closed boolean
+);
+CREATE INDEX IF NOT EXISTS idx_time_punches_deleted_at ON time_punches (deleted_at);
+-- an employee can only be clocked on to one job at a time
+CREATE UNIQUE INDEX IF NOT EXISTS idx_time_punches_open
+	ON time_punches (employee_id)
+	WHERE clock_off IS NULL AND deleted_at IS NULL;
@@ -0,0 +1,79 @@
+CREATE TABLE IF NOT EXISTS inspection_templates (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	name text
+);
+CREATE INDEX IF NOT EXISTS idx_inspection_templates_deleted_at ON inspection_templates (deleted_at);
+
+CREATE TABLE IF NOT EXISTS inspection_sections (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	inspection_template_id integer,
+	name text,
+	"position" integer
+);
+CREATE INDEX IF NOT EXISTS idx_inspection_sections_deleted_at ON inspection_sections (deleted_at);
+
+CREATE TABLE IF NOT EXISTS inspection_template_items (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	inspection_section_id integer,
+	name text,
+	"position" integer,
+	unit text
+);
+CREATE INDEX IF NOT EXISTS idx_inspection_template_items_deleted_at ON inspection_template_items (deleted_at);
+
+CREATE TABLE IF NOT EXISTS inspections (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	car_id integer,
+	inspection_template_id integer,
+	technician_id integer,
+	miles text,
+	status text
+);
+CREATE INDEX IF NOT EXISTS idx_inspections_deleted_at ON inspections (deleted_at);
+
+CREATE TABLE IF NOT EXISTS inspection_results (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	inspection_id integer,
+	inspection_template_item_id integer,
+	section text,
+	item text,
+	"position" integer,
+	rating text,
+	notes text,
+	measurement real,
+	unit text,
+	service_id integer
+);
+CREATE INDEX IF NOT EXISTS idx_inspection_results_deleted_at ON inspection_results (deleted_at);
+
+CREATE TABLE IF NOT EXISTS attachments (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	car_id integer,
+	service_id integer,
+	customer_id integer,
+	file_name text,
+	content_type text,
+	size bigint,
+	checksum text,
+	blob_key text,
+	thumbnail_key text
+);
+CREATE INDEX IF NOT EXISTS idx_attachments_deleted_at ON attachments (deleted_at);
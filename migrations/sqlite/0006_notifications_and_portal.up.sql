@@ -0,0 +1,56 @@
+ALTER TABLE customers ADD COLUMN email text;
+ALTER TABLE customers ADD COLUMN email_opt_out boolean;
+ALTER TABLE customers ADD COLUMN sms_opt_out boolean;
+ALTER TABLE customers ADD COLUMN quiet_hours_start text;
+ALTER TABLE customers ADD COLUMN quiet_hours_end text;
+
+CREATE TABLE IF NOT EXISTS notifications (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	customer_id integer,
+	car_id integer,
+	event text,
+	channel text,
+	recipient text,
+	subject text,
+	body text,
+	status text,
+	attempts integer,
+	next_attempt_at datetime,
+	last_error text,
+	sent_at datetime
+);
+CREATE INDEX IF NOT EXISTS idx_notifications_deleted_at ON notifications (deleted_at);
+
+-- overrides exist once per event, channel and language
+CREATE TABLE IF NOT EXISTS notification_templates (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	event varchar(50),
+	channel varchar(20),
+	language varchar(5),
+	subject text,
+	body text
+);
+UPDATE notification_templates SET language = 'en' WHERE language IS NULL OR language = '';
+DROP INDEX IF EXISTS idx_notification_template;
+CREATE INDEX IF NOT EXISTS idx_notification_templates_deleted_at ON notification_templates (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_notification_template_language ON notification_templates (event, channel, language);
+
+CREATE TABLE IF NOT EXISTS portal_tokens (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	customer_id integer,
+	token_hash varchar(64),
+	kind text,
+	expires_at datetime,
+	used_at datetime
+);
+CREATE INDEX IF NOT EXISTS idx_portal_tokens_deleted_at ON portal_tokens (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_portal_tokens_token_hash ON portal_tokens (token_hash);
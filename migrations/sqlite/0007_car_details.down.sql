@@ -0,0 +1,11 @@
+DROP INDEX IF EXISTS idx_cars_plate;
+ALTER TABLE cars DROP COLUMN vin_issues;
+ALTER TABLE cars DROP COLUMN mileage_unit;
+ALTER TABLE cars DROP COLUMN fuel_type;
+ALTER TABLE cars DROP COLUMN transmission;
+ALTER TABLE cars DROP COLUMN engine;
+ALTER TABLE cars DROP COLUMN "trim";
+ALTER TABLE cars DROP COLUMN year;
+ALTER TABLE cars DROP COLUMN plate_country;
+ALTER TABLE cars DROP COLUMN plate_state;
+ALTER TABLE cars DROP COLUMN license_plate;
@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS customer_contacts;
+ALTER TABLE services DROP COLUMN po_number;
+ALTER TABLE customers DROP COLUMN require_po_number;
+ALTER TABLE customers DROP COLUMN billing_terms;
+ALTER TABLE customers DROP COLUMN tax_id;
+ALTER TABLE customers DROP COLUMN company_name;
+ALTER TABLE customers DROP COLUMN kind;
+DROP TABLE IF EXISTS car_ownerships;
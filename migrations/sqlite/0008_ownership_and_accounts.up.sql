@@ -0,0 +1,40 @@
+CREATE TABLE IF NOT EXISTS car_ownerships (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	car_id integer,
+	customer_id integer,
+	started_at datetime,
+	ended_at datetime,
+	private boolean,
+	note text
+);
+CREATE INDEX IF NOT EXISTS idx_car_ownerships_deleted_at ON car_ownerships (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_car_ownerships_car_id ON car_ownerships (car_id);
+CREATE INDEX IF NOT EXISTS idx_car_ownerships_customer_id ON car_ownerships (customer_id);
+
+ALTER TABLE customers ADD COLUMN kind text;
+ALTER TABLE customers ADD COLUMN company_name text;
+ALTER TABLE customers ADD COLUMN tax_id text;
+ALTER TABLE customers ADD COLUMN billing_terms text;
+ALTER TABLE customers ADD COLUMN require_po_number boolean;
+-- customers saved before accounts had a kind are individuals
+UPDATE customers SET kind = 'individual' WHERE kind IS NULL OR kind = '';
+
+ALTER TABLE services ADD COLUMN po_number text;
+
+CREATE TABLE IF NOT EXISTS customer_contacts (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	customer_id integer,
+	name text,
+	role text,
+	phone text,
+	email text,
+	is_primary boolean
+);
+CREATE INDEX IF NOT EXISTS idx_customer_contacts_deleted_at ON customer_contacts (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_customer_contacts_customer_id ON customer_contacts (customer_id);
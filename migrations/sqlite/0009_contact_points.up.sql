@@ -0,0 +1,44 @@
+ALTER TABLE customers ADD COLUMN preferred_language text;
+ALTER TABLE customers ADD COLUMN preferred_channel text;
+ALTER TABLE customers ADD COLUMN marketing_consent boolean;
+ALTER TABLE customers ADD COLUMN marketing_consent_at datetime;
+UPDATE customers SET preferred_language = 'en' WHERE preferred_language IS NULL OR preferred_language = '';
+
+-- two customers can share a phone now, lookups go through contact_points
+DROP INDEX IF EXISTS uix_customers_phone;
+DROP INDEX IF EXISTS idx_customers_phone;
+
+CREATE TABLE IF NOT EXISTS contact_points (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	customer_id integer,
+	kind text,
+	value text,
+	normalized text,
+	is_primary boolean,
+	verified boolean,
+	verified_at datetime
+);
+CREATE INDEX IF NOT EXISTS idx_contact_points_deleted_at ON contact_points (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_contact_points_customer_id ON contact_points (customer_id);
+CREATE INDEX IF NOT EXISTS idx_contact_points_normalized ON contact_points (normalized);
+
+CREATE TABLE IF NOT EXISTS addresses (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	customer_id integer,
+	kind text,
+	line1 text,
+	line2 text,
+	city text,
+	state text,
+	postal_code text,
+	country text,
+	is_primary boolean
+);
+CREATE INDEX IF NOT EXISTS idx_addresses_deleted_at ON addresses (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_addresses_customer_id ON addresses (customer_id);
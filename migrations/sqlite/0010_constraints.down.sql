@@ -0,0 +1,15 @@
+DROP INDEX IF EXISTS idx_portal_tokens_customer_id;
+DROP INDEX IF EXISTS idx_time_punches_employee_id;
+DROP INDEX IF EXISTS idx_notifications_customer_id;
+DROP INDEX IF EXISTS idx_attachments_car_id;
+DROP INDEX IF EXISTS idx_inspection_results_inspection_id;
+DROP INDEX IF EXISTS idx_inspections_car_id;
+DROP INDEX IF EXISTS idx_odometer_readings_car_id;
+DROP INDEX IF EXISTS idx_stock_movements_part_id;
+DROP INDEX IF EXISTS idx_service_parts_service_id;
+DROP INDEX IF EXISTS idx_services_car_id;
+DROP INDEX IF EXISTS idx_cars_customer_id;
+
+-- cars may share an empty VIN by now, so the index can't be unique again
+DROP INDEX IF EXISTS idx_cars_vin;
+CREATE INDEX IF NOT EXISTS idx_cars_vin_number ON cars (vin_number);
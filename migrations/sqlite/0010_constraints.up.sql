@@ -0,0 +1,22 @@
+-- VINs are unique among cars that have one, the old index also counted
+-- empty and deleted ones
+DROP INDEX IF EXISTS uix_cars_vin_number;
+DROP INDEX IF EXISTS idx_cars_vin_number;
+UPDATE cars SET vin_number = '' WHERE vin_number IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_cars_vin
+	ON cars (vin_number)
+	WHERE vin_number <> '' AND deleted_at IS NULL;
+
+-- the columns lookups go through. SQLite can only declare foreign keys when a
+-- table is created, so here they are left to the postgres schema
+CREATE INDEX IF NOT EXISTS idx_cars_customer_id ON cars (customer_id);
+CREATE INDEX IF NOT EXISTS idx_services_car_id ON services (car_id);
+CREATE INDEX IF NOT EXISTS idx_service_parts_service_id ON service_parts (service_id);
+CREATE INDEX IF NOT EXISTS idx_stock_movements_part_id ON stock_movements (part_id);
+CREATE INDEX IF NOT EXISTS idx_odometer_readings_car_id ON odometer_readings (car_id);
+CREATE INDEX IF NOT EXISTS idx_inspections_car_id ON inspections (car_id);
+CREATE INDEX IF NOT EXISTS idx_inspection_results_inspection_id ON inspection_results (inspection_id);
+CREATE INDEX IF NOT EXISTS idx_attachments_car_id ON attachments (car_id);
+CREATE INDEX IF NOT EXISTS idx_notifications_customer_id ON notifications (customer_id);
+CREATE INDEX IF NOT EXISTS idx_time_punches_employee_id ON time_punches (employee_id);
+CREATE INDEX IF NOT EXISTS idx_portal_tokens_customer_id ON portal_tokens (customer_id);
@@ -0,0 +1,17 @@
+-- the audit trail of merged duplicate customers, merged_id is the customer
+-- that is gone
+CREATE TABLE IF NOT EXISTS customer_merges (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	survivor_id integer,
+	merged_id integer,
+	score real,
+	note text,
+	merged text,
+	moved text
+);
+CREATE INDEX IF NOT EXISTS idx_customer_merges_deleted_at ON customer_merges (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_customer_merges_survivor_id ON customer_merges (survivor_id);
+CREATE INDEX IF NOT EXISTS idx_customer_merges_merged_id ON customer_merges (merged_id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS privacy_requests;
+ALTER TABLE customers DROP COLUMN anonymized_at;
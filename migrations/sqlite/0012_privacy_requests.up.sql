@@ -0,0 +1,17 @@
+ALTER TABLE customers ADD COLUMN anonymized_at datetime;
+
+-- the log of data exports and anonymizations asked for by customers, kept
+-- when the customer is deleted
+CREATE TABLE IF NOT EXISTS privacy_requests (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	customer_id integer,
+	kind text,
+	requested_by text,
+	note text,
+	summary text
+);
+CREATE INDEX IF NOT EXISTS idx_privacy_requests_deleted_at ON privacy_requests (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_privacy_requests_customer_id ON privacy_requests (customer_id);
@@ -0,0 +1,81 @@
+DROP INDEX IF EXISTS idx_notification_template_language;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_notification_template_language ON notification_templates (event, channel, language);
+DROP INDEX IF EXISTS uix_labor_operations_code;
+CREATE UNIQUE INDEX IF NOT EXISTS uix_labor_operations_code ON labor_operations (code);
+DROP INDEX IF EXISTS uix_parts_sku;
+CREATE UNIQUE INDEX IF NOT EXISTS uix_parts_sku ON parts (sku);
+DROP INDEX IF EXISTS idx_cars_plate;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_cars_plate
+	ON cars (license_plate, plate_state, plate_country)
+	WHERE license_plate <> '' AND deleted_at IS NULL;
+DROP INDEX IF EXISTS idx_cars_vin;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_cars_vin
+	ON cars (vin_number)
+	WHERE vin_number <> '' AND deleted_at IS NULL;
+
+DROP INDEX IF EXISTS idx_privacy_requests_shop_id;
+ALTER TABLE privacy_requests DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_customer_merges_shop_id;
+ALTER TABLE customer_merges DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_addresses_shop_id;
+ALTER TABLE addresses DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_contact_points_shop_id;
+ALTER TABLE contact_points DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_customer_contacts_shop_id;
+ALTER TABLE customer_contacts DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_car_ownerships_shop_id;
+ALTER TABLE car_ownerships DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_portal_tokens_shop_id;
+ALTER TABLE portal_tokens DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_notification_templates_shop_id;
+ALTER TABLE notification_templates DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_notifications_shop_id;
+ALTER TABLE notifications DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_maintenance_rules_shop_id;
+ALTER TABLE maintenance_rules DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_odometer_readings_shop_id;
+ALTER TABLE odometer_readings DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_attachments_shop_id;
+ALTER TABLE attachments DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_inspection_results_shop_id;
+ALTER TABLE inspection_results DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_inspections_shop_id;
+ALTER TABLE inspections DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_inspection_template_items_shop_id;
+ALTER TABLE inspection_template_items DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_inspection_sections_shop_id;
+ALTER TABLE inspection_sections DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_inspection_templates_shop_id;
+ALTER TABLE inspection_templates DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_time_punches_shop_id;
+ALTER TABLE time_punches DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_employees_shop_id;
+ALTER TABLE employees DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_canned_job_parts_shop_id;
+ALTER TABLE canned_job_parts DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_canned_job_labors_shop_id;
+ALTER TABLE canned_job_labors DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_canned_jobs_shop_id;
+ALTER TABLE canned_jobs DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_labor_operations_shop_id;
+ALTER TABLE labor_operations DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_purchase_order_lines_shop_id;
+ALTER TABLE purchase_order_lines DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_purchase_orders_shop_id;
+ALTER TABLE purchase_orders DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_suppliers_shop_id;
+ALTER TABLE suppliers DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_service_parts_shop_id;
+ALTER TABLE service_parts DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_stock_movements_shop_id;
+ALTER TABLE stock_movements DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_parts_shop_id;
+ALTER TABLE parts DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_services_shop_id;
+ALTER TABLE services DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_cars_shop_id;
+ALTER TABLE cars DROP COLUMN shop_id;
+DROP INDEX IF EXISTS idx_customers_shop_id;
+ALTER TABLE customers DROP COLUMN shop_id;
+
+DROP TABLE IF EXISTS shops;
@@ -0,0 +1,97 @@
+-- shops served by one deployment. SQLite databases only ever have the first
+-- one, serving several shops needs postgres and its row-level security.
+CREATE TABLE IF NOT EXISTS shops (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	name text,
+	subdomain text,
+	api_key_hash text
+);
+CREATE INDEX IF NOT EXISTS idx_shops_deleted_at ON shops (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_shops_subdomain ON shops (subdomain) WHERE subdomain <> '';
+CREATE UNIQUE INDEX IF NOT EXISTS idx_shops_api_key_hash ON shops (api_key_hash) WHERE api_key_hash <> '';
+INSERT OR IGNORE INTO shops (id, created_at, updated_at, name, subdomain, api_key_hash)
+	VALUES (1, datetime('now'), datetime('now'), 'Main shop', '', '');
+
+ALTER TABLE customers ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_customers_shop_id ON customers (shop_id);
+ALTER TABLE cars ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_cars_shop_id ON cars (shop_id);
+ALTER TABLE services ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_services_shop_id ON services (shop_id);
+ALTER TABLE parts ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_parts_shop_id ON parts (shop_id);
+ALTER TABLE stock_movements ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_stock_movements_shop_id ON stock_movements (shop_id);
+ALTER TABLE service_parts ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_service_parts_shop_id ON service_parts (shop_id);
+ALTER TABLE suppliers ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_suppliers_shop_id ON suppliers (shop_id);
+ALTER TABLE purchase_orders ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_purchase_orders_shop_id ON purchase_orders (shop_id);
+ALTER TABLE purchase_order_lines ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_purchase_order_lines_shop_id ON purchase_order_lines (shop_id);
+ALTER TABLE labor_operations ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_labor_operations_shop_id ON labor_operations (shop_id);
+ALTER TABLE canned_jobs ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_canned_jobs_shop_id ON canned_jobs (shop_id);
+ALTER TABLE canned_job_labors ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_canned_job_labors_shop_id ON canned_job_labors (shop_id);
+ALTER TABLE canned_job_parts ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_canned_job_parts_shop_id ON canned_job_parts (shop_id);
+ALTER TABLE employees ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_employees_shop_id ON employees (shop_id);
+ALTER TABLE time_punches ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_time_punches_shop_id ON time_punches (shop_id);
+ALTER TABLE inspection_templates ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_inspection_templates_shop_id ON inspection_templates (shop_id);
+ALTER TABLE inspection_sections ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_inspection_sections_shop_id ON inspection_sections (shop_id);
+ALTER TABLE inspection_template_items ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_inspection_template_items_shop_id ON inspection_template_items (shop_id);
+ALTER TABLE inspections ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_inspections_shop_id ON inspections (shop_id);
+ALTER TABLE inspection_results ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_inspection_results_shop_id ON inspection_results (shop_id);
+ALTER TABLE attachments ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_attachments_shop_id ON attachments (shop_id);
+ALTER TABLE odometer_readings ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_odometer_readings_shop_id ON odometer_readings (shop_id);
+ALTER TABLE maintenance_rules ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_maintenance_rules_shop_id ON maintenance_rules (shop_id);
+ALTER TABLE notifications ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_notifications_shop_id ON notifications (shop_id);
+ALTER TABLE notification_templates ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_notification_templates_shop_id ON notification_templates (shop_id);
+ALTER TABLE portal_tokens ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_portal_tokens_shop_id ON portal_tokens (shop_id);
+ALTER TABLE car_ownerships ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_car_ownerships_shop_id ON car_ownerships (shop_id);
+ALTER TABLE customer_contacts ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_customer_contacts_shop_id ON customer_contacts (shop_id);
+ALTER TABLE contact_points ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_contact_points_shop_id ON contact_points (shop_id);
+ALTER TABLE addresses ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_addresses_shop_id ON addresses (shop_id);
+ALTER TABLE customer_merges ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_customer_merges_shop_id ON customer_merges (shop_id);
+ALTER TABLE privacy_requests ADD COLUMN shop_id integer NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_privacy_requests_shop_id ON privacy_requests (shop_id);
+
+-- what has to be unique only has to be unique within a shop
+DROP INDEX IF EXISTS idx_cars_vin;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_cars_vin
+	ON cars (shop_id, vin_number)
+	WHERE vin_number <> '' AND deleted_at IS NULL;
+DROP INDEX IF EXISTS idx_cars_plate;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_cars_plate
+	ON cars (shop_id, license_plate, plate_state, plate_country)
+	WHERE license_plate <> '' AND deleted_at IS NULL;
+DROP INDEX IF EXISTS uix_parts_sku;
+CREATE UNIQUE INDEX IF NOT EXISTS uix_parts_sku ON parts (shop_id, sku);
+DROP INDEX IF EXISTS uix_labor_operations_code;
+CREATE UNIQUE INDEX IF NOT EXISTS uix_labor_operations_code ON labor_operations (shop_id, code);
+DROP INDEX IF EXISTS idx_notification_template_language;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_notification_template_language ON notification_templates (shop_id, event, channel, language);
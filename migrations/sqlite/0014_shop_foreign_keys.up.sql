@@ -0,0 +1,3 @@
+-- a SQLite database only ever has the first shop, references can't cross
+-- shops there
+SELECT 1;
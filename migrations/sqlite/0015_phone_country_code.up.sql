@@ -0,0 +1,4 @@
+-- phones are stored without the country code of US numbers, the way they
+-- are looked up
+UPDATE contact_points SET normalized = substr(normalized, 2)
+	WHERE kind IN ('mobile', 'home', 'work') AND length(normalized) = 11 AND normalized LIKE '1%';
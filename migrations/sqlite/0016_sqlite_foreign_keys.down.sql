@@ -0,0 +1,579 @@
+-- the same tables built again without their foreign keys
+PRAGMA defer_foreign_keys = ON;
+
+ALTER TABLE cars RENAME TO cars_old;
+ALTER TABLE services RENAME TO services_old;
+ALTER TABLE parts RENAME TO parts_old;
+ALTER TABLE stock_movements RENAME TO stock_movements_old;
+ALTER TABLE service_parts RENAME TO service_parts_old;
+ALTER TABLE purchase_orders RENAME TO purchase_orders_old;
+ALTER TABLE purchase_order_lines RENAME TO purchase_order_lines_old;
+ALTER TABLE canned_job_labors RENAME TO canned_job_labors_old;
+ALTER TABLE canned_job_parts RENAME TO canned_job_parts_old;
+ALTER TABLE time_punches RENAME TO time_punches_old;
+ALTER TABLE inspection_sections RENAME TO inspection_sections_old;
+ALTER TABLE inspection_template_items RENAME TO inspection_template_items_old;
+ALTER TABLE inspections RENAME TO inspections_old;
+ALTER TABLE inspection_results RENAME TO inspection_results_old;
+ALTER TABLE attachments RENAME TO attachments_old;
+ALTER TABLE odometer_readings RENAME TO odometer_readings_old;
+ALTER TABLE maintenance_rules RENAME TO maintenance_rules_old;
+ALTER TABLE notifications RENAME TO notifications_old;
+ALTER TABLE portal_tokens RENAME TO portal_tokens_old;
+ALTER TABLE car_ownerships RENAME TO car_ownerships_old;
+ALTER TABLE customer_contacts RENAME TO customer_contacts_old;
+ALTER TABLE contact_points RENAME TO contact_points_old;
+ALTER TABLE addresses RENAME TO addresses_old;
+ALTER TABLE customer_merges RENAME TO customer_merges_old;
+ALTER TABLE privacy_requests RENAME TO privacy_requests_old;
+
+CREATE TABLE cars (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	make text,
+	modelo text,
+	color text,
+	vin_number text,
+	customer_id integer,
+	license_plate text,
+	plate_state text,
+	plate_country text,
+	year integer,
+	"trim" text,
+	engine text,
+	transmission text,
+	fuel_type text,
+	mileage_unit text,
+	vin_issues text,
+	shop_id integer NOT NULL DEFAULT 1
+);
+INSERT INTO cars (id, created_at, updated_at, deleted_at, make, modelo, color, vin_number, customer_id, license_plate, plate_state, plate_country, year, "trim", engine, transmission, fuel_type, mileage_unit, vin_issues, shop_id) SELECT id, created_at, updated_at, deleted_at, make, modelo, color, vin_number, customer_id, license_plate, plate_state, plate_country, year, "trim", engine, transmission, fuel_type, mileage_unit, vin_issues, shop_id FROM cars_old;
+DELETE FROM sqlite_sequence WHERE name = 'cars';
+UPDATE sqlite_sequence SET name = 'cars' WHERE name = 'cars_old';
+
+CREATE TABLE services (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	comment text,
+	miles text,
+	car_id integer,
+	status text,
+	labor_operation_id integer,
+	technician_id integer,
+	hours real,
+	price real,
+	miles_unparsed boolean,
+	po_number text,
+	shop_id integer NOT NULL DEFAULT 1
+);
+INSERT INTO services (id, created_at, updated_at, deleted_at, comment, miles, car_id, status, labor_operation_id, technician_id, hours, price, miles_unparsed, po_number, shop_id) SELECT id, created_at, updated_at, deleted_at, comment, miles, car_id, status, labor_operation_id, technician_id, hours, price, miles_unparsed, po_number, shop_id FROM services_old;
+DELETE FROM sqlite_sequence WHERE name = 'services';
+UPDATE sqlite_sequence SET name = 'services' WHERE name = 'services_old';
+
+CREATE TABLE parts (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	sku varchar(100),
+	description text,
+	brand text,
+	cost real,
+	price real,
+	bin_location text,
+	on_hand integer,
+	reserved integer,
+	min_quantity integer,
+	reorder_quantity integer,
+	preferred_supplier_id integer,
+	shop_id integer NOT NULL DEFAULT 1
+);
+INSERT INTO parts (id, created_at, updated_at, deleted_at, sku, description, brand, cost, price, bin_location, on_hand, reserved, min_quantity, reorder_quantity, preferred_supplier_id, shop_id) SELECT id, created_at, updated_at, deleted_at, sku, description, brand, cost, price, bin_location, on_hand, reserved, min_quantity, reorder_quantity, preferred_supplier_id, shop_id FROM parts_old;
+DELETE FROM sqlite_sequence WHERE name = 'parts';
+UPDATE sqlite_sequence SET name = 'parts' WHERE name = 'parts_old';
+
+CREATE TABLE stock_movements (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	part_id integer,
+	service_id integer,
+	kind text,
+	quantity integer,
+	unit_cost real,
+	note text,
+	shop_id integer NOT NULL DEFAULT 1
+);
+INSERT INTO stock_movements (id, created_at, updated_at, deleted_at, part_id, service_id, kind, quantity, unit_cost, note, shop_id) SELECT id, created_at, updated_at, deleted_at, part_id, service_id, kind, quantity, unit_cost, note, shop_id FROM stock_movements_old;
+DELETE FROM sqlite_sequence WHERE name = 'stock_movements';
+UPDATE sqlite_sequence SET name = 'stock_movements' WHERE name = 'stock_movements_old';
+
+CREATE TABLE service_parts (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	service_id integer,
+	part_id integer,
+	quantity integer,
+	price real,
+	status text,
+	shop_id integer NOT NULL DEFAULT 1
+);
+INSERT INTO service_parts (id, created_at, updated_at, deleted_at, service_id, part_id, quantity, price, status, shop_id) SELECT id, created_at, updated_at, deleted_at, service_id, part_id, quantity, price, status, shop_id FROM service_parts_old;
+DELETE FROM sqlite_sequence WHERE name = 'service_parts';
+UPDATE sqlite_sequence SET name = 'service_parts' WHERE name = 'service_parts_old';
+
+CREATE TABLE purchase_orders (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	supplier_id integer,
+	status text,
+	notes text,
+	sent_at datetime,
+	received_at datetime,
+	shop_id integer NOT NULL DEFAULT 1
+);
+INSERT INTO purchase_orders (id, created_at, updated_at, deleted_at, supplier_id, status, notes, sent_at, received_at, shop_id) SELECT id, created_at, updated_at, deleted_at, supplier_id, status, notes, sent_at, received_at, shop_id FROM purchase_orders_old;
+DELETE FROM sqlite_sequence WHERE name = 'purchase_orders';
+UPDATE sqlite_sequence SET name = 'purchase_orders' WHERE name = 'purchase_orders_old';
+
+CREATE TABLE purchase_order_lines (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	purchase_order_id integer,
+	part_id integer,
+	quantity integer,
+	quantity_received integer,
+	unit_cost real,
+	shop_id integer NOT NULL DEFAULT 1
+);
+INSERT INTO purchase_order_lines (id, created_at, updated_at, deleted_at, purchase_order_id, part_id, quantity, quantity_received, unit_cost, shop_id) SELECT id, created_at, updated_at, deleted_at, purchase_order_id, part_id, quantity, quantity_received, unit_cost, shop_id FROM purchase_order_lines_old;
+DELETE FROM sqlite_sequence WHERE name = 'purchase_order_lines';
+UPDATE sqlite_sequence SET name = 'purchase_order_lines' WHERE name = 'purchase_order_lines_old';
+
+CREATE TABLE canned_job_labors (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	canned_job_id integer,
+	labor_operation_id integer,
+	shop_id integer NOT NULL DEFAULT 1
+);
+INSERT INTO canned_job_labors (id, created_at, updated_at, deleted_at, canned_job_id, labor_operation_id, shop_id) SELECT id, created_at, updated_at, deleted_at, canned_job_id, labor_operation_id, shop_id FROM canned_job_labors_old;
+DELETE FROM sqlite_sequence WHERE name = 'canned_job_labors';
+UPDATE sqlite_sequence SET name = 'canned_job_labors' WHERE name = 'canned_job_labors_old';
+
+CREATE TABLE canned_job_parts (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	canned_job_id integer,
+	part_id integer,
+	quantity integer,
+	shop_id integer NOT NULL DEFAULT 1
+);
+INSERT INTO canned_job_parts (id, created_at, updated_at, deleted_at, canned_job_id, part_id, quantity, shop_id) SELECT id, created_at, updated_at, deleted_at, canned_job_id, part_id, quantity, shop_id FROM canned_job_parts_old;
+DELETE FROM sqlite_sequence WHERE name = 'canned_job_parts';
+UPDATE sqlite_sequence SET name = 'canned_job_parts' WHERE name = 'canned_job_parts_old';
+
+CREATE TABLE time_punches (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	employee_id integer,
+	service_id integer,
+	clock_on datetime,
+	clock_off datetime,
+	auto_closed boolean,
+	shop_id integer NOT NULL DEFAULT 1
+);
+INSERT INTO time_punches (id, created_at, updated_at, deleted_at, employee_id, service_id, clock_on, clock_off, auto_closed, shop_id) SELECT id, created_at, updated_at, deleted_at, employee_id, service_id, clock_on, clock_off, auto_closed, shop_id FROM time_punches_old;
+DELETE FROM sqlite_sequence WHERE name = 'time_punches';
+UPDATE sqlite_sequence SET name = 'time_punches' WHERE name = 'time_punches_old';
+
+CREATE TABLE inspection_sections (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	inspection_template_id integer,
+	name text,
+	"position" integer,
+	shop_id integer NOT NULL DEFAULT 1
+);
+INSERT INTO inspection_sections (id, created_at, updated_at, deleted_at, inspection_template_id, name, "position", shop_id) SELECT id, created_at, updated_at, deleted_at, inspection_template_id, name, "position", shop_id FROM inspection_sections_old;
+DELETE FROM sqlite_sequence WHERE name = 'inspection_sections';
+UPDATE sqlite_sequence SET name = 'inspection_sections' WHERE name = 'inspection_sections_old';
+
+CREATE TABLE inspection_template_items (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	inspection_section_id integer,
+	name text,
+	"position" integer,
+	unit text,
+	shop_id integer NOT NULL DEFAULT 1
+);
+INSERT INTO inspection_template_items (id, created_at, updated_at, deleted_at, inspection_section_id, name, "position", unit, shop_id) SELECT id, created_at, updated_at, deleted_at, inspection_section_id, name, "position", unit, shop_id FROM inspection_template_items_old;
+DELETE FROM sqlite_sequence WHERE name = 'inspection_template_items';
+UPDATE sqlite_sequence SET name = 'inspection_template_items' WHERE name = 'inspection_template_items_old';
+
+CREATE TABLE inspections (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	car_id integer,
+	inspection_template_id integer,
+	technician_id integer,
+	miles text,
+	status text,
+	shop_id integer NOT NULL DEFAULT 1
+);
+INSERT INTO inspections (id, created_at, updated_at, deleted_at, car_id, inspection_template_id, technician_id, miles, status, shop_id) SELECT id, created_at, updated_at, deleted_at, car_id, inspection_template_id, technician_id, miles, status, shop_id FROM inspections_old;
+DELETE FROM sqlite_sequence WHERE name = 'inspections';
+UPDATE sqlite_sequence SET name = 'inspections' WHERE name = 'inspections_old';
+
+CREATE TABLE inspection_results (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	inspection_id integer,
+	inspection_template_item_id integer,
+	section text,
+	item text,
+	"position" integer,
+	rating text,
+	notes text,
+	measurement real,
+	unit text,
+	service_id integer,
+	shop_id integer NOT NULL DEFAULT 1
+);
+INSERT INTO inspection_results (id, created_at, updated_at, deleted_at, inspection_id, inspection_template_item_id, section, item, "position", rating, notes, measurement, unit, service_id, shop_id) SELECT id, created_at, updated_at, deleted_at, inspection_id, inspection_template_item_id, section, item, "position", rating, notes, measurement, unit, service_id, shop_id FROM inspection_results_old;
+DELETE FROM sqlite_sequence WHERE name = 'inspection_results';
+UPDATE sqlite_sequence SET name = 'inspection_results' WHERE name = 'inspection_results_old';
+
+CREATE TABLE attachments (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	car_id integer,
+	service_id integer,
+	customer_id integer,
+	file_name text,
+	content_type text,
+	size bigint,
+	checksum text,
+	blob_key text,
+	thumbnail_key text,
+	shop_id integer NOT NULL DEFAULT 1
+);
+INSERT INTO attachments (id, created_at, updated_at, deleted_at, car_id, service_id, customer_id, file_name, content_type, size, checksum, blob_key, thumbnail_key, shop_id) SELECT id, created_at, updated_at, deleted_at, car_id, service_id, customer_id, file_name, content_type, size, checksum, blob_key, thumbnail_key, shop_id FROM attachments_old;
+DELETE FROM sqlite_sequence WHERE name = 'attachments';
+UPDATE sqlite_sequence SET name = 'attachments' WHERE name = 'attachments_old';
+
+CREATE TABLE odometer_readings (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	car_id integer,
+	service_id integer,
+	value integer,
+	unit text,
+	read_at datetime,
+	replacement boolean,
+	source text,
+	note text,
+	shop_id integer NOT NULL DEFAULT 1
+);
+INSERT INTO odometer_readings (id, created_at, updated_at, deleted_at, car_id, service_id, value, unit, read_at, replacement, source, note, shop_id) SELECT id, created_at, updated_at, deleted_at, car_id, service_id, value, unit, read_at, replacement, source, note, shop_id FROM odometer_readings_old;
+DELETE FROM sqlite_sequence WHERE name = 'odometer_readings';
+UPDATE sqlite_sequence SET name = 'odometer_readings' WHERE name = 'odometer_readings_old';
+
+CREATE TABLE maintenance_rules (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	name text,
+	make text,
+	modelo text,
+	year_from integer,
+	year_to integer,
+	interval_miles integer,
+	interval_months integer,
+	warn_miles integer,
+	warn_days integer,
+	labor_operation_id integer,
+	keywords text,
+	shop_id integer NOT NULL DEFAULT 1
+);
+INSERT INTO maintenance_rules (id, created_at, updated_at, deleted_at, name, make, modelo, year_from, year_to, interval_miles, interval_months, warn_miles, warn_days, labor_operation_id, keywords, shop_id) SELECT id, created_at, updated_at, deleted_at, name, make, modelo, year_from, year_to, interval_miles, interval_months, warn_miles, warn_days, labor_operation_id, keywords, shop_id FROM maintenance_rules_old;
+DELETE FROM sqlite_sequence WHERE name = 'maintenance_rules';
+UPDATE sqlite_sequence SET name = 'maintenance_rules' WHERE name = 'maintenance_rules_old';
+
+CREATE TABLE notifications (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	customer_id integer,
+	car_id integer,
+	event text,
+	channel text,
+	recipient text,
+	subject text,
+	body text,
+	status text,
+	attempts integer,
+	next_attempt_at datetime,
+	last_error text,
+	sent_at datetime,
+	shop_id integer NOT NULL DEFAULT 1
+);
+INSERT INTO notifications (id, created_at, updated_at, deleted_at, customer_id, car_id, event, channel, recipient, subject, body, status, attempts, next_attempt_at, last_error, sent_at, shop_id) SELECT id, created_at, updated_at, deleted_at, customer_id, car_id, event, channel, recipient, subject, body, status, attempts, next_attempt_at, last_error, sent_at, shop_id FROM notifications_old;
+DELETE FROM sqlite_sequence WHERE name = 'notifications';
+UPDATE sqlite_sequence SET name = 'notifications' WHERE name = 'notifications_old';
+
+CREATE TABLE portal_tokens (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	customer_id integer,
+	token_hash varchar(64),
+	kind text,
+	expires_at datetime,
+	used_at datetime,
+	shop_id integer NOT NULL DEFAULT 1
+);
+INSERT INTO portal_tokens (id, created_at, updated_at, deleted_at, customer_id, token_hash, kind, expires_at, used_at, shop_id) SELECT id, created_at, updated_at, deleted_at, customer_id, token_hash, kind, expires_at, used_at, shop_id FROM portal_tokens_old;
+DELETE FROM sqlite_sequence WHERE name = 'portal_tokens';
+UPDATE sqlite_sequence SET name = 'portal_tokens' WHERE name = 'portal_tokens_old';
+
+CREATE TABLE car_ownerships (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	car_id integer,
+	customer_id integer,
+	started_at datetime,
+	ended_at datetime,
+	private boolean,
+	note text,
+	shop_id integer NOT NULL DEFAULT 1
+);
+INSERT INTO car_ownerships (id, created_at, updated_at, deleted_at, car_id, customer_id, started_at, ended_at, private, note, shop_id) SELECT id, created_at, updated_at, deleted_at, car_id, customer_id, started_at, ended_at, private, note, shop_id FROM car_ownerships_old;
+DELETE FROM sqlite_sequence WHERE name = 'car_ownerships';
+UPDATE sqlite_sequence SET name = 'car_ownerships' WHERE name = 'car_ownerships_old';
+
+CREATE TABLE customer_contacts (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	customer_id integer,
+	name text,
+	role text,
+	phone text,
+	email text,
+	is_primary boolean,
+	shop_id integer NOT NULL DEFAULT 1
+);
+INSERT INTO customer_contacts (id, created_at, updated_at, deleted_at, customer_id, name, role, phone, email, is_primary, shop_id) SELECT id, created_at, updated_at, deleted_at, customer_id, name, role, phone, email, is_primary, shop_id FROM customer_contacts_old;
+DELETE FROM sqlite_sequence WHERE name = 'customer_contacts';
+UPDATE sqlite_sequence SET name = 'customer_contacts' WHERE name = 'customer_contacts_old';
+
+CREATE TABLE contact_points (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	customer_id integer,
+	kind text,
+	value text,
+	normalized text,
+	is_primary boolean,
+	verified boolean,
+	verified_at datetime,
+	shop_id integer NOT NULL DEFAULT 1
+);
+INSERT INTO contact_points (id, created_at, updated_at, deleted_at, customer_id, kind, value, normalized, is_primary, verified, verified_at, shop_id) SELECT id, created_at, updated_at, deleted_at, customer_id, kind, value, normalized, is_primary, verified, verified_at, shop_id FROM contact_points_old;
+DELETE FROM sqlite_sequence WHERE name = 'contact_points';
+UPDATE sqlite_sequence SET name = 'contact_points' WHERE name = 'contact_points_old';
+
+CREATE TABLE addresses (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	customer_id integer,
+	kind text,
+	line1 text,
+	line2 text,
+	city text,
+	state text,
+	postal_code text,
+	country text,
+	is_primary boolean,
+	shop_id integer NOT NULL DEFAULT 1
+);
+INSERT INTO addresses (id, created_at, updated_at, deleted_at, customer_id, kind, line1, line2, city, state, postal_code, country, is_primary, shop_id) SELECT id, created_at, updated_at, deleted_at, customer_id, kind, line1, line2, city, state, postal_code, country, is_primary, shop_id FROM addresses_old;
+DELETE FROM sqlite_sequence WHERE name = 'addresses';
+UPDATE sqlite_sequence SET name = 'addresses' WHERE name = 'addresses_old';
+
+CREATE TABLE customer_merges (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	survivor_id integer,
+	merged_id integer,
+	score real,
+	note text,
+	merged text,
+	moved text,
+	shop_id integer NOT NULL DEFAULT 1
+);
+INSERT INTO customer_merges (id, created_at, updated_at, deleted_at, survivor_id, merged_id, score, note, merged, moved, shop_id) SELECT id, created_at, updated_at, deleted_at, survivor_id, merged_id, score, note, merged, moved, shop_id FROM customer_merges_old;
+DELETE FROM sqlite_sequence WHERE name = 'customer_merges';
+UPDATE sqlite_sequence SET name = 'customer_merges' WHERE name = 'customer_merges_old';
+
+CREATE TABLE privacy_requests (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	customer_id integer,
+	kind text,
+	requested_by text,
+	note text,
+	summary text,
+	shop_id integer NOT NULL DEFAULT 1
+);
+INSERT INTO privacy_requests (id, created_at, updated_at, deleted_at, customer_id, kind, requested_by, note, summary, shop_id) SELECT id, created_at, updated_at, deleted_at, customer_id, kind, requested_by, note, summary, shop_id FROM privacy_requests_old;
+DELETE FROM sqlite_sequence WHERE name = 'privacy_requests';
+UPDATE sqlite_sequence SET name = 'privacy_requests' WHERE name = 'privacy_requests_old';
+
+-- a table goes before the tables it references
+DROP TABLE stock_movements_old;
+DROP TABLE service_parts_old;
+DROP TABLE time_punches_old;
+DROP TABLE inspection_results_old;
+DROP TABLE attachments_old;
+DROP TABLE odometer_readings_old;
+DROP TABLE services_old;
+DROP TABLE inspections_old;
+DROP TABLE notifications_old;
+DROP TABLE car_ownerships_old;
+DROP TABLE cars_old;
+DROP TABLE purchase_order_lines_old;
+DROP TABLE canned_job_parts_old;
+DROP TABLE parts_old;
+DROP TABLE purchase_orders_old;
+DROP TABLE canned_job_labors_old;
+DROP TABLE inspection_template_items_old;
+DROP TABLE inspection_sections_old;
+DROP TABLE maintenance_rules_old;
+DROP TABLE portal_tokens_old;
+DROP TABLE customer_contacts_old;
+DROP TABLE contact_points_old;
+DROP TABLE addresses_old;
+DROP TABLE customer_merges_old;
+DROP TABLE privacy_requests_old;
+
+CREATE INDEX idx_cars_customer_id ON cars (customer_id);
+CREATE INDEX idx_cars_deleted_at ON cars (deleted_at);
+CREATE UNIQUE INDEX idx_cars_plate ON cars (shop_id, license_plate, plate_state, plate_country) WHERE license_plate <> '' AND deleted_at IS NULL;
+CREATE INDEX idx_cars_shop_id ON cars (shop_id);
+CREATE UNIQUE INDEX idx_cars_vin ON cars (shop_id, vin_number) WHERE vin_number <> '' AND deleted_at IS NULL;
+CREATE INDEX idx_services_car_id ON services (car_id);
+CREATE INDEX idx_services_deleted_at ON services (deleted_at);
+CREATE INDEX idx_services_shop_id ON services (shop_id);
+CREATE INDEX idx_parts_deleted_at ON parts (deleted_at);
+CREATE INDEX idx_parts_shop_id ON parts (shop_id);
+CREATE UNIQUE INDEX uix_parts_sku ON parts (shop_id, sku);
+CREATE INDEX idx_stock_movements_deleted_at ON stock_movements (deleted_at);
+CREATE INDEX idx_stock_movements_part_id ON stock_movements (part_id);
+CREATE INDEX idx_stock_movements_shop_id ON stock_movements (shop_id);
+CREATE INDEX idx_service_parts_deleted_at ON service_parts (deleted_at);
+CREATE INDEX idx_service_parts_service_id ON service_parts (service_id);
+CREATE INDEX idx_service_parts_shop_id ON service_parts (shop_id);
+CREATE INDEX idx_purchase_orders_deleted_at ON purchase_orders (deleted_at);
+CREATE INDEX idx_purchase_orders_shop_id ON purchase_orders (shop_id);
+CREATE INDEX idx_purchase_order_lines_deleted_at ON purchase_order_lines (deleted_at);
+CREATE INDEX idx_purchase_order_lines_shop_id ON purchase_order_lines (shop_id);
+CREATE INDEX idx_canned_job_labors_deleted_at ON canned_job_labors (deleted_at);
+CREATE INDEX idx_canned_job_labors_shop_id ON canned_job_labors (shop_id);
+CREATE INDEX idx_canned_job_parts_deleted_at ON canned_job_parts (deleted_at);
+CREATE INDEX idx_canned_job_parts_shop_id ON canned_job_parts (shop_id);
+CREATE INDEX idx_time_punches_deleted_at ON time_punches (deleted_at);
+CREATE INDEX idx_time_punches_employee_id ON time_punches (employee_id);
+CREATE UNIQUE INDEX idx_time_punches_open ON time_punches (employee_id) WHERE clock_off IS NULL AND deleted_at IS NULL;
+CREATE INDEX idx_time_punches_shop_id ON time_punches (shop_id);
+CREATE INDEX idx_inspection_sections_deleted_at ON inspection_sections (deleted_at);
+CREATE INDEX idx_inspection_sections_shop_id ON inspection_sections (shop_id);
+CREATE INDEX idx_inspection_template_items_deleted_at ON inspection_template_items (deleted_at);
+CREATE INDEX idx_inspection_template_items_shop_id ON inspection_template_items (shop_id);
+CREATE INDEX idx_inspections_car_id ON inspections (car_id);
+CREATE INDEX idx_inspections_deleted_at ON inspections (deleted_at);
+CREATE INDEX idx_inspections_shop_id ON inspections (shop_id);
+CREATE INDEX idx_inspection_results_deleted_at ON inspection_results (deleted_at);
+CREATE INDEX idx_inspection_results_inspection_id ON inspection_results (inspection_id);
+CREATE INDEX idx_inspection_results_shop_id ON inspection_results (shop_id);
+CREATE INDEX idx_attachments_car_id ON attachments (car_id);
+CREATE INDEX idx_attachments_deleted_at ON attachments (deleted_at);
+CREATE INDEX idx_attachments_shop_id ON attachments (shop_id);
+CREATE INDEX idx_odometer_readings_car_id ON odometer_readings (car_id);
+CREATE INDEX idx_odometer_readings_deleted_at ON odometer_readings (deleted_at);
+CREATE INDEX idx_odometer_readings_shop_id ON odometer_readings (shop_id);
+CREATE INDEX idx_maintenance_rules_deleted_at ON maintenance_rules (deleted_at);
+CREATE INDEX idx_maintenance_rules_shop_id ON maintenance_rules (shop_id);
+CREATE INDEX idx_notifications_customer_id ON notifications (customer_id);
+CREATE INDEX idx_notifications_deleted_at ON notifications (deleted_at);
+CREATE INDEX idx_notifications_shop_id ON notifications (shop_id);
+CREATE INDEX idx_portal_tokens_customer_id ON portal_tokens (customer_id);
+CREATE INDEX idx_portal_tokens_deleted_at ON portal_tokens (deleted_at);
+CREATE INDEX idx_portal_tokens_shop_id ON portal_tokens (shop_id);
+CREATE UNIQUE INDEX uix_portal_tokens_token_hash ON portal_tokens (token_hash);
+CREATE INDEX idx_car_ownerships_car_id ON car_ownerships (car_id);
+CREATE INDEX idx_car_ownerships_customer_id ON car_ownerships (customer_id);
+CREATE INDEX idx_car_ownerships_deleted_at ON car_ownerships (deleted_at);
+CREATE INDEX idx_car_ownerships_shop_id ON car_ownerships (shop_id);
+CREATE INDEX idx_customer_contacts_customer_id ON customer_contacts (customer_id);
+CREATE INDEX idx_customer_contacts_deleted_at ON customer_contacts (deleted_at);
+CREATE INDEX idx_customer_contacts_shop_id ON customer_contacts (shop_id);
+CREATE INDEX idx_contact_points_customer_id ON contact_points (customer_id);
+CREATE INDEX idx_contact_points_deleted_at ON contact_points (deleted_at);
+CREATE INDEX idx_contact_points_normalized ON contact_points (normalized);
+CREATE INDEX idx_contact_points_shop_id ON contact_points (shop_id);
+CREATE INDEX idx_addresses_customer_id ON addresses (customer_id);
+CREATE INDEX idx_addresses_deleted_at ON addresses (deleted_at);
+CREATE INDEX idx_addresses_shop_id ON addresses (shop_id);
+CREATE INDEX idx_customer_merges_deleted_at ON customer_merges (deleted_at);
+CREATE INDEX idx_customer_merges_merged_id ON customer_merges (merged_id);
+CREATE INDEX idx_customer_merges_shop_id ON customer_merges (shop_id);
+CREATE INDEX idx_customer_merges_survivor_id ON customer_merges (survivor_id);
+CREATE INDEX idx_privacy_requests_customer_id ON privacy_requests (customer_id);
+CREATE INDEX idx_privacy_requests_deleted_at ON privacy_requests (deleted_at);
+CREATE INDEX idx_privacy_requests_shop_id ON privacy_requests (shop_id);
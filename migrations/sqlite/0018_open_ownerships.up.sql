@@ -0,0 +1,17 @@
+-- cars from before ownerships were recorded get one starting when the car
+-- was created, reading a car's owners used to add it
+INSERT INTO car_ownerships (created_at, updated_at, car_id, customer_id, started_at, private, note, shop_id)
+SELECT datetime('now'), datetime('now'), cars.id, cars.customer_id, COALESCE(cars.created_at, datetime('now')), false, '', cars.shop_id
+FROM cars
+WHERE cars.deleted_at IS NULL
+	AND NOT EXISTS (SELECT 1 FROM car_ownerships o WHERE o.car_id = cars.id AND o.ended_at IS NULL AND o.deleted_at IS NULL);
+
+-- two reads at once could each add one, the first added stays
+UPDATE car_ownerships SET deleted_at = datetime('now')
+WHERE ended_at IS NULL AND deleted_at IS NULL
+	AND EXISTS (SELECT 1 FROM car_ownerships o WHERE o.car_id = car_ownerships.car_id AND o.ended_at IS NULL AND o.deleted_at IS NULL AND o.id < car_ownerships.id);
+
+-- a car has one owner at a time
+CREATE UNIQUE INDEX IF NOT EXISTS idx_car_ownerships_open
+	ON car_ownerships (car_id)
+	WHERE ended_at IS NULL AND deleted_at IS NULL;
@@ -0,0 +1,19 @@
+-- times customers are booked to bring a car in, shown in the portal
+CREATE TABLE IF NOT EXISTS appointments (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	customer_id integer,
+	car_id integer,
+	starts_at datetime,
+	note text,
+	shop_id integer NOT NULL DEFAULT 1,
+	FOREIGN KEY (customer_id) REFERENCES customers (id) ON DELETE CASCADE,
+	FOREIGN KEY (car_id) REFERENCES cars (id) ON DELETE SET NULL
+);
+CREATE INDEX IF NOT EXISTS idx_appointments_deleted_at ON appointments (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_appointments_customer_id ON appointments (customer_id);
+CREATE INDEX IF NOT EXISTS idx_appointments_car_id ON appointments (car_id);
+CREATE INDEX IF NOT EXISTS idx_appointments_starts_at ON appointments (starts_at);
+CREATE INDEX IF NOT EXISTS idx_appointments_shop_id ON appointments (shop_id);
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+//notification channels
+const (
+	ChannelEmail = "email"
+	ChannelSMS   = "sms"
+)
+
+//events customers are notified about
+const (
+	EventAppointmentConfirmed = "appointment_confirmed"
+	EventCarReady             = "car_ready"
+	EventEstimateApproval     = "estimate_approval"
+	EventPortalLink           = "portal_link"
+)
+
+//status of a queued notification
+const (
+	NotificationQueued     = "queued"
+	NotificationSending    = "sending"
+	NotificationSent       = "sent"
+	NotificationFailed     = "failed"
+	NotificationSuppressed = "suppressed"
+)
+
+//a notification is given up on after this many failed sends
+const maxNotificationAttempts = 5
+
+var (
+	emailSender EmailSender
+	smsSender   SMSSender
+)
+
+// Notification is a message in the outgoing queue. Subject and Body are
+// rendered when it is queued, so later template edits don't change it.
+type Notification struct {
+	gorm.Model
+
+	CustomerId    uint
+	CarId         *uint
+	Event         string
+	Channel       string
+	Recipient     string
+	Subject       string
+	Body          string
+	Status        string
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+	SentAt        *time.Time
+}
+
+// NotificationTemplate overrides the built-in text of an event on a channel
+// in a language
+type NotificationTemplate struct {
+	gorm.Model
+
+	Event    string `gorm:"type:varchar(50);unique_index:idx_notification_template_language"`
+	Channel  string `gorm:"type:varchar(20);unique_index:idx_notification_template_language"`
+	Language string `gorm:"type:varchar(5);unique_index:idx_notification_template_language"`
+	Subject  string
+	Body     string
+}
+
+//built-in templates, used when there is no override in the database
+var defaultNotificationTemplates = map[string]map[string]NotificationTemplate{
+	EventAppointmentConfirmed: {
+		ChannelEmail: {
+			Subject: "Your appointment at {{.ShopName}} is confirmed",
+			Body:    "Hi {{.Customer.FirstName}},\n\nYour appointment{{with .Data.When}} on {{.}}{{end}} is confirmed.{{with .Car}} We'll see you and your {{.Make}} {{.Modelo}}.{{end}}\n\n{{.ShopName}}",
+		},
+		ChannelSMS: {
+			Body: "{{.ShopName}}: appointment confirmed{{with .Data.When}} for {{.}}{{end}}.",
+		},
+	},
+	EventCarReady: {
+		ChannelEmail: {
+			Subject: "Your {{.Car.Make}} {{.Car.Modelo}} is ready",
+			Body:    "Hi {{.Customer.FirstName}},\n\nYour {{.Car.Make}} {{.Car.Modelo}} is ready to be picked up.\n\n{{.ShopName}}",
+		},
+		ChannelSMS: {
+			Body: "{{.ShopName}}: your {{.Car.Make}} {{.Car.Modelo}} is ready to be picked up.",
+		},
+	},
+	EventEstimateApproval: {
+		ChannelEmail: {
+			Subject: "We need your approval for work on your {{.Car.Make}} {{.Car.Modelo}}",
+			Body:    "Hi {{.Customer.FirstName}},\n\nWe found the following on your {{.Car.Make}} {{.Car.Modelo}}:\n{{range .Services}}\n- {{.Comment}}{{if .Price}} ({{printf \"%.2f\" .Price}}){{end}}{{end}}\n\nPlease let us know if you'd like us to go ahead.\n\n{{.ShopName}}",
+		},
+		ChannelSMS: {
+			Body: "{{.ShopName}}: your {{.Car.Make}} {{.Car.Modelo}} needs {{len .Services}} item(s) approved. Please call us.",
+		},
+	},
+	EventPortalLink: {
+		ChannelEmail: {
+			Subject: "Your {{.ShopName}} sign-in link",
+			Body:    "Hi {{.Customer.FirstName}},\n\nUse this link to see your cars and their service history:\n{{.Data.Link}}\n\nIt expires in {{.Data.Expires}}. If you didn't ask for it you can ignore this message.\n\n{{.ShopName}}",
+		},
+		ChannelSMS: {
+			Body: "{{.ShopName}}: sign in to see your cars: {{.Data.Link}} (expires in {{.Data.Expires}})",
+		},
+	},
+}
+
+//built-in Spanish templates, English is used for anything missing here
+var defaultNotificationTemplatesEs = map[string]map[string]NotificationTemplate{
+	EventAppointmentConfirmed: {
+		ChannelEmail: {
+			Subject: "Su cita en {{.ShopName}} está confirmada",
+			Body:    "Hola {{.Customer.FirstName}},\n\nSu cita{{with .Data.When}} para el {{.}}{{end}} está confirmada.{{with .Car}} Lo esperamos con su {{.Make}} {{.Modelo}}.{{end}}\n\n{{.ShopName}}",
+		},
+		ChannelSMS: {
+			Body: "{{.ShopName}}: cita confirmada{{with .Data.When}} para el {{.}}{{end}}.",
+		},
+	},
+	EventCarReady: {
+		ChannelEmail: {
+			Subject: "Su {{.Car.Make}} {{.Car.Modelo}} está listo",
+			Body:    "Hola {{.Customer.FirstName}},\n\nSu {{.Car.Make}} {{.Car.Modelo}} está listo para recoger.\n\n{{.ShopName}}",
+		},
+		ChannelSMS: {
+			Body: "{{.ShopName}}: su {{.Car.Make}} {{.Car.Modelo}} está listo para recoger.",
+		},
+	},
+	EventEstimateApproval: {
+		ChannelEmail: {
+			Subject: "Necesitamos su aprobación para trabajos en su {{.Car.Make}} {{.Car.Modelo}}",
+			Body:    "Hola {{.Customer.FirstName}},\n\nEncontramos lo siguiente en su {{.Car.Make}} {{.Car.Modelo}}:\n{{range .Services}}\n- {{.Comment}}{{if .Price}} ({{printf \"%.2f\" .Price}}){{end}}{{end}}\n\nAvísenos si desea que procedamos.\n\n{{.ShopName}}",
+		},
+		ChannelSMS: {
+			Body: "{{.ShopName}}: su {{.Car.Make}} {{.Car.Modelo}} tiene {{len .Services}} trabajo(s) por aprobar. Por favor llámenos.",
+		},
+	},
+	EventPortalLink: {
+		ChannelEmail: {
+			Subject: "Su enlace para entrar a {{.ShopName}}",
+			Body:    "Hola {{.Customer.FirstName}},\n\nUse este enlace para ver sus autos y su historial de servicio:\n{{.Data.Link}}\n\nVence en {{.Data.Expires}}. Si usted no lo pidió puede ignorar este mensaje.\n\n{{.ShopName}}",
+		},
+		ChannelSMS: {
+			Body: "{{.ShopName}}: entre para ver sus autos: {{.Data.Link}} (vence en {{.Data.Expires}})",
+		},
+	},
+}
+
+// notificationData is what templates are rendered with
+type notificationData struct {
+	ShopName string
+	Customer Customer
+	Car      *Car
+	Services []Service
+	Data     map[string]string
+}
+
+//sets up the providers notifications are sent through
+func setupNotifications() error {
+	var err error
+	if emailSender, err = newEmailSenderFromEnv(); err != nil {
+		return err
+	}
+	smsSender, err = newSMSSenderFromEnv()
+	return err
+}
+
+//the shop's time zone, quiet hours and shift ends are times of day in it.
+//SHOP_TIMEZONE sets it, hosts like Heroku run in UTC.
+var shopLocation = time.Local
+
+//reads SHOP_TIMEZONE, an IANA name like America/Chicago
+func setupShopLocation() error {
+	name := os.Getenv("SHOP_TIMEZONE")
+	if name == "" {
+		log.Printf("WARNING: SHOP_TIMEZONE is not set, quiet hours and shift ends are read in the server's time zone (%s)", time.Local)
+		shopLocation = time.Local
+		return nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return fmt.Errorf("invalid SHOP_TIMEZONE %q: %v", name, err)
+	}
+	shopLocation = loc
+	return nil
+}
+
+func shopName() string {
+	if name := os.Getenv("SHOP_NAME"); name != "" {
+		return name
+	}
+	return "Mecanica"
+}
+
+//template for an event and channel in a language, the database override
+//first, then the built-in one of the language, then the English one
+func findNotificationTemplate(tx *gorm.DB, event, channel, language string) (NotificationTemplate, bool) {
+	var tmpl NotificationTemplate
+	if language == "" {
+		language = LanguageEnglish
+	}
+	if !tx.Where("event = ? AND channel = ? AND language = ?", event, channel, language).First(&tmpl).RecordNotFound() {
+		return tmpl, true
+	}
+	tmpl, ok := defaultNotificationTemplates[event][channel]
+	if language == LanguageSpanish {
+		if es, found := defaultNotificationTemplatesEs[event][channel]; found {
+			tmpl, ok = es, true
+		}
+	}
+	tmpl.Event, tmpl.Channel, tmpl.Language = event, channel, language
+	return tmpl, ok
+}
+
+func renderNotificationText(text string, data notificationData) (string, error) {
+	t, err := template.New("notification").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := t.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+//parses an HH:MM time of day on the day of t
+func clockOnDay(t time.Time, hhmm string) (time.Time, error) {
+	clock, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time of day %q", hhmm)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), clock.Hour(), clock.Minute(), 0, 0, t.Location()), nil
+}
+
+//tells whether t falls in a customer's quiet hours, and when they end.
+//Quiet hours are in the shop's time zone and may wrap past midnight, like
+//21:00 to 08:00.
+func quietUntil(customer Customer, t time.Time) (time.Time, bool) {
+	if customer.QuietHoursStart == "" || customer.QuietHoursEnd == "" {
+		return time.Time{}, false
+	}
+	t = t.In(shopLocation)
+	start, err := clockOnDay(t, customer.QuietHoursStart)
+	if err != nil {
+		return time.Time{}, false
+	}
+	end, err := clockOnDay(t, customer.QuietHoursEnd)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	if start.Before(end) {
+		if !t.Before(start) && t.Before(end) {
+			return end, true
+		}
+		return time.Time{}, false
+	}
+	//wraps midnight: quiet from start to the end of the day, then until end
+	if !t.Before(start) {
+		return end.AddDate(0, 0, 1), true
+	}
+	if t.Before(end) {
+		return end, true
+	}
+	return time.Time{}, false
+}
+
+//queues an event for a customer on their preferred channel, or on every
+//channel they can be reached on when they don't have one
+func notifyCustomer(tx *gorm.DB, customerId uint, event string, car *Car, services []Service, extra map[string]string) ([]Notification, error) {
+	channels := []string{ChannelEmail, ChannelSMS}
+	var customer Customer
+	if !tx.Select("id, preferred_channel").First(&customer, customerId).RecordNotFound() && customer.PreferredChannel != "" {
+		channels = []string{customer.PreferredChannel}
+	}
+	return notifyCustomerOn(tx, channels, customerId, event, car, services, extra)
+}
+
+//queues an event for a customer on the given channels. Channels the
+//customer opted out of are recorded as suppressed.
+func notifyCustomerOn(tx *gorm.DB, channels []string, customerId uint, event string, car *Car, services []Service, extra map[string]string) ([]Notification, error) {
+	var customer Customer
+	if tx.First(&customer, customerId).RecordNotFound() {
+		return nil, fmt.Errorf("customer %d not found", customerId)
+	}
+	if _, ok := defaultNotificationTemplates[event]; !ok {
+		return nil, fmt.Errorf("unknown event %q", event)
+	}
+
+	data := notificationData{ShopName: shopName(), Customer: customer, Car: car, Services: services, Data: extra}
+	if data.Data == nil {
+		data.Data = map[string]string{}
+	}
+
+	recipients := map[string]string{ChannelEmail: customer.Email, ChannelSMS: textablePhone(tx, customer)}
+	optedOut := map[string]bool{ChannelEmail: customer.EmailOptOut, ChannelSMS: customer.SmsOptOut}
+
+	var queued []Notification
+	for _, channel := range channels {
+		if recipients[channel] == "" {
+			continue
+		}
+		tmpl, ok := findNotificationTemplate(tx, event, channel, customer.PreferredLanguage)
+		if !ok {
+			continue
+		}
+		subject, err := renderNotificationText(tmpl.Subject, data)
+		if err != nil {
+			return nil, err
+		}
+		body, err := renderNotificationText(tmpl.Body, data)
+		if err != nil {
+			return nil, err
+		}
+
+		notification := Notification{
+			CustomerId:    customer.ID,
+			Event:         event,
+			Channel:       channel,
+			Recipient:     recipients[channel],
+			Subject:       subject,
+			Body:          body,
+			Status:        NotificationQueued,
+			NextAttemptAt: time.Now(),
+		}
+		if car != nil {
+			notification.CarId = &car.ID
+		}
+		if optedOut[channel] {
+			notification.Status = NotificationSuppressed
+			notification.LastError = "customer opted out"
+		}
+		if err := tx.Create(&notification).Error; err != nil {
+			return nil, err
+		}
+		queued = append(queued, notification)
+	}
+	return queued, nil
+}
+
+//queues an event about a car for its owner, logging instead of failing so
+//the work that triggered it still goes through
+func notifyCarOwner(tx *gorm.DB, event string, car Car, services []Service) {
+	if _, err := notifyCustomer(tx, car.CustomerId, event, &car, services, nil); err != nil {
+		log.Printf("notify: %s for car %d: %v", event, car.ID, err)
+	}
+}
+
+//sends one claimed notification
+func deliverNotification(n Notification) error {
+	switch n.Channel {
+	case ChannelEmail:
+		return emailSender.SendEmail(n.Recipient, n.Subject, n.Body)
+	case ChannelSMS:
+		return smsSender.SendSMS(n.Recipient, n.Body)
+	}
+	return fmt.Errorf("unknown channel %q", n.Channel)
+}
+
+//sends the notifications that are due. Each one is claimed with a
+//conditional update first, so several instances can share the queue.
+func processNotifications(tx *gorm.DB, now time.Time) {
+	var due []Notification
+	tx.Where("status = ? AND next_attempt_at <= ?", NotificationQueued, now).Order("next_attempt_at, id").Limit(50).Find(&due)
+
+	for _, n := range due {
+		claim := tx.Model(&Notification{}).Where("id = ? AND status = ?", n.ID, NotificationQueued).Update("status", NotificationSending)
+		if claim.Error != nil || claim.RowsAffected == 0 {
+			continue
+		}
+
+		//sign-in links are asked for by the customer, so they go out right away
+		var customer Customer
+		tx.First(&customer, n.CustomerId)
+		if until, quiet := quietUntil(customer, now); quiet && n.Event != EventPortalLink {
+			tx.Model(&n).Updates(map[string]interface{}{"status": NotificationQueued, "next_attempt_at": until})
+			continue
+		}
+
+		err := deliverNotification(n)
+		if err == nil {
+			sentAt := time.Now()
+			tx.Model(&n).Updates(map[string]interface{}{"status": NotificationSent, "sent_at": sentAt, "attempts": n.Attempts + 1, "last_error": ""})
+			continue
+		}
+
+		attempts := n.Attempts + 1
+		updates := map[string]interface{}{"attempts": attempts, "last_error": err.Error()}
+		if attempts >= maxNotificationAttempts {
+			updates["status"] = NotificationFailed
+		} else {
+			//back off 1, 2, 4, 8 minutes
+			updates["status"] = NotificationQueued
+			updates["next_attempt_at"] = now.Add(time.Duration(1<<uint(attempts-1)) * time.Minute)
+		}
+		tx.Model(&n).Updates(updates)
+		log.Printf("notify: sending %d to %s failed (attempt %d): %v", n.ID, n.Recipient, attempts, err)
+	}
+}
+
+//runs processNotifications every interval. Notifications left in sending
+//by an instance that died are put back in the queue first.
+func watchNotifications(interval time.Duration) {
+	jobsDB().Model(&Notification{}).Where("status = ? AND updated_at < ?", NotificationSending, time.Now().Add(-10*time.Minute)).
+		Update("status", NotificationQueued)
+	for now := range time.Tick(interval) {
+		processNotifications(jobsDB(), now)
+	}
+}
+
+//get notifications, optionally by ?customerId= and ?status=
+func getNotifications(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	query := shopDB(r).Order("id desc").Limit(200)
+	if customerId := r.URL.Query().Get("customerId"); customerId != "" {
+		query = query.Where("customer_id = ?", customerId)
+	}
+	if status := r.URL.Query().Get("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var notifications []Notification
+	query.Find(&notifications)
+	json.NewEncoder(w).Encode(&notifications)
+}
+
+//get a notification
+func getNotification(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var notification Notification
+	if shopDB(r).First(&notification, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("notification %s not found", params["id"]))
+		return
+	}
+	json.NewEncoder(w).Encode(&notification)
+}
+
+//queue a notification to a customer, like an appointment confirmation:
+//{"Event": "appointment_confirmed", "CarId": 3, "Data": {"When": "Monday 9:00"}}
+func notifyCustomerHandler(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var customer Customer
+	if shopDB(r).First(&customer, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("customer %s not found", params["id"]))
+		return
+	}
+
+	var body struct {
+		Event string
+		CarId *uint
+		Data  map[string]string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if body.Event == EventPortalLink {
+		writeError(w, http.StatusBadRequest, errors.New("sign-in links are sent through /portal/login"))
+		return
+	}
+
+	var car *Car
+	var services []Service
+	if body.CarId != nil {
+		car = &Car{}
+		if shopDB(r).Where("id = ? AND customer_id = ?", *body.CarId, customer.ID).First(car).RecordNotFound() {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("car %d is not this customer's", *body.CarId))
+			return
+		}
+		shopDB(r).Where("car_id = ? AND status = ?", car.ID, ServiceEstimate).Find(&services)
+	} else if body.Event != EventAppointmentConfirmed {
+		writeError(w, http.StatusBadRequest, errors.New("CarId is required for this event"))
+		return
+	}
+
+	queued, err := notifyCustomer(shopDB(r), customer.ID, body.Event, car, services, body.Data)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&queued)
+}
+
+//get the templates of every event and channel, overrides included
+func getNotificationTemplates(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	var templates []NotificationTemplate
+	for _, event := range []string{EventAppointmentConfirmed, EventCarReady, EventEstimateApproval, EventPortalLink} {
+		for _, channel := range []string{ChannelEmail, ChannelSMS} {
+			for _, language := range []string{LanguageEnglish, LanguageSpanish} {
+				if tmpl, ok := findNotificationTemplate(shopDB(r), event, channel, language); ok {
+					templates = append(templates, tmpl)
+				}
+			}
+		}
+	}
+	json.NewEncoder(w).Encode(&templates)
+}
+
+//override the template of an event and channel, in English unless Language
+//says otherwise
+func updateNotificationTemplate(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	var changes NotificationTemplate
+	if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if _, ok := defaultNotificationTemplates[changes.Event][changes.Channel]; !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown event %q or channel %q", changes.Event, changes.Channel))
+		return
+	}
+	if changes.Language == "" {
+		changes.Language = LanguageEnglish
+	}
+	if changes.Language != LanguageEnglish && changes.Language != LanguageSpanish {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Language must be %s or %s", LanguageEnglish, LanguageSpanish))
+		return
+	}
+	//make sure it renders before saving it
+	sample := notificationData{ShopName: shopName(), Car: &Car{}, Data: map[string]string{}}
+	for _, text := range []string{changes.Subject, changes.Body} {
+		if _, err := renderNotificationText(text, sample); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if strings.TrimSpace(changes.Body) == "" {
+		writeError(w, http.StatusBadRequest, errors.New("Body is required"))
+		return
+	}
+
+	var tmpl NotificationTemplate
+	shopDB(r).Where("event = ? AND channel = ? AND language = ?", changes.Event, changes.Channel, changes.Language).FirstOrInit(&tmpl)
+	tmpl.Event, tmpl.Channel, tmpl.Language = changes.Event, changes.Channel, changes.Language
+	tmpl.Subject, tmpl.Body = changes.Subject, changes.Body
+	if err := shopDB(r).Save(&tmpl).Error; err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&tmpl)
+}
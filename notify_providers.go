@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// EmailSender delivers an email message
+type EmailSender interface {
+	SendEmail(to, subject, body string) error
+}
+
+// SMSSender delivers a text message
+type SMSSender interface {
+	SendSMS(to, body string) error
+}
+
+//picks the email sender from NOTIFY_EMAIL (smtp or log). Without one
+//email is only logged, and the log says so loudly on startup.
+func newEmailSenderFromEnv() (EmailSender, error) {
+	switch os.Getenv("NOTIFY_EMAIL") {
+	case "":
+		warnNotDelivered("NOTIFY_EMAIL", "email", "smtp")
+		return LogSender{}, nil
+	case "log":
+		return LogSender{}, nil
+	case "smtp":
+		sender := &SMTPEmailSender{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     os.Getenv("SMTP_PORT"),
+			Username: os.Getenv("SMTP_USER"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("SMTP_FROM"),
+		}
+		if sender.Host == "" || sender.From == "" {
+			return nil, fmt.Errorf("SMTP_HOST and SMTP_FROM are required")
+		}
+		if sender.Port == "" {
+			sender.Port = "587"
+		}
+		return sender, nil
+	}
+	return nil, fmt.Errorf("unknown NOTIFY_EMAIL %q", os.Getenv("NOTIFY_EMAIL"))
+}
+
+//picks the SMS sender from NOTIFY_SMS (gateway or log), log when it isn't set
+func newSMSSenderFromEnv() (SMSSender, error) {
+	switch os.Getenv("NOTIFY_SMS") {
+	case "":
+		warnNotDelivered("NOTIFY_SMS", "texts", "gateway")
+		return LogSender{}, nil
+	case "log":
+		return LogSender{}, nil
+	case "gateway":
+		sender := &HTTPSMSGateway{
+			URL:    os.Getenv("SMS_GATEWAY_URL"),
+			Token:  os.Getenv("SMS_GATEWAY_TOKEN"),
+			From:   os.Getenv("SMS_FROM"),
+			client: &http.Client{Timeout: 15 * time.Second},
+		}
+		if sender.URL == "" {
+			return nil, fmt.Errorf("SMS_GATEWAY_URL is required")
+		}
+		return sender, nil
+	}
+	return nil, fmt.Errorf("unknown NOTIFY_SMS %q", os.Getenv("NOTIFY_SMS"))
+}
+
+//a provider left unset is easy to miss until customers say they got nothing
+func warnNotDelivered(name, what, provider string) {
+	log.Printf("WARNING: %s is not set, %s will be logged and NOT delivered to customers. Set %s=%s to deliver them, or %s=log to keep logging them.", name, what, name, provider, name)
+}
+
+// SMTPEmailSender sends plain text email through an SMTP server
+type SMTPEmailSender struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s *SMTPEmailSender) SendEmail(to, subject, body string) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", strings.NewReplacer("\r", "", "\n", " ").Replace(subject))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=UTF-8\r\n")
+	fmt.Fprintf(&msg, "\r\n%s\r\n", body)
+
+	return smtp.SendMail(s.Host+":"+s.Port, auth, s.From, []string{to}, msg.Bytes())
+}
+
+// HTTPSMSGateway posts text messages as JSON to an SMS gateway:
+// {"from": "...", "to": "...", "body": "..."} with a bearer token
+type HTTPSMSGateway struct {
+	URL    string
+	Token  string
+	From   string
+	client *http.Client
+}
+
+func (g *HTTPSMSGateway) SendSMS(to, body string) error {
+	payload, err := json.Marshal(map[string]string{"from": g.From, "to": to, "body": body})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", g.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if g.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+g.Token)
+	}
+
+	res, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		detail, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("sms gateway: %s: %s", res.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+// LogSender stands in for both providers when working locally. Nothing is
+// delivered: it logs that a message would have gone out, without its text and
+// with the recipient masked.
+type LogSender struct{}
+
+func (LogSender) SendEmail(to, subject, body string) error {
+	log.Printf("notify: email to %s not delivered, NOTIFY_EMAIL=log", maskRecipient(to))
+	return nil
+}
+
+func (LogSender) SendSMS(to, body string) error {
+	log.Printf("notify: text to %s not delivered, NOTIFY_SMS=log", maskRecipient(to))
+	return nil
+}
+
+//enough of an address or number to tell messages apart in a log
+func maskRecipient(to string) string {
+	if at := strings.LastIndex(to, "@"); at > 0 {
+		return to[:1] + "***" + to[at:]
+	}
+	if len(to) > 4 {
+		return "***" + to[len(to)-4:]
+	}
+	return "***"
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//a provider that keeps what it is given, or fails every send with Fail
+type fakeSender struct {
+	mu   sync.Mutex
+	Sent []Notification
+	Fail error
+}
+
+func (s *fakeSender) SendEmail(to, subject, body string) error {
+	return s.keep(Notification{Channel: ChannelEmail, Recipient: to, Subject: subject, Body: body})
+}
+
+func (s *fakeSender) SendSMS(to, body string) error {
+	return s.keep(Notification{Channel: ChannelSMS, Recipient: to, Body: body})
+}
+
+func (s *fakeSender) keep(n Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Fail != nil {
+		return s.Fail
+	}
+	s.Sent = append(s.Sent, n)
+	return nil
+}
+
+//points both providers at a fake for as long as the test runs
+func useFakeSender(t *testing.T) *fakeSender {
+	t.Helper()
+	fake := &fakeSender{}
+	previousEmail, previousSMS := emailSender, smsSender
+	emailSender, smsSender = fake, fake
+	t.Cleanup(func() {
+		emailSender, smsSender = previousEmail, previousSMS
+	})
+	return fake
+}
+
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	previous, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestUnsetProvidersLogWithAWarning(t *testing.T) {
+	setenv(t, "NOTIFY_EMAIL", "")
+	setenv(t, "NOTIFY_SMS", "")
+	useFakeSender(t)
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	if err := setupNotifications(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := emailSender.(LogSender); !ok {
+		t.Errorf("email sender = %T, want LogSender", emailSender)
+	}
+	if _, ok := smsSender.(LogSender); !ok {
+		t.Errorf("SMS sender = %T, want LogSender", smsSender)
+	}
+	for _, name := range []string{"NOTIFY_EMAIL", "NOTIFY_SMS"} {
+		if !strings.Contains(out.String(), "WARNING: "+name+" is not set") {
+			t.Errorf("no warning about %s in %q", name, out.String())
+		}
+	}
+
+	setenv(t, "NOTIFY_EMAIL", "carrier-pigeon")
+	if err := setupNotifications(); err == nil {
+		t.Error("an unknown provider was accepted")
+	}
+}
+
+func TestQuietHoursAreInTheShopsTimeZone(t *testing.T) {
+	chicago, err := time.LoadLocation("America/Chicago")
+	if err != nil {
+		t.Skip(err)
+	}
+	setenv(t, "SHOP_TIMEZONE", "America/Chicago")
+	previous := shopLocation
+	defer func() { shopLocation = previous }()
+	if err := setupShopLocation(); err != nil {
+		t.Fatal(err)
+	}
+
+	customer := Customer{QuietHoursStart: "21:00", QuietHoursEnd: "08:00"}
+	//16:00 in Chicago, though 21:00 on a server running in UTC
+	afternoon := time.Date(2026, 3, 10, 21, 0, 0, 0, time.UTC)
+	if until, quiet := quietUntil(customer, afternoon); quiet {
+		t.Errorf("quiet in the afternoon until %s", until)
+	}
+	//22:30 in Chicago, 03:30 the next day in UTC
+	night := time.Date(2026, 3, 11, 3, 30, 0, 0, time.UTC)
+	until, quiet := quietUntil(customer, night)
+	if !quiet {
+		t.Fatal("not quiet at night")
+	}
+	if want := time.Date(2026, 3, 11, 8, 0, 0, 0, chicago); !until.Equal(want) {
+		t.Errorf("quiet until %s, want %s", until, want)
+	}
+
+	setenv(t, "SHOP_TIMEZONE", "Mars/Olympus_Mons")
+	if err := setupShopLocation(); err == nil {
+		t.Error("an unknown time zone was accepted")
+	}
+}
+
+func TestLogSenderKeepsMessagesOutOfTheLog(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	LogSender{}.SendEmail("ana.ruiz@example.com", "Your car is ready", "Ford F150, $120")
+	LogSender{}.SendSMS("5551234567", "Your car is ready")
+	for _, secret := range []string{"ana.ruiz", "555123", "ready", "F150"} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("log has %q: %s", secret, out.String())
+		}
+	}
+}
+
+func TestFailedNotificationsAreRetried(t *testing.T) {
+	tx := setupTestDB(t)
+	fake := useFakeSender(t)
+	fake.Fail = errors.New("provider is down")
+
+	customer := Customer{FirstName: "Ana", Email: "ana@example.com"}
+	tx.Create(&customer)
+	now := time.Now()
+	n := Notification{CustomerId: customer.ID, Channel: ChannelEmail, Recipient: customer.Email, Subject: "ready", Body: "ready", Status: NotificationQueued, NextAttemptAt: now}
+	tx.Create(&n)
+
+	processNotifications(tx, now)
+	tx.First(&n, n.ID)
+	if n.Status != NotificationQueued || n.Attempts != 1 || n.LastError == "" {
+		t.Fatalf("after a failed send: status %s, %d attempts, error %q", n.Status, n.Attempts, n.LastError)
+	}
+
+	fake.Fail = nil
+	processNotifications(tx, n.NextAttemptAt)
+	tx.First(&n, n.ID)
+	if n.Status != NotificationSent || len(fake.Sent) != 1 || fake.Sent[0].Recipient != customer.Email {
+		t.Fatalf("after the retry: status %s, sent %+v", n.Status, fake.Sent)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+//odometer units
+const (
+	UnitMiles      = "mi"
+	UnitKilometers = "km"
+)
+
+//where an odometer reading came from
+const (
+	ReadingFromService   = "service"
+	ReadingFromManual    = "manual"
+	ReadingFromMigration = "migration"
+)
+
+const kmPerMile = 1.609344
+
+var errOdometerWentBack = errors.New("odometer reading is lower than the car's previous reading")
+
+// OdometerReading is the mileage of a car at a point in time. Replacement
+// marks a reading taken after the odometer was replaced or rolled over, so
+// it may be lower than the ones before it.
+type OdometerReading struct {
+	gorm.Model
+
+	CarId       uint
+	ServiceId   *uint
+	Value       int
+	Unit        string
+	ReadAt      time.Time
+	Replacement bool
+	Source      string
+	Note        string
+}
+
+// Miles is the reading converted to miles
+func (o OdometerReading) Miles() float64 {
+	if o.Unit == UnitKilometers {
+		return float64(o.Value) / kmPerMile
+	}
+	return float64(o.Value)
+}
+
+//a number, optionally followed by k or mil (Spanish for thousand), then a unit
+var milesPattern = regexp.MustCompile(`^([0-9][0-9.,' ]*)(k|mil)?(mi|mis|miles|millas|km|kms|kilometros|kilómetros)?$`)
+
+var separatorPattern = regexp.MustCompile(`[.,]`)
+
+//parses the free-form Service.Miles strings people typed over the years,
+//like "85000", "120,000 mi", "120k", "95 mil" or "140.000 km". The unit is
+//empty when none was typed, callers fall back to the car's mileage unit.
+func parseMiles(s string) (int, string, error) {
+	raw := strings.ToLower(strings.TrimSpace(s))
+	raw = strings.TrimSuffix(raw, ".")
+	raw = strings.Join(strings.Fields(raw), " ")
+	compact := strings.Replace(raw, " ", "", -1)
+
+	m := milesPattern.FindStringSubmatch(compact)
+	if m == nil {
+		return 0, "", fmt.Errorf("cannot parse mileage %q", s)
+	}
+	number, multiplier := m[1], m[2]
+
+	unit := ""
+	switch {
+	case strings.HasPrefix(m[3], "k"):
+		unit = UnitKilometers
+	case m[3] != "":
+		unit = UnitMiles
+	}
+
+	//a separator followed by exactly three digits groups thousands,
+	//anything else is a decimal point
+	number = strings.Replace(number, "'", "", -1)
+	groups := separatorPattern.Split(number, -1)
+	digits := groups[0]
+	decimals := ""
+	for i, group := range groups[1:] {
+		if len(group) == 3 {
+			digits += group
+			continue
+		}
+		if i != len(groups)-2 {
+			return 0, "", fmt.Errorf("cannot parse mileage %q", s)
+		}
+		decimals = group
+	}
+
+	value, err := strconv.ParseFloat(digits+"."+decimals+"0", 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("cannot parse mileage %q", s)
+	}
+	if multiplier != "" {
+		value *= 1000
+	}
+	if value > 2000000 {
+		return 0, "", fmt.Errorf("mileage %q is not believable", s)
+	}
+	return int(math.Round(value)), unit, nil
+}
+
+//unit a car's odometer reads in, miles unless the car says otherwise
+func carMileageUnit(tx *gorm.DB, carId uint) string {
+	var car Car
+	if tx.Select("id, mileage_unit").First(&car, carId).RecordNotFound() || car.MileageUnit == "" {
+		return UnitMiles
+	}
+	return car.MileageUnit
+}
+
+//latest reading of a car, if any
+func lastOdometerReading(tx *gorm.DB, carId uint) (OdometerReading, bool) {
+	var last OdometerReading
+	found := !tx.Where("car_id = ?", carId).Order("read_at desc, id desc").First(&last).RecordNotFound()
+	return last, found
+}
+
+//stores a reading after checking it doesn't go back in time
+func recordOdometerReading(tx *gorm.DB, reading *OdometerReading) error {
+	if reading.Unit != UnitMiles && reading.Unit != UnitKilometers {
+		return fmt.Errorf("unit must be %s or %s", UnitMiles, UnitKilometers)
+	}
+	if reading.Value < 0 {
+		return errors.New("odometer reading cannot be negative")
+	}
+	if reading.ReadAt.IsZero() {
+		reading.ReadAt = time.Now()
+	}
+
+	if last, ok := lastOdometerReading(tx, reading.CarId); ok && !reading.Replacement {
+		//allow a mile of slack for km/mi rounding
+		if reading.Miles() < last.Miles()-1 {
+			return fmt.Errorf("%w (%d %s)", errOdometerWentBack, last.Value, last.Unit)
+		}
+	}
+	return tx.Create(reading).Error
+}
+
+//records the reading typed on a service, if it has one. Miles that can't be
+//read are kept as typed and flagged, like the ones backfilled in 0005.
+func recordServiceMiles(tx *gorm.DB, service *Service) error {
+	if strings.TrimSpace(service.Miles) == "" {
+		return nil
+	}
+	value, unit, err := parseMiles(service.Miles)
+	if err != nil {
+		service.MilesUnparsed = true
+		return tx.Model(service).UpdateColumn("miles_unparsed", true).Error
+	}
+	if unit == "" {
+		unit = carMileageUnit(tx, service.CarId)
+	}
+	reading := OdometerReading{
+		CarId:       service.CarId,
+		ServiceId:   &service.ID,
+		Value:       value,
+		Unit:        unit,
+		Replacement: service.OdometerReplaced,
+		Source:      ReadingFromService,
+	}
+	return recordOdometerReading(tx, &reading)
+}
+
+//turns the Miles strings of services recorded before readings existed into
+//readings, flagging the ones that can't be parsed. Services already turned
+//into readings or flagged are skipped. Runs as part of migration 0005.
+func backfillOdometerReadings(tx *gorm.DB) error {
+	var services []Service
+	err := tx.Where("miles <> '' AND miles_unparsed = ?", false).
+		Where("NOT EXISTS (SELECT 1 FROM odometer_readings o WHERE o.service_id = services.id)").
+		Order("created_at").Find(&services).Error
+	if err != nil {
+		return err
+	}
+
+	parsed, flagged := 0, 0
+	for _, service := range services {
+		value, unit, err := parseMiles(service.Miles)
+		if err != nil {
+			flagged++
+			if err := tx.Model(&service).UpdateColumn("miles_unparsed", true).Error; err != nil {
+				return err
+			}
+			continue
+		}
+		if unit == "" {
+			unit = carMileageUnit(tx, service.CarId)
+		}
+		//history is taken as it is, even when it goes back
+		serviceId := service.ID
+		reading := OdometerReading{
+			CarId:     service.CarId,
+			ServiceId: &serviceId,
+			Value:     value,
+			Unit:      unit,
+			ReadAt:    service.CreatedAt,
+			Source:    ReadingFromMigration,
+			Note:      service.Miles,
+		}
+		if err := tx.Create(&reading).Error; err != nil {
+			return err
+		}
+		parsed++
+	}
+	if parsed+flagged > 0 {
+		log.Printf("odometer backfill: %d readings created, %d services flagged with unparseable miles", parsed, flagged)
+	}
+	return nil
+}
+
+//get the odometer history of a car in its own mileage unit, ?unit=mi|km
+//converts it
+func getOdometerSeries(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var car Car
+	if shopDB(r).First(&car, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("car %s not found", params["id"]))
+		return
+	}
+
+	unit := r.URL.Query().Get("unit")
+	if unit == "" {
+		unit = car.MileageUnit
+	}
+	if unit == "" {
+		unit = UnitMiles
+	}
+	if unit != UnitMiles && unit != UnitKilometers {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unit must be %s or %s", UnitMiles, UnitKilometers))
+		return
+	}
+
+	type point struct {
+		ReadingId   uint
+		ServiceId   *uint
+		ReadAt      time.Time
+		Value       int
+		Unit        string
+		Odometer    int
+		Replacement bool
+		Source      string
+	}
+
+	var readings []OdometerReading
+	shopDB(r).Where("car_id = ?", car.ID).Order("read_at, id").Find(&readings)
+
+	series := struct {
+		CarId  uint
+		Unit   string
+		Points []point
+	}{CarId: car.ID, Unit: unit, Points: []point{}}
+	for _, reading := range readings {
+		odometer := reading.Miles()
+		if unit == UnitKilometers {
+			odometer *= kmPerMile
+		}
+		series.Points = append(series.Points, point{
+			ReadingId:   reading.ID,
+			ServiceId:   reading.ServiceId,
+			ReadAt:      reading.ReadAt,
+			Value:       reading.Value,
+			Unit:        reading.Unit,
+			Odometer:    int(math.Round(odometer)),
+			Replacement: reading.Replacement,
+			Source:      reading.Source,
+		})
+	}
+	json.NewEncoder(w).Encode(&series)
+}
+
+//record an odometer reading outside of a service
+func createOdometerReading(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var car Car
+	if shopDB(r).First(&car, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("car %s not found", params["id"]))
+		return
+	}
+
+	var reading OdometerReading
+	if err := json.NewDecoder(r.Body).Decode(&reading); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	reading.CarId = car.ID
+	reading.ServiceId = nil
+	reading.Source = ReadingFromManual
+	if reading.Unit == "" {
+		reading.Unit = carMileageUnit(shopDB(r), car.ID)
+	}
+
+	if err := recordOdometerReading(shopDB(r), &reading); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errOdometerWentBack) {
+			status = http.StatusConflict
+		}
+		writeError(w, status, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&reading)
+}
+
+//list services whose Miles could not be parsed, so they can be fixed by hand
+func getUnparsedMiles(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	var services []Service
+	readDB(r).Where("miles_unparsed = ?", true).Order("car_id, id").Find(&services)
+	json.NewEncoder(w).Encode(&services)
+}
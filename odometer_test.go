@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServiceKeepsMilesThatCantBeRead(t *testing.T) {
+	tx := setupTestDB(t)
+	car := createTestService(t, tx).CarId
+
+	body := fmt.Sprintf(`{"CarId": %d, "Comment": "tune up", "Miles": "around fifty thousand"}`, car)
+	w := httptest.NewRecorder()
+	createService(w, httptest.NewRequest("POST", "/create/service", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("create service: %d %s", w.Code, w.Body)
+	}
+	var service Service
+	json.NewDecoder(w.Body).Decode(&service)
+
+	tx.First(&service, service.ID)
+	if !service.MilesUnparsed || service.Miles != "around fifty thousand" {
+		t.Fatalf("service has Miles %q, flagged %v", service.Miles, service.MilesUnparsed)
+	}
+	var readings int
+	tx.Model(&OdometerReading{}).Where("service_id = ?", service.ID).Count(&readings)
+	if readings != 0 {
+		t.Fatalf("%d readings were recorded", readings)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// CarOwnership is a period a customer owned a car. The current owner's period
+// has no EndedAt. A Private period doesn't show who the owner was to anyone
+// looking at the history of the car.
+type CarOwnership struct {
+	gorm.Model
+
+	CarId      uint `gorm:"index"`
+	CustomerId uint `gorm:"index"`
+	StartedAt  time.Time
+	EndedAt    *time.Time
+	Private    bool
+	Note       string
+}
+
+// OwnershipPeriod is one owner in the history of a car with the services done
+// while they had it. Customer is nil and CustomerId zero when the period is
+// private.
+type OwnershipPeriod struct {
+	CarOwnership
+	Customer *Customer
+	Services []Service
+}
+
+var errSameOwner = errors.New("the car already belongs to that customer")
+
+//the open ownership of a car. Every car gets one when it is created, cars
+//from before ownerships were recorded got theirs in a migration.
+func currentOwnership(tx *gorm.DB, car Car) (CarOwnership, error) {
+	var ownership CarOwnership
+	if tx.Where("car_id = ? AND ended_at IS NULL", car.ID).First(&ownership).RecordNotFound() {
+		return ownership, fmt.Errorf("car %d has no current owner on record", car.ID)
+	}
+	return ownership, nil
+}
+
+//records the owner of a new car, from when it was created
+func startOwnership(tx *gorm.DB, car Car) error {
+	return tx.Create(&CarOwnership{CarId: car.ID, CustomerId: car.CustomerId, StartedAt: car.CreatedAt}).Error
+}
+
+//hands a car over to another customer on a date, closing the current
+//ownership. The car keeps its services.
+func transferCar(tx *gorm.DB, car *Car, customerId uint, at time.Time, hidePrevious bool, note string) (CarOwnership, error) {
+	if customerId == car.CustomerId {
+		return CarOwnership{}, errSameOwner
+	}
+	previous, err := currentOwnership(tx, *car)
+	if err != nil {
+		return CarOwnership{}, err
+	}
+	if at.Before(previous.StartedAt) {
+		return CarOwnership{}, fmt.Errorf("transfer date %s is before the current owner got the car on %s",
+			at.Format("2006-01-02"), previous.StartedAt.Format("2006-01-02"))
+	}
+
+	previous.EndedAt = &at
+	previous.Private = hidePrevious
+	if err := tx.Save(&previous).Error; err != nil {
+		return CarOwnership{}, err
+	}
+	next := CarOwnership{CarId: car.ID, CustomerId: customerId, StartedAt: at, Note: note}
+	if err := tx.Create(&next).Error; err != nil {
+		return CarOwnership{}, err
+	}
+
+	car.CustomerId = customerId
+	return next, tx.Model(car).Update("customer_id", customerId).Error
+}
+
+//the owners of a car, oldest first, each with the services done under them
+func carOwnershipHistory(tx *gorm.DB, car Car) ([]OwnershipPeriod, error) {
+	var ownerships []CarOwnership
+	tx.Where("car_id = ?", car.ID).Order("started_at, id").Find(&ownerships)
+
+	history := []OwnershipPeriod{}
+	for _, ownership := range ownerships {
+		period := OwnershipPeriod{CarOwnership: ownership, Services: []Service{}}
+		if ownership.Private {
+			period.CustomerId = 0
+		} else {
+			var customer Customer
+			if !tx.First(&customer, ownership.CustomerId).RecordNotFound() {
+				period.Customer = &customer
+			}
+		}
+
+		query := tx.Where("car_id = ? AND created_at >= ?", car.ID, ownership.StartedAt)
+		if ownership.EndedAt != nil {
+			query = query.Where("created_at < ?", *ownership.EndedAt)
+		}
+		query.Order("id").Find(&period.Services)
+		history = append(history, period)
+	}
+	return history, nil
+}
+
+//move a car to another customer keeping its history
+func transferCarHandler(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var body struct {
+		CustomerId        uint
+		Date              *time.Time
+		HidePreviousOwner bool
+		Note              string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	at := time.Now()
+	if body.Date != nil {
+		at = *body.Date
+	}
+
+	var car Car
+	var ownership CarOwnership
+	status := http.StatusBadRequest
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		if tx.First(&car, params["id"]).RecordNotFound() {
+			status = http.StatusNotFound
+			return fmt.Errorf("car %s not found", params["id"])
+		}
+		var customer Customer
+		if tx.First(&customer, body.CustomerId).RecordNotFound() {
+			status = http.StatusNotFound
+			return fmt.Errorf("customer %d not found", body.CustomerId)
+		}
+		var err error
+		ownership, err = transferCar(tx, &car, customer.ID, at, body.HidePreviousOwner, body.Note)
+		if err == errSameOwner {
+			status = http.StatusConflict
+		}
+		return err
+	})
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&ownership)
+}
+
+//who owned a car and what was done while they had it
+func getCarOwners(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var car Car
+	if shopDB(r).First(&car, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("car %s not found", params["id"]))
+		return
+	}
+	history, err := carOwnershipHistory(shopDB(r), car)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&history)
+}
+
+//turn the privacy of a past ownership on or off
+func updateOwnership(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var ownership CarOwnership
+	if shopDB(r).First(&ownership, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("ownership %s not found", params["id"]))
+		return
+	}
+	var body struct {
+		Private *bool
+		Note    *string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if body.Private != nil {
+		ownership.Private = *body.Private
+	}
+	if body.Note != nil {
+		ownership.Note = *body.Note
+	}
+	if err := shopDB(r).Save(&ownership).Error; err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&ownership)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCarsWithoutAnOwnershipGetOneFromTheMigration(t *testing.T) {
+	conn, err := openDatabase("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := db
+	db = conn
+	defer func() {
+		db = previous
+		conn.Close()
+	}()
+	if _, err := migrateUp(17); err != nil {
+		t.Fatal(err)
+	}
+
+	customer := Customer{FirstName: "Ana"}
+	conn.Create(&customer)
+	created := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	unrecorded := Car{Make: "Ford", CustomerId: customer.ID}
+	unrecorded.CreatedAt = created
+	twice := Car{Make: "Honda", CustomerId: customer.ID}
+	for _, car := range []*Car{&unrecorded, &twice} {
+		if err := conn.Create(car).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		conn.Create(&CarOwnership{CarId: twice.ID, CustomerId: customer.ID, StartedAt: created})
+	}
+
+	if _, err := migrateUp(0); err != nil {
+		t.Fatal(err)
+	}
+	for _, car := range []Car{unrecorded, twice} {
+		var open []CarOwnership
+		conn.Where("car_id = ? AND ended_at IS NULL", car.ID).Find(&open)
+		if len(open) != 1 || open[0].CustomerId != customer.ID || !open[0].StartedAt.Equal(created) {
+			t.Errorf("car %d has open ownerships %+v, want one of customer %d from %s", car.ID, open, customer.ID, created)
+		}
+	}
+
+	err = conn.Create(&CarOwnership{CarId: twice.ID, CustomerId: customer.ID, StartedAt: time.Now()}).Error
+	if err == nil {
+		t.Error("a car got a second current owner")
+	}
+}
+
+func TestReadingOwnersWritesNothing(t *testing.T) {
+	tx := setupTestDB(t)
+	service := createTestService(t, tx)
+	var car Car
+	tx.First(&car, service.CarId)
+	//a car the migration would have given an ownership
+	tx.Unscoped().Where("car_id = ?", car.ID).Delete(&CarOwnership{})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/car/{id}/owners", getCarOwners).Methods("GET")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", fmt.Sprintf("/car/%d/owners", car.ID), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var count int
+	tx.Unscoped().Model(&CarOwnership{}).Where("car_id = ?", car.ID).Count(&count)
+	if count != 0 {
+		t.Errorf("reading the owners added %d ownerships", count)
+	}
+}
+
+func TestTransferEndsTheCurrentOwnership(t *testing.T) {
+	tx := setupTestDB(t)
+	service := createTestService(t, tx)
+	var car Car
+	tx.First(&car, service.CarId)
+	if err := startOwnership(tx, car); err != nil {
+		t.Fatal(err)
+	}
+	buyer := Customer{FirstName: "Luis"}
+	tx.Create(&buyer)
+
+	sold := car.CreatedAt.Add(24 * time.Hour)
+	if _, err := transferCar(tx, &car, buyer.ID, sold, true, "sold"); err != nil {
+		t.Fatal(err)
+	}
+	history, err := carOwnershipHistory(tx, car)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].EndedAt == nil || history[0].Customer != nil || history[1].CustomerId != buyer.ID {
+		t.Fatalf("history %+v, want the hidden first owner then the buyer", history)
+	}
+	if _, err := transferCar(tx, &car, buyer.ID, sold, false, ""); err != errSameOwner {
+		t.Errorf("transfer to the owner: %v, want %v", err, errSameOwner)
+	}
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+//kinds of stock movements recorded in the ledger
+const (
+	MovementAdjust  = "adjust"
+	MovementReceive = "receive"
+	MovementReserve = "reserve"
+	MovementRelease = "release"
+	MovementConsume = "consume"
+)
+
+//status of a part line on a service
+const (
+	PartLineReserved = "reserved"
+	PartLineReleased = "released"
+	PartLineConsumed = "consumed"
+)
+
+//status of a service (work order line), estimates become open once the
+//customer approves them
+const (
+	ServiceEstimate  = "estimate"
+	ServiceOpen      = "open"
+	ServiceCompleted = "completed"
+)
+
+var errInsufficientStock = errors.New("not enough stock available")
+
+var errPartLineSettled = errors.New("part line is no longer reserved")
+
+type Part struct {
+	gorm.Model
+
+	SKU         string `gorm:"type:varchar(100);unique_index"`
+	Description string
+	Brand       string
+	Cost        float64
+	Price       float64
+	BinLocation string
+	// OnHand and Reserved are only changed through stock movements
+	OnHand      int
+	Reserved    int
+	MinQuantity int
+	// ReorderQuantity is how much to buy when restocking, when zero we buy
+	// back up to MinQuantity
+	ReorderQuantity     int
+	PreferredSupplierId *uint
+}
+
+// Available is what can still be reserved for new work
+func (p Part) Available() int {
+	return p.OnHand - p.Reserved
+}
+
+// StockMovement is an append-only ledger entry. Quantity is signed: reserve
+// and release move stock in and out of Reserved, everything else moves OnHand.
+type StockMovement struct {
+	gorm.Model
+
+	PartId    uint
+	ServiceId *uint
+	Kind      string
+	Quantity  int
+	UnitCost  float64
+	Note      string
+}
+
+// ServicePart is a part used on a service
+type ServicePart struct {
+	gorm.Model
+
+	ServiceId uint
+	PartId    uint
+	Quantity  int
+	Price     float64
+	Status    string
+}
+
+//adds a movement to the ledger
+func recordMovement(tx *gorm.DB, m StockMovement) error {
+	return tx.Create(&m).Error
+}
+
+//reserves qty units of a part for a service. The check and the update are a
+//single statement so concurrent reservations cannot drive stock negative.
+func reservePart(tx *gorm.DB, partId, serviceId uint, qty int) error {
+	res := tx.Exec(`
+		UPDATE parts SET reserved = reserved + ?
+		WHERE id = ? AND deleted_at IS NULL AND on_hand - reserved >= ?;`,
+		qty, partId, qty)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errInsufficientStock
+	}
+	return recordMovement(tx, StockMovement{PartId: partId, ServiceId: &serviceId, Kind: MovementReserve, Quantity: qty})
+}
+
+//moves a reserved line to status. The check is part of the update, so a
+//line two requests settle at once only gives its stock back or uses it once.
+func settlePartLine(tx *gorm.DB, line *ServicePart, status string) error {
+	res := tx.Model(&ServicePart{}).Where("id = ? AND status = ?", line.ID, PartLineReserved).Update("status", status)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errPartLineSettled
+	}
+	line.Status = status
+	return nil
+}
+
+//gives reserved units back to available stock
+func releasePart(tx *gorm.DB, line *ServicePart) error {
+	if err := settlePartLine(tx, line, PartLineReleased); err != nil {
+		return err
+	}
+	res := tx.Exec(`
+		UPDATE parts SET reserved = reserved - ?
+		WHERE id = ? AND reserved - ? >= 0;`,
+		line.Quantity, line.PartId, line.Quantity)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errInsufficientStock
+	}
+	return recordMovement(tx, StockMovement{PartId: line.PartId, ServiceId: &line.ServiceId, Kind: MovementRelease, Quantity: -line.Quantity})
+}
+
+//gives back the stock still reserved on services that are going away
+func releaseServiceParts(tx *gorm.DB, serviceIds []uint) error {
+	var lines []ServicePart
+	if err := tx.Where("service_id IN (?) AND status = ?", append(serviceIds, 0), PartLineReserved).Find(&lines).Error; err != nil {
+		return err
+	}
+	for i := range lines {
+		if err := releasePart(tx, &lines[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//takes reserved units out of stock for good
+func consumePart(tx *gorm.DB, line *ServicePart) error {
+	if err := settlePartLine(tx, line, PartLineConsumed); err != nil {
+		return err
+	}
+	res := tx.Exec(`
+		UPDATE parts SET on_hand = on_hand - ?, reserved = reserved - ?
+		WHERE id = ? AND on_hand - ? >= 0 AND reserved - ? >= 0;`,
+		line.Quantity, line.Quantity, line.PartId, line.Quantity, line.Quantity)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errInsufficientStock
+	}
+	return recordMovement(tx, StockMovement{PartId: line.PartId, ServiceId: &line.ServiceId, Kind: MovementConsume, Quantity: -line.Quantity})
+}
+
+//adds (or removes when negative) stock on hand, never below what is reserved
+func adjustStock(tx *gorm.DB, partId uint, qty int, kind string, unitCost float64, note string) error {
+	res := tx.Exec(`
+		UPDATE parts SET on_hand = on_hand + ?
+		WHERE id = ? AND deleted_at IS NULL AND on_hand + ? >= reserved;`,
+		qty, partId, qty)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errInsufficientStock
+	}
+	return recordMovement(tx, StockMovement{PartId: partId, Kind: kind, Quantity: qty, UnitCost: unitCost, Note: note})
+}
+
+//scopes a query to the parts below their reorder point
+func partsBelowMinimum(tx *gorm.DB) *gorm.DB {
+	return tx.Where("min_quantity > 0 AND on_hand - reserved < min_quantity").Order("sku")
+}
+
+//logs an alert when a part falls below its minimum
+func checkLowStock(tx *gorm.DB, partId uint) {
+	var part Part
+	if tx.First(&part, partId).RecordNotFound() {
+		return
+	}
+	if part.MinQuantity > 0 && part.Available() < part.MinQuantity {
+		log.Printf("low stock: part %s (%d) has %d available, minimum is %d", part.SKU, part.ID, part.Available(), part.MinQuantity)
+	}
+}
+
+//get all parts
+func getParts(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	var parts []Part
+	shopDB(r).Order("sku").Find(&parts)
+	json.NewEncoder(w).Encode(&parts)
+}
+
+//get a part
+func getPart(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var part Part
+	if shopDB(r).First(&part, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("part %s not found", params["id"]))
+		return
+	}
+	json.NewEncoder(w).Encode(&part)
+}
+
+//get the stock ledger of a part
+func getPartMovements(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var movements []StockMovement
+	shopDB(r).Where("part_id = ?", params["id"]).Order("id").Find(&movements)
+	json.NewEncoder(w).Encode(&movements)
+}
+
+//create a part, the initial OnHand is recorded as an adjustment
+func createPart(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	var part Part
+	if err := json.NewDecoder(r.Body).Decode(&part); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if part.SKU == "" {
+		writeError(w, http.StatusBadRequest, errors.New("SKU is required"))
+		return
+	}
+
+	initial := part.OnHand
+	part.OnHand = 0
+	part.Reserved = 0
+
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&part).Error; err != nil {
+			return err
+		}
+		if initial != 0 {
+			if err := adjustStock(tx, part.ID, initial, MovementAdjust, part.Cost, "initial stock"); err != nil {
+				return err
+			}
+		}
+		return tx.First(&part, part.ID).Error
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&part)
+}
+
+//edit a part's catalog data, stock levels are not editable here
+func updatePart(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var part Part
+	if shopDB(r).First(&part, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("part %s not found", params["id"]))
+		return
+	}
+
+	onHand, reserved := part.OnHand, part.Reserved
+	if err := json.NewDecoder(r.Body).Decode(&part); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	part.OnHand, part.Reserved = onHand, reserved
+
+	if err := shopDB(r).Omit("on_hand", "reserved").Save(&part).Error; err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&part)
+}
+
+//adjust stock on hand (counts, damage, returns)
+func adjustPart(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var part Part
+	if shopDB(r).First(&part, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("part %s not found", params["id"]))
+		return
+	}
+
+	var adjustment struct {
+		Quantity int
+		Note     string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&adjustment); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if adjustment.Quantity == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("Quantity must not be zero"))
+		return
+	}
+
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		return adjustStock(tx, part.ID, adjustment.Quantity, MovementAdjust, part.Cost, adjustment.Note)
+	})
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	checkLowStock(shopDB(r), part.ID)
+
+	shopDB(r).First(&part, part.ID)
+	json.NewEncoder(w).Encode(&part)
+}
+
+//list parts whose available stock is below their minimum
+func getReorderReport(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	var parts []Part
+	if err := partsBelowMinimum(readDB(r)).Find(&parts).Error; err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&parts)
+}
+
+//add a part to a service, reserving it
+func reserveServicePart(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var service Service
+	if shopDB(r).First(&service, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("service %s not found", params["id"]))
+		return
+	}
+	if service.Status == ServiceCompleted {
+		writeError(w, http.StatusConflict, errors.New("service is already completed"))
+		return
+	}
+
+	var line ServicePart
+	if err := json.NewDecoder(r.Body).Decode(&line); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if line.Quantity <= 0 {
+		writeError(w, http.StatusBadRequest, errors.New("Quantity must be positive"))
+		return
+	}
+
+	var part Part
+	if shopDB(r).First(&part, line.PartId).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("part %d not found", line.PartId))
+		return
+	}
+
+	line.ServiceId = service.ID
+	line.Status = PartLineReserved
+	if line.Price == 0 {
+		line.Price = part.Price
+	}
+
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		if err := reservePart(tx, part.ID, service.ID, line.Quantity); err != nil {
+			return err
+		}
+		return tx.Create(&line).Error
+	})
+	if errors.Is(err, errInsufficientStock) {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	checkLowStock(shopDB(r), part.ID)
+
+	json.NewEncoder(w).Encode(&line)
+}
+
+//remove a part from a service, releasing the reservation
+func releaseServicePart(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var line ServicePart
+	if shopDB(r).Where("id = ? AND service_id = ?", params["lineId"], params["id"]).First(&line).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("part line %s not found", params["lineId"]))
+		return
+	}
+	if line.Status != PartLineReserved {
+		writeError(w, http.StatusConflict, fmt.Errorf("part line is %s", line.Status))
+		return
+	}
+
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		return releasePart(tx, &line)
+	})
+	if errors.Is(err, errPartLineSettled) {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&line)
+}
+
+//complete a service, consuming every reserved part
+func completeService(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var service Service
+	if shopDB(r).First(&service, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("service %s not found", params["id"]))
+		return
+	}
+	if service.Status == ServiceCompleted {
+		writeError(w, http.StatusConflict, errors.New("service is already completed"))
+		return
+	}
+	if service.Status == ServiceEstimate {
+		writeError(w, http.StatusConflict, errors.New("service is an estimate that has not been approved"))
+		return
+	}
+
+	var lines []ServicePart
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("service_id = ? AND status = ?", service.ID, PartLineReserved).Find(&lines).Error; err != nil {
+			return err
+		}
+		for i := range lines {
+			if err := consumePart(tx, &lines[i]); err != nil {
+				return err
+			}
+		}
+		service.Status = ServiceCompleted
+		return tx.Save(&service).Error
+	})
+	if errors.Is(err, errPartLineSettled) {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	for _, line := range lines {
+		checkLowStock(shopDB(r), line.PartId)
+	}
+
+	//the car is ready once nothing approved is left to do on it
+	var pending int
+	shopDB(r).Model(&Service{}).Where("car_id = ? AND status = ?", service.CarId, ServiceOpen).Count(&pending)
+	if pending == 0 {
+		var car Car
+		if !shopDB(r).First(&car, service.CarId).RecordNotFound() {
+			notifyCarOwner(shopDB(r), EventCarReady, car, nil)
+		}
+	}
+
+	shopDB(r).Model(&service).Related(&service.Parts)
+	json.NewEncoder(w).Encode(&service)
+}
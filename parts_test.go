@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+//a part with onHand units and a line reserving qty of them for service
+func reserveTestLine(t *testing.T, tx *gorm.DB, service Service, onHand, qty int) (Part, ServicePart) {
+	t.Helper()
+	part := Part{SKU: "BRK-1", OnHand: onHand}
+	if err := tx.Create(&part).Error; err != nil {
+		t.Fatal(err)
+	}
+	line := ServicePart{ServiceId: service.ID, PartId: part.ID, Quantity: qty, Status: PartLineReserved}
+	err := tx.Transaction(func(tx *gorm.DB) error {
+		if err := reservePart(tx, part.ID, service.ID, qty); err != nil {
+			return err
+		}
+		return tx.Create(&line).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return part, line
+}
+
+func assertStock(t *testing.T, tx *gorm.DB, partId uint, onHand, reserved int) {
+	t.Helper()
+	var part Part
+	tx.First(&part, partId)
+	if part.OnHand != onHand || part.Reserved != reserved {
+		t.Fatalf("part has %d on hand and %d reserved, want %d and %d", part.OnHand, part.Reserved, onHand, reserved)
+	}
+}
+
+func TestSettledLineIsNotSettledAgain(t *testing.T) {
+	tx := setupTestDB(t)
+	part, line := reserveTestLine(t, tx, createTestService(t, tx), 5, 2)
+
+	//both requests loaded the line while it was still reserved
+	stale := line
+	if err := tx.Transaction(func(tx *gorm.DB) error { return releasePart(tx, &line) }); err != nil {
+		t.Fatal(err)
+	}
+	err := tx.Transaction(func(tx *gorm.DB) error { return consumePart(tx, &stale) })
+	if err != errPartLineSettled {
+		t.Fatalf("consuming a released line: got %v, want %v", err, errPartLineSettled)
+	}
+	err = tx.Transaction(func(tx *gorm.DB) error { return releasePart(tx, &stale) })
+	if err != errPartLineSettled {
+		t.Fatalf("releasing a released line: got %v, want %v", err, errPartLineSettled)
+	}
+	assertStock(t, tx, part.ID, 5, 0)
+
+	var movements int
+	tx.Model(&StockMovement{}).Where("part_id = ?", part.ID).Count(&movements)
+	if movements != 2 {
+		t.Fatalf("%d movements in the ledger, want the reservation and one release", movements)
+	}
+}
+
+func TestConsumeNeverDrivesStockNegative(t *testing.T) {
+	tx := setupTestDB(t)
+	part, line := reserveTestLine(t, tx, createTestService(t, tx), 3, 3)
+
+	//stock counted out from under the reservation
+	tx.Exec(`UPDATE parts SET on_hand = 1 WHERE id = ?`, part.ID)
+	err := tx.Transaction(func(tx *gorm.DB) error { return consumePart(tx, &line) })
+	if err != errInsufficientStock {
+		t.Fatalf("got %v, want %v", err, errInsufficientStock)
+	}
+	//the transaction rolled back, the line is still reserved
+	var saved ServicePart
+	tx.First(&saved, line.ID)
+	if saved.Status != PartLineReserved {
+		t.Fatalf("line is %s, want %s", saved.Status, PartLineReserved)
+	}
+	assertStock(t, tx, part.ID, 1, 3)
+}
+
+func TestConcurrentReleasesReleaseOnce(t *testing.T) {
+	tx := setupTestDB(t)
+	service := createTestService(t, tx)
+	part, line := reserveTestLine(t, tx, service, 4, 4)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/service/{id}/part/{lineId}", releaseServicePart).Methods("DELETE")
+	path := fmt.Sprintf("/service/%d/part/%d", service.ID, line.ID)
+
+	codes := make([]int, 5)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("DELETE", path, nil))
+			codes[i] = w.Code
+		}(i)
+	}
+	wg.Wait()
+
+	ok := 0
+	for _, code := range codes {
+		switch code {
+		case http.StatusOK:
+			ok++
+		case http.StatusConflict:
+		default:
+			t.Fatalf("release answered %d", code)
+		}
+	}
+	if ok != 1 {
+		t.Fatalf("%d releases went through, want 1", ok)
+	}
+	assertStock(t, tx, part.ID, 4, 0)
+}
+
+func TestDeletingWorkGivesItsReservationsBack(t *testing.T) {
+	tx := setupTestDB(t)
+	router := mux.NewRouter()
+	router.HandleFunc("/delete/customer/{id}", deleteCustomer).Methods("DELETE")
+	router.HandleFunc("/delete/car/{id}", deleteCar).Methods("DELETE")
+	router.HandleFunc("/delete/service", deleteService).Methods("DELETE")
+
+	for _, remove := range []func(Service, Car) string{
+		func(s Service, c Car) string { return fmt.Sprintf("/delete/service?id=%d", s.ID) },
+		func(s Service, c Car) string { return fmt.Sprintf("/delete/car/%d", c.ID) },
+		func(s Service, c Car) string { return fmt.Sprintf("/delete/customer/%d", c.CustomerId) },
+	} {
+		service := createTestService(t, tx)
+		var car Car
+		tx.First(&car, service.CarId)
+		part := Part{SKU: fmt.Sprintf("OIL-%d", service.ID), OnHand: 4}
+		tx.Create(&part)
+		line := ServicePart{ServiceId: service.ID, PartId: part.ID, Quantity: 3, Status: PartLineReserved}
+		err := tx.Transaction(func(tx *gorm.DB) error {
+			if err := reservePart(tx, part.ID, service.ID, 3); err != nil {
+				return err
+			}
+			return tx.Create(&line).Error
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		path := remove(service, car)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("DELETE", path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", path, w.Code, w.Body)
+		}
+		assertStock(t, tx, part.ID, 4, 0)
+	}
+}
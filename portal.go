@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+//kinds of portal tokens: a link is emailed or texted and can be used once to
+//open a session, the session token is what the portal sends on every request
+const (
+	PortalTokenLink    = "link"
+	PortalTokenSession = "session"
+)
+
+const (
+	portalLinkTTL    = 15 * time.Minute
+	portalSessionTTL = 24 * time.Hour
+	//a customer can't ask for links faster than this
+	portalLinkInterval = time.Minute
+)
+
+type portalContextKey struct{}
+
+var errPortalUnauthorized = errors.New("sign-in link or session is invalid or has expired")
+
+// PortalToken lets a customer read their own data. Only the hash of the
+// token is stored.
+type PortalToken struct {
+	gorm.Model
+
+	CustomerId uint
+	TokenHash  string `gorm:"type:varchar(64);unique_index"`
+	Kind       string
+	ExpiresAt  time.Time
+	UsedAt     *time.Time
+}
+
+//creates a token for a customer, returning the secret to hand out
+func issuePortalToken(tx *gorm.DB, customerId uint, kind string, ttl time.Duration) (string, PortalToken, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", PortalToken{}, err
+	}
+	secret := hex.EncodeToString(b)
+	token := PortalToken{
+		CustomerId: customerId,
+		TokenHash:  sha256Hex([]byte(secret)),
+		Kind:       kind,
+		ExpiresAt:  time.Now().Add(ttl),
+	}
+	return secret, token, tx.Create(&token).Error
+}
+
+//finds the live token of a kind matching a secret
+func findPortalToken(tx *gorm.DB, secret, kind string) (PortalToken, bool) {
+	var token PortalToken
+	if secret == "" {
+		return token, false
+	}
+	notFound := tx.Where("token_hash = ? AND kind = ? AND expires_at > ? AND used_at IS NULL", sha256Hex([]byte(secret)), kind, time.Now()).
+		First(&token).RecordNotFound()
+	return token, !notFound
+}
+
+func portalURL() string {
+	if u := os.Getenv("PORTAL_URL"); u != "" {
+		return u
+	}
+	return "http://localhost:3000/portal"
+}
+
+//wraps a portal handler so it only runs with a valid session, which sets
+//the customer the request is scoped to
+func portalAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		if (*r).Method == "OPTIONS" {
+			return
+		}
+
+		secret := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		token, ok := findPortalToken(shopDB(r), secret, PortalTokenSession)
+		if !ok {
+			writeError(w, http.StatusUnauthorized, errPortalUnauthorized)
+			return
+		}
+		ctx := context.WithValue(r.Context(), portalContextKey{}, token)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+//session token of an authenticated portal request
+func portalSession(r *http.Request) PortalToken {
+	token, _ := r.Context().Value(portalContextKey{}).(PortalToken)
+	return token
+}
+
+//ask for a sign-in link by phone or email. The answer is the same whether or
+//not a customer was found, so it can't be used to look customers up.
+func portalLogin(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	var body struct {
+		Phone string
+		Email string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var customer Customer
+	var channel string
+	var found bool
+	switch {
+	case strings.TrimSpace(body.Phone) != "":
+		channel = ChannelSMS
+		//a shared phone can't tell us who is asking
+		if customers := findCustomersByPhone(shopDB(r), body.Phone); len(customers) == 1 {
+			customer, found = customers[0], true
+		}
+	case strings.TrimSpace(body.Email) != "":
+		channel = ChannelEmail
+		customer, found = findCustomerByEmail(shopDB(r), body.Email)
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("Phone or Email is required"))
+		return
+	}
+
+	if found {
+		var recent int
+		shopDB(r).Model(&PortalToken{}).Where("customer_id = ? AND kind = ? AND created_at > ?", customer.ID, PortalTokenLink, time.Now().Add(-portalLinkInterval)).Count(&recent)
+		if recent == 0 {
+			sendPortalLink(shopDB(r), customer, channel)
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"Message": "if we know you, a sign-in link is on its way"})
+}
+
+//issues a sign-in link and queues it to the customer
+func sendPortalLink(tx *gorm.DB, customer Customer, channel string) {
+	secret, _, err := issuePortalToken(tx, customer.ID, PortalTokenLink, portalLinkTTL)
+	if err != nil {
+		log.Printf("portal: issuing link for customer %d: %v", customer.ID, err)
+		return
+	}
+	link := portalURL() + "?token=" + url.QueryEscape(secret)
+	extra := map[string]string{"Link": link, "Expires": portalLinkTTL.String()}
+	if _, err := notifyCustomerOn(tx, []string{channel}, customer.ID, EventPortalLink, nil, nil, extra); err != nil {
+		log.Printf("portal: queueing link for customer %d: %v", customer.ID, err)
+		return
+	}
+	go processNotifications(tx, time.Now())
+}
+
+//trade a sign-in link token for a session token, the link can't be used again
+func portalCreateSession(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	var body struct {
+		Token string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var session struct {
+		Token     string
+		ExpiresAt time.Time
+	}
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		link, ok := findPortalToken(tx, body.Token, PortalTokenLink)
+		if !ok {
+			return errPortalUnauthorized
+		}
+		//only one request can mark the link used
+		res := tx.Model(&PortalToken{}).Where("id = ? AND used_at IS NULL", link.ID).Update("used_at", time.Now())
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errPortalUnauthorized
+		}
+
+		secret, token, err := issuePortalToken(tx, link.CustomerId, PortalTokenSession, portalSessionTTL)
+		session.Token, session.ExpiresAt = secret, token.ExpiresAt
+		return err
+	})
+	if err == errPortalUnauthorized {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&session)
+}
+
+//end the current portal session
+func portalLogout(w http.ResponseWriter, r *http.Request) {
+	token := portalSession(r)
+	shopDB(r).Model(&token).Update("used_at", time.Now())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//the signed-in customer and their cars
+func portalMe(w http.ResponseWriter, r *http.Request) {
+	customer, ok := findCustomerWithCars(shopDB(r), portalSession(r).CustomerId)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errPortalUnauthorized)
+		return
+	}
+	json.NewEncoder(w).Encode(&customer)
+}
+
+//one of the signed-in customer's cars with its full history
+func portalCar(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	car, ok := findCarWithHistory(shopDB(r), params["id"])
+	if !ok || car.CustomerId != portalSession(r).CustomerId {
+		writeError(w, http.StatusNotFound, fmt.Errorf("car %s not found", params["id"]))
+		return
+	}
+	json.NewEncoder(w).Encode(&car)
+}
+
+//estimate lines waiting for the signed-in customer's approval
+func portalEstimates(w http.ResponseWriter, r *http.Request) {
+	var services []Service
+	shopDB(r).Joins("JOIN cars ON cars.id = services.car_id").
+		Where("cars.customer_id = ? AND cars.deleted_at IS NULL AND services.status = ?", portalSession(r).CustomerId, ServiceEstimate).
+		Order("services.car_id, services.id").Find(&services)
+	json.NewEncoder(w).Encode(&services)
+}
+
+//what the signed-in customer was billed for the services done on their cars
+//while they had them
+func portalInvoices(w http.ResponseWriter, r *http.Request) {
+	customer, ok := findCustomerWithCars(shopDB(r), portalSession(r).CustomerId)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errPortalUnauthorized)
+		return
+	}
+	var ownerships []CarOwnership
+	shopDB(r).Where("customer_id = ?", customer.ID).Find(&ownerships)
+	cars, err := customerCarHistory(shopDB(r), customer, ownerships)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	//the history keeps deleted services, the portal doesn't show them
+	for i, car := range cars {
+		services := []*Service{}
+		for _, service := range car.Services {
+			if service.DeletedAt == nil {
+				services = append(services, service)
+			}
+		}
+		cars[i].Services = services
+	}
+	json.NewEncoder(w).Encode(customerInvoices(shopDB(r), cars))
+}
+
+//the signed-in customer's appointments that are still to come
+func portalAppointments(w http.ResponseWriter, r *http.Request) {
+	appointments := []Appointment{}
+	shopDB(r).Where("customer_id = ? AND starts_at >= ?", portalSession(r).CustomerId, time.Now()).
+		Order("starts_at, id").Find(&appointments)
+	json.NewEncoder(w).Encode(&appointments)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPortalInvoicesOfTheSignedInCustomer(t *testing.T) {
+	tx := setupTestDB(t)
+	billed := createTestService(t, tx)
+	tx.Model(&billed).Updates(map[string]interface{}{"status": ServiceCompleted, "price": 120.0})
+	estimate := Service{Comment: "tires", Status: ServiceEstimate, CarId: billed.CarId}
+	deleted := Service{Comment: "oil", Status: ServiceCompleted, CarId: billed.CarId, Price: 40}
+	tx.Create(&estimate)
+	tx.Create(&deleted)
+	tx.Delete(&deleted)
+	createTestService(t, tx)
+
+	var car Car
+	tx.First(&car, billed.CarId)
+	secret, _, err := issuePortalToken(tx, car.CustomerId, PortalTokenSession, portalSessionTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/portal/invoices", nil)
+	req.Header.Set("Authorization", "Bearer "+secret)
+	w := httptest.NewRecorder()
+	portalAuth(portalInvoices)(w, req)
+
+	var invoices []Invoice
+	if err := json.NewDecoder(w.Body).Decode(&invoices); err != nil {
+		t.Fatalf("%d %v", w.Code, err)
+	}
+	if len(invoices) != 1 || invoices[0].ServiceId != billed.ID || invoices[0].Total != 120 {
+		t.Fatalf("got invoices %+v, want only service %d for 120", invoices, billed.ID)
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+//kinds of privacy requests
+const (
+	PrivacyExport    = "export"
+	PrivacyAnonymize = "anonymize"
+)
+
+var errCustomerAnonymized = errors.New("the customer has been anonymized")
+
+// PrivacyRequest logs a customer's data being handed out or scrubbed.
+// Summary says what was in it, as JSON.
+type PrivacyRequest struct {
+	gorm.Model
+
+	CustomerId  uint `gorm:"index"`
+	Kind        string
+	RequestedBy string
+	Note        string
+	Summary     string
+}
+
+// InvoiceLine is a part billed on an invoice
+type InvoiceLine struct {
+	PartId      uint
+	SKU         string
+	Description string
+	Quantity    int
+	Price       float64
+	Amount      float64
+}
+
+// Invoice is what a customer was billed for a service, estimates aren't
+// billed and released parts aren't on it
+type Invoice struct {
+	ServiceId uint
+	CarId     uint
+	Date      time.Time
+	Status    string
+	PONumber  string
+	Labor     float64
+	Lines     []InvoiceLine
+	Parts     float64
+	Total     float64
+}
+
+// CustomerDataExport is everything kept about a customer: their record with
+// contacts, contact points and addresses, the cars they have or had with the
+// services done while they had them, the messages sent to them, their
+// appointments and what they were billed. Deleted rows are in it too, they
+// are still kept.
+type CustomerDataExport struct {
+	ExportedAt    time.Time
+	Customer      Customer
+	Cars          []Car
+	Ownerships    []CarOwnership
+	Invoices      []Invoice
+	Notifications []Notification
+	Appointments  []Appointment
+	Attachments   []Attachment
+	Merges        []CustomerMerge
+}
+
+//the cars a customer has or had and the services done on each while it was
+//theirs
+func customerCarHistory(tx *gorm.DB, customer Customer, ownerships []CarOwnership) ([]Car, error) {
+	carIds := []uint{}
+	if err := tx.Unscoped().Model(&Car{}).Where("customer_id = ?", customer.ID).Pluck("id", &carIds).Error; err != nil {
+		return nil, err
+	}
+	periods := map[uint][]CarOwnership{}
+	for _, ownership := range ownerships {
+		if len(periods[ownership.CarId]) == 0 {
+			carIds = append(carIds, ownership.CarId)
+		}
+		periods[ownership.CarId] = append(periods[ownership.CarId], ownership)
+	}
+
+	cars := []Car{}
+	seen := map[uint]bool{}
+	for _, id := range carIds {
+		var car Car
+		if seen[id] || tx.Unscoped().First(&car, id).RecordNotFound() {
+			continue
+		}
+		seen[id] = true
+
+		//a car that never changed hands has no ownerships, all of its
+		//services are the customer's
+		query := tx.Unscoped().Where("car_id = ?", car.ID)
+		var others int
+		tx.Model(&CarOwnership{}).Where("car_id = ? AND customer_id <> ?", car.ID, customer.ID).Count(&others)
+		if others > 0 || car.CustomerId != customer.ID {
+			clause, args := "1 = 0", []interface{}{}
+			for _, period := range periods[car.ID] {
+				if period.EndedAt == nil {
+					clause += " OR created_at >= ?"
+					args = append(args, period.StartedAt)
+				} else {
+					clause += " OR (created_at >= ? AND created_at < ?)"
+					args = append(args, period.StartedAt, *period.EndedAt)
+				}
+			}
+			query = query.Where(clause, args...)
+		}
+		if err := query.Order("id").Find(&car.Services).Error; err != nil {
+			return nil, err
+		}
+		for _, service := range car.Services {
+			tx.Unscoped().Where("service_id = ?", service.ID).Order("id").Find(&service.Parts)
+		}
+		if car.CustomerId == customer.ID {
+			car.Inspections = carInspections(tx, car.ID)
+		}
+		cars = append(cars, car)
+	}
+	return cars, nil
+}
+
+//the invoices of the services on a customer's cars
+func customerInvoices(tx *gorm.DB, cars []Car) []Invoice {
+	invoices := []Invoice{}
+	parts := map[uint]Part{}
+	for _, car := range cars {
+		for _, service := range car.Services {
+			if service.Status == ServiceEstimate {
+				continue
+			}
+			invoice := Invoice{
+				ServiceId: service.ID,
+				CarId:     car.ID,
+				Date:      service.CreatedAt,
+				Status:    service.Status,
+				PONumber:  service.PONumber,
+				Labor:     service.Price,
+				Lines:     []InvoiceLine{},
+			}
+			for _, line := range service.Parts {
+				if line.Status == PartLineReleased {
+					continue
+				}
+				part, ok := parts[line.PartId]
+				if !ok {
+					tx.Unscoped().First(&part, line.PartId)
+					parts[line.PartId] = part
+				}
+				amount := float64(line.Quantity) * line.Price
+				invoice.Lines = append(invoice.Lines, InvoiceLine{
+					PartId:      line.PartId,
+					SKU:         part.SKU,
+					Description: part.Description,
+					Quantity:    line.Quantity,
+					Price:       line.Price,
+					Amount:      amount,
+				})
+				invoice.Parts += amount
+			}
+			invoice.Total = invoice.Labor + invoice.Parts
+			invoices = append(invoices, invoice)
+		}
+	}
+	return invoices
+}
+
+//gathers everything kept about a customer
+func exportCustomerData(tx *gorm.DB, id interface{}) (CustomerDataExport, bool, error) {
+	export := CustomerDataExport{ExportedAt: time.Now().UTC()}
+	customer, ok := findCustomerWithCars(tx, id)
+	if !ok {
+		return export, false, nil
+	}
+	customer.Cars = nil
+	tx.Unscoped().Where("customer_id = ?", customer.ID).Order("id").Find(&customer.Contacts)
+	tx.Unscoped().Where("customer_id = ?", customer.ID).Order("kind, id").Find(&customer.ContactPoints)
+	tx.Unscoped().Where("customer_id = ?", customer.ID).Order("id").Find(&customer.Addresses)
+	export.Customer = customer
+
+	if err := tx.Unscoped().Where("customer_id = ?", customer.ID).Order("started_at, id").Find(&export.Ownerships).Error; err != nil {
+		return export, true, err
+	}
+	var err error
+	if export.Cars, err = customerCarHistory(tx, customer, export.Ownerships); err != nil {
+		return export, true, err
+	}
+	export.Invoices = customerInvoices(tx, export.Cars)
+
+	if err := tx.Unscoped().Where("customer_id = ?", customer.ID).Order("id").Find(&export.Notifications).Error; err != nil {
+		return export, true, err
+	}
+	if err := tx.Unscoped().Where("customer_id = ?", customer.ID).Order("starts_at, id").Find(&export.Appointments).Error; err != nil {
+		return export, true, err
+	}
+	carIds, serviceIds := []uint{0}, []uint{0}
+	for _, car := range export.Cars {
+		carIds = append(carIds, car.ID)
+		for _, service := range car.Services {
+			serviceIds = append(serviceIds, service.ID)
+		}
+	}
+	err = tx.Unscoped().Where("customer_id = ? OR car_id IN (?) OR service_id IN (?)", customer.ID, carIds, serviceIds).
+		Order("id").Find(&export.Attachments).Error
+	if err != nil {
+		return export, true, err
+	}
+	if err := tx.Unscoped().Where("survivor_id = ?", customer.ID).Order("id").Find(&export.Merges).Error; err != nil {
+		return export, true, err
+	}
+	return export, true, nil
+}
+
+//adds a privacy request to the log
+func logPrivacyRequest(tx *gorm.DB, customerId uint, kind, requestedBy, note string, summary interface{}) (PrivacyRequest, error) {
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return PrivacyRequest{}, err
+	}
+	request := PrivacyRequest{CustomerId: customerId, Kind: kind, RequestedBy: requestedBy, Note: note, Summary: string(data)}
+	if err := tx.Create(&request).Error; err != nil {
+		return PrivacyRequest{}, err
+	}
+	log.Printf("privacy: %s of customer %d requested by %q", kind, customerId, requestedBy)
+	return request, nil
+}
+
+//scrubs a customer's personal data for good. Their cars and services stay
+//for the statistics with the VIN and plate taken off, their contact points,
+//addresses, contacts, portal tokens and attachments are deleted and the
+//messages sent to them are emptied, the ones still waiting to go out fail
+//instead of being sent to nobody. It returns the blobs of the deleted
+//attachments, to be removed once the transaction has committed.
+func anonymizeCustomer(tx *gorm.DB, customer *Customer) (map[string]int64, []string, error) {
+	if customer.AnonymizedAt != nil {
+		return nil, nil, errCustomerAnonymized
+	}
+	carIds, serviceIds := []uint{}, []uint{}
+	if err := tx.Unscoped().Model(&Car{}).Where("customer_id = ?", customer.ID).Pluck("id", &carIds).Error; err != nil {
+		return nil, nil, err
+	}
+	if err := tx.Unscoped().Model(&Service{}).Where("car_id IN (?)", append(carIds, 0)).Pluck("id", &serviceIds).Error; err != nil {
+		return nil, nil, err
+	}
+
+	var attachments []Attachment
+	err := tx.Unscoped().Where("customer_id = ? OR car_id IN (?) OR service_id IN (?)", customer.ID, append(carIds, 0), append(serviceIds, 0)).
+		Find(&attachments).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	var blobKeys []string
+	for _, attachment := range attachments {
+		for _, key := range []string{attachment.BlobKey, attachment.ThumbnailKey} {
+			if key != "" {
+				blobKeys = append(blobKeys, key)
+			}
+		}
+		if err := tx.Unscoped().Delete(&attachment).Error; err != nil {
+			return nil, nil, err
+		}
+	}
+	counts := map[string]int64{"attachments": int64(len(attachments))}
+
+	steps := []struct {
+		table string
+		run   func() *gorm.DB
+	}{
+		{"contact_points", func() *gorm.DB {
+			return tx.Unscoped().Where("customer_id = ?", customer.ID).Delete(&ContactPoint{})
+		}},
+		{"addresses", func() *gorm.DB {
+			return tx.Unscoped().Where("customer_id = ?", customer.ID).Delete(&Address{})
+		}},
+		{"customer_contacts", func() *gorm.DB {
+			return tx.Unscoped().Where("customer_id = ?", customer.ID).Delete(&CustomerContact{})
+		}},
+		{"portal_tokens", func() *gorm.DB {
+			return tx.Unscoped().Where("customer_id = ?", customer.ID).Delete(&PortalToken{})
+		}},
+		{"notifications", func() *gorm.DB {
+			return tx.Unscoped().Model(&Notification{}).Where("customer_id = ?", customer.ID).
+				Updates(map[string]interface{}{"recipient": "", "subject": "", "body": "", "last_error": ""})
+		}},
+		{"customer_merges", func() *gorm.DB {
+			return tx.Unscoped().Model(&CustomerMerge{}).Where("survivor_id = ?", customer.ID).
+				Updates(map[string]interface{}{"merged": "", "note": ""})
+		}},
+		{"appointments", func() *gorm.DB {
+			return tx.Unscoped().Model(&Appointment{}).Where("customer_id = ?", customer.ID).Update("note", "")
+		}},
+		{"car_ownerships", func() *gorm.DB {
+			return tx.Unscoped().Model(&CarOwnership{}).Where("customer_id = ?", customer.ID).Update("note", "")
+		}},
+		{"cars", func() *gorm.DB {
+			return tx.Unscoped().Model(&Car{}).Where("customer_id = ?", customer.ID).
+				Updates(map[string]interface{}{"vin_number": "", "license_plate": "", "vin_issues": ""})
+		}},
+		{"services", func() *gorm.DB {
+			return tx.Unscoped().Model(&Service{}).Where("id IN (?)", append(serviceIds, 0)).Update("po_number", "")
+		}},
+	}
+	for _, step := range steps {
+		result := step.run()
+		if result.Error != nil {
+			return nil, nil, fmt.Errorf("anonymizing %s: %v", step.table, result.Error)
+		}
+		counts[step.table] = result.RowsAffected
+	}
+
+	unsent := tx.Unscoped().Model(&Notification{}).Where("customer_id = ? AND status IN (?)", customer.ID, []string{NotificationQueued, NotificationSending}).
+		Updates(map[string]interface{}{"status": NotificationFailed, "last_error": "customer was anonymized"})
+	if unsent.Error != nil {
+		return nil, nil, fmt.Errorf("anonymizing notifications: %v", unsent.Error)
+	}
+	counts["unsent_notifications"] = unsent.RowsAffected
+
+	now := time.Now()
+	err = tx.Model(customer).Updates(map[string]interface{}{
+		"first_name":           "",
+		"last_name":            "",
+		"phone":                "",
+		"email":                "",
+		"company_name":         "",
+		"tax_id":               "",
+		"billing_terms":        "",
+		"quiet_hours_start":    "",
+		"quiet_hours_end":      "",
+		"preferred_channel":    "",
+		"email_opt_out":        true,
+		"sms_opt_out":          true,
+		"marketing_consent":    false,
+		"marketing_consent_at": nil,
+		"anonymized_at":        now,
+	}).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	return counts, blobKeys, nil
+}
+
+//download everything kept about a customer as JSON. ?requestedBy= and
+//?note= go in the log.
+func getCustomerDataExport(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	var export CustomerDataExport
+	found := false
+	err := withExportSnapshot(shopDB(r), func(tx *gorm.DB) error {
+		var err error
+		export, found, err = exportCustomerData(tx, params["id"])
+		return err
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Errorf("customer %s not found", params["id"]))
+		return
+	}
+
+	for i := range export.Attachments {
+		signAttachment(&export.Attachments[i], requestShopId(r))
+	}
+
+	summary := map[string]int{
+		"cars":          len(export.Cars),
+		"invoices":      len(export.Invoices),
+		"notifications": len(export.Notifications),
+		"attachments":   len(export.Attachments),
+	}
+	_, err = logPrivacyRequest(shopDB(r), export.Customer.ID, PrivacyExport, r.URL.Query().Get("requestedBy"), r.URL.Query().Get("note"), summary)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="customer-%d-%s.json"`, export.Customer.ID, time.Now().Format("20060102")))
+	json.NewEncoder(w).Encode(&export)
+}
+
+//scrub a customer's personal data, this can't be undone. The body has to
+//confirm the customer's id.
+func anonymizeCustomerHandler(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	var body struct {
+		Confirm     uint
+		RequestedBy string
+		Note        string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var request PrivacyRequest
+	var blobKeys []string
+	status := http.StatusInternalServerError
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		var customer Customer
+		if tx.First(&customer, params["id"]).RecordNotFound() {
+			status = http.StatusNotFound
+			return fmt.Errorf("customer %s not found", params["id"])
+		}
+		if body.Confirm != customer.ID {
+			status = http.StatusBadRequest
+			return fmt.Errorf("anonymizing can't be undone, send Confirm: %d to go ahead", customer.ID)
+		}
+		counts, keys, err := anonymizeCustomer(tx, &customer)
+		if err == errCustomerAnonymized {
+			status = http.StatusConflict
+		}
+		if err != nil {
+			return err
+		}
+		blobKeys = keys
+		request, err = logPrivacyRequest(tx, customer.ID, PrivacyAnonymize, body.RequestedBy, body.Note, counts)
+		return err
+	})
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	for _, key := range blobKeys {
+		if err := blobs.Delete(key); err != nil {
+			log.Printf("privacy: deleting blob %s: %v", key, err)
+		}
+	}
+	//backups can't be rewritten, they have to age out
+	log.Printf("privacy: customer %d anonymized, archives made with /admin/export before now still hold their data", request.CustomerId)
+	w.Header().Set("Warning", `299 - "archives made with /admin/export before now still hold the customer's data"`)
+	json.NewEncoder(w).Encode(&request)
+}
+
+//the log of privacy requests, newest first, ?customerId= narrows it down
+func getPrivacyRequests(w http.ResponseWriter, r *http.Request) {
+	requests := []PrivacyRequest{}
+	query := shopDB(r).Order("id DESC")
+	if customerId := r.URL.Query().Get("customerId"); customerId != "" {
+		query = query.Where("customer_id = ?", customerId)
+	}
+	query.Find(&requests)
+	json.NewEncoder(w).Encode(&requests)
+}
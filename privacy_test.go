@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAnonymizeStopsUnsentNotifications(t *testing.T) {
+	tx := setupTestDB(t)
+	customer := Customer{FirstName: "Ana", Email: "ana@example.com"}
+	tx.Create(&customer)
+	sentAt := time.Now()
+	sent := Notification{CustomerId: customer.ID, Channel: ChannelEmail, Recipient: customer.Email, Body: "ready", Status: NotificationSent, SentAt: &sentAt}
+	queued := Notification{CustomerId: customer.ID, Channel: ChannelEmail, Recipient: customer.Email, Body: "ready", Status: NotificationQueued, NextAttemptAt: time.Now()}
+	tx.Create(&sent)
+	tx.Create(&queued)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/customer/{id}/anonymize", anonymizeCustomerHandler).Methods("POST")
+	w := httptest.NewRecorder()
+	body := fmt.Sprintf(`{"Confirm": %d}`, customer.ID)
+	router.ServeHTTP(w, httptest.NewRequest("POST", fmt.Sprintf("/admin/customer/%d/anonymize", customer.ID), strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("anonymize: %d %s", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Header().Get("Warning"), "/admin/export") {
+		t.Errorf("no warning about earlier archives, got %q", w.Header().Get("Warning"))
+	}
+
+	tx.First(&sent, sent.ID)
+	tx.First(&queued, queued.ID)
+	if sent.Status != NotificationSent || sent.Recipient != "" {
+		t.Errorf("sent notification is %s to %q", sent.Status, sent.Recipient)
+	}
+	if queued.Status != NotificationFailed || queued.Recipient != "" {
+		t.Errorf("queued notification is %s to %q, want %s to nobody", queued.Status, queued.Recipient, NotificationFailed)
+	}
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+//purchase order workflow: draft -> sent -> partially_received -> received
+const (
+	PurchaseOrderDraft             = "draft"
+	PurchaseOrderSent              = "sent"
+	PurchaseOrderPartiallyReceived = "partially_received"
+	PurchaseOrderReceived          = "received"
+)
+
+type Supplier struct {
+	gorm.Model
+
+	Name        string
+	ContactName string
+	Phone       string
+	Email       string
+	Notes       string
+}
+
+type PurchaseOrder struct {
+	gorm.Model
+
+	SupplierId uint
+	Status     string
+	Notes      string
+	SentAt     *time.Time
+	ReceivedAt *time.Time
+	Lines      []PurchaseOrderLine
+}
+
+type PurchaseOrderLine struct {
+	gorm.Model
+
+	PurchaseOrderId  uint
+	PartId           uint
+	Quantity         int
+	QuantityReceived int
+	UnitCost         float64
+}
+
+// Outstanding is what has been ordered but not received yet
+func (l PurchaseOrderLine) Outstanding() int {
+	return l.Quantity - l.QuantityReceived
+}
+
+//loads a purchase order and its lines
+func findPurchaseOrder(tx *gorm.DB, id interface{}) (PurchaseOrder, bool) {
+	var order PurchaseOrder
+	if tx.First(&order, id).RecordNotFound() {
+		return order, false
+	}
+	tx.Where("purchase_order_id = ?", order.ID).Order("id").Find(&order.Lines)
+	return order, true
+}
+
+//receives stock into inventory, moving the part's cost to the weighted
+//average of what was on hand and what came in
+func receiveStock(tx *gorm.DB, partId uint, qty int, unitCost float64, note string) error {
+	res := tx.Exec(`
+		UPDATE parts SET
+			cost = CASE WHEN on_hand + ? > 0 THEN (on_hand * cost + ? * ?) / (on_hand + ?) ELSE ? END,
+			on_hand = on_hand + ?
+		WHERE id = ? AND deleted_at IS NULL;`,
+		qty, qty, unitCost, qty, unitCost, qty, partId)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("part %d not found", partId)
+	}
+	return recordMovement(tx, StockMovement{PartId: partId, Kind: MovementReceive, Quantity: qty, UnitCost: unitCost, Note: note})
+}
+
+//quantity of each part already ordered and not yet received
+func outstandingByPart(tx *gorm.DB) (map[uint]int, error) {
+	rows, err := tx.Raw(`
+		SELECT l.part_id, SUM(l.quantity - l.quantity_received)
+		FROM purchase_order_lines l
+		JOIN purchase_orders o ON o.id = l.purchase_order_id
+		WHERE o.status IN (?) AND o.deleted_at IS NULL AND l.deleted_at IS NULL
+		GROUP BY l.part_id;`,
+		[]string{PurchaseOrderDraft, PurchaseOrderSent, PurchaseOrderPartiallyReceived}).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	outstanding := map[uint]int{}
+	for rows.Next() {
+		var partId uint
+		var qty int
+		if err := rows.Scan(&partId, &qty); err != nil {
+			return nil, err
+		}
+		outstanding[partId] = qty
+	}
+	return outstanding, rows.Err()
+}
+
+//get all suppliers
+func getSuppliers(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	var suppliers []Supplier
+	shopDB(r).Order("name").Find(&suppliers)
+	json.NewEncoder(w).Encode(&suppliers)
+}
+
+//get a supplier
+func getSupplier(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var supplier Supplier
+	if shopDB(r).First(&supplier, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("supplier %s not found", params["id"]))
+		return
+	}
+	json.NewEncoder(w).Encode(&supplier)
+}
+
+//create a supplier
+func createSupplier(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	var supplier Supplier
+	if err := json.NewDecoder(r.Body).Decode(&supplier); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if supplier.Name == "" {
+		writeError(w, http.StatusBadRequest, errors.New("Name is required"))
+		return
+	}
+	if err := shopDB(r).Create(&supplier).Error; err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&supplier)
+}
+
+//edit a supplier
+func updateSupplier(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var supplier Supplier
+	if shopDB(r).First(&supplier, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("supplier %s not found", params["id"]))
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&supplier); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := shopDB(r).Save(&supplier).Error; err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&supplier)
+}
+
+//get purchase orders, optionally filtered by ?status=
+func getPurchaseOrders(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	query := shopDB(r).Order("id desc")
+	if status := r.URL.Query().Get("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var orders []PurchaseOrder
+	query.Find(&orders)
+	json.NewEncoder(w).Encode(&orders)
+}
+
+//get a purchase order and its lines
+func getPurchaseOrder(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	order, ok := findPurchaseOrder(shopDB(r), params["id"])
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("purchase order %s not found", params["id"]))
+		return
+	}
+	json.NewEncoder(w).Encode(&order)
+}
+
+//create a draft purchase order with its lines
+func createPurchaseOrder(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	var order PurchaseOrder
+	if err := json.NewDecoder(r.Body).Decode(&order); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var supplier Supplier
+	if shopDB(r).First(&supplier, order.SupplierId).RecordNotFound() {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("supplier %d not found", order.SupplierId))
+		return
+	}
+	for i, line := range order.Lines {
+		if line.Quantity <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("line %d: Quantity must be positive", i))
+			return
+		}
+		var part Part
+		if shopDB(r).First(&part, line.PartId).RecordNotFound() {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("line %d: part %d not found", i, line.PartId))
+			return
+		}
+		if line.UnitCost == 0 {
+			order.Lines[i].UnitCost = part.Cost
+		}
+		order.Lines[i].QuantityReceived = 0
+	}
+
+	order.Status = PurchaseOrderDraft
+	order.SentAt = nil
+	order.ReceivedAt = nil
+
+	//gorm creates the lines along with the order
+	if err := shopDB(r).Create(&order).Error; err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&order)
+}
+
+//create draft purchase orders for every part below its reorder point, one
+//per preferred supplier. Parts without a preferred supplier are returned
+//separately so they can be ordered by hand.
+func generatePurchaseOrders(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	var result struct {
+		PurchaseOrders []PurchaseOrder
+		Unassigned     []Part
+	}
+
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		var parts []Part
+		if err := partsBelowMinimum(tx).Find(&parts).Error; err != nil {
+			return err
+		}
+		outstanding, err := outstandingByPart(tx)
+		if err != nil {
+			return err
+		}
+
+		bySupplier := map[uint]*PurchaseOrder{}
+		var suppliers []uint
+		for _, part := range parts {
+			//stock already on order counts towards the minimum
+			short := part.MinQuantity - part.Available() - outstanding[part.ID]
+			if short <= 0 {
+				continue
+			}
+			if part.PreferredSupplierId == nil {
+				result.Unassigned = append(result.Unassigned, part)
+				continue
+			}
+
+			qty := part.ReorderQuantity
+			if qty < short {
+				qty = short
+			}
+
+			supplierId := *part.PreferredSupplierId
+			order, ok := bySupplier[supplierId]
+			if !ok {
+				order = &PurchaseOrder{SupplierId: supplierId, Status: PurchaseOrderDraft, Notes: "generated from reorder report"}
+				bySupplier[supplierId] = order
+				suppliers = append(suppliers, supplierId)
+			}
+			order.Lines = append(order.Lines, PurchaseOrderLine{PartId: part.ID, Quantity: qty, UnitCost: part.Cost})
+		}
+
+		for _, supplierId := range suppliers {
+			order := bySupplier[supplierId]
+			if err := tx.Create(order).Error; err != nil {
+				return err
+			}
+			result.PurchaseOrders = append(result.PurchaseOrders, *order)
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&result)
+}
+
+//mark a draft purchase order as sent to the supplier
+func sendPurchaseOrder(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	order, ok := findPurchaseOrder(shopDB(r), params["id"])
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("purchase order %s not found", params["id"]))
+		return
+	}
+	if order.Status != PurchaseOrderDraft {
+		writeError(w, http.StatusConflict, fmt.Errorf("purchase order is %s", order.Status))
+		return
+	}
+	if len(order.Lines) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("purchase order has no lines"))
+		return
+	}
+
+	now := time.Now()
+	order.Status = PurchaseOrderSent
+	order.SentAt = &now
+	if err := shopDB(r).Model(&order).Updates(map[string]interface{}{"status": order.Status, "sent_at": now}).Error; err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&order)
+}
+
+//receive some or all of a sent purchase order into inventory. The body lists
+//the quantities that arrived by line, e.g. {"Lines": [{"LineId": 1, "Quantity": 4}]}
+func receivePurchaseOrder(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var receipt struct {
+		Lines []struct {
+			LineId   uint
+			Quantity int
+			UnitCost float64
+		}
+	}
+	if err := json.NewDecoder(r.Body).Decode(&receipt); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var order PurchaseOrder
+	status := http.StatusBadRequest
+	err := shopDB(r).Transaction(func(tx *gorm.DB) error {
+		//receipts of the same order wait for each other here, so the lines
+		//read below are current
+		if err := tx.Model(&PurchaseOrder{}).Where("id = ?", params["id"]).Update("updated_at", time.Now()).Error; err != nil {
+			return err
+		}
+		var ok bool
+		order, ok = findPurchaseOrder(tx, params["id"])
+		if !ok {
+			status = http.StatusNotFound
+			return fmt.Errorf("purchase order %s not found", params["id"])
+		}
+		if order.Status != PurchaseOrderSent && order.Status != PurchaseOrderPartiallyReceived {
+			status = http.StatusConflict
+			return fmt.Errorf("purchase order is %s", order.Status)
+		}
+
+		lines := map[uint]*PurchaseOrderLine{}
+		for i := range order.Lines {
+			lines[order.Lines[i].ID] = &order.Lines[i]
+		}
+
+		for _, received := range receipt.Lines {
+			line, ok := lines[received.LineId]
+			if !ok {
+				return fmt.Errorf("line %d is not on this purchase order", received.LineId)
+			}
+			if received.Quantity <= 0 || received.Quantity > line.Outstanding() {
+				return fmt.Errorf("line %d: can receive between 1 and %d", line.ID, line.Outstanding())
+			}
+			unitCost := line.UnitCost
+			if received.UnitCost > 0 {
+				unitCost = received.UnitCost
+			}
+
+			//never more than was ordered, whatever else is receiving the line
+			res := tx.Model(&PurchaseOrderLine{}).Where("id = ? AND quantity_received + ? <= quantity", line.ID, received.Quantity).
+				Update("quantity_received", gorm.Expr("quantity_received + ?", received.Quantity))
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected == 0 {
+				status = http.StatusConflict
+				return fmt.Errorf("line %d: more than was ordered would be received", line.ID)
+			}
+			line.QuantityReceived += received.Quantity
+
+			note := fmt.Sprintf("purchase order %d", order.ID)
+			if err := receiveStock(tx, line.PartId, received.Quantity, unitCost, note); err != nil {
+				return err
+			}
+		}
+
+		order.Status = PurchaseOrderReceived
+		for _, line := range order.Lines {
+			if line.Outstanding() > 0 {
+				order.Status = PurchaseOrderPartiallyReceived
+				break
+			}
+		}
+		updates := map[string]interface{}{"status": order.Status}
+		if order.Status == PurchaseOrderReceived {
+			now := time.Now()
+			order.ReceivedAt = &now
+			updates["received_at"] = now
+		}
+		return tx.Model(&order).Updates(updates).Error
+	})
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&order)
+}
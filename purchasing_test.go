@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestConcurrentReceiptsNeverReceiveMoreThanOrdered(t *testing.T) {
+	tx := setupTestDB(t)
+	supplier := Supplier{Name: "Parts Co"}
+	tx.Create(&supplier)
+	part := Part{SKU: "FLT-1", OnHand: 1}
+	tx.Create(&part)
+	order := PurchaseOrder{SupplierId: supplier.ID, Status: PurchaseOrderSent, Lines: []PurchaseOrderLine{{PartId: part.ID, Quantity: 5}}}
+	if err := tx.Create(&order).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/receive/purchaseorder/{id}", receivePurchaseOrder).Methods("POST")
+	path := fmt.Sprintf("/receive/purchaseorder/%d", order.ID)
+	body := fmt.Sprintf(`{"Lines": [{"LineId": %d, "Quantity": 2}]}`, order.Lines[0].ID)
+
+	codes := make([]int, 4)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(body)))
+			codes[i] = w.Code
+		}(i)
+	}
+	wg.Wait()
+
+	ok := 0
+	for _, code := range codes {
+		if code == http.StatusOK {
+			ok++
+		}
+	}
+	var line PurchaseOrderLine
+	tx.First(&line, order.Lines[0].ID)
+	if ok != 2 || line.QuantityReceived != 4 {
+		t.Fatalf("%d receipts went through and %d were received, want 2 and 4", ok, line.QuantityReceived)
+	}
+	assertStock(t, tx, part.ID, 5, 0)
+	tx.First(&order, order.ID)
+	if order.Status != PurchaseOrderPartiallyReceived {
+		t.Fatalf("order is %s, want %s", order.Status, PurchaseOrderPartiallyReceived)
+	}
+}
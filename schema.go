@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/jinzhu/gorm"
+)
+
+//the schema the migrations are built into while checking, it only exists
+//inside a transaction that is rolled back
+const expectedSchemaName = "schema_check_expected"
+
+var errSchemaDrift = errors.New("the database schema doesn't match the migrations")
+
+//what a schema has, each object keyed by what identifies it and mapped to
+//its definition
+type schemaSnapshot struct {
+	Columns     map[string]string
+	Indexes     map[string]string
+	Constraints map[string]string
+}
+
+// SchemaDifference is one thing the live database has differently from the
+// migrations
+type SchemaDifference struct {
+	Kind     string
+	Object   string
+	Expected string
+	Actual   string
+}
+
+//reads the tables, columns, indexes and constraints of a schema. Schema
+//names are taken out of definitions so two schemas can be compared.
+func snapshotSchema(tx *gorm.DB, schema string) (schemaSnapshot, error) {
+	snapshot := schemaSnapshot{Columns: map[string]string{}, Indexes: map[string]string{}, Constraints: map[string]string{}}
+	strip := regexp.MustCompile(`\b` + regexp.QuoteMeta(schema) + `\.`)
+
+	rows, err := tx.Raw(`SELECT table_name, column_name, data_type, COALESCE(character_maximum_length, 0), is_nullable
+		FROM information_schema.columns
+		WHERE table_schema = ? AND table_name <> 'schema_migrations'`, schema).Rows()
+	if err != nil {
+		return snapshot, err
+	}
+	for rows.Next() {
+		var table, column, dataType, nullable string
+		var length int
+		if err := rows.Scan(&table, &column, &dataType, &length, &nullable); err != nil {
+			rows.Close()
+			return snapshot, err
+		}
+		definition := dataType
+		if length > 0 {
+			definition = fmt.Sprintf("%s(%d)", dataType, length)
+		}
+		if nullable == "NO" {
+			definition += " not null"
+		}
+		snapshot.Columns[table+"."+column] = definition
+	}
+	rows.Close()
+
+	rows, err = tx.Raw(`SELECT tablename, indexname, indexdef FROM pg_indexes
+		WHERE schemaname = ? AND tablename <> 'schema_migrations'`, schema).Rows()
+	if err != nil {
+		return snapshot, err
+	}
+	for rows.Next() {
+		var table, name, definition string
+		if err := rows.Scan(&table, &name, &definition); err != nil {
+			rows.Close()
+			return snapshot, err
+		}
+		snapshot.Indexes[table+"."+name] = strip.ReplaceAllString(definition, "")
+	}
+	rows.Close()
+
+	rows, err = tx.Raw(`SELECT rel.relname, con.conname, pg_get_constraintdef(con.oid)
+		FROM pg_constraint con
+		JOIN pg_class rel ON rel.oid = con.conrelid
+		JOIN pg_namespace ns ON ns.oid = rel.relnamespace
+		WHERE ns.nspname = ? AND rel.relname <> 'schema_migrations'`, schema).Rows()
+	if err != nil {
+		return snapshot, err
+	}
+	for rows.Next() {
+		var table, name, definition string
+		if err := rows.Scan(&table, &name, &definition); err != nil {
+			rows.Close()
+			return snapshot, err
+		}
+		snapshot.Constraints[table+"."+name] = strip.ReplaceAllString(definition, "")
+	}
+	rows.Close()
+	return snapshot, nil
+}
+
+//what the schema should look like: every migration applied to an empty
+//schema inside a transaction that is thrown away
+func expectedSchema() (schemaSnapshot, error) {
+	migrations, err := loadMigrations(DialectPostgres)
+	if err != nil {
+		return schemaSnapshot{}, err
+	}
+
+	var snapshot schemaSnapshot
+	errRollback := errors.New("rollback")
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(`CREATE SCHEMA ` + expectedSchemaName).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`SET LOCAL search_path TO ` + expectedSchemaName).Error; err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if err := tx.Exec(m.Up).Error; err != nil {
+				return fmt.Errorf("migration %04d_%s: %v", m.Version, m.Name, err)
+			}
+		}
+		var err error
+		if snapshot, err = snapshotSchema(tx, expectedSchemaName); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		return snapshot, err
+	}
+	return snapshot, nil
+}
+
+//compares one kind of object of two snapshots
+func diffObjects(kind string, expected, actual map[string]string) []SchemaDifference {
+	var differences []SchemaDifference
+	for object, definition := range expected {
+		got, ok := actual[object]
+		switch {
+		case !ok:
+			differences = append(differences, SchemaDifference{Kind: kind, Object: object, Expected: definition})
+		case got != definition:
+			differences = append(differences, SchemaDifference{Kind: kind, Object: object, Expected: definition, Actual: got})
+		}
+	}
+	for object, definition := range actual {
+		if _, ok := expected[object]; !ok {
+			differences = append(differences, SchemaDifference{Kind: kind, Object: object, Actual: definition})
+		}
+	}
+	return differences
+}
+
+//compares the live database against the migrations
+func checkSchema() ([]SchemaDifference, error) {
+	expected, err := expectedSchema()
+	if err != nil {
+		return nil, err
+	}
+	var current string
+	if err := db.Raw(`SELECT current_schema()`).Row().Scan(&current); err != nil {
+		return nil, err
+	}
+	actual, err := snapshotSchema(db, current)
+	if err != nil {
+		return nil, err
+	}
+
+	var differences []SchemaDifference
+	differences = append(differences, diffObjects("column", expected.Columns, actual.Columns)...)
+	differences = append(differences, diffObjects("index", expected.Indexes, actual.Indexes)...)
+	differences = append(differences, diffObjects("constraint", expected.Constraints, actual.Constraints)...)
+	sort.Slice(differences, func(i, j int) bool {
+		if differences[i].Kind != differences[j].Kind {
+			return differences[i].Kind < differences[j].Kind
+		}
+		return differences[i].Object < differences[j].Object
+	})
+	return differences, nil
+}
+
+//mecanica-service schema check
+func runSchemaCommand(args []string) error {
+	if len(args) == 0 || args[0] != "check" {
+		return errors.New("usage: schema check")
+	}
+
+	pending, err := pendingMigrations(db)
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		fmt.Printf("pending migration %04d_%s\n", m.Version, m.Name)
+	}
+
+	//the check reads the postgres catalogs
+	if isSQLite(db) {
+		fmt.Println("schema check needs postgres, only pending migrations are checked on SQLite")
+		return nil
+	}
+
+	differences, err := checkSchema()
+	if err != nil {
+		return err
+	}
+	for _, d := range differences {
+		switch {
+		case d.Actual == "":
+			fmt.Printf("missing %s %s: %s\n", d.Kind, d.Object, d.Expected)
+		case d.Expected == "":
+			fmt.Printf("unexpected %s %s: %s\n", d.Kind, d.Object, d.Actual)
+		default:
+			fmt.Printf("different %s %s:\n  expected %s\n  actual   %s\n", d.Kind, d.Object, d.Expected, d.Actual)
+		}
+	}
+	if len(differences) > 0 {
+		return fmt.Errorf("%w: %d difference(s)", errSchemaDrift, len(differences))
+	}
+	fmt.Println("schema matches the migrations")
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDiffObjectsReportsMissingUnexpectedAndDifferent(t *testing.T) {
+	expected := map[string]string{
+		"cars.fk_cars_customer_id":    "FOREIGN KEY (customer_id) REFERENCES customers(id) ON DELETE CASCADE",
+		"services.fk_services_car_id": "FOREIGN KEY (car_id) REFERENCES cars(id) ON DELETE CASCADE",
+		"cars.uix_cars_shop_id_id":    "UNIQUE (shop_id, id)",
+	}
+	actual := map[string]string{
+		"cars.fk_cars_customer_id": "FOREIGN KEY (customer_id) REFERENCES customers(id)",
+		"cars.uix_cars_shop_id_id": "UNIQUE (shop_id, id)",
+		"cars.hand_made":           "CHECK (make <> '')",
+	}
+
+	differences := diffObjects("constraint", expected, actual)
+	sort.Slice(differences, func(i, j int) bool { return differences[i].Object < differences[j].Object })
+	want := []SchemaDifference{
+		{Kind: "constraint", Object: "cars.fk_cars_customer_id", Expected: expected["cars.fk_cars_customer_id"], Actual: actual["cars.fk_cars_customer_id"]},
+		{Kind: "constraint", Object: "cars.hand_made", Actual: actual["cars.hand_made"]},
+		{Kind: "constraint", Object: "services.fk_services_car_id", Expected: expected["services.fk_services_car_id"]},
+	}
+	if !reflect.DeepEqual(differences, want) {
+		t.Fatalf("got %+v, want %+v", differences, want)
+	}
+	if differences := diffObjects("index", actual, actual); len(differences) != 0 {
+		t.Fatalf("a schema differs from itself: %+v", differences)
+	}
+}
+
+func TestSchemaCheckOnSQLiteOnlyLooksForPendingMigrations(t *testing.T) {
+	setupTestDB(t)
+	if err := runSchemaCommand(nil); err == nil {
+		t.Error("schema without check was accepted")
+	}
+	if err := runSchemaCommand([]string{"check"}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+)
+
+//the shop everything belonged to before there were several, and the only
+//one a single-shop deployment has
+const defaultShopId = 1
+
+//what app.shop_id is set to on connections that see every shop
+const allShopsSetting = "all"
+
+// Shop is one of the independent shops a deployment serves. Every other
+// table has a shop_id the database fills in from the connection, which is
+// why the models don't carry it.
+type Shop struct {
+	gorm.Model
+
+	Name string
+	//the shop answers on <Subdomain>.<SHOP_DOMAIN>
+	Subdomain string
+	//only the hash of the shop's API key is stored
+	APIKeyHash string `json:"-"`
+}
+
+//MULTI_TENANT=true serves several shops from one database. Requests have to
+//say which shop they are for, and every query runs on a connection that
+//row-level security limits to that shop.
+var multiTenant bool
+
+var (
+	errNoShop         = errors.New("no shop: use the shop's subdomain")
+	errUnknownAPIKey  = errors.New("unknown API key")
+	errAPIKeyRequired = errors.New("the shop's X-Api-Key is required")
+	errShopConflict   = errors.New("the API key, session and subdomain belong to different shops")
+)
+
+type shopContextKey struct{}
+
+//the connections of one shop. Replica is nil without READ_DATABASE_URL.
+type shopConns struct {
+	Id      uint
+	Primary *gorm.DB
+	Replica *gorm.DB
+}
+
+//opens the connections of each shop the first time it is asked for and
+//keeps them for the life of the process
+type shopPools struct {
+	mu         sync.Mutex
+	dialect    string
+	url        string
+	replicaURL string
+	conns      map[uint]*shopConns
+}
+
+var shops = &shopPools{conns: map[uint]*shopConns{}}
+
+//sees the rows of every shop, only used to work out which shop a request is
+//for and by the background jobs. nil unless MULTI_TENANT is set.
+var allShops *gorm.DB
+
+//whether an environment variable is set to something true
+func envFlag(name string) bool {
+	on, _ := strconv.ParseBool(os.Getenv(name))
+	return on
+}
+
+//adds the app.shop_id setting to a postgres url, in either of the forms
+//lib/pq takes. SQLite urls and an empty setting are left as they are.
+func withShopSetting(dialect, dsn, setting string) string {
+	if setting == "" || strings.ToLower(strings.TrimSpace(dialect)) != DialectPostgres {
+		return dsn
+	}
+	option := "-c app.shop_id=" + setting
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return dsn
+		}
+		query := u.Query()
+		query.Add("options", option)
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+	return strings.TrimSpace(dsn+" options='"+option) + "'"
+}
+
+//the shop the main connection is limited to: the first one for a single
+//shop, none with MULTI_TENANT, so a query that wasn't given its shop's
+//connection sees nothing and can't write
+func mainShopSetting() string {
+	if multiTenant {
+		return ""
+	}
+	return strconv.Itoa(defaultShopId)
+}
+
+//remembers where the shops' connections go. With MULTI_TENANT it connects
+//to every shop and, for commands, switches db to the shop SHOP names.
+func setupShops(dialect, url string) error {
+	shops.dialect = dialect
+	shops.url = url
+	shops.replicaURL = os.Getenv("READ_DATABASE_URL")
+	if !multiTenant {
+		return nil
+	}
+	if isSQLite(db) {
+		return errors.New("MULTI_TENANT needs postgres, SQLite has no row-level security")
+	}
+	var err error
+	if allShops, err = connectDatabase(dialect, withShopSetting(dialect, url, allShopsSetting)); err != nil {
+		return err
+	}
+
+	if name := os.Getenv("SHOP"); name != "" {
+		shop, err := findShop(name)
+		if err != nil {
+			return err
+		}
+		conns, err := shops.get(shop.ID)
+		if err != nil {
+			return err
+		}
+		db = conns.Primary
+	}
+	return nil
+}
+
+//a shop by id or subdomain
+func findShop(name string) (Shop, error) {
+	var shop Shop
+	query := db.Where("subdomain = ?", name)
+	if id, err := strconv.Atoi(name); err == nil {
+		query = db.Where("id = ?", id)
+	}
+	if query.First(&shop).RecordNotFound() {
+		return shop, fmt.Errorf("there is no shop %q", name)
+	}
+	return shop, nil
+}
+
+//the connections of a shop, opened on first use. A shop's pool is smaller
+//than the main one, SHOP_DB_MAX_OPEN_CONNS (5 by default) caps it.
+func (p *shopPools) get(id uint) (*shopConns, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if conns, ok := p.conns[id]; ok {
+		return conns, nil
+	}
+
+	setting := strconv.FormatUint(uint64(id), 10)
+	conns := &shopConns{Id: id}
+	var err error
+	if conns.Primary, err = openShopDatabase(p.dialect, withShopSetting(p.dialect, p.url, setting)); err != nil {
+		return nil, err
+	}
+	if replica != nil && p.replicaURL != "" {
+		if conns.Replica, err = openShopDatabase(p.dialect, withShopSetting(p.dialect, p.replicaURL, setting)); err != nil {
+			log.Printf("read replica unavailable for shop %d, reading from the primary: %v", id, err)
+		}
+	}
+	p.conns[id] = conns
+	return conns, nil
+}
+
+func openShopDatabase(dialect, url string) (*gorm.DB, error) {
+	conn, err := openDatabase(dialect, url)
+	if err != nil {
+		return nil, err
+	}
+	configurePool(conn)
+	conn.DB().SetMaxOpenConns(envInt("SHOP_DB_MAX_OPEN_CONNS", 5))
+	conn.DB().SetMaxIdleConns(envInt("SHOP_DB_MAX_IDLE_CONNS", 2))
+	return conn, nil
+}
+
+//refuses to serve several shops unless the database keeps them apart: the
+//role can't bypass row-level security, and every table the service keeps
+//has a shop_id and a policy that is forced on its owner as well. Tables
+//are taken from backupModels, which every new table joins to be backed up.
+func checkTenantIsolation() error {
+	var role struct {
+		Rolsuper     bool
+		Rolbypassrls bool
+	}
+	if err := db.Raw(`SELECT rolsuper, rolbypassrls FROM pg_roles WHERE rolname = current_user`).Scan(&role).Error; err != nil {
+		return err
+	}
+	if role.Rolsuper || role.Rolbypassrls {
+		return errors.New("MULTI_TENANT needs a database role that doesn't bypass row-level security")
+	}
+
+	for _, model := range backupModels {
+		name := db.NewScope(model).TableName()
+		var table struct {
+			Relrowsecurity      bool
+			Relforcerowsecurity bool
+			ShopColumns         int
+			Policies            int
+		}
+		err := db.Raw(`SELECT c.relrowsecurity, c.relforcerowsecurity,
+			(SELECT COUNT(*) FROM pg_attribute a WHERE a.attrelid = c.oid AND a.attname = 'shop_id' AND NOT a.attisdropped) AS shop_columns,
+			(SELECT COUNT(*) FROM pg_policy p WHERE p.polrelid = c.oid) AS policies
+			FROM pg_class c WHERE c.oid = to_regclass(?)`, name).Scan(&table).Error
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if table.ShopColumns == 0 || table.Policies == 0 || !table.Relrowsecurity || !table.Relforcerowsecurity {
+			return fmt.Errorf("%s isn't limited to one shop, it needs a shop_id and a forced row-level security policy", name)
+		}
+	}
+	return nil
+}
+
+//lets a migration see and change the rows of every shop
+func seeEveryShop(tx *gorm.DB) error {
+	if isSQLite(tx) {
+		return nil
+	}
+	return tx.Exec(`SET LOCAL app.shop_id = '` + allShopsSetting + `'`).Error
+}
+
+//the connection background jobs go through every shop with
+func jobsDB() *gorm.DB {
+	if allShops != nil {
+		return allShops
+	}
+	return db
+}
+
+//the shops a request names: by API key, by portal session, by signed
+//download URL and by subdomain of SHOP_DOMAIN. Whatever it names has to be
+//the same shop. Staff endpoints need the API key, a subdomain only says
+//which shop, a portal session only lets a customer into the portal and a
+//download URL only opens the attachment it was signed for.
+func shopOfRequest(r *http.Request) (uint, error) {
+	portal := strings.HasPrefix(r.URL.Path, "/portal/")
+	download := signedDownload(r)
+	key := r.Header.Get("X-Api-Key")
+	if key == "" && !portal && !download {
+		return 0, errAPIKeyRequired
+	}
+
+	var found []uint
+	if key != "" {
+		var shop Shop
+		if allShops.Where("api_key_hash = ?", sha256Hex([]byte(key))).First(&shop).RecordNotFound() {
+			return 0, errUnknownAPIKey
+		}
+		found = append(found, shop.ID)
+	}
+
+	if secret := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); portal && secret != "" {
+		var ids []uint
+		allShops.Model(&PortalToken{}).Where("token_hash = ? AND kind = ?", sha256Hex([]byte(secret)), PortalTokenSession).Pluck("shop_id", &ids)
+		found = append(found, ids...)
+	}
+
+	//the signature checked by downloadAttachment covers the shop
+	if download {
+		if id, err := strconv.ParseUint(r.URL.Query().Get("shop"), 10, 64); err == nil {
+			found = append(found, uint(id))
+		}
+	}
+
+	if domain := strings.TrimPrefix(os.Getenv("SHOP_DOMAIN"), "."); domain != "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(host)
+		if strings.HasSuffix(host, "."+domain) {
+			subdomain := strings.TrimSuffix(host, "."+domain)
+			var shop Shop
+			if allShops.Where("subdomain = ?", subdomain).First(&shop).RecordNotFound() {
+				return 0, fmt.Errorf("there is no shop %q", subdomain)
+			}
+			found = append(found, shop.ID)
+		}
+	}
+
+	if len(found) == 0 {
+		return 0, errNoShop
+	}
+	for _, id := range found[1:] {
+		if id != found[0] {
+			return 0, errShopConflict
+		}
+	}
+	return found[0], nil
+}
+
+//whether a request is for a signed attachment download URL
+func signedDownload(r *http.Request) bool {
+	parts := strings.Split(r.URL.Path, "/")
+	return len(parts) == 4 && parts[1] == "attachment" && parts[3] == "download"
+}
+
+//works out the shop of every request with MULTI_TENANT and hands the
+//handlers its connections. A request for no shop doesn't get further.
+func resolveShop(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (*r).Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id, err := shopOfRequest(r)
+		if err == errShopConflict {
+			setupResponse(&w, r)
+			writeError(w, http.StatusForbidden, err)
+			return
+		} else if err != nil {
+			setupResponse(&w, r)
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+		conns, err := shops.get(id)
+		if err != nil {
+			log.Printf("shop %d: %v", id, err)
+			setupResponse(&w, r)
+			writeError(w, http.StatusServiceUnavailable, errors.New("the shop's database is unavailable"))
+			return
+		}
+		ctx := context.WithValue(r.Context(), shopContextKey{}, conns)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+//the connection a request reads and writes its shop's rows with. Without
+//MULTI_TENANT that is the main one.
+func shopDB(r *http.Request) *gorm.DB {
+	if conns, ok := r.Context().Value(shopContextKey{}).(*shopConns); ok {
+		return conns.Primary
+	}
+	return db
+}
+
+//the shop a request was resolved to. Without MULTI_TENANT that is the only
+//one.
+func requestShopId(r *http.Request) uint {
+	if conns, ok := r.Context().Value(shopContextKey{}).(*shopConns); ok {
+		return conns.Id
+	}
+	return defaultShopId
+}
+
+//the replica connection of a request's shop, nil when there is none
+func shopReplica(r *http.Request) *gorm.DB {
+	if conns, ok := r.Context().Value(shopContextKey{}).(*shopConns); ok {
+		return conns.Replica
+	}
+	return replica
+}
+
+//a new API key for a shop, returning the key to hand out
+func issueShopKey(tx *gorm.DB, shop *Shop) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	key := hex.EncodeToString(b)
+	return key, tx.Model(shop).Update("api_key_hash", sha256Hex([]byte(key))).Error
+}
+
+//mecanica-service shop list | add <name> [subdomain] | key <id|subdomain>
+func runShopCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: shop list | add <name> [subdomain] | key <id|subdomain>")
+	}
+	switch args[0] {
+	case "list":
+		var list []Shop
+		if err := db.Order("id").Find(&list).Error; err != nil {
+			return err
+		}
+		for _, shop := range list {
+			key := "no API key"
+			if shop.APIKeyHash != "" {
+				key = "API key set"
+			}
+			fmt.Printf("%4d  %-30s %-20s %s\n", shop.ID, shop.Name, shop.Subdomain, key)
+		}
+		return nil
+	case "add":
+		if len(args) < 2 || strings.TrimSpace(args[1]) == "" {
+			return errors.New("usage: shop add <name> [subdomain]")
+		}
+		shop := Shop{Name: strings.TrimSpace(args[1])}
+		if len(args) > 2 {
+			shop.Subdomain = strings.ToLower(strings.TrimSpace(args[2]))
+		}
+		if err := db.Create(&shop).Error; err != nil {
+			return err
+		}
+		key, err := issueShopKey(db, &shop)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("shop %d %q created, its API key is %s\n", shop.ID, shop.Name, key)
+		return nil
+	case "key":
+		if len(args) < 2 {
+			return errors.New("usage: shop key <id|subdomain>")
+		}
+		shop, err := findShop(args[1])
+		if err != nil {
+			return err
+		}
+		key, err := issueShopKey(db, &shop)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("the new API key of shop %d is %s, the old one no longer works\n", shop.ID, key)
+		return nil
+	}
+	return fmt.Errorf("unknown shop command %q", args[0])
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+//two shops on the test database, each with an API key. Every shop's
+//connection is the test one: these tests are about telling shops apart,
+//keeping their rows apart is row-level security's job on postgres.
+func setupTestShops(t *testing.T, tx *gorm.DB) (Shop, string, Shop, string) {
+	t.Helper()
+	previousAll, previousConns := allShops, shops.conns
+	allShops = tx
+	shops.conns = map[uint]*shopConns{}
+	t.Cleanup(func() {
+		allShops, shops.conns = previousAll, previousConns
+	})
+
+	var first Shop
+	tx.First(&first, defaultShopId)
+	tx.Model(&first).Update("subdomain", "north")
+	second := Shop{Name: "South", Subdomain: "south"}
+	tx.Create(&second)
+	firstKey, err := issueShopKey(tx, &first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondKey, err := issueShopKey(tx, &second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, shop := range []Shop{first, second} {
+		shops.conns[shop.ID] = &shopConns{Id: shop.ID, Primary: tx}
+	}
+	return first, firstKey, second, secondKey
+}
+
+func TestShopOfRequest(t *testing.T) {
+	tx := setupTestDB(t)
+	first, firstKey, second, secondKey := setupTestShops(t, tx)
+	setenv(t, "SHOP_DOMAIN", "mecanica.test")
+
+	cases := []struct {
+		name, path, host, key string
+		shop                  uint
+		err                   error
+	}{
+		{"staff route by key", "/cars", "api.test", firstKey, first.ID, nil},
+		{"other shop's key", "/cars", "api.test", secondKey, second.ID, nil},
+		{"staff route without key", "/cars", "south.mecanica.test", "", 0, errAPIKeyRequired},
+		{"key and subdomain disagree", "/cars", "south.mecanica.test", firstKey, 0, errShopConflict},
+		{"unknown key", "/cars", "api.test", "nope", 0, errUnknownAPIKey},
+		{"portal by subdomain", "/portal/login", "south.mecanica.test", "", second.ID, nil},
+		{"portal without shop", "/portal/login", "api.test", "", 0, errNoShop},
+		{"signed download", fmt.Sprintf("/attachment/7/download?shop=%d", second.ID), "api.test", "", second.ID, nil},
+		{"download of another shop than the subdomain", fmt.Sprintf("/attachment/7/download?shop=%d", first.ID), "south.mecanica.test", "", 0, errShopConflict},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", c.path, nil)
+		r.Host = c.host
+		if c.key != "" {
+			r.Header.Set("X-Api-Key", c.key)
+		}
+		shop, err := shopOfRequest(r)
+		if shop != c.shop || err != c.err {
+			t.Errorf("%s: got shop %d and %v, want %d and %v", c.name, shop, err, c.shop, c.err)
+		}
+	}
+}
+
+func TestSignedDownloadNeedsNoKeyButOnlyOpensItsShop(t *testing.T) {
+	tx := setupTestDB(t)
+	_, _, second, _ := setupTestShops(t, tx)
+	useFakeS3(t)
+	blobs.Put("attachments/a.pdf", []byte("%PDF-1.4"), "application/pdf")
+	service := createTestService(t, tx)
+	attachment := Attachment{CarId: &service.CarId, FileName: "a.pdf", ContentType: "application/pdf", BlobKey: "attachments/a.pdf"}
+	tx.Create(&attachment)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/attachment/{id}/download", downloadAttachment).Methods("GET")
+	router.HandleFunc("/attachment/{id}", getAttachment).Methods("GET")
+	handler := resolveShop(router)
+
+	signAttachment(&attachment, second.ID)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", attachment.URL, nil))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), []byte("%PDF-1.4")) {
+		t.Fatalf("signed download: %d %s", w.Code, w.Body)
+	}
+
+	//pointing the URL at another shop breaks the signature
+	tampered := strings.Replace(attachment.URL, fmt.Sprintf("shop=%d", second.ID), fmt.Sprintf("shop=%d", defaultShopId), 1)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", tampered, nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("download signed for another shop: got %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	//the metadata is a staff route and still needs the key
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", fmt.Sprintf("/attachment/%d", attachment.ID), nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("attachment without a key: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
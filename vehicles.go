@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+//fuel types a car can have
+var fuelTypes = map[string]bool{
+	"gasoline":       true,
+	"diesel":         true,
+	"hybrid":         true,
+	"plug_in_hybrid": true,
+	"electric":       true,
+	"lpg":            true,
+	"cng":            true,
+	"flex":           true,
+}
+
+//plates are compared without spaces or dashes and in upper case, so
+//"abc-123" and "ABC 123" are the same plate
+func normalizePlate(plate string) string {
+	return strings.ToUpper(strings.NewReplacer(" ", "", "-", "", ".", "").Replace(strings.TrimSpace(plate)))
+}
+
+//cleans up and checks the details of a car before it is saved
+func normalizeCar(car *Car) error {
+	car.LicensePlate = normalizePlate(car.LicensePlate)
+	car.PlateState = strings.ToUpper(strings.TrimSpace(car.PlateState))
+	car.PlateCountry = strings.ToUpper(strings.TrimSpace(car.PlateCountry))
+	car.FuelType = strings.ToLower(strings.TrimSpace(car.FuelType))
+	car.MileageUnit = strings.ToLower(strings.TrimSpace(car.MileageUnit))
+
+	if car.MileageUnit == "" {
+		car.MileageUnit = UnitMiles
+	}
+	if car.MileageUnit != UnitMiles && car.MileageUnit != UnitKilometers {
+		return fmt.Errorf("MileageUnit must be %s or %s", UnitMiles, UnitKilometers)
+	}
+	if car.FuelType != "" && !fuelTypes[car.FuelType] {
+		return fmt.Errorf("unknown FuelType %q", car.FuelType)
+	}
+	//checked after the VIN had its say, it may have filled the year in
+	applyVinDecode(car)
+	if car.Year != 0 && !validModelYear(car.Year) {
+		return fmt.Errorf("Year %d is not a valid model year", car.Year)
+	}
+	return nil
+}
+
+//model years go from the first cars to next year's models
+func validModelYear(year int) bool {
+	return year >= 1900 && year <= time.Now().Year()+1
+}
+
+//narrows cars down to a plate, and to its state and country when given
+func carsWithPlate(query *gorm.DB, plate, state, country string) *gorm.DB {
+	query = query.Where("cars.license_plate = ?", normalizePlate(plate))
+	if state != "" {
+		query = query.Where("cars.plate_state = ?", strings.ToUpper(strings.TrimSpace(state)))
+	}
+	if country != "" {
+		query = query.Where("cars.plate_country = ?", strings.ToUpper(strings.TrimSpace(country)))
+	}
+	return query
+}
+
+//cars with a plate, narrowed down by state and country when given
+func findCarsByPlate(tx *gorm.DB, plate, state, country string) []Car {
+	cars := []Car{}
+	carsWithPlate(tx, plate, state, country).Order("id").Find(&cars)
+	return cars
+}
+
+//tells whether another car already has this car's plate
+func plateTaken(tx *gorm.DB, car Car) bool {
+	if car.LicensePlate == "" {
+		return false
+	}
+	var count int
+	tx.Model(&Car{}).Where("license_plate = ? AND plate_state = ? AND plate_country = ? AND id <> ?",
+		car.LicensePlate, car.PlateState, car.PlateCountry, car.ID).Count(&count)
+	return count > 0
+}
+
+//tells whether another car already has this car's VIN
+func vinTaken(tx *gorm.DB, car Car) bool {
+	if car.VinNumber == "" {
+		return false
+	}
+	var count int
+	tx.Model(&Car{}).Where("vin_number = ? AND id <> ?", car.VinNumber, car.ID).Count(&count)
+	return count > 0
+}
+
+//get the cars with a license plate, ?state= and ?country= narrow it down
+func getCarByPlate(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	cars := findCarsByPlate(shopDB(r), params["plate"], r.URL.Query().Get("state"), r.URL.Query().Get("country"))
+	if len(cars) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no car with plate %s", normalizePlate(params["plate"])))
+		return
+	}
+	json.NewEncoder(w).Encode(&cars)
+}
+
+//edit a car
+func updateCar(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	var car Car
+	if shopDB(r).First(&car, params["id"]).RecordNotFound() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("car %s not found", params["id"]))
+		return
+	}
+
+	id, customerId := car.ID, car.CustomerId
+	if err := json.NewDecoder(r.Body).Decode(&car); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	//cars don't change owner through an edit
+	car.ID, car.CustomerId = id, customerId
+	car.Services, car.Inspections = nil, nil
+
+	if err := normalizeCar(&car); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if plateTaken(shopDB(r), car) {
+		writeError(w, http.StatusConflict, fmt.Errorf("plate %s %s %s belongs to another car", car.LicensePlate, car.PlateState, car.PlateCountry))
+		return
+	}
+	if vinTaken(shopDB(r), car) {
+		writeError(w, http.StatusConflict, fmt.Errorf("VIN %s belongs to another car", car.VinNumber))
+		return
+	}
+	if err := shopDB(r).Save(&car).Error; err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&car)
+}
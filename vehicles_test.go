@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestPlatesAreUniqueWithinAStateAndFoundHoweverTheyAreWritten(t *testing.T) {
+	tx := setupTestDB(t)
+	customer := Customer{FirstName: "Ana"}
+	tx.Create(&customer)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/create/car", createCar).Methods("POST")
+	router.HandleFunc("/update/car/{id}", updateCar).Methods("PUT")
+	router.HandleFunc("/car/plate/{plate}", getCarByPlate).Methods("GET")
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	create := func(plate, state string) *httptest.ResponseRecorder {
+		return send("POST", "/create/car", fmt.Sprintf(`{"Make": "Honda", "CustomerId": %d, "LicensePlate": %q, "PlateState": %q, "PlateCountry": "us"}`, customer.ID, plate, state))
+	}
+
+	w := create("abc-123", "tx")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var texas Car
+	json.NewDecoder(w.Body).Decode(&texas)
+	if texas.LicensePlate != "ABC123" || texas.PlateState != "TX" || texas.PlateCountry != "US" {
+		t.Errorf("plate saved as %q %q %q, want ABC123 TX US", texas.LicensePlate, texas.PlateState, texas.PlateCountry)
+	}
+	if w := create("ABC 123", "TX"); w.Code != http.StatusConflict {
+		t.Errorf("the same plate written another way: status %d, want 409", w.Code)
+	}
+	w = create("ABC123", "NM")
+	if w.Code != http.StatusOK {
+		t.Fatalf("the same plate in another state: status %d: %s", w.Code, w.Body)
+	}
+	var newMexico Car
+	json.NewDecoder(w.Body).Decode(&newMexico)
+	w = send("PUT", fmt.Sprintf("/update/car/%d", newMexico.ID), `{"Make": "Honda", "LicensePlate": "abc123", "PlateState": "TX", "PlateCountry": "US"}`)
+	if w.Code != http.StatusConflict {
+		t.Errorf("editing a car onto a taken plate: status %d, want 409", w.Code)
+	}
+
+	var found []Car
+	json.NewDecoder(send("GET", "/car/plate/abc-123", "").Body).Decode(&found)
+	if len(found) != 2 {
+		t.Errorf("found %d cars with the plate, want 2", len(found))
+	}
+	found = nil
+	json.NewDecoder(send("GET", "/car/plate/abc%20123?state=tx", "").Body).Decode(&found)
+	if len(found) != 1 || found[0].ID != texas.ID {
+		t.Errorf("found %+v in Texas, want car %d", found, texas.ID)
+	}
+	if w := send("GET", "/car/plate/ZZZ999", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown plate: status %d, want 404", w.Code)
+	}
+
+	//the database refuses a duplicate the handlers didn't catch
+	duplicate := Car{Make: "Ford", CustomerId: customer.ID, LicensePlate: "ABC123", PlateState: "TX", PlateCountry: "US"}
+	if err := tx.Create(&duplicate).Error; err == nil {
+		t.Error("the database took a second car with the same plate")
+	}
+}
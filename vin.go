@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// VinInfo is what can be read out of a 17 character VIN without going to
+// the network
+type VinInfo struct {
+	VIN   string
+	Valid bool
+	// CheckDigitValid only matters for North American VINs, elsewhere
+	// position 9 doesn't have to be a check digit
+	CheckDigitValid bool
+	WMI             string
+	Manufacturer    string
+	Make            string
+	Country         string
+	Year            int
+	PlantCode       string
+	SerialNumber    string
+	Problems        []string
+}
+
+type wmiEntry struct {
+	Manufacturer string
+	Make         string
+}
+
+//world manufacturer identifiers (the first three characters of a VIN) of
+//the makes we see in the shop
+var wmiTable = map[string]wmiEntry{
+	"1FA": {"Ford Motor Company", "Ford"},
+	"1FB": {"Ford Motor Company", "Ford"},
+	"1FC": {"Ford Motor Company", "Ford"},
+	"1FD": {"Ford Motor Company", "Ford"},
+	"1FM": {"Ford Motor Company", "Ford"},
+	"1FT": {"Ford Motor Company", "Ford"},
+	"1LN": {"Ford Motor Company", "Lincoln"},
+	"1ZV": {"AutoAlliance International", "Ford"},
+	"2FA": {"Ford Motor Company of Canada", "Ford"},
+	"2FM": {"Ford Motor Company of Canada", "Ford"},
+	"2FT": {"Ford Motor Company of Canada", "Ford"},
+	"3FA": {"Ford Motor Company Mexico", "Ford"},
+	"3FE": {"Ford Motor Company Mexico", "Ford"},
+	"WF0": {"Ford-Werke GmbH", "Ford"},
+	"1G1": {"General Motors", "Chevrolet"},
+	"1GC": {"General Motors", "Chevrolet"},
+	"1GN": {"General Motors", "Chevrolet"},
+	"1G4": {"General Motors", "Buick"},
+	"1G6": {"General Motors", "Cadillac"},
+	"1GY": {"General Motors", "Cadillac"},
+	"1GT": {"General Motors", "GMC"},
+	"1GK": {"General Motors", "GMC"},
+	"1G2": {"General Motors", "Pontiac"},
+	"2G1": {"General Motors of Canada", "Chevrolet"},
+	"2GN": {"General Motors of Canada", "Chevrolet"},
+	"3G1": {"General Motors de Mexico", "Chevrolet"},
+	"3GC": {"General Motors de Mexico", "Chevrolet"},
+	"3GN": {"General Motors de Mexico", "Chevrolet"},
+	"3GT": {"General Motors de Mexico", "GMC"},
+	"KL1": {"GM Korea", "Chevrolet"},
+	"9BG": {"General Motors do Brasil", "Chevrolet"},
+	"1C3": {"FCA US", "Chrysler"},
+	"1C4": {"FCA US", "Jeep"},
+	"1C6": {"FCA US", "Ram"},
+	"1B3": {"FCA US", "Dodge"},
+	"1D7": {"FCA US", "Dodge"},
+	"2C3": {"FCA Canada", "Chrysler"},
+	"2C4": {"FCA Canada", "Chrysler"},
+	"3C4": {"FCA Mexico", "Chrysler"},
+	"3C6": {"FCA Mexico", "Ram"},
+	"1J4": {"FCA US", "Jeep"},
+	"1J8": {"FCA US", "Jeep"},
+	"1HG": {"Honda of America", "Honda"},
+	"2HG": {"Honda of Canada", "Honda"},
+	"2HK": {"Honda of Canada", "Honda"},
+	"3HG": {"Honda de Mexico", "Honda"},
+	"5FN": {"Honda Manufacturing of Alabama", "Honda"},
+	"5J6": {"Honda of America", "Honda"},
+	"19X": {"Honda of America", "Honda"},
+	"19U": {"Honda of America", "Acura"},
+	"JHM": {"Honda Motor Co.", "Honda"},
+	"JHL": {"Honda Motor Co.", "Honda"},
+	"JH4": {"Honda Motor Co.", "Acura"},
+	"4T1": {"Toyota Motor Manufacturing Kentucky", "Toyota"},
+	"4T3": {"Toyota Motor Manufacturing", "Toyota"},
+	"4T4": {"Toyota Motor Manufacturing", "Toyota"},
+	"5TD": {"Toyota Motor Manufacturing", "Toyota"},
+	"5TF": {"Toyota Motor Manufacturing Texas", "Toyota"},
+	"2T1": {"Toyota Motor Manufacturing Canada", "Toyota"},
+	"2T3": {"Toyota Motor Manufacturing Canada", "Toyota"},
+	"3TM": {"Toyota Motor Manufacturing de Baja California", "Toyota"},
+	"JT2": {"Toyota Motor Corporation", "Toyota"},
+	"JTD": {"Toyota Motor Corporation", "Toyota"},
+	"JTE": {"Toyota Motor Corporation", "Toyota"},
+	"JTM": {"Toyota Motor Corporation", "Toyota"},
+	"JTN": {"Toyota Motor Corporation", "Toyota"},
+	"JTH": {"Toyota Motor Corporation", "Lexus"},
+	"JTJ": {"Toyota Motor Corporation", "Lexus"},
+	"2T2": {"Toyota Motor Manufacturing Canada", "Lexus"},
+	"1N4": {"Nissan North America", "Nissan"},
+	"1N6": {"Nissan North America", "Nissan"},
+	"5N1": {"Nissan North America", "Nissan"},
+	"3N1": {"Nissan Mexicana", "Nissan"},
+	"3N6": {"Nissan Mexicana", "Nissan"},
+	"JN1": {"Nissan Motor Co.", "Nissan"},
+	"JN8": {"Nissan Motor Co.", "Nissan"},
+	"JNK": {"Nissan Motor Co.", "Infiniti"},
+	"1VW": {"Volkswagen of America", "Volkswagen"},
+	"3VW": {"Volkswagen de Mexico", "Volkswagen"},
+	"3VV": {"Volkswagen de Mexico", "Volkswagen"},
+	"WVW": {"Volkswagen AG", "Volkswagen"},
+	"WVG": {"Volkswagen AG", "Volkswagen"},
+	"9BW": {"Volkswagen do Brasil", "Volkswagen"},
+	"WAU": {"Audi AG", "Audi"},
+	"WA1": {"Audi AG", "Audi"},
+	"WP0": {"Dr. Ing. h.c. F. Porsche AG", "Porsche"},
+	"WP1": {"Dr. Ing. h.c. F. Porsche AG", "Porsche"},
+	"WBA": {"BMW AG", "BMW"},
+	"WBS": {"BMW M GmbH", "BMW"},
+	"WBX": {"BMW AG", "BMW"},
+	"5UX": {"BMW Manufacturing", "BMW"},
+	"4US": {"BMW Manufacturing", "BMW"},
+	"WMW": {"BMW AG", "MINI"},
+	"WDB": {"Daimler AG", "Mercedes-Benz"},
+	"WDC": {"Daimler AG", "Mercedes-Benz"},
+	"WDD": {"Daimler AG", "Mercedes-Benz"},
+	"W1K": {"Mercedes-Benz AG", "Mercedes-Benz"},
+	"W1N": {"Mercedes-Benz AG", "Mercedes-Benz"},
+	"4JG": {"Mercedes-Benz U.S. International", "Mercedes-Benz"},
+	"1YV": {"Mazda Motor Manufacturing USA", "Mazda"},
+	"3MZ": {"Mazda de Mexico", "Mazda"},
+	"JM1": {"Mazda Motor Corporation", "Mazda"},
+	"JM3": {"Mazda Motor Corporation", "Mazda"},
+	"4S3": {"Subaru of Indiana Automotive", "Subaru"},
+	"4S4": {"Subaru of Indiana Automotive", "Subaru"},
+	"JF1": {"Subaru Corporation", "Subaru"},
+	"JF2": {"Subaru Corporation", "Subaru"},
+	"JA3": {"Mitsubishi Motors", "Mitsubishi"},
+	"JA4": {"Mitsubishi Motors", "Mitsubishi"},
+	"ML3": {"Mitsubishi Motors Thailand", "Mitsubishi"},
+	"JS2": {"Suzuki Motor Corporation", "Suzuki"},
+	"JS3": {"Suzuki Motor Corporation", "Suzuki"},
+	"KMH": {"Hyundai Motor Company", "Hyundai"},
+	"KM8": {"Hyundai Motor Company", "Hyundai"},
+	"5NP": {"Hyundai Motor Manufacturing Alabama", "Hyundai"},
+	"5NM": {"Hyundai Motor Manufacturing Alabama", "Hyundai"},
+	"MAL": {"Hyundai Motor India", "Hyundai"},
+	"KNA": {"Kia Corporation", "Kia"},
+	"KND": {"Kia Corporation", "Kia"},
+	"5XY": {"Kia Georgia", "Kia"},
+	"3KP": {"Kia Motors Mexico", "Kia"},
+	"5YJ": {"Tesla", "Tesla"},
+	"7SA": {"Tesla", "Tesla"},
+	"YV1": {"Volvo Cars", "Volvo"},
+	"YV4": {"Volvo Cars", "Volvo"},
+	"SAL": {"Jaguar Land Rover", "Land Rover"},
+	"SAJ": {"Jaguar Land Rover", "Jaguar"},
+	"ZFA": {"Fiat", "Fiat"},
+	"3C3": {"FCA Mexico", "Fiat"},
+	"9BD": {"Fiat Automoveis", "Fiat"},
+	"ZAR": {"Alfa Romeo", "Alfa Romeo"},
+	"ZFF": {"Ferrari", "Ferrari"},
+	"VF1": {"Renault", "Renault"},
+	"VF3": {"Peugeot", "Peugeot"},
+	"VF7": {"Citroen", "Citroen"},
+	"VSS": {"SEAT", "SEAT"},
+	"TMB": {"Skoda Auto", "Skoda"},
+	"W0L": {"Opel Automobile", "Opel"},
+}
+
+//country of manufacture by the first character of the VIN
+func vinCountry(first byte) string {
+	switch {
+	case first == '1', first == '4', first == '5', first == '7':
+		return "United States"
+	case first == '2':
+		return "Canada"
+	case first == '3':
+		return "Mexico"
+	case first == '9':
+		return "Brazil"
+	case first == 'J':
+		return "Japan"
+	case first == 'K':
+		return "South Korea"
+	case first == 'L':
+		return "China"
+	case first == 'M':
+		return "India / Southeast Asia"
+	case first == 'S':
+		return "United Kingdom"
+	case first == 'T':
+		return "Central Europe"
+	case first == 'V':
+		return "France / Spain"
+	case first == 'W':
+		return "Germany"
+	case first == 'Y':
+		return "Sweden / Finland"
+	case first == 'Z':
+		return "Italy"
+	}
+	return ""
+}
+
+//value of each character in the check digit sum
+func vinTransliterate(c byte) int {
+	if c >= '0' && c <= '9' {
+		return int(c - '0')
+	}
+	return map[byte]int{
+		'A': 1, 'B': 2, 'C': 3, 'D': 4, 'E': 5, 'F': 6, 'G': 7, 'H': 8,
+		'J': 1, 'K': 2, 'L': 3, 'M': 4, 'N': 5, 'P': 7, 'R': 9,
+		'S': 2, 'T': 3, 'U': 4, 'V': 5, 'W': 6, 'X': 7, 'Y': 8, 'Z': 9,
+	}[c]
+}
+
+var vinWeights = [17]int{8, 7, 6, 5, 4, 3, 2, 10, 0, 9, 8, 7, 6, 5, 4, 3, 2}
+
+//the check digit (position 9) a VIN should have
+func vinCheckDigit(vin string) byte {
+	sum := 0
+	for i := 0; i < 17; i++ {
+		sum += vinTransliterate(vin[i]) * vinWeights[i]
+	}
+	if sum%11 == 10 {
+		return 'X'
+	}
+	return byte('0' + sum%11)
+}
+
+//VINs of cars built for North America, WMI regions 1 to 5, which follow the
+//US rules for the check digit and the model year
+func northAmericanVin(vin string) bool {
+	return vin[0] >= '1' && vin[0] <= '5'
+}
+
+//model year from position 10. The codes repeat every 30 years: North
+//American VINs tell the cycles apart with a letter in position 7 for 2010
+//on, for the rest we take the latest year that isn't in the future.
+func vinModelYear(vin string, now time.Time) int {
+	const codes = "ABCDEFGHJKLMNPRSTVWXY123456789"
+	i := strings.IndexByte(codes, vin[9])
+	if i < 0 {
+		return 0
+	}
+	year := 1980 + i
+
+	if northAmericanVin(vin) {
+		if vin[6] < '0' || vin[6] > '9' {
+			year += 30
+		}
+		return year
+	}
+	for year+30 <= now.Year()+1 {
+		year += 30
+	}
+	return year
+}
+
+//decodes a VIN offline
+func decodeVin(raw string) VinInfo {
+	vin := strings.ToUpper(strings.TrimSpace(raw))
+	info := VinInfo{VIN: vin}
+
+	if len(vin) != 17 {
+		info.Problems = append(info.Problems, fmt.Sprintf("a VIN has 17 characters, this one has %d", len(vin)))
+		return info
+	}
+	for i := 0; i < 17; i++ {
+		c := vin[i]
+		if !(c >= '0' && c <= '9' || c >= 'A' && c <= 'Z') || c == 'I' || c == 'O' || c == 'Q' {
+			info.Problems = append(info.Problems, fmt.Sprintf("invalid character %q at position %d", c, i+1))
+			return info
+		}
+	}
+
+	info.Valid = true
+	info.WMI = vin[:3]
+	info.Country = vinCountry(vin[0])
+	info.Year = vinModelYear(vin, time.Now())
+	info.PlantCode = vin[10:11]
+	info.SerialNumber = vin[11:]
+
+	if entry, ok := wmiTable[info.WMI]; ok {
+		info.Manufacturer = entry.Manufacturer
+		info.Make = entry.Make
+	} else {
+		info.Problems = append(info.Problems, fmt.Sprintf("unknown manufacturer code %s", info.WMI))
+	}
+
+	expected := vinCheckDigit(vin)
+	info.CheckDigitValid = vin[8] == expected
+	if !info.CheckDigitValid && northAmericanVin(vin) {
+		info.Problems = append(info.Problems, fmt.Sprintf("check digit is %c, expected %c", vin[8], expected))
+	}
+	return info
+}
+
+//fills in the Make and Year of a car from its VIN when they are missing, and
+//records in VinIssues where the VIN and what was typed disagree
+func applyVinDecode(car *Car) {
+	car.VinIssues = ""
+	if strings.TrimSpace(car.VinNumber) == "" {
+		return
+	}
+	car.VinNumber = strings.ToUpper(strings.TrimSpace(car.VinNumber))
+	if len(car.VinNumber) != 17 {
+		//older cars have shorter serials, nothing to decode
+		return
+	}
+
+	info := decodeVin(car.VinNumber)
+	issues := info.Problems
+	if info.Valid {
+		if info.Make != "" {
+			if strings.TrimSpace(car.Make) == "" {
+				car.Make = info.Make
+			} else if !strings.EqualFold(strings.TrimSpace(car.Make), info.Make) {
+				issues = append(issues, fmt.Sprintf("Make is %s but the VIN says %s", car.Make, info.Make))
+			}
+		}
+		if info.Year != 0 {
+			if !validModelYear(info.Year) {
+				issues = append(issues, fmt.Sprintf("the VIN says %d, which is not a valid model year", info.Year))
+			} else if car.Year == 0 {
+				car.Year = info.Year
+			} else if car.Year != info.Year {
+				issues = append(issues, fmt.Sprintf("Year is %d but the VIN says %d", car.Year, info.Year))
+			}
+		}
+	}
+	car.VinIssues = strings.Join(issues, "; ")
+}
+
+//decode a VIN without saving anything
+func getVinDecode(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	params := mux.Vars(r)
+	info := decodeVin(params["vin"])
+	if !info.Valid {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(&info)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckDigitIsOnlyRequiredInNorthAmerica(t *testing.T) {
+	european := decodeVin("WVWZZZ1JZ3W386752")
+	for _, problem := range european.Problems {
+		if strings.Contains(problem, "check digit") {
+			t.Errorf("European VIN flagged: %s", problem)
+		}
+	}
+
+	american := decodeVin("1FAHP3FA0Y1234567")
+	if american.CheckDigitValid {
+		t.Fatal("the check digit of the test VIN should be wrong")
+	}
+	found := false
+	for _, problem := range american.Problems {
+		found = found || strings.Contains(problem, "check digit")
+	}
+	if !found {
+		t.Errorf("North American VIN with a wrong check digit wasn't flagged: %v", american.Problems)
+	}
+}
+
+func TestYearFromTheVinIsValidated(t *testing.T) {
+	//position 7 is a letter, so position 10 reads as 2039
+	car := Car{VinNumber: "1FAHP3FA091234567"}
+	if err := normalizeCar(&car); err != nil {
+		t.Fatal(err)
+	}
+	if car.Year != 0 || !strings.Contains(car.VinIssues, "2039") {
+		t.Fatalf("got Year %d and issues %q", car.Year, car.VinIssues)
+	}
+}